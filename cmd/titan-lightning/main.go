@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -21,7 +22,24 @@ import (
 	rolling "github.com/arthurkiller/rollingwriter"
 )
 
+// commands are the subcommands, the import runs without one
+var commands = map[string]func(args []string) error{
+	"convert":       convert,
+	"inspect":       inspect,
+	"pd-schedulers": pdSchedulers,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed, %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var confPath string
 	flag.StringVar(&confPath, "c", "conf/import.toml", "conf file path")
 	flag.Parse()
@@ -43,12 +61,130 @@ func main() {
 		zap.L().Error("new lightning err", zap.Error(err))
 		return
 	}
+	http.Handle("/titan-lightning/progress", l.Progress())
+	http.Handle("/titan-lightning/rate-limits", l.RateLimits())
+	if cfg.StatusAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(cfg.StatusAddr, nil); err != nil {
+				zap.L().Error("status server err", zap.Error(err))
+			}
+		}()
+	}
 	if err := l.Run(); err != nil {
 		zap.L().Error("import data err", zap.Error(err))
 		return
 	}
 }
 
+// convert writes the objects of a rdb file as json lines, csv or resp commands
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	format := fs.String("format", lightning.FormatJSONL, "output format(jsonl, csv, resp)")
+	output := fs.String("o", "", "output file, stdout if empty")
+	db := fs.Int("db", -1, "only convert the keys of the database, -1 for all")
+	match := fs.String("match", "", "only convert the keys matching the glob pattern")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s convert [flags] dump.rdb\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !lightning.ValidConvertFormat(*format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	path := fs.Arg(0)
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	var accept func(n int, key []byte) bool
+	if *db >= 0 || *match != "" {
+		accept = func(n int, key []byte) bool {
+			return (*db < 0 || n == *db) && (*match == "" || lightning.MatchKey([]byte(*match), key))
+		}
+	}
+	if err := lightning.Convert(path, in, out, *format, accept); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+// inspect reports the content of a rdb file and the titan kvs it imports to
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of biggest keys and prefixes reported")
+	delimiter := fs.String("delimiter", ":", "delimiter ending the key prefixes")
+	namespace := fs.String("namespace", "default", "titan namespace of the estimated kvs")
+	asJSON := fs.Bool("json", false, "write the report as json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect [flags] dump.rdb\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	path := fs.Arg(0)
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	rep, err := lightning.Inspect(path, in, *namespace, *top, *delimiter)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(rep)
+	}
+	return rep.WriteText(os.Stdout)
+}
+
+// pdSchedulers restores the pd settings saved in the checkpoint by an import
+// which did not finish
+func pdSchedulers(args []string) error {
+	fs := flag.NewFlagSet("pd-schedulers", flag.ExitOnError)
+	confPath := fs.String("c", "conf/import.toml", "conf file path")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s pd-schedulers [flags] restore\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "restore" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg := &conf.Import{}
+	if err := configo.Load(*confPath, cfg); err != nil {
+		return err
+	}
+	if err := ConfigureZap(cfg.Logger.Name, "stderr", cfg.Logger.Level, "", false); err != nil {
+		return err
+	}
+	return lightning.RestoreSchedulers(context.Background(), cfg)
+}
+
 func ConfigureZap(name, path, level, pattern string, compress bool) error {
 	writer, err := Writer(path, pattern, compress)
 	if err != nil {
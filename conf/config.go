@@ -8,7 +8,39 @@ type Import struct {
 	SwitchModInterval time.Duration `cfg:"switch-mod-interval;20m;;switch mod tick interval"`
 	NameSpace         string        `cfg:"namespace; default; ;database namespace"`
 	PdAddrs           string        `cfg:"pd-addrs; 127.0.0.1:2379; ;pd address in tidb"`
-	SourceAddrs       string        `cfg:"source-addrs; ./dump.rdb; ;source data address "`
+	SourceAddrs       string        `cfg:"source-addrs; ./dump.rdb; ;source data addresses, comma separated files, globs, directories, s3 objects or prefixes"`
+	SourceConcurrency int           `cfg:"source-concurrency; 4; >0; max number of sources imported concurrently"`
+	DuplicateKey      string        `cfg:"duplicate-key; warn; ;action on keys found in more than one source(warn, error)"`
+	CheckpointPath    string        `cfg:"checkpoint-path; titan-lightning.checkpoint; ;checkpoint file path, empty to disable"`
+	CheckpointSize    string        `cfg:"checkpoint-size; 256M; ;bytes of a source decoded between two resumable checkpoints, 0 to disable"`
+	StatusAddr        string        `cfg:"status-addr; 127.0.0.1:8289; ;http status server address, its rate limits can be changed without authentication, empty to disable"`
+	Conflict          string        `cfg:"conflict; error; ;policy for keys already in the namespace(error, replace, skip)"`
+	Partition         string        `cfg:"partition; none; ;how the kvs of a source are split into engines imported on their own(none, db, size, class), class splits the meta keys, data keys and expire index"`
+	PartitionSize     string        `cfg:"partition-size; 8G; ;bytes of kvs of an engine of the size partition policy"`
+	MaxPendingEngines int           `cfg:"max-pending-engines; 4; >0; max number of closed engines waiting for or being imported, decoding pauses when it is reached"`
+	SourceFormat      string        `cfg:"source-format; ; ;format of the sources(rdb, aof, resp, jsonl, csv), detected by the extension or the content if empty"`
+	CommandError      string        `cfg:"command-error; error; ;action on commands of aof and resp sources which can not be replayed(error, skip)"`
+	ProtoMaxBulkLen   string        `cfg:"proto-max-bulk-len; 512M; ;max length of a bulk string of the commands of aof and resp sources, longer ones fail the source"`
+	LineError         string        `cfg:"line-error; error; ;action on invalid lines of jsonl and csv sources(error, skip)"`
+	Stream            string        `cfg:"stream; skip; ;how streams are imported(skip, hash, dump), hash imports each entry as a hash at key:id indexed by a sorted set at the key, dump imports the payload of DUMP as a string"`
+	Module            string        `cfg:"module; skip; ;how values of module types are imported(skip, raw), raw imports the payload of DUMP as a string at module-prefix followed by the key"`
+	ModulePrefix      string        `cfg:"module-prefix; __module__:; ;prefix of the keys of the raw module values"`
+	ModuleJSON        bool          `cfg:"module-json; false; boolean; import RedisJSON documents as strings holding the serialized json"`
+	ListZipLength     int           `cfg:"list-zip-length; 0; numeric; lists with at most this many elements are imported in titan's ziplist encoding, 0 disables it"`
+	ListZipValue      int           `cfg:"list-zip-value; 64; numeric; the max bytes of an element of a list imported in the ziplist encoding"`
+	Layout            string        `cfg:"layout; v0.6; ; layout of the target titan release(v0.4, v0.6, auto), auto detects it from the hashes in the target namespace"`
+	ObjectID          string        `cfg:"object-id; random; ;how object ids are made(random, hash), hash derives them from the namespace, db and key so that importing a dump again overwrites the same keys"`
+	ImportID          string        `cfg:"import-id; ; ;key of the hashed object ids, imports sharing it produce the same ids"`
+	IdleTime          bool          `cfg:"idle-time; false; boolean; derive the update time of the objects from the LRU idle time of the dump"`
+	PauseSchedulers   bool          `cfg:"pause-schedulers; true; boolean; remove the balance schedulers of pd, stop region merge and raise the schedule limits during the import, requires checkpoint-path"`
+	PresplitRegions   int           `cfg:"presplit-regions; 0; numeric; number of regions split by the keys sampled from the sources and scattered before the import, 0 disables it"`
+	PresplitSample    string        `cfg:"presplit-sample; 64M; ;bytes decoded from the start of each source to sample the keys of the pre-split"`
+	Compact           string        `cfg:"compact; none; ;compaction of the tikv stores once every source is imported(none, level-1, full)"`
+	CompactTimeout    time.Duration `cfg:"compact-timeout; 1h; ;max time waited for the compaction, the stores go on compacting after it, 0 for unlimited"`
+	PreVerify         bool          `cfg:"pre-verify; false; boolean; decode every source and verify its checksum before switching tikv to import mode"`
+	Redis             Redis         `cfg:"redis"`
+	S3                S3            `cfg:"s3"`
+	Health            Health        `cfg:"health"`
 	Logger            Logger        `cfg:"logger"`
 	PIDFileName       string        `cfg:"pid-filename; titan.pid; ; the file name to record connd PID"`
 }
@@ -19,6 +51,34 @@ type Backend struct {
 	SortedDir      string `cfg:"sorted-dir; ./data; ; sorted sstable file path"`
 	Concurrency    int    `cfg:"concurrency;16;;concurrency num"`
 	SendKVPairs    int    `cfg:"send-kv-pairs;32768;;send kv paris"`
+	UploadRate     string `cfg:"upload-rate; 0; ; max bytes per second of the engines uploaded to tikv, requires partition size, 0 for unlimited"`
+	IngestOps      int    `cfg:"ingest-ops; 0; numeric; max regions per second ingested by tikv, requires partition size, 0 for unlimited"`
+	WriteRate      string `cfg:"write-rate; 0; ; max bytes per second of kvs written into the local engines, 0 for unlimited"`
+	WriteOps       int    `cfg:"write-ops; 0; numeric; max kvs per second written into the local engines, 0 for unlimited"`
+	DiskQuota      string `cfg:"disk-quota; 0; ; max size of the engines in sorted-dir, the largest engines are imported early when it is approached, 0 disables it"`
+}
+
+type Redis struct {
+	Username string        `cfg:"username; ; ;acl user of the redis cluster nodes"`
+	Password string        `cfg:"password; ; ;password of the redis cluster nodes"`
+	Timeout  time.Duration `cfg:"timeout; 1m; ;network timeout of the redis cluster nodes"`
+}
+
+type S3 struct {
+	Endpoint       string `cfg:"endpoint; ; ;endpoint of the s3 compatible storage, empty for aws"`
+	Region         string `cfg:"region; us-east-1; ;region of the buckets"`
+	AccessKey      string `cfg:"access-key; ; ;access key, empty to use the default credential chain"`
+	SecretKey      string `cfg:"secret-key; ; ;secret key"`
+	ForcePathStyle bool   `cfg:"force-path-style; true; boolean; use path style urls, needed by most s3 compatible storages"`
+	PartSize       string `cfg:"part-size; 64M; ;bytes requested by one ranged get"`
+	Retries        int    `cfg:"retries; 5; ;max retries of a failed request"`
+}
+
+type Health struct {
+	Interval             time.Duration `cfg:"interval; 0s; ;interval of the health checks of the tikv stores, the engines are not ingested while a store is unhealthy, 0 disables them"`
+	MaxDiskUsage         int           `cfg:"max-disk-usage; 80; numeric; max used percent of the disk of a store"`
+	MaxPendingCompaction string        `cfg:"max-pending-compaction; 64G; ;max pending compaction bytes of the kv db of a store, 0 for unlimited"`
+	WriteStall           bool          `cfg:"write-stall; true; boolean; pause while the kv db of a store stalls writes"`
 }
 
 type Security struct {
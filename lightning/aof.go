@@ -0,0 +1,303 @@
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nioshield/titan-lightning/rdb"
+	"go.uber.org/zap"
+)
+
+// Command error actions
+const (
+	// CommandErrorFail fails the source on a command which can not be replayed
+	CommandErrorFail = "error"
+	// CommandErrorSkip logs and skips the commands which can not be replayed
+	CommandErrorSkip = "skip"
+)
+
+// aofManifestSuffix is the suffix of the manifest of a redis 7 multi part aof
+const aofManifestSuffix = ".manifest"
+
+// DecodeAOF replays the append only file in r and emits the final state of
+// every key to d. The keys of an RDB preamble are streamed to d, except the
+// ones in touched, which are loaded before the commands so that the commands
+// apply to them. A nil touched loads every key of the preamble. The commands
+// of a transaction are applied on EXEC, and a truncated command or
+// transaction at the end of the file is discarded like redis does with
+// aof-load-truncated. Bulk strings longer than maxBulk fail the source
+func DecodeAOF(r io.Reader, d rdb.Decoder, onError string, maxBulk int64, touched *TouchedKeys) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	rp := NewReplayer()
+	if !hasPreamble(br) {
+		if err := ReplayCommands(br, rp, onError, false, maxBulk); err != nil {
+			emitSample(rp, d)
+			return err
+		}
+		rp.Emit(d)
+		return nil
+	}
+	d.StartRDB()
+	if err := rdb.Decode(br, newPreambleDecoder(d, rp, touched)); err != nil {
+		emitSample(rp, d)
+		return fmt.Errorf("decode rdb preamble: %v", err)
+	}
+	rp.db = 0
+	if err := ReplayCommands(br, rp, onError, false, maxBulk); err != nil {
+		emitSample(rp, d)
+		return err
+	}
+	rp.emitDatabases(d)
+	d.EndRDB()
+	return nil
+}
+
+// DecodeRESP replays a file of commands written for redis-cli --pipe and
+// emits the final state of every key to d, the commands are either RESP
+// arrays or inline commands, bulk strings longer than maxBulk fail the source
+func DecodeRESP(r io.Reader, d rdb.Decoder, onError string, maxBulk int64) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	rp := NewReplayer()
+	if err := ReplayCommands(br, rp, onError, true, maxBulk); err != nil {
+		emitSample(rp, d)
+		return err
+	}
+	rp.Emit(d)
+	return nil
+}
+
+// sampler is implemented by the decoders of the samples of the sources, whose
+// end cuts the source anywhere
+type sampler interface {
+	sample()
+}
+
+// emitSample emits the objects replayed before a failure to a sampler, so
+// that the sample of a source replayed as a whole is not lost
+func emitSample(rp *Replayer, d rdb.Decoder) {
+	if _, ok := d.(sampler); ok {
+		rp.Emit(d)
+	}
+}
+
+// ReplayCommands applies the commands read from br to rp. Unless pipe is set,
+// only RESP arrays are accepted and a truncated command at the end is
+// discarded as in an aof, a pipe file also accepts inline commands and must
+// not be truncated
+func ReplayCommands(br *bufio.Reader, rp *Replayer, onError string, pipe bool, maxBulk int64) error {
+	rr := NewRespReader(br)
+	rr.SetMaxBulkLen(maxBulk)
+	var queued [][][]byte
+	var n, skipped int64
+	multi := false
+	apply := func(args [][]byte) error {
+		err := rp.Apply(args)
+		if err == nil {
+			return nil
+		}
+		if onError != CommandErrorSkip {
+			return fmt.Errorf("command %d %s: %v", n, args[0], err)
+		}
+		skipped++
+		zap.L().Warn("skip command", zap.Int64("command", n), zap.ByteString("name", args[0]), zap.Error(err))
+		return nil
+	}
+	for {
+		var args [][]byte
+		var err error
+		if head, _ := br.Peek(1); pipe && len(head) == 1 && head[0] != '*' {
+			args, err = rr.ReadInline()
+		} else {
+			args, err = rr.ReadCommand()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF && !pipe {
+			zap.L().Warn("discard truncated command at the end", zap.Int64("command", n+1))
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("command %d: %v", n+1, err)
+		}
+		n++
+		switch strings.ToUpper(string(args[0])) {
+		case "MULTI":
+			multi, queued = true, queued[:0]
+		case "EXEC":
+			multi = false
+			for _, args := range queued {
+				if err := apply(args); err != nil {
+					return err
+				}
+			}
+		default:
+			if multi {
+				queued = append(queued, args)
+			} else if err := apply(args); err != nil {
+				return err
+			}
+		}
+	}
+	if multi {
+		zap.L().Warn("discard unterminated transaction at the end", zap.Int("commands", len(queued)))
+	}
+	if skipped > 0 {
+		zap.L().Warn("commands skipped", zap.Int64("count", skipped), zap.Int64("total", n))
+	}
+	return nil
+}
+
+// findManifest returns the manifest of the multi part aof addressed by addr,
+// which is either the manifest itself or the directory holding it, an empty
+// string is returned if addr is not a multi part aof
+func findManifest(addr string) (string, error) {
+	info, err := os.Stat(addr)
+	if err != nil {
+		return "", nil
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(addr, aofManifestSuffix) {
+			return addr, nil
+		}
+		return "", nil
+	}
+	matches, err := filepath.Glob(filepath.Join(addr, "*"+aofManifestSuffix))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("more than one aof manifest in %s", addr)
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	return "", nil
+}
+
+// parseManifest returns the base file followed by the incremental files listed
+// in the manifest, history files are ignored
+func parseManifest(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	type incr struct {
+		name string
+		seq  int64
+	}
+	var base string
+	var incrs []incr
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest %s line %d", path, i+1)
+		}
+		attrs := make(map[string]string)
+		for j := 0; j < len(fields); j += 2 {
+			value := fields[j+1]
+			if strings.HasPrefix(value, "\"") {
+				if value, err = strconv.Unquote(value); err != nil {
+					return nil, fmt.Errorf("invalid aof manifest %s line %d", path, i+1)
+				}
+			}
+			attrs[fields[j]] = value
+		}
+		switch attrs["type"] {
+		case "b":
+			base = attrs["file"]
+		case "i":
+			seq, err := strconv.ParseInt(attrs["seq"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid aof manifest %s line %d", path, i+1)
+			}
+			incrs = append(incrs, incr{name: attrs["file"], seq: seq})
+		}
+	}
+	sort.SliceStable(incrs, func(i, j int) bool { return incrs[i].seq < incrs[j].seq })
+	var files []string
+	if base != "" {
+		files = append(files, base)
+	}
+	for _, f := range incrs {
+		files = append(files, f.name)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no aof file in manifest %s", path)
+	}
+	return files, nil
+}
+
+// aofDirSource returns the multi part aof of the manifest as one source, the
+// base file and the incremental files are read as a single stream, the same
+// way as an aof with an rdb preamble
+func aofDirSource(manifest string) (*Source, error) {
+	dir := filepath.Dir(manifest)
+	names, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	src := &Source{Path: dir, Format: FormatAOF}
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		src.Size += info.Size()
+		if mt := info.ModTime().UnixNano(); mt > src.ModTime {
+			src.ModTime = mt
+		}
+		paths = append(paths, path)
+	}
+	src.open = func(offset int64) (io.ReadCloser, error) {
+		mr := &multiFileReader{}
+		readers := make([]io.Reader, 0, len(paths))
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				mr.Close()
+				return nil, err
+			}
+			mr.files = append(mr.files, f)
+			readers = append(readers, f)
+		}
+		mr.Reader = io.MultiReader(readers...)
+		return mr, nil
+	}
+	return src, nil
+}
+
+// multiFileReader reads the files one after another
+type multiFileReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (mr *multiFileReader) Close() error {
+	var err error
+	for _, f := range mr.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
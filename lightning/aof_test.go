@@ -0,0 +1,155 @@
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// eventRecorder records the objects decoded and the idle times in order
+type eventRecorder struct {
+	rdb.NopDecoder
+	db     int
+	events []string
+}
+
+func (r *eventRecorder) StartDatabase(n int) {
+	r.db = n
+}
+
+func (r *eventRecorder) Idle(seconds uint64) {
+	r.events = append(r.events, fmt.Sprintf("idle %d", seconds))
+}
+
+func (r *eventRecorder) Set(key, value []byte, expiry int64) {
+	r.events = append(r.events, fmt.Sprintf("set %d/%s %s", r.db, key, value))
+}
+
+func (r *eventRecorder) Stream(key []byte, s *rdb.Stream, expiry int64) {
+	r.events = append(r.events, fmt.Sprintf("stream %d/%s %d-%d", r.db, key, s.LastID.Ms, s.LastID.Seq))
+}
+
+func (r *eventRecorder) EndRDB() {
+	r.events = append(r.events, "end")
+}
+
+func commands(cmds ...string) string {
+	var b strings.Builder
+	for _, cmd := range cmds {
+		args := strings.Fields(cmd)
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	return b.String()
+}
+
+func preambleAOF(cmds ...string) []byte {
+	b := newRDB(9).aux("ctime", "1700000000").selectDB(0)
+	b.idle(100).set("a", "1").set("b", "2").stream("s", 1000).stream("t", 2000).idle(7).set("c", "3")
+	b.selectDB(1).set("a", "x")
+	return append(b.end(), commands(cmds...)...)
+}
+
+func TestDecodeAOFPreamble(t *testing.T) {
+	aof := preambleAOF("APPEND b 3", "DEL t", "SELECT 1", "SET z v")
+	touched, err := ScanAOF(bytes.NewReader(aof), DefaultMaxBulkLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		db      int
+		key     string
+		touched bool
+	}{
+		{0, "a", false}, {0, "b", true}, {0, "s", false}, {0, "t", true}, {0, "c", false},
+		{1, "a", false}, {1, "z", true}, {0, "z", false},
+	} {
+		if touched.has(c.db, []byte(c.key)) != c.touched {
+			t.Errorf("%d/%s: touched %v, expect %v", c.db, c.key, !c.touched, c.touched)
+		}
+	}
+
+	// the keys not touched are streamed with their idle time before the
+	// commands are replayed, the touched ones follow
+	rec := &eventRecorder{}
+	if err := DecodeAOF(bytes.NewReader(aof), rec, CommandErrorFail, DefaultMaxBulkLen, touched); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"idle 100", "set 0/a 1", "stream 0/s 1000-0", "idle 7", "set 0/c 3", "set 1/a x",
+		"set 0/b 23", "set 1/z v", "end"}
+	if !reflect.DeepEqual(rec.events, expect) {
+		t.Errorf("decoded %q, expect %q", rec.events, expect)
+	}
+
+	// without the touched keys the preamble is replayed as a whole
+	rec = &eventRecorder{}
+	if err := DecodeAOF(bytes.NewReader(aof), rec, CommandErrorFail, DefaultMaxBulkLen, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"set 0/a 1", "set 0/b 23", "set 0/c 3", "stream 0/s 1000-0", "set 1/a x", "set 1/z v", "end"}
+	if !reflect.DeepEqual(rec.events, expect) {
+		t.Errorf("replayed %q, expect %q", rec.events, expect)
+	}
+}
+
+func TestDecodeAOFPreambleStream(t *testing.T) {
+	for _, c := range []struct {
+		cmds []string
+		keys string
+		err  string
+	}{
+		// the streams are imported with the strategy of the rdb sources
+		{nil, "a,b,c,s,t", ""},
+		{[]string{"EXPIRE s 1000", "DEL t", "RENAME b s2"}, "a,c,s,s2", ""},
+		{[]string{"SET s v"}, "a,b,c,s,t", ""},
+		// the commands of streams are not replayed, other commands fail on them
+		{[]string{"XADD s * f v"}, "", "unsupported command XADD"},
+		{[]string{"APPEND s v"}, "", errWrongType.Error()},
+		{[]string{"FLUSHDB"}, "", ""},
+	} {
+		aof := preambleAOF(c.cmds...)
+		touched, err := ScanAOF(bytes.NewReader(aof), DefaultMaxBulkLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := newKVRecorder()
+		rd := newTestDecode(rec, WithStream(StreamDump))
+		err = DecodeAOF(bytes.NewReader(aof), rd, CommandErrorFail, DefaultMaxBulkLen, touched)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expect error %q, got %v", c.cmds, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.cmds, err)
+			continue
+		}
+		if got := strings.Join(rec.metaKeys("ns", 0), ","); got != c.keys {
+			t.Errorf("%q: imported keys %q, expect %q", c.cmds, got, c.keys)
+		}
+	}
+
+	// a stream replayed in memory keeps its expiry and its dump payload
+	aof := preambleAOF("EXPIRE s 1000")
+	touched, err := ScanAOF(bytes.NewReader(aof), DefaultMaxBulkLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newKVRecorder()
+	if err := DecodeAOF(bytes.NewReader(aof), newTestDecode(rec, WithStream(StreamDump)), CommandErrorFail,
+		DefaultMaxBulkLen, touched); err != nil {
+		t.Fatal(err)
+	}
+	obj, val := rec.meta("ns", 0, "s")
+	if obj == nil || obj.Type != db.ObjectString || obj.ExpireAt == 0 || !bytes.Contains(val, []byte{15}) {
+		t.Errorf("stream imported as %+v %q", obj, val)
+	}
+}
@@ -3,6 +3,8 @@ package lightning
 import (
 	"context"
 	"math"
+	"os"
+	"path/filepath"
 
 	units "github.com/docker/go-units"
 	"github.com/nioshield/titan-lightning/conf"
@@ -10,6 +12,9 @@ import (
 	"github.com/pingcap/tidb-lightning/lightning/common"
 )
 
+// engineMetaSuffix is the suffix of the meta file the local backend saves when an engine is closed
+const engineMetaSuffix = ".meta"
+
 type Backend struct {
 	b   kv.Backend
 	cfg *conf.Backend
@@ -43,3 +48,23 @@ func NewBackend(ctx context.Context, cfg *conf.Backend, tls *common.TLS, pdAddr
 func (bk *Backend) OpenEngine(ctx context.Context, preKey string, enginID int32) (*kv.OpenedEngine, error) {
 	return bk.b.OpenEngine(ctx, preKey, enginID)
 }
+
+// UnsafeCloseEngine closes an engine opened by a previous run, it is used when
+// resuming from a checkpoint
+func (bk *Backend) UnsafeCloseEngine(ctx context.Context, preKey string, enginID int32) (*kv.ClosedEngine, error) {
+	return bk.b.UnsafeCloseEngine(ctx, preKey, enginID)
+}
+
+// ResetEngine removes the local files of an engine which was never closed,
+// the data written into it by a previous run is dropped
+func (bk *Backend) ResetEngine(preKey string, enginID int32) error {
+	_, engineUUID := kv.MakeUUID(preKey, enginID)
+	dir := filepath.Join(bk.cfg.SortedDir, engineUUID.String())
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Remove(dir + engineMetaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
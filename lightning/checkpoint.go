@@ -0,0 +1,332 @@
+package lightning
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// CheckpointStatus is the import status of one source
+type CheckpointStatus int
+
+// Source status, a source moves through them in order
+const (
+	CheckpointPending CheckpointStatus = iota
+	// CheckpointWriting means the engine may hold partially written data
+	CheckpointWriting
+	// CheckpointClosed means all the data is in the closed engine
+	CheckpointClosed
+	// CheckpointImported means the engine is ingested and cleaned up
+	CheckpointImported
+)
+
+// String representation of CheckpointStatus
+func (s CheckpointStatus) String() string {
+	switch s {
+	case CheckpointPending:
+		return "pending"
+	case CheckpointWriting:
+		return "writing"
+	case CheckpointClosed:
+		return "closed"
+	case CheckpointImported:
+		return "imported"
+	}
+	return "unknown"
+}
+
+// SourceCheckpoint records the progress of one source
+type SourceCheckpoint struct {
+	EngineID  int32            `json:"engine-id"`
+	Size      int64            `json:"size"`
+	ModTime   int64            `json:"mod-time"`
+	Partition string           `json:"partition,omitempty"`
+	Status    CheckpointStatus `json:"status"`
+	// Position is where a writing source resumes, everything before it is
+	// flushed into the engines
+	Position *rdb.Position `json:"position,omitempty"`
+	// Part and PartSize are the current partition of the size policy at
+	// Position and the bytes written into it
+	Part     int32 `json:"part,omitempty"`
+	PartSize int64 `json:"part-size,omitempty"`
+	// Engines are the status of the engines opened for the source by id
+	Engines map[int32]CheckpointStatus `json:"engines,omitempty"`
+	// Partitions are the partitions of the engines being written by id
+	Partitions map[int32]int32 `json:"partitions,omitempty"`
+}
+
+// Checkpoint persists the import progress so a failed import can be resumed
+type Checkpoint struct {
+	path string
+	mu   sync.Mutex
+
+	Namespace string                       `json:"namespace"`
+	Sources   map[string]*SourceCheckpoint `json:"sources"`
+	// Schedulers holds the pd settings to restore once the import ends
+	Schedulers *PDState `json:"pd-schedulers,omitempty"`
+	// Compaction is the compaction of the stores done after the import
+	Compaction string `json:"compaction,omitempty"`
+
+	// partition is the partition policy of the sources
+	partition string
+}
+
+// LoadCheckpoint reads the checkpoint in path, a new checkpoint is returned if
+// the file does not exist or belongs to another namespace, an empty path
+// disables persisting. Sources partially imported with another partition
+// policy are an error.
+func LoadCheckpoint(path, ns, partition string) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		path:      path,
+		Namespace: ns,
+		Sources:   make(map[string]*SourceCheckpoint),
+		partition: partition,
+	}
+	if path == "" {
+		return cp, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &Checkpoint{}
+	if err := json.Unmarshal(b, saved); err != nil {
+		return nil, err
+	}
+	// the pd settings are restored whatever was imported
+	cp.Schedulers = saved.Schedulers
+	if saved.Namespace != ns || saved.Sources == nil {
+		return cp, nil
+	}
+	cp.Compaction = saved.Compaction
+	for path, scp := range saved.Sources {
+		if scp.Partition != partition && (scp.Status == CheckpointWriting || scp.Status == CheckpointClosed) {
+			return nil, fmt.Errorf("source %s is partially imported with partition %s, keep it or remove the checkpoint",
+				path, scp.Partition)
+		}
+	}
+	cp.Sources = saved.Sources
+	return cp, nil
+}
+
+// Source returns the checkpoint of src, the saved progress is dropped if the
+// source file changed since it was recorded
+func (cp *Checkpoint) Source(src *Source) *SourceCheckpoint {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	scp := cp.source(src)
+	copied := *scp
+	copied.Engines = make(map[int32]CheckpointStatus, len(scp.Engines))
+	for id, status := range scp.Engines {
+		copied.Engines[id] = status
+	}
+	copied.Partitions = make(map[int32]int32, len(scp.Partitions))
+	for id, partition := range scp.Partitions {
+		copied.Partitions[id] = partition
+	}
+	return &copied
+}
+
+func (cp *Checkpoint) source(src *Source) *SourceCheckpoint {
+	scp, ok := cp.Sources[src.Path]
+	if ok && scp.Size == src.Size && scp.ModTime == src.ModTime && scp.EngineID == src.ID &&
+		(scp.Partition == cp.partition || scp.Status == CheckpointImported) {
+		return scp
+	}
+	scp = &SourceCheckpoint{EngineID: src.ID, Size: src.Size, ModTime: src.ModTime, Partition: cp.partition}
+	cp.Sources[src.Path] = scp
+	return scp
+}
+
+// Started reports whether any source has moved beyond pending
+func (cp *Checkpoint) Started() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, scp := range cp.Sources {
+		if scp.Status != CheckpointPending {
+			return true
+		}
+	}
+	return false
+}
+
+// Update records the status of src and persists the checkpoint, the position
+// is dropped
+func (cp *Checkpoint) Update(src *Source, status CheckpointStatus) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	scp := cp.source(src)
+	scp.Status = status
+	scp.Position = nil
+	scp.Part = 0
+	scp.PartSize = 0
+	return cp.save()
+}
+
+// UpdatePosition records that src is written up to pos, with part holding
+// partSize bytes, and persists the checkpoint
+func (cp *Checkpoint) UpdatePosition(src *Source, pos rdb.Position, part int32, partSize int64) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	scp := cp.source(src)
+	scp.Status = CheckpointWriting
+	scp.Position = &pos
+	scp.Part = part
+	scp.PartSize = partSize
+	return cp.save()
+}
+
+// OpenEngine records that the engine id of src is written with the kvs of
+// partition and persists the checkpoint
+func (cp *Checkpoint) OpenEngine(src *Source, id, partition int32) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	scp := cp.source(src)
+	if scp.Engines == nil {
+		scp.Engines = make(map[int32]CheckpointStatus)
+	}
+	scp.Engines[id] = CheckpointWriting
+	if scp.Partitions == nil {
+		scp.Partitions = make(map[int32]int32)
+	}
+	scp.Partitions[id] = partition
+	return cp.save()
+}
+
+// UpdateEngine records the status of the engine id of src, which is no longer
+// written, and persists the checkpoint, a pending status removes the engine
+func (cp *Checkpoint) UpdateEngine(src *Source, id int32, status CheckpointStatus) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	scp := cp.source(src)
+	delete(scp.Partitions, id)
+	if status == CheckpointPending {
+		delete(scp.Engines, id)
+	} else {
+		if scp.Engines == nil {
+			scp.Engines = make(map[int32]CheckpointStatus)
+		}
+		scp.Engines[id] = status
+	}
+	return cp.save()
+}
+
+// PD returns the saved pd settings, nil if pd is not changed
+func (cp *Checkpoint) PD() *PDState {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.Schedulers
+}
+
+// UpdatePD records the pd settings to restore, nil once they are restored,
+// and persists the checkpoint
+func (cp *Checkpoint) UpdatePD(state *PDState) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Schedulers = state
+	return cp.save()
+}
+
+// Compacted returns the compaction of the stores done, empty if none
+func (cp *Checkpoint) Compacted() string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.Compaction
+}
+
+// UpdateCompaction records that the stores are compacted by compaction and
+// persists the checkpoint
+func (cp *Checkpoint) UpdateCompaction(compaction string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Compaction = compaction
+	return cp.save()
+}
+
+// Remove deletes the persisted checkpoint once the import is finished
+func (cp *Checkpoint) Remove() error {
+	if cp.path == "" {
+		return nil
+	}
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (cp *Checkpoint) save() error {
+	if cp.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCheckpoint(cp.path, b)
+}
+
+// writeCheckpoint replaces the checkpoint in path with b
+func writeCheckpoint(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pdStateField is the json field of Checkpoint.Schedulers
+const pdStateField = "pd-schedulers"
+
+// LoadPDState reads the pd settings saved in the checkpoint in path, nil if
+// there are none. The rest of the checkpoint is not checked, the settings are
+// restored whatever the namespace and the partition policy of the sources
+func LoadPDState(path string) (*PDState, error) {
+	fields, err := readCheckpointFields(path)
+	if err != nil || fields[pdStateField] == nil {
+		return nil, err
+	}
+	var state *PDState
+	if err := json.Unmarshal(fields[pdStateField], &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ClearPDState removes the pd settings from the checkpoint in path once they
+// are restored, the other fields are kept as they are
+func ClearPDState(path string) error {
+	fields, err := readCheckpointFields(path)
+	if err != nil || fields[pdStateField] == nil {
+		return err
+	}
+	delete(fields, pdStateField)
+	b, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCheckpoint(path, b)
+}
+
+// readCheckpointFields reads the fields of the checkpoint in path, nil if the
+// file does not exist
+func readCheckpointFields(path string) (map[string]json.RawMessage, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,70 @@
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestResumeKeepsCTime(t *testing.T) {
+	const ctime = 1600000000
+	b := newRDB(9).aux("ctime", fmt.Sprint(ctime)).selectDB(0)
+	for i := 0; i < 10; i++ {
+		b.idle(100+i).set(fmt.Sprintf("key%d", i), "v")
+	}
+	dump := b.end()
+	full := &keyOrder{Decoder: newTestDecode(newKVRecorder(), WithIdleTime(true))}
+	if err := rdb.Decode(bytes.NewReader(dump), full); err != nil {
+		t.Fatal(err)
+	}
+	i := len(full.positions) / 2
+	if full.positions[i].CTime != fmt.Sprint(ctime) {
+		t.Fatalf("position %+v lacks the ctime", full.positions[i])
+	}
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	src := &Source{Path: "dump.rdb", Size: int64(len(dump)), Resumable: true}
+	cp, err := LoadCheckpoint(path, "ns", PartitionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.UpdatePosition(src, full.positions[i], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = LoadCheckpoint(path, "ns", PartitionNone); err != nil {
+		t.Fatal(err)
+	}
+	pos := cp.Source(src).Position
+	if pos == nil || pos.CTime != fmt.Sprint(ctime) {
+		t.Fatalf("checkpointed position %+v lacks the ctime", pos)
+	}
+
+	// the resumed keys are dated from the ctime of the dump, not the import
+	rec := newKVRecorder()
+	resumed := &keyOrder{Decoder: newTestDecode(rec, WithIdleTime(true))}
+	if err := rdb.Resume(bytes.NewReader(dump[pos.Offset:]), resumed, *pos); err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed.keys) == 0 {
+		t.Fatal("no key resumed")
+	}
+	for _, key := range resumed.keys {
+		var n int
+		fmt.Sscanf(key, "key%d", &n)
+		obj, _ := rec.meta("ns", 0, key)
+		if want := int64(ctime-100-n) * int64(time.Second); obj == nil || obj.UpdatedAt != want {
+			t.Errorf("key %s updated at %v, expect %d", key, obj, want)
+		}
+	}
+}
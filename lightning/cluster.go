@@ -0,0 +1,455 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"go.uber.org/zap"
+)
+
+// RedisClusterScheme is the source address prefix of a redis cluster seed node
+const RedisClusterScheme = "redis-cluster://"
+
+// SlotCount is the number of hash slots of a redis cluster
+const SlotCount = 16384
+
+// SlotSet is a set of hash slots
+type SlotSet [SlotCount / 8]byte
+
+// Add adds the slots in [from, to]
+func (s *SlotSet) Add(from, to int) {
+	for slot := from; slot <= to && slot < SlotCount; slot++ {
+		if slot >= 0 {
+			s[slot/8] |= 1 << uint(slot%8)
+		}
+	}
+}
+
+// Has reports whether the slot is in the set
+func (s *SlotSet) Has(slot int) bool {
+	if slot < 0 || slot >= SlotCount {
+		return false
+	}
+	return s[slot/8]&(1<<uint(slot%8)) != 0
+}
+
+// KeySlot returns the hash slot of key, honouring hash tags
+func KeySlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % SlotCount)
+}
+
+// crc16 is the CRC16-CCITT (XModem) checksum used by redis cluster
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ClusterNode is a master of a redis cluster
+type ClusterNode struct {
+	ID    string
+	Addr  string
+	Slots SlotSet
+}
+
+type redisConn struct {
+	conn    net.Conn
+	rr      *RespReader
+	timeout time.Duration
+}
+
+func dialRedis(addr string, cfg *conf.Redis) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, timeout: cfg.Timeout}
+	c.rr = NewRespReader(bufio.NewReader(&deadlineReader{conn: conn, timeout: cfg.Timeout}))
+	if cfg.Password != "" {
+		args := []string{"AUTH", cfg.Password}
+		if cfg.Username != "" {
+			args = []string{"AUTH", cfg.Username, cfg.Password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply, error replies are returned as errors
+func (c *redisConn) Do(args ...string) (interface{}, error) {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := WriteCommand(c.conn, bargs...); err != nil {
+		return nil, err
+	}
+	reply, err := c.rr.ReadValue()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(RespError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// deadlineReader extends the read deadline before every read, so that a long
+// transfer only fails if the peer stays silent for the timeout
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(b []byte) (int, error) {
+	dr.conn.SetReadDeadline(time.Now().Add(dr.timeout))
+	return dr.conn.Read(b)
+}
+
+// DiscoverCluster returns the masters of the cluster the seed node belongs to,
+// CLUSTER SHARDS is used if supported, CLUSTER NODES otherwise
+func DiscoverCluster(seed string, cfg *conf.Redis) ([]*ClusterNode, error) {
+	c, err := dialRedis(seed, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var nodes []*ClusterNode
+	reply, err := c.Do("CLUSTER", "SHARDS")
+	if err == nil {
+		nodes, err = parseClusterShards(reply)
+	} else if _, ok := err.(RespError); ok {
+		zap.L().Info("cluster shards not supported, fall back to cluster nodes", zap.String("seed", seed), zap.Error(err))
+		if reply, err = c.Do("CLUSTER", "NODES"); err == nil {
+			nodes, err = parseClusterNodes(reply)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no master found in cluster of %s", seed)
+	}
+	return nodes, nil
+}
+
+// parseClusterShards parses the reply of CLUSTER SHARDS, a list of shards of
+// alternating field names and values
+func parseClusterShards(reply interface{}) ([]*ClusterNode, error) {
+	shards, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New("invalid cluster shards reply")
+	}
+	var nodes []*ClusterNode
+	for _, shard := range shards {
+		fields := respMap(shard)
+		var slots SlotSet
+		ranges, _ := fields["slots"].([]interface{})
+		for i := 0; i+1 < len(ranges); i += 2 {
+			from, _ := ranges[i].(int64)
+			to, _ := ranges[i+1].(int64)
+			slots.Add(int(from), int(to))
+		}
+		members, _ := fields["nodes"].([]interface{})
+		for _, member := range members {
+			node := respMap(member)
+			if respString(node["role"]) != "master" || respString(node["health"]) == "fail" {
+				continue
+			}
+			host := respString(node["endpoint"])
+			if host == "" || host == "?" {
+				host = respString(node["ip"])
+			}
+			port, _ := node["port"].(int64)
+			nodes = append(nodes, &ClusterNode{
+				ID:    respString(node["id"]),
+				Addr:  net.JoinHostPort(host, strconv.FormatInt(port, 10)),
+				Slots: slots,
+			})
+		}
+	}
+	return nodes, nil
+}
+
+// parseClusterNodes parses the text reply of CLUSTER NODES
+func parseClusterNodes(reply interface{}) ([]*ClusterNode, error) {
+	text, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.New("invalid cluster nodes reply")
+	}
+	var nodes []*ClusterNode
+	for _, line := range strings.Split(string(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		flags := strings.Split(fields[2], ",")
+		master, failed := false, false
+		for _, flag := range flags {
+			switch flag {
+			case "master":
+				master = true
+			case "fail", "noaddr", "handshake":
+				failed = true
+			}
+		}
+		if !master || failed {
+			continue
+		}
+		// ip:port@cport[,hostname]
+		addr := strings.SplitN(strings.SplitN(fields[1], ",", 2)[0], "@", 2)[0]
+		node := &ClusterNode{ID: fields[0], Addr: addr}
+		for _, slot := range fields[8:] {
+			if strings.HasPrefix(slot, "[") {
+				// slots being migrated or imported are owned by the other node
+				continue
+			}
+			bounds := strings.SplitN(slot, "-", 2)
+			from, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid slot %s of node %s", slot, node.ID)
+			}
+			to := from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid slot %s of node %s", slot, node.ID)
+				}
+			}
+			node.Slots.Add(from, to)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func respMap(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	values, _ := v.([]interface{})
+	for i := 0; i+1 < len(values); i += 2 {
+		m[respString(values[i])] = values[i+1]
+	}
+	return m
+}
+
+func respString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case int64:
+		return strconv.FormatInt(s, 10)
+	}
+	return ""
+}
+
+// replicaReader streams the RDB payload a master sends to a new replica
+type replicaReader struct {
+	c    *redisConn
+	r    io.Reader
+	size int64
+}
+
+// FetchRDB starts a full resynchronization with the node at addr and returns
+// the RDB payload, the connection is closed when the reader is closed
+func FetchRDB(addr string, cfg *conf.Redis) (io.ReadCloser, error) {
+	c, err := dialRedis(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := startSync(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return rr, nil
+}
+
+func startSync(c *redisConn) (*replicaReader, error) {
+	// only ask for the snapshot and accept a diskless payload, the masters
+	// which do not know these options reply with an error
+	for _, opt := range [][]string{{"REPLCONF", "rdb-only", "1"}, {"REPLCONF", "capa", "eof"}} {
+		if _, err := c.Do(opt...); err != nil {
+			if _, ok := err.(RespError); !ok {
+				return nil, err
+			}
+		}
+	}
+	reply, err := c.Do("PSYNC", "?", "-1")
+	if _, ok := err.(RespError); ok {
+		// redis before 2.8 only supports SYNC, which replies with the payload directly
+		if err := WriteCommand(c.conn, []byte("SYNC")); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if s, ok := reply.(string); !ok || !strings.HasPrefix(s, "FULLRESYNC") {
+		return nil, fmt.Errorf("unexpected psync reply %v", reply)
+	}
+
+	br := c.rr.Buffered()
+	for {
+		// the master sends newlines to keep the connection alive while saving
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != '\n' {
+			br.UnreadByte()
+			break
+		}
+	}
+	line, err := c.rr.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("unexpected sync payload header %q", line)
+	}
+	if bytes.HasPrefix(line, []byte("$EOF:")) {
+		// a diskless payload of unknown size, which ends with the mark
+		mark := line[len("$EOF:"):]
+		if len(mark) != eofMarkLen {
+			return nil, fmt.Errorf("invalid diskless sync mark %q", mark)
+		}
+		return &replicaReader{c: c, r: &eofReader{r: br, mark: append([]byte{}, mark...)}}, nil
+	}
+	size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaReader{c: c, r: io.LimitReader(br, size), size: size}, nil
+}
+
+// eofMarkLen is the length of the random mark ending a diskless payload
+const eofMarkLen = 40
+
+// eofReader reads a diskless payload up to its mark, the last bytes read are
+// held back until they can not be the mark
+type eofReader struct {
+	r     io.Reader
+	mark  []byte
+	buf   []byte
+	chunk []byte
+	eof   bool
+}
+
+func (er *eofReader) Read(b []byte) (int, error) {
+	for !er.eof && len(er.buf) <= len(er.mark) {
+		if er.chunk == nil {
+			er.chunk = make([]byte, 32<<10)
+		}
+		n, err := er.r.Read(er.chunk)
+		er.buf = append(er.buf, er.chunk[:n]...)
+		if bytes.HasSuffix(er.buf, er.mark) {
+			er.buf, er.eof = er.buf[:len(er.buf)-len(er.mark)], true
+			break
+		}
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	avail := len(er.buf)
+	if !er.eof {
+		avail -= len(er.mark)
+	}
+	if avail == 0 && er.eof {
+		return 0, io.EOF
+	}
+	n := copy(b, er.buf[:avail])
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+func (rr *replicaReader) Read(b []byte) (int, error) {
+	return rr.r.Read(b)
+}
+
+// Size returns the size of the RDB payload, 0 for a diskless payload
+func (rr *replicaReader) Size() int64 {
+	return rr.size
+}
+
+func (rr *replicaReader) Close() error {
+	return rr.c.Close()
+}
+
+// clusterSources discovers the masters of the cluster and returns a source for each of them
+func clusterSources(seed string, cfg *conf.Redis) ([]*Source, error) {
+	nodes, err := DiscoverCluster(seed, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var sources []*Source
+	for _, node := range nodes {
+		node := node
+		zap.L().Info("discover cluster master", zap.String("id", node.ID), zap.String("addr", node.Addr))
+		sources = append(sources, &Source{
+			Path:   "redis://" + node.Addr,
+			Slots:  &node.Slots,
+			Format: FormatRDB,
+			open: func(offset int64) (io.ReadCloser, error) {
+				return FetchRDB(node.Addr, cfg)
+			},
+		})
+	}
+	return sources, nil
+}
+
+// slotDecoder drops the keys outside the slots owned by the source, and reports
+// the slots the dump claims but the node does not own according to the cluster
+type slotDecoder struct {
+	*FilterDecoder
+	src *Source
+}
+
+func newSlotDecoder(d *RdbDecode, src *Source) *slotDecoder {
+	return &slotDecoder{
+		FilterDecoder: NewFilterDecoder(d, func(n int, key []byte) bool {
+			return src.Slots.Has(KeySlot(key))
+		}),
+		src: src,
+	}
+}
+
+func (sd *slotDecoder) SlotInfo(slot, size, expiresSize uint64) {
+	if !sd.src.Slots.Has(int(slot)) {
+		zap.L().Warn("dump holds slot not owned by the node", zap.String("source", sd.src.Path),
+			zap.Uint64("slot", slot), zap.Uint64("keys", size))
+	}
+	sd.FilterDecoder.SlotInfo(slot, size, expiresSize)
+}
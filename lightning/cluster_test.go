@@ -0,0 +1,285 @@
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// fakeCluster is a redis cluster of masters answering the discovery commands
+// and sending their RDB to a replica
+type fakeCluster struct {
+	mu     sync.Mutex
+	shards bool
+	nodes  []*fakeNode
+}
+
+type fakeNode struct {
+	c     *fakeCluster
+	id    string
+	ln    net.Listener
+	from  int
+	to    int
+	rdb   []byte
+	syncs int
+	// diskless sends the rdb framed by a mark to the replicas which accept it
+	diskless bool
+}
+
+func startFakeCluster(t *testing.T, shards bool, slots [][2]int) *fakeCluster {
+	c := &fakeCluster{shards: shards}
+	for i, r := range slots {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &fakeNode{c: c, id: fmt.Sprintf("%040d", i), ln: ln, from: r[0], to: r[1]}
+		c.nodes = append(c.nodes, n)
+		go n.serve()
+	}
+	return c
+}
+
+func (c *fakeCluster) Close() {
+	for _, n := range c.nodes {
+		n.ln.Close()
+	}
+}
+
+func (c *fakeCluster) clusterNodes() string {
+	var b strings.Builder
+	for i, n := range c.nodes {
+		flags := "master"
+		if i == 0 {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s@%d %s - 0 0 %d connected %d-%d\n", n.id, n.ln.Addr(),
+			n.ln.Addr().(*net.TCPAddr).Port+10000, flags, i+1, n.from, n.to)
+	}
+	// a replica and a failed master are not sources
+	fmt.Fprintf(&b, "%040d 127.0.0.1:1@11 slave %s 0 0 1 connected\n", 100, c.nodes[0].id)
+	fmt.Fprintf(&b, "%040d 127.0.0.1:2@12 master,fail - 0 0 1 disconnected\n", 101)
+	return b.String()
+}
+
+func (c *fakeCluster) clusterShards() []interface{} {
+	var shards []interface{}
+	for _, n := range c.nodes {
+		addr := n.ln.Addr().(*net.TCPAddr)
+		shards = append(shards, []interface{}{
+			"slots", []interface{}{int64(n.from), int64(n.to)},
+			"nodes", []interface{}{
+				[]interface{}{"id", n.id, "port", int64(addr.Port), "ip", addr.IP.String(),
+					"endpoint", addr.IP.String(), "role", "master", "health", "online"},
+				[]interface{}{"id", "replica", "port", int64(1), "ip", "127.0.0.1",
+					"endpoint", "127.0.0.1", "role", "replica", "health", "online"},
+			},
+		})
+	}
+	return shards
+}
+
+func (n *fakeNode) serve() {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		go n.handle(conn)
+	}
+}
+
+func (n *fakeNode) handle(conn net.Conn) {
+	defer conn.Close()
+	rr := NewRespReader(conn)
+	capaEOF := false
+	for {
+		args, err := rr.ReadCommand()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(string(args[0]))
+		if len(args) > 1 {
+			cmd += " " + strings.ToUpper(string(args[1]))
+		}
+		var reply bytes.Buffer
+		switch cmd {
+		case "CLUSTER SHARDS":
+			if !n.c.shards {
+				reply.WriteString("-ERR unknown subcommand 'SHARDS'\r\n")
+				break
+			}
+			writeResp(&reply, n.c.clusterShards())
+		case "CLUSTER NODES":
+			writeResp(&reply, n.c.clusterNodes())
+		case "REPLCONF RDB-ONLY":
+			reply.WriteString("+OK\r\n")
+		case "REPLCONF CAPA":
+			capaEOF = capaEOF || strings.EqualFold(string(args[2]), "eof")
+			reply.WriteString("+OK\r\n")
+		case "PSYNC ?":
+			n.c.mu.Lock()
+			n.syncs++
+			n.c.mu.Unlock()
+			// the newlines keep the connection alive while the master saves
+			fmt.Fprintf(&reply, "+FULLRESYNC %s 0\r\n\n\n", n.id)
+			if n.diskless && capaEOF {
+				mark := strings.Repeat("m", eofMarkLen)
+				fmt.Fprintf(&reply, "$EOF:%s\r\n%s%s", mark, n.rdb, mark)
+			} else {
+				fmt.Fprintf(&reply, "$%d\r\n%s", len(n.rdb), n.rdb)
+			}
+		default:
+			fmt.Fprintf(&reply, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		if _, err := conn.Write(reply.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// writeResp writes strings as bulk strings, int64 as integers and slices as arrays
+func writeResp(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeResp(w, e)
+		}
+	}
+}
+
+func testClusterImport(t *testing.T, shards bool) {
+	c := startFakeCluster(t, shards, [][2]int{{0, 5460}, {5461, 10922}, {10923, SlotCount - 1}})
+	defer c.Close()
+	owner := func(key string) int {
+		slot := KeySlot([]byte(key))
+		for i, n := range c.nodes {
+			if slot >= n.from && slot <= n.to {
+				return i
+			}
+		}
+		return -1
+	}
+	var want []string
+	dumps := make([]*rdbBuilder, len(c.nodes))
+	for i := range dumps {
+		dumps[i] = newRDB(9)
+		dumps[i].selectDB(0)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		want = append(want, key)
+		n := owner(key)
+		dumps[n].set(key, "v")
+		// a key left behind by a slot migration on the next node
+		if i%10 == 0 {
+			dumps[(n+1)%len(dumps)].set(key, "stale")
+		}
+	}
+	for i, n := range c.nodes {
+		n.rdb = dumps[i].end()
+	}
+	// a master of repl-diskless-sync streams its rdb without a size
+	diskless := c.nodes[len(c.nodes)-1]
+	diskless.diskless = true
+
+	cfg := &conf.Import{Redis: conf.Redis{Timeout: 5 * time.Second}}
+	sources, err := ParseSources(RedisClusterScheme+c.nodes[0].ln.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != len(c.nodes) {
+		t.Fatalf("expect %d sources, got %d", len(c.nodes), len(sources))
+	}
+	rec := newKVRecorder()
+	for _, src := range sources {
+		if src.Slots == nil {
+			t.Fatalf("source %s has no slots", src.Path)
+		}
+		f, err := src.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// cluster sources only know their size once opened
+		if sized, ok := f.(interface{ Size() int64 }); !ok || (sized.Size() == 0) != (src.Path == "redis://"+diskless.ln.Addr().String()) {
+			t.Errorf("source %s has no size", src.Path)
+		}
+		sd := newSlotDecoder(newTestDecode(rec), src)
+		err = rdb.Decode(f, sd)
+		f.Close()
+		if err != nil {
+			t.Fatalf("decode %s: %v", src.Path, err)
+		}
+		if sd.Skipped() == 0 {
+			t.Errorf("no stale key of %s skipped", src.Path)
+		}
+	}
+	if got := rec.metaKeys("ns", 0); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("imported keys %v, expect %v", got, want)
+	}
+	for _, n := range c.nodes {
+		if n.syncs != 1 {
+			t.Errorf("node %s synced %d times", n.ln.Addr(), n.syncs)
+		}
+	}
+}
+
+func TestClusterImportNodes(t *testing.T) {
+	testClusterImport(t, false)
+}
+
+func TestClusterImportShards(t *testing.T) {
+	testClusterImport(t, true)
+}
+
+func TestFetchRDBReadsPayloadOnly(t *testing.T) {
+	for _, diskless := range []bool{false, true} {
+		c := startFakeCluster(t, false, [][2]int{{0, SlotCount - 1}})
+		c.nodes[0].diskless = diskless
+		c.nodes[0].rdb = newRDB(9).selectDB(0).set("k", "v").end()
+		f, err := FetchRDB(c.nodes[0].ln.Addr().String(), &conf.Redis{Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, c.nodes[0].rdb) {
+			t.Errorf("diskless %v: payload %q, expect %q", diskless, b, c.nodes[0].rdb)
+		}
+	}
+}
+
+func TestEOFReader(t *testing.T) {
+	mark := []byte(strings.Repeat("0123456789", 4))
+	payload := bytes.Repeat([]byte("payload"), 10000)
+	// the mark is split over the reads
+	r := &eofReader{r: iotest.OneByteReader(bytes.NewReader(append(append([]byte{}, payload...), mark...))), mark: mark}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, payload) {
+		t.Errorf("read %d bytes, %v, expect the %d bytes of the payload", len(b), err, len(payload))
+	}
+	// a connection closed before the mark
+	r = &eofReader{r: bytes.NewReader(append(payload, mark[:10]...)), mark: mark}
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("payload without its mark: got %v, expect %v", err, io.ErrUnexpectedEOF)
+	}
+}
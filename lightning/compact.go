@@ -0,0 +1,133 @@
+package lightning
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	kv "github.com/pingcap/tidb-lightning/lightning/backend"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"go.uber.org/zap"
+)
+
+// Compactions of the tikv stores once every source is imported, which merge
+// the ingested ssts left in level 0
+const (
+	CompactNone = "none"
+	// CompactLevel1 compacts level 0 into level 1
+	CompactLevel1 = "level-1"
+	// CompactFull compacts every level into the bottommost one
+	CompactFull = "full"
+)
+
+// compactLogInterval is the interval of the progress logs of a compaction
+const compactLogInterval = time.Minute
+
+// ValidCompact reports whether c is a known compaction
+func ValidCompact(c string) bool {
+	switch c {
+	case CompactNone, CompactLevel1, CompactFull:
+		return true
+	}
+	return false
+}
+
+// compactLevel is the output level of the compaction c, -1 for the bottommost
+func compactLevel(c string) int32 {
+	if c == CompactLevel1 {
+		return 1
+	}
+	return -1
+}
+
+// StoreCompactor compacts the tikv stores of the cluster
+type StoreCompactor interface {
+	// ForAllStores calls fn concurrently for each store which can be
+	// compacted, the disconnected and down stores are left out
+	ForAllStores(ctx context.Context, fn func(ctx context.Context, addr string) error) error
+	// Compact compacts the store at addr into level, -1 for the bottommost
+	Compact(ctx context.Context, addr string, level int32) error
+}
+
+// tikvCompactor compacts the stores through the import service of tikv
+type tikvCompactor struct {
+	tls *common.TLS
+}
+
+// NewTiKVCompactor returns the compactor of the stores listed by pd
+func NewTiKVCompactor(tls *common.TLS) StoreCompactor {
+	return &tikvCompactor{tls: tls}
+}
+
+func (c *tikvCompactor) ForAllStores(ctx context.Context, fn func(ctx context.Context, addr string) error) error {
+	return kv.ForAllStores(ctx, c.tls, kv.StoreStateOffline, func(ctx context.Context, store *kv.Store) error {
+		return fn(ctx, store.Address)
+	})
+}
+
+func (c *tikvCompactor) Compact(ctx context.Context, addr string, level int32) error {
+	return kv.Compact(ctx, c.tls, addr, level)
+}
+
+// compact compacts the stores unless the checkpoint records that it is done.
+// The stores which did not finish in compact-timeout keep compacting on their
+// own, and the import ends without waiting for them. The data is imported
+// already, so a failed compaction is only logged.
+func (l *Lightning) compact(ctx context.Context) error {
+	done := l.cp.Compacted()
+	if l.cfg.Compact == CompactNone || done == l.cfg.Compact || done == CompactFull {
+		return nil
+	}
+	cctx := ctx
+	if l.cfg.CompactTimeout > 0 {
+		var cancel context.CancelFunc
+		cctx, cancel = context.WithTimeout(ctx, l.cfg.CompactTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	var stores, compacted int32
+	logCtx, stop := context.WithCancel(cctx)
+	defer stop()
+	go func() {
+		ticker := time.NewTicker(compactLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-logCtx.Done():
+				return
+			case <-ticker.C:
+				zap.L().Info("compaction progress", zap.String("compact", l.cfg.Compact),
+					zap.Int32("stores", atomic.LoadInt32(&stores)), zap.Int32("compacted", atomic.LoadInt32(&compacted)),
+					zap.Duration("elapsed", time.Since(start)))
+			}
+		}
+	}()
+	zap.L().Info("compact stores", zap.String("compact", l.cfg.Compact))
+	err := l.compactor.ForAllStores(cctx, func(c context.Context, addr string) error {
+		atomic.AddInt32(&stores, 1)
+		if err := l.compactor.Compact(c, addr, compactLevel(l.cfg.Compact)); err != nil {
+			return err
+		}
+		zap.L().Info("store compacted", zap.String("store", addr), zap.Duration("elapsed", time.Since(start)))
+		atomic.AddInt32(&compacted, 1)
+		return nil
+	})
+	if err != nil && cctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		zap.L().Warn("compaction timed out, the stores go on compacting", zap.Duration("compact-timeout", l.cfg.CompactTimeout),
+			zap.Int32("stores", atomic.LoadInt32(&stores)), zap.Int32("compacted", atomic.LoadInt32(&compacted)))
+		return nil
+	}
+	if err != nil {
+		zap.L().Warn("compact stores failed, the stores compact on their own", zap.String("compact", l.cfg.Compact),
+			zap.Int32("stores", atomic.LoadInt32(&stores)), zap.Int32("compacted", atomic.LoadInt32(&compacted)),
+			zap.Error(err))
+		return nil
+	}
+	zap.L().Info("stores compacted", zap.String("compact", l.cfg.Compact), zap.Int32("stores", compacted),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := l.cp.UpdateCompaction(l.cfg.Compact); err != nil {
+		zap.L().Error("save checkpoint failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
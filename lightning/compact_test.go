@@ -0,0 +1,136 @@
+package lightning
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+// fakeCompactor compacts its stores at once, the stores in fail fail and the
+// ones in hang compact until the context is done
+type fakeCompactor struct {
+	mu        sync.Mutex
+	stores    []string
+	fail      map[string]bool
+	hang      map[string]bool
+	levels    []int32
+	compacted []string
+}
+
+func (c *fakeCompactor) ForAllStores(ctx context.Context, fn func(ctx context.Context, addr string) error) error {
+	errs := make(chan error, len(c.stores))
+	for _, addr := range c.stores {
+		go func(addr string) { errs <- fn(ctx, addr) }(addr)
+	}
+	var err error
+	for range c.stores {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *fakeCompactor) Compact(ctx context.Context, addr string, level int32) error {
+	c.mu.Lock()
+	c.levels = append(c.levels, level)
+	c.mu.Unlock()
+	if c.fail[addr] {
+		return errors.New("compact failed")
+	}
+	if c.hang[addr] {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compacted = append(c.compacted, addr)
+	sort.Strings(c.compacted)
+	return nil
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores := []string{"store1", "store2", "store3"}
+	for _, c := range []struct {
+		name      string
+		compact   string
+		done      string
+		fail      string
+		hang      string
+		calls     int
+		level     int32
+		recorded  string
+		compacted string
+	}{
+		{name: "disabled", compact: CompactNone},
+		{name: "full", compact: CompactFull, calls: 3, level: -1, recorded: CompactFull,
+			compacted: "store1,store2,store3"},
+		{name: "level-1", compact: CompactLevel1, calls: 3, level: 1, recorded: CompactLevel1,
+			compacted: "store1,store2,store3"},
+		// a resumed import does not compact again
+		{name: "resumed", compact: CompactLevel1, done: CompactLevel1, recorded: CompactLevel1},
+		{name: "resumed after full", compact: CompactLevel1, done: CompactFull, recorded: CompactFull},
+		{name: "full after level-1", compact: CompactFull, done: CompactLevel1, calls: 3, level: -1,
+			recorded: CompactFull, compacted: "store1,store2,store3"},
+		// the failures and the timeouts are logged and not recorded
+		{name: "failed", compact: CompactFull, fail: "store2", calls: 3, level: -1,
+			compacted: "store1,store3"},
+		{name: "timeout", compact: CompactFull, hang: "store3", calls: 3, level: -1,
+			compacted: "store1,store2"},
+	} {
+		cp, err := LoadCheckpoint(filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)), "ns", PartitionNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.done != "" {
+			if err := cp.UpdateCompaction(c.done); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fc := &fakeCompactor{stores: stores, fail: map[string]bool{c.fail: true}, hang: map[string]bool{c.hang: true}}
+		l := &Lightning{
+			cfg:       &conf.Import{Compact: c.compact, CompactTimeout: 100 * time.Millisecond},
+			cp:        cp,
+			compactor: fc,
+		}
+		start := time.Now()
+		if err := l.compact(context.Background()); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if c.hang != "" && time.Since(start) > 5*time.Second {
+			t.Errorf("%s: compaction outlived its timeout", c.name)
+		}
+		if len(fc.levels) != c.calls {
+			t.Errorf("%s: %d stores compacted, expect %d", c.name, len(fc.levels), c.calls)
+		}
+		for _, level := range fc.levels {
+			if level != c.level {
+				t.Errorf("%s: compacted into level %d, expect %d", c.name, level, c.level)
+			}
+		}
+		if got := strings.Join(fc.compacted, ","); got != c.compacted {
+			t.Errorf("%s: compacted %q, expect %q", c.name, got, c.compacted)
+		}
+		// the compaction recorded survives a restart
+		if cp, err = LoadCheckpoint(cp.path, "ns", PartitionNone); err != nil {
+			t.Fatal(err)
+		}
+		if got := cp.Compacted(); got != c.recorded {
+			t.Errorf("%s: checkpoint records %q, expect %q", c.name, got, c.recorded)
+		}
+	}
+}
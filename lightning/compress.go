@@ -0,0 +1,84 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Compression formats of the sources
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionLz4   = "lz4"
+	CompressionBzip2 = "bzip2"
+)
+
+var compressionMagics = []struct {
+	magic       []byte
+	compression string
+}{
+	{[]byte{0x1f, 0x8b}, CompressionGzip},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, CompressionZstd},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, CompressionLz4},
+	{[]byte("BZh"), CompressionBzip2},
+}
+
+var compressionExts = map[string]string{
+	".gz":   CompressionGzip,
+	".gzip": CompressionGzip,
+	".zst":  CompressionZstd,
+	".zstd": CompressionZstd,
+	".lz4":  CompressionLz4,
+	".bz2":  CompressionBzip2,
+}
+
+// DetectCompression returns the compression of the source in path by its
+// extension, or by the magic bytes at the beginning of br
+func DetectCompression(path string, br *bufio.Reader) string {
+	if c, ok := compressionExts[strings.ToLower(filepath.Ext(path))]; ok {
+		return c
+	}
+	head, _ := br.Peek(4)
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// Decompress wraps r with a streaming decompressor if the source in path is
+// compressed, r is read lazily so the bytes read from it measure the progress
+func Decompress(path string, r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	c := DetectCompression(path, br)
+	switch c {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, c, err
+		}
+		return zr, c, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, c, err
+		}
+		return zr.IOReadCloser(), c, nil
+	case CompressionLz4:
+		return ioutil.NopCloser(lz4.NewReader(br)), c, nil
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), c, nil
+	}
+	return ioutil.NopCloser(br), c, nil
+}
@@ -0,0 +1,116 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// bzip2Dump is newRDB(9).selectDB(0).set("k", "v").end() compressed by bzip2,
+// which the standard library only decompresses
+const bzip2Dump = "425a6839314159265359130445000000084f80e400402006201800000801000001a00021a9ea320cca1000019640457314ae" +
+	"9584fe2ee48a70a12026088a00"
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += n
+	return n, err
+}
+
+func compressDump(t *testing.T, compression string, dump []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	case CompressionLz4:
+		w = lz4.NewWriter(&buf)
+	case CompressionBzip2:
+		b, err := hex.DecodeString(bzip2Dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	default:
+		return dump
+	}
+	if _, err := w.Write(dump); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	dump := newRDB(9).selectDB(0).set("k", "v").end()
+	for _, c := range []struct {
+		path        string
+		compression string
+	}{
+		// by the extension, in any case
+		{"dump.rdb.gz", CompressionGzip},
+		{"dump.rdb.GZIP", CompressionGzip},
+		{"dump.rdb.zst", CompressionZstd},
+		{"dump.rdb.zstd", CompressionZstd},
+		{"dump.rdb.lz4", CompressionLz4},
+		{"dump.rdb.bz2", CompressionBzip2},
+		// by the magic bytes
+		{"gzip.rdb", CompressionGzip},
+		{"zstd.rdb", CompressionZstd},
+		{"lz4.rdb", CompressionLz4},
+		{"bzip2.rdb", CompressionBzip2},
+		{"dump.rdb", CompressionNone},
+	} {
+		compressed := compressDump(t, c.compression, dump)
+		if got := DetectCompression(c.path, bufio.NewReader(bytes.NewReader(compressed))); got != c.compression {
+			t.Errorf("%s: detected %q, expect %q", c.path, got, c.compression)
+		}
+		in := &countingReader{r: bytes.NewReader(compressed)}
+		r, compression, err := Decompress(c.path, in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || compression != c.compression || !bytes.Equal(b, dump) {
+			t.Errorf("%s: decompressed %q as %q, %v, expect %q as %q", c.path, b, compression, err, dump, c.compression)
+		}
+		// the progress follows the compressed bytes
+		if in.n != len(compressed) {
+			t.Errorf("%s: read %d of the %d compressed bytes", c.path, in.n, len(compressed))
+		}
+	}
+
+	// the extension wins over the magic bytes
+	if got := DetectCompression("dump.rdb.gz", bufio.NewReader(bytes.NewReader(dump))); got != CompressionGzip {
+		t.Errorf("dump.rdb.gz detected as %q", got)
+	}
+	// a file shorter than the magic bytes
+	if got := DetectCompression("short", bufio.NewReader(bytes.NewReader([]byte{0x1f}))); got != CompressionNone {
+		t.Errorf("1 byte file detected as %q", got)
+	}
+	if _, _, err := Decompress("dump.rdb.gz", bytes.NewReader(dump)); err == nil {
+		t.Error("gzip reader accepted an uncompressed dump")
+	}
+}
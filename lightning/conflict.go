@@ -0,0 +1,339 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/distributedio/titan/db"
+	"github.com/distributedio/titan/db/store"
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb/config"
+	tidbkv "github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv"
+	"go.uber.org/zap"
+)
+
+// Conflict policies for keys already present in the target namespace
+const (
+	// ConflictError fails the import if the namespace already holds data
+	ConflictError = "error"
+	// ConflictReplace deletes the whole namespace, its expire index entries
+	// and its pending gc before importing
+	ConflictReplace = "replace"
+	// ConflictSkip keeps the existing objects and drops the imported ones
+	ConflictSkip = "skip"
+)
+
+const (
+	deleteRangeConcurrency = 16
+	deleteBatchSize        = 1024
+)
+
+// KeyStore looks up the keys already present in the target cluster
+type KeyStore interface {
+	// IsEmpty reports whether there is no key in [start, end)
+	IsEmpty(ctx context.Context, start, end []byte) (bool, error)
+	// Scan returns at most limit kvs of [start, end) in order
+	Scan(ctx context.Context, start, end []byte, limit int) ([]common.KvPair, error)
+	// DeleteRange removes all the keys in [start, end)
+	DeleteRange(ctx context.Context, start, end []byte) error
+	// Delete removes the keys
+	Delete(ctx context.Context, keys [][]byte) error
+	// Close releases the underlying connections
+	Close() error
+}
+
+// NamespaceRange returns the key range [start, end) holding the meta and data keys of ns
+func NamespaceRange(ns string) ([]byte, []byte) {
+	start := []byte(ns + ":")
+	end := []byte(ns + ";")
+	return start, end
+}
+
+// sysGCPrefix is the prefix of the keys of titan's gc, which deletes the data
+// keys following it: {sys ns}:{sys db id}:GC:{ns}:{db id}:D:{object id}
+var sysGCPrefix = []byte("$sys:\x00:GC:")
+
+// GCRange returns the key range [start, end) of the pending gc of ns
+func GCRange(ns string) ([]byte, []byte) {
+	start := append(append([]byte{}, sysGCPrefix...), ns+":"...)
+	end := append(append([]byte{}, sysGCPrefix...), ns+";"...)
+	return start, end
+}
+
+// deleteExpires removes the entries of the objects of ns from the expire
+// index, which is shared by the namespaces and ordered by time, so the whole
+// index is scanned
+func deleteExpires(ctx context.Context, ks KeyStore, layout *Layout, ns string) (int, error) {
+	start := layout.ExpirePrefix
+	end := tidbkv.Key(layout.ExpirePrefix).PrefixNext()
+	prefix := []byte(ns + ":")
+	deleted := 0
+	for {
+		kvs, err := ks.Scan(ctx, start, end, deleteBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		var keys [][]byte
+		for _, pair := range kvs {
+			// the meta key follows the timestamp and a ':'
+			if metaKey := pair.Key[len(layout.ExpirePrefix):]; len(metaKey) > 9 && bytes.HasPrefix(metaKey[9:], prefix) {
+				keys = append(keys, pair.Key)
+			}
+		}
+		if len(keys) > 0 {
+			if err := ks.Delete(ctx, keys); err != nil {
+				return deleted, err
+			}
+			deleted += len(keys)
+		}
+		if len(kvs) < deleteBatchSize {
+			return deleted, nil
+		}
+		start = append(append([]byte{}, kvs[len(kvs)-1].Key...), 0)
+	}
+}
+
+// replaceNamespace deletes the keys of ns and the entries titan's expire and gc
+// workers keep for them. Left behind, they would delete the objects imported
+// again under the same ids with object-id=hash once they are due.
+func replaceNamespace(ctx context.Context, ks KeyStore, layout *Layout, ns string) error {
+	zap.L().Info("delete existing namespace", zap.String("namespace", ns))
+	start, end := NamespaceRange(ns)
+	if err := ks.DeleteRange(ctx, start, end); err != nil {
+		return err
+	}
+	start, end = GCRange(ns)
+	if err := ks.DeleteRange(ctx, start, end); err != nil {
+		return err
+	}
+	n, err := deleteExpires(ctx, ks, layout, ns)
+	if err != nil {
+		return err
+	}
+	zap.L().Info("delete expire index of namespace", zap.String("namespace", ns), zap.Int("keys", n))
+	return nil
+}
+
+// CheckConflict applies the policy to the namespace before any data is written
+func CheckConflict(ctx context.Context, ks KeyStore, layout *Layout, policy, ns string) error {
+	start, end := NamespaceRange(ns)
+	switch policy {
+	case ConflictError:
+		empty, err := ks.IsEmpty(ctx, start, end)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("namespace %s is not empty", ns)
+		}
+	case ConflictReplace:
+		return replaceNamespace(ctx, ks, layout, ns)
+	case ConflictSkip:
+	default:
+		return fmt.Errorf("unknown conflict policy %s", policy)
+	}
+	return nil
+}
+
+// existingDir is the directory of the keys already in the namespace in sorted-dir
+const existingDir = "existing-keys"
+
+// existingScanned marks an index holding every meta key of the namespace, the
+// meta keys start with the namespace and never with this byte
+var existingScanned = []byte("\x00scanned")
+
+// ExistingKeys indexes the meta keys the namespace held before the import.
+// The namespace is scanned once, so that conflict=skip looks the keys up
+// locally instead of reading each of them from the cluster.
+type ExistingKeys struct {
+	*keyIndex
+}
+
+// LoadExistingKeys opens the index of the meta keys of ns in dir. The index
+// completed by a former run is kept if resume is set, as the namespace holds
+// the keys imported by that run, otherwise the namespace is scanned.
+func LoadExistingKeys(ctx context.Context, ks KeyStore, ns, dir string, resume bool) (*ExistingKeys, error) {
+	ki, err := openKeyIndex(dir, resume)
+	if err != nil {
+		return nil, err
+	}
+	ek := &ExistingKeys{keyIndex: ki}
+	_, scanned, err := ki.get(existingScanned)
+	if err == nil && scanned {
+		return ek, nil
+	}
+	if err == nil {
+		if resume {
+			zap.L().Warn("existing keys not indexed by the former run, the keys it imported are skipped as existing")
+		}
+		err = ek.scan(ctx, ks, ns)
+	}
+	if err != nil {
+		ki.Close()
+		return nil, err
+	}
+	return ek, nil
+}
+
+func (ek *ExistingKeys) scan(ctx context.Context, ks KeyStore, ns string) error {
+	var n int64
+	for id := 0; id <= math.MaxUint8; id++ {
+		start := db.MetaKey(&db.DB{Namespace: ns, ID: db.DBID(id)}, nil)
+		end := tidbkv.Key(start).PrefixNext()
+		for {
+			kvs, err := ks.Scan(ctx, start, end, deleteBatchSize)
+			if err != nil {
+				return err
+			}
+			for _, pair := range kvs {
+				if err := ek.set(pair.Key, nil); err != nil {
+					return err
+				}
+			}
+			n += int64(len(kvs))
+			if len(kvs) < deleteBatchSize {
+				break
+			}
+			start = append(append([]byte{}, kvs[len(kvs)-1].Key...), 0)
+		}
+	}
+	zap.L().Info("existing keys indexed", zap.String("namespace", ns), zap.Int64("keys", n))
+	return ek.set(existingScanned, nil)
+}
+
+// Exists reports whether the meta key was in the namespace before the import
+func (ek *ExistingKeys) Exists(key []byte) (bool, error) {
+	_, ok, err := ek.get(key)
+	return ok, err
+}
+
+type tikvStore struct {
+	s store.Storage
+}
+
+// NewKeyStore connects to the cluster behind the pd addresses, addrs with the
+// mocktikv:// scheme open a local stand-in store
+func NewKeyStore(pdAddrs string, sec *conf.Security) (KeyStore, error) {
+	addrs := pdAddrs
+	if !strings.Contains(addrs, "://") {
+		addrs = "tikv://" + addrs
+	}
+	if sec.CAPath != "" {
+		config.UpdateGlobal(func(c *config.Config) {
+			c.Security.ClusterSSLCA = sec.CAPath
+			c.Security.ClusterSSLCert = sec.CertPath
+			c.Security.ClusterSSLKey = sec.KeyPath
+		})
+	}
+	s, err := store.Open(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &tikvStore{s: s}, nil
+}
+
+func (ts *tikvStore) IsEmpty(ctx context.Context, start, end []byte) (bool, error) {
+	txn, err := ts.s.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback()
+	iter, err := txn.Iter(start, end)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return !iter.Valid(), nil
+}
+
+func (ts *tikvStore) Scan(ctx context.Context, start, end []byte, limit int) ([]common.KvPair, error) {
+	txn, err := ts.s.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+	iter, err := txn.Iter(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var kvs []common.KvPair
+	for iter.Valid() && len(kvs) < limit {
+		kvs = append(kvs, common.KvPair{Key: iter.Key().Clone(), Val: append([]byte{}, iter.Value()...)})
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return kvs, nil
+}
+
+func (ts *tikvStore) DeleteRange(ctx context.Context, start, end []byte) error {
+	if s, ok := ts.s.(tikv.Storage); ok {
+		return tikv.NewDeleteRangeTask(s, start, end, deleteRangeConcurrency).Execute(ctx)
+	}
+	// stand-in stores do not support range deletion, remove the keys in batches
+	for {
+		n, err := ts.deleteBatch(ctx, start, end)
+		if err != nil {
+			return err
+		}
+		if n < deleteBatchSize {
+			return nil
+		}
+	}
+}
+
+func (ts *tikvStore) Delete(ctx context.Context, keys [][]byte) error {
+	txn, err := ts.s.Begin()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit(ctx)
+}
+
+func (ts *tikvStore) deleteBatch(ctx context.Context, start, end []byte) (int, error) {
+	txn, err := ts.s.Begin()
+	if err != nil {
+		return 0, err
+	}
+	iter, err := txn.Iter(start, end)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	var keys []tidbkv.Key
+	for iter.Valid() && len(keys) < deleteBatchSize {
+		keys = append(keys, iter.Key().Clone())
+		if err := iter.Next(); err != nil {
+			iter.Close()
+			txn.Rollback()
+			return 0, err
+		}
+	}
+	iter.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+	if err := txn.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (ts *tikvStore) Close() error {
+	return ts.s.Close()
+}
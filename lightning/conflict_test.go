@@ -0,0 +1,174 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+	"github.com/nioshield/titan-lightning/rdb"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// memKeyStore is a KeyStore holding the keys in memory
+type memKeyStore struct {
+	kvs map[string][]byte
+}
+
+func newMemKeyStore() *memKeyStore {
+	return &memKeyStore{kvs: make(map[string][]byte)}
+}
+
+func (m *memKeyStore) put(key, val []byte) {
+	m.kvs[string(key)] = val
+}
+
+func (m *memKeyStore) keys(start, end []byte) []string {
+	var keys []string
+	for k := range m.kvs {
+		if k >= string(start) && k < string(end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memKeyStore) IsEmpty(ctx context.Context, start, end []byte) (bool, error) {
+	return len(m.keys(start, end)) == 0, nil
+}
+
+func (m *memKeyStore) Scan(ctx context.Context, start, end []byte, limit int) ([]common.KvPair, error) {
+	var kvs []common.KvPair
+	for _, k := range m.keys(start, end) {
+		if len(kvs) == limit {
+			break
+		}
+		kvs = append(kvs, common.KvPair{Key: []byte(k), Val: m.kvs[k]})
+	}
+	return kvs, nil
+}
+
+func (m *memKeyStore) DeleteRange(ctx context.Context, start, end []byte) error {
+	for _, k := range m.keys(start, end) {
+		delete(m.kvs, k)
+	}
+	return nil
+}
+
+func (m *memKeyStore) Delete(ctx context.Context, keys [][]byte) error {
+	for _, k := range keys {
+		delete(m.kvs, string(k))
+	}
+	return nil
+}
+
+func (m *memKeyStore) Close() error {
+	return nil
+}
+
+func TestCheckConflictReplace(t *testing.T) {
+	ctx := context.Background()
+	ks := newMemKeyStore()
+	var kept [][]byte
+	for _, ns := range []string{"ns", "other"} {
+		d := &db.DB{Namespace: ns}
+		// more expire entries than a scan returns at once
+		for i := 0; i < deleteBatchSize+10; i++ {
+			metaKey := db.MetaKey(d, []byte(fmt.Sprintf("key%d", i)))
+			ekey, err := DefaultLayout.ExpireKey(metaKey, int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gcKey := append(append([]byte{}, sysGCPrefix...), db.DataKey(d, []byte(fmt.Sprintf("id%d", i)))...)
+			for _, key := range [][]byte{metaKey, ekey, gcKey} {
+				ks.put(key, []byte("v"))
+				if ns == "other" {
+					kept = append(kept, key)
+				}
+			}
+		}
+	}
+	// the namespace is a prefix of this one, which must be kept
+	longer := db.MetaKey(&db.DB{Namespace: "ns2"}, []byte("key"))
+	ks.put(longer, nil)
+	kept = append(kept, longer)
+
+	if err := CheckConflict(ctx, ks, DefaultLayout, ConflictError, "ns"); err == nil {
+		t.Fatal("expect an error for a non-empty namespace")
+	}
+	if err := CheckConflict(ctx, ks, DefaultLayout, ConflictReplace, "ns"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.kvs) != len(kept) {
+		t.Errorf("%d keys left, expect %d", len(ks.kvs), len(kept))
+	}
+	for _, key := range kept {
+		if _, ok := ks.kvs[string(key)]; !ok {
+			t.Errorf("key %q of another namespace deleted", key)
+		}
+	}
+	if err := CheckConflict(ctx, ks, DefaultLayout, ConflictError, "ns"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExistingKeysSkip(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, existingDir)
+
+	ks := newMemKeyStore()
+	// more keys than a scan returns at once
+	for i := 0; i < deleteBatchSize+10; i++ {
+		ks.put(db.MetaKey(&db.DB{Namespace: "ns", ID: 3}, []byte(fmt.Sprintf("old%d", i))), []byte("v"))
+	}
+	ks.put(db.MetaKey(&db.DB{Namespace: "ns"}, []byte("a")), []byte("v"))
+	ks.put(db.DataKey(&db.DB{Namespace: "ns"}, []byte("b")), []byte("v"))
+	ks.put(db.MetaKey(&db.DB{Namespace: "other"}, []byte("c")), []byte("v"))
+
+	ek, err := LoadExistingKeys(ctx, ks, "ns", dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newKVRecorder()
+	dump := newRDB(9).selectDB(0).set("a", "new").set("b", "new").set("c", "new").
+		selectDB(3).set("old7", "new").set(fmt.Sprintf("old%d", deleteBatchSize+9), "new").set("new", "new").end()
+	if err := rdb.Decode(bytes.NewReader(dump), newTestDecode(rec, WithExistingKeys(ek))); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rec.metaKeys("ns", 0), ","); got != "b,c" {
+		t.Errorf("imported keys %s of db 0, expect b,c", got)
+	}
+	if got := strings.Join(rec.metaKeys("ns", 3), ","); got != "new" {
+		t.Errorf("imported keys %s of db 3, expect new", got)
+	}
+	if err := ek.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a resumed import keeps the keys indexed before the first run wrote
+	imported := db.MetaKey(&db.DB{Namespace: "ns"}, []byte("b"))
+	ks.put(imported, []byte("v"))
+	for _, resume := range []bool{true, false} {
+		ek, err := LoadExistingKeys(ctx, ks, "ns", dir, resume)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := ek.Exists(imported)
+		ek.Close()
+		if err != nil || exists == resume {
+			t.Errorf("resume %v: key written by the import reported existing %v, %v", resume, exists, err)
+		}
+	}
+}
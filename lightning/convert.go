@@ -0,0 +1,379 @@
+package lightning
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// convertBatch is the max number of elements written by one resp command
+const convertBatch = 64
+
+// ValidConvertFormat reports whether an rdb can be converted to format f
+func ValidConvertFormat(f string) bool {
+	switch f {
+	case FormatJSONL, FormatCSV, FormatRESP:
+		return true
+	}
+	return false
+}
+
+// Convert decodes the rdb in r, compressed or not, and writes the objects
+// accepted by accept to w in format, which is jsonl, csv or resp. The jsonl
+// and csv output follow the layouts read by DecodeJSONL and DecodeCSV with
+// the ttls relative to the time of the conversion, the resp output is a file
+// for redis-cli --pipe with absolute expiries. Expired objects are dropped as
+// they are by the import, and accept may be nil to convert every object.
+func Convert(path string, r io.Reader, w io.Writer, format string, accept func(n int, key []byte) bool) error {
+	bw := bufio.NewWriter(w)
+	var ow objectWriter
+	switch format {
+	case FormatJSONL:
+		ow = &jsonlWriter{w: bw}
+	case FormatCSV:
+		cw := &csvWriter{w: csv.NewWriter(bw)}
+		if err := cw.w.Write([]string{"db", "key", "type", "ttl_ms", "field", "value"}); err != nil {
+			return err
+		}
+		ow = cw
+	case FormatRESP:
+		ow = &respWriter{w: bw, db: -1}
+	default:
+		return fmt.Errorf("unknown convert format %q", format)
+	}
+
+	dr, _, err := Decompress(path, r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	c := &objectCollector{w: ow, now: nowMs()}
+	var d rdb.Decoder = c
+	if accept != nil {
+		d = NewFilterDecoder(c, accept)
+	}
+	if err := rdb.Decode(bufio.NewReader(dr), d); err != nil {
+		return err
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if err := ow.flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// object is a whole object collected from the decoder events, values holds
+// the value of a string, the values of a hash, the members of a set or a
+// sorted set and the elements of a list
+type object struct {
+	db     int
+	key    []byte
+	typ    rdb.ValueType
+	ttl    int64
+	expiry int64
+	fields [][]byte
+	values [][]byte
+	scores []float64
+}
+
+func (obj *object) typeName() string {
+	switch obj.typ {
+	case rdb.TypeHash:
+		return "hash"
+	case rdb.TypeSet:
+		return "set"
+	case rdb.TypeList:
+		return "list"
+	case rdb.TypeZSet:
+		return "zset"
+	}
+	return "string"
+}
+
+// validUTF8 reports whether the key, fields and values are valid utf-8
+func (obj *object) validUTF8() bool {
+	if !utf8.Valid(obj.key) {
+		return false
+	}
+	for _, field := range obj.fields {
+		if !utf8.Valid(field) {
+			return false
+		}
+	}
+	for _, value := range obj.values {
+		if !utf8.Valid(value) {
+			return false
+		}
+	}
+	return true
+}
+
+type objectWriter interface {
+	write(obj *object) error
+	flush() error
+}
+
+// objectCollector collects the objects of an rdb and passes them to w
+type objectCollector struct {
+	w    objectWriter
+	now  int64
+	db   int
+	obj  *object
+	skip bool
+	err  error
+}
+
+func (c *objectCollector) start(key []byte, typ rdb.ValueType, expiry int64) {
+	c.skip = expiry > 0 && expiry <= c.now
+	c.obj = &object{db: c.db, key: key, typ: typ, expiry: expiry}
+	if expiry > 0 {
+		c.obj.ttl = expiry - c.now
+	}
+}
+
+func (c *objectCollector) end() {
+	if !c.skip && c.err == nil && len(c.obj.values) > 0 {
+		if err := c.w.write(c.obj); err != nil {
+			c.err = fmt.Errorf("convert key %q: %v", c.obj.key, err)
+		}
+	}
+	c.obj = nil
+}
+
+func (c *objectCollector) add(value []byte) {
+	if !c.skip {
+		c.obj.values = append(c.obj.values, value)
+	}
+}
+
+func (c *objectCollector) StartRDB() {}
+
+func (c *objectCollector) StartDatabase(n int) {
+	c.db = n
+}
+
+func (c *objectCollector) Aux(key, value []byte) {}
+
+func (c *objectCollector) ResizeDatabase(dbSize, expiresSize uint32) {}
+
+func (c *objectCollector) Set(key, value []byte, expiry int64) {
+	c.start(key, rdb.TypeString, expiry)
+	c.add(value)
+	c.end()
+}
+
+func (c *objectCollector) StartHash(key []byte, length, expiry int64) {
+	c.start(key, rdb.TypeHash, expiry)
+}
+
+func (c *objectCollector) Hset(key, field, value []byte) {
+	if !c.skip {
+		c.obj.fields = append(c.obj.fields, field)
+	}
+	c.add(value)
+}
+
+func (c *objectCollector) EndHash(key []byte) {
+	c.end()
+}
+
+func (c *objectCollector) StartSet(key []byte, cardinality, expiry int64) {
+	c.start(key, rdb.TypeSet, expiry)
+}
+
+func (c *objectCollector) Sadd(key, member []byte) {
+	c.add(member)
+}
+
+func (c *objectCollector) EndSet(key []byte) {
+	c.end()
+}
+
+func (c *objectCollector) StartList(key []byte, length, expiry int64) {
+	c.start(key, rdb.TypeList, expiry)
+}
+
+func (c *objectCollector) Rpush(key, value []byte) {
+	c.add(value)
+}
+
+func (c *objectCollector) EndList(key []byte) {
+	c.end()
+}
+
+func (c *objectCollector) StartZSet(key []byte, cardinality, expiry int64) {
+	c.start(key, rdb.TypeZSet, expiry)
+}
+
+func (c *objectCollector) Zadd(key []byte, score float64, member []byte) {
+	if !c.skip {
+		c.obj.scores = append(c.obj.scores, score)
+	}
+	c.add(member)
+}
+
+func (c *objectCollector) EndZSet(key []byte) {
+	c.end()
+}
+
+func (c *objectCollector) EndDatabase(n int) {}
+
+func (c *objectCollector) EndRDB() {}
+
+// jsonlWriter writes an object per line, objects holding data which is not
+// valid utf-8 are written with the key and the strings of the value in base64
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func (jw *jsonlWriter) write(obj *object) error {
+	encoding := ""
+	str := func(b []byte) string { return string(b) }
+	if !obj.validUTF8() {
+		encoding = jsonBase64
+		str = base64.StdEncoding.EncodeToString
+	}
+	var value interface{}
+	switch obj.typ {
+	case rdb.TypeString:
+		value = str(obj.values[0])
+	case rdb.TypeHash:
+		v := make(map[string]string, len(obj.values))
+		for i, field := range obj.fields {
+			v[str(field)] = str(obj.values[i])
+		}
+		value = v
+	case rdb.TypeSet, rdb.TypeList:
+		v := make([]string, len(obj.values))
+		for i, elem := range obj.values {
+			v[i] = str(elem)
+		}
+		value = v
+	case rdb.TypeZSet:
+		v := make(map[string]float64, len(obj.values))
+		for i, member := range obj.values {
+			if math.IsInf(obj.scores[i], 0) {
+				return fmt.Errorf("score %v of member %q has no json representation", obj.scores[i], member)
+			}
+			v[str(member)] = obj.scores[i]
+		}
+		value = v
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	key := str(obj.key)
+	line, err := json.Marshal(&jsonRecord{DB: obj.db, Key: &key, Type: obj.typeName(), TTL: obj.ttl, Value: raw,
+		Encoding: encoding})
+	if err != nil {
+		return err
+	}
+	if _, err := jw.w.Write(line); err != nil {
+		return err
+	}
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonlWriter) flush() error {
+	return nil
+}
+
+// csvWriter writes a row per member of an object
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) write(obj *object) error {
+	db, key, typ := strconv.Itoa(obj.db), string(obj.key), obj.typeName()
+	ttl := ""
+	if obj.ttl > 0 {
+		ttl = strconv.FormatInt(obj.ttl, 10)
+	}
+	for i, value := range obj.values {
+		var row []string
+		switch obj.typ {
+		case rdb.TypeHash:
+			row = []string{db, key, typ, ttl, string(obj.fields[i]), string(value)}
+		case rdb.TypeZSet:
+			row = []string{db, key, typ, ttl, string(value), string(formatFloat(obj.scores[i]))}
+		default:
+			row = []string{db, key, typ, ttl, "", string(value)}
+		}
+		if err := cw.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *csvWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// respWriter writes the commands creating an object, with a SELECT whenever
+// the database changes
+type respWriter struct {
+	w  *bufio.Writer
+	db int
+}
+
+func (rw *respWriter) write(obj *object) error {
+	if obj.db != rw.db {
+		if err := WriteCommand(rw.w, []byte("SELECT"), []byte(strconv.Itoa(obj.db))); err != nil {
+			return err
+		}
+		rw.db = obj.db
+	}
+	var name string
+	var args [][]byte
+	switch obj.typ {
+	case rdb.TypeString:
+		name, args = "SET", obj.values
+	case rdb.TypeHash:
+		name = "HSET"
+		for i, field := range obj.fields {
+			args = append(args, field, obj.values[i])
+		}
+	case rdb.TypeSet:
+		name, args = "SADD", obj.values
+	case rdb.TypeList:
+		name, args = "RPUSH", obj.values
+	case rdb.TypeZSet:
+		name = "ZADD"
+		for i, member := range obj.values {
+			args = append(args, formatFloat(obj.scores[i]), member)
+		}
+	}
+	step := len(args) / len(obj.values)
+	for len(args) > 0 {
+		n := convertBatch * step
+		if n > len(args) {
+			n = len(args)
+		}
+		cmd := append([][]byte{[]byte(name), obj.key}, args[:n]...)
+		if err := WriteCommand(rw.w, cmd...); err != nil {
+			return err
+		}
+		args = args[n:]
+	}
+	if obj.expiry > 0 {
+		return WriteCommand(rw.w, []byte("PEXPIREAT"), obj.key, []byte(strconv.FormatInt(obj.expiry, 10)))
+	}
+	return nil
+}
+
+func (rw *respWriter) flush() error {
+	return nil
+}
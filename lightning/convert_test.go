@@ -0,0 +1,48 @@
+package lightning
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConvertJSONLBinary(t *testing.T) {
+	dump := newRDB(9).selectDB(0).
+		set("plain", "text").
+		set("bin\xff", "v\x00\xfe").
+		list("list", "a", "\xc3\x28").
+		end()
+	var out bytes.Buffer
+	if err := Convert("dump.rdb", bytes.NewReader(dump), &out, FormatJSONL, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines, got %q", out.String())
+	}
+	for _, line := range lines {
+		plain := strings.Contains(line, `"key":"plain"`)
+		if encoded := strings.Contains(line, `"encoding":"base64"`); encoded == plain {
+			t.Errorf("line %s, expect base64 only for binary objects", line)
+		}
+	}
+
+	rec := newKVRecorder()
+	if err := DecodeJSONL(&out, newTestDecode(rec), LineErrorFail); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rec.metaKeys("ns", 0), ","); got != "bin\xff,list,plain" {
+		t.Errorf("imported keys %q", got)
+	}
+	if _, val := rec.meta("ns", 0, "bin\xff"); !bytes.HasSuffix(val, []byte("v\x00\xfe")) {
+		t.Errorf("binary value imported as %q", val)
+	}
+	if _, val := rec.meta("ns", 0, "plain"); !bytes.HasSuffix(val, []byte("text")) {
+		t.Errorf("value imported as %q", val)
+	}
+
+	if err := DecodeJSONL(strings.NewReader(`{"key":"!!","type":"string","value":"dg==","encoding":"base64"}`),
+		newTestDecode(newKVRecorder()), LineErrorFail); err == nil || !strings.Contains(err.Error(), "base64") {
+		t.Errorf("expect the invalid base64 key to fail, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package lightning
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// csvColumns are the columns of a CSV source, the ones marked true are required
+var csvColumns = map[string]bool{
+	"db":     false,
+	"key":    true,
+	"type":   true,
+	"ttl_ms": false,
+	"field":  false,
+	"value":  true,
+}
+
+// DecodeCSV decodes a typed CSV source, the first line is a header naming the
+// columns db, key, type, ttl_ms, field and value. Each row holds a string, a
+// field of a hash, a member of a set, an element of a list, or a member of a
+// sorted set in field with its score in value, the rows of a key are folded
+// into one object which is emitted to d once the file ends. Invalid rows are
+// reported by the line they start on.
+func DecodeCSV(r io.Reader, d rdb.Decoder, onError string) error {
+	lines := &csvLines{line: 1, start: 1, empty: true}
+	cr := csv.NewReader(io.TeeReader(r, lines))
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("read csv header: %v", err)
+	}
+	lines.next()
+	cols := make(map[string]int)
+	for i, name := range header {
+		if _, ok := csvColumns[name]; !ok {
+			return fmt.Errorf("unknown csv column %q", name)
+		}
+		cols[name] = i
+	}
+	for name, required := range csvColumns {
+		if _, ok := cols[name]; required && !ok {
+			return fmt.Errorf("missing csv column %q", name)
+		}
+	}
+
+	le := &lineErrors{action: onError}
+	rp := NewReplayer()
+	if err := replayCSV(cr, lines, rp, cols, le); err != nil {
+		emitSample(rp, d)
+		return err
+	}
+	le.report()
+	rp.Emit(d)
+	return nil
+}
+
+// replayCSV applies the rows read from cr to rp
+func replayCSV(cr *csv.Reader, lines *csvLines, rp *Replayer, cols map[string]int, le *lineErrors) error {
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		n := lines.next()
+		if perr, ok := err.(*csv.ParseError); ok && perr.Err == csv.ErrFieldCount {
+			if herr := le.handle(n, perr.Err); herr != nil {
+				return herr
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyCSVRow(rp, cols, row); err != nil {
+			if herr := le.handle(n, err); herr != nil {
+				return herr
+			}
+		}
+	}
+}
+
+// csvLines follows the bytes read by a csv.Reader and records the line each
+// row starts on, the quoted line breaks of a row and the empty lines skipped
+// by the reader are counted as lines too
+type csvLines struct {
+	line  int64
+	start int64
+	// quoted is set inside a quoted field, a doubled quote toggles it twice
+	quoted bool
+	empty  bool
+	starts []int64
+}
+
+func (cl *csvLines) Write(p []byte) (int, error) {
+	for _, c := range p {
+		switch c {
+		case '"':
+			cl.quoted = !cl.quoted
+			cl.empty = false
+		case '\n':
+			cl.line++
+			if cl.quoted {
+				continue
+			}
+			if !cl.empty {
+				cl.starts = append(cl.starts, cl.start)
+			}
+			cl.start, cl.empty = cl.line, true
+		case '\r':
+		default:
+			cl.empty = false
+		}
+	}
+	return len(p), nil
+}
+
+// next returns the line of the row read last, the reader reads ahead so the
+// rows after it may be recorded already
+func (cl *csvLines) next() int64 {
+	if len(cl.starts) == 0 {
+		// the last row has no line break
+		return cl.start
+	}
+	start := cl.starts[0]
+	cl.starts = cl.starts[1:]
+	return start
+}
+
+func applyCSVRow(rp *Replayer, cols map[string]int, row []string) error {
+	column := func(name string) string {
+		if i, ok := cols[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+	db := 0
+	if v := column("db"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid db %q", v)
+		}
+		db = n
+	}
+	key, field, value := column("key"), column("field"), column("value")
+	if key == "" {
+		return errors.New("missing key")
+	}
+	var ttl int64
+	if v := column("ttl_ms"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid ttl_ms %q", v)
+		}
+		ttl = n
+	}
+
+	var args []string
+	switch typ := column("type"); typ {
+	case "string":
+		args = []string{"SET", key, value}
+	case "hash":
+		args = []string{"HSET", key, field, value}
+	case "set":
+		args = []string{"SADD", key, value}
+	case "list":
+		args = []string{"RPUSH", key, value}
+	case "zset":
+		args = []string{"ZADD", key, value, field}
+	default:
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	if (args[0] == "HSET" || args[0] == "ZADD") && field == "" {
+		return errors.New("missing field")
+	}
+	rp.db = db
+	if obj, ok := rp.keys()[key]; ok && args[0] == "SET" && obj.typ != rdb.TypeString {
+		// SET would replace the object, the rows of a key must agree on its type
+		return errWrongType
+	}
+	if err := rp.Apply(bytesArgs(args...)); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return rp.Apply(bytesArgs("PEXPIRE", key, strconv.FormatInt(ttl, 10)))
+	}
+	return nil
+}
+
+func bytesArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
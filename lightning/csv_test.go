@@ -0,0 +1,32 @@
+package lightning
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestDecodeCSVErrorLine(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("key,type,field,value\r\n")
+	// the rows are read ahead of the one failing
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&b, "k%d,string,,v\r\n", i)
+	}
+	b.WriteString("multi,hash,f,\"first\r\nsecond \"\"quoted\"\"\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("bad,stream,,v\r\n")
+	b.WriteString("k,string,,v\r\n")
+
+	err := DecodeCSV(strings.NewReader(b.String()), rdb.NopDecoder{}, LineErrorFail)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 505:") {
+		t.Fatalf("expect the invalid row at line 505, got %v", err)
+	}
+	// the last row has no line break
+	err = DecodeCSV(strings.NewReader("key,type,value\n\"a\nb\",string,v\nc,set"), rdb.NopDecoder{}, LineErrorFail)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 4:") {
+		t.Fatalf("expect the row at line 4 to fail, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package lightning
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Duplicate key actions
+const (
+	// DuplicateWarn logs the keys found in more than one source and imports them
+	DuplicateWarn = "warn"
+	// DuplicateError fails the source in which a duplicate key is found
+	DuplicateError = "error"
+)
+
+// duplicateDir is the directory of the keys seen by the detector in sorted-dir
+const duplicateDir = "duplicate-keys"
+
+// duplicateLocks is the number of locks the keys are spread over
+const duplicateLocks = 256
+
+// DuplicateDetector detects keys which appear in more than one source. The
+// keys are kept whole in a local key index, which bounds the memory and only
+// reports the keys really seen twice.
+type DuplicateDetector struct {
+	*keyIndex
+	// locks serialize the lookup and the insert of a key
+	locks [duplicateLocks]sync.Mutex
+	count int64
+}
+
+// NewDuplicateDetector creates a detector keeping the keys in dir. A resumed
+// import keeps the keys of the sources imported before, otherwise the keys
+// left in dir by a former import are removed.
+func NewDuplicateDetector(dir string, resume bool) (*DuplicateDetector, error) {
+	ki, err := openKeyIndex(dir, resume)
+	if err != nil {
+		return nil, err
+	}
+	return &DuplicateDetector{keyIndex: ki}, nil
+}
+
+// Add records the key of database n seen in source src, it returns the ID of
+// another source which already holds the key
+func (dd *DuplicateDetector) Add(n int, key []byte, src int32) (int32, bool, error) {
+	k := make([]byte, 0, len(key)+1)
+	k = append(append(k, byte(n)), key...)
+	h := fnv.New32a()
+	h.Write(k)
+	mu := &dd.locks[h.Sum32()%duplicateLocks]
+	mu.Lock()
+	defer mu.Unlock()
+
+	val, ok, err := dd.get(k)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
+		// the sources of a resumed import keep their IDs
+		prev := int32(binary.BigEndian.Uint32(val))
+		if prev == src {
+			return 0, false, nil
+		}
+		atomic.AddInt64(&dd.count, 1)
+		return prev, true, nil
+	}
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], uint32(src))
+	return 0, false, dd.set(k, v[:])
+}
+
+// Count returns the number of duplicate keys found
+func (dd *DuplicateDetector) Count() int64 {
+	return atomic.LoadInt64(&dd.count)
+}
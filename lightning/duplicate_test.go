@@ -0,0 +1,64 @@
+package lightning
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDuplicateDetector(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "duplicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, duplicateDir)
+	dd, err := NewDuplicateDetector(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, ok, err := dd.Add(0, []byte(fmt.Sprintf("key%d", i)), 1); err != nil || ok {
+			t.Fatalf("key%d reported as duplicate, %v", i, err)
+		}
+	}
+	// a key seen again in its own source is not a duplicate
+	if _, ok, err := dd.Add(0, []byte("key1"), 1); err != nil || ok {
+		t.Fatalf("key1 of the same source reported as duplicate, %v", err)
+	}
+	// nor is the same key of another database
+	if _, ok, err := dd.Add(1, []byte("key1"), 2); err != nil || ok {
+		t.Fatalf("key1 of db 1 reported as duplicate, %v", err)
+	}
+	prev, ok, err := dd.Add(0, []byte("key1"), 2)
+	if err != nil || !ok || prev != 1 {
+		t.Fatalf("expect key1 found in source 1, got %d %v %v", prev, ok, err)
+	}
+	if n := dd.Count(); n != 1 {
+		t.Errorf("expect 1 duplicate, got %d", n)
+	}
+	if err := dd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a resumed import still knows the keys of the sources imported before
+	for _, resume := range []bool{true, false} {
+		dd, err := NewDuplicateDetector(dir, resume)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := dd.Add(0, []byte("key2"), 3)
+		dd.Close()
+		if err != nil || ok != resume {
+			t.Errorf("resume %v: key2 of source 1 reported as duplicate %v, %v", resume, ok, err)
+		}
+	}
+	if err := removeKeyIndexes(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("keys left in %s", dir)
+	}
+}
@@ -5,25 +5,10 @@ import (
 	"math"
 
 	"github.com/distributedio/titan/db"
+	"github.com/distributedio/titan/db/zlistproto"
+	"github.com/golang/protobuf/proto"
 )
 
-var (
-	expireKeyPrefix = []byte("$sys:0:at:")
-)
-
-func ExpireKey(key []byte, ts int64) ([]byte, error) {
-	var buf []byte
-	buf = append(buf, expireKeyPrefix...)
-	encode, err := db.EncodeInt64(ts)
-	if err != nil {
-		return nil, err
-	}
-	buf = append(buf, encode...)
-	buf = append(buf, ':')
-	buf = append(buf, key...)
-	return buf, nil
-}
-
 func HashItemKey(dbInfo *db.DB, meta *HashMeta, field []byte) []byte {
 	b := db.DataKey(dbInfo, meta.ID)
 	b = append(b, ':')
@@ -48,24 +33,6 @@ func LListItemKey(dbInfo *db.DB, meta *LListMeta, index float64) ([]byte, error)
 	return key, nil
 }
 
-func ZsetItemKey(dkey []byte, member []byte) []byte {
-	var memberKey []byte
-	memberKey = append(memberKey, dkey...)
-	memberKey = append(memberKey, ':', 'M', ':')
-	memberKey = append(memberKey, member...)
-	return memberKey
-}
-
-func ZsetScoreKey(dkey []byte, score []byte, member []byte) []byte {
-	var scoreKey []byte
-	scoreKey = append(scoreKey, dkey...)
-	scoreKey = append(scoreKey, ':', 'S', ':')
-	scoreKey = append(scoreKey, score...)
-	scoreKey = append(scoreKey, ':')
-	scoreKey = append(scoreKey, member...)
-	return scoreKey
-}
-
 type Meta interface {
 	Encode() []byte
 	Decode([]byte) error
@@ -132,6 +99,8 @@ func NewHashMeta() *HashMeta {
 
 type HashMeta struct {
 	db.Object
+	// Len is only encoded by the layouts keeping the length of the hashes
+	Len int64
 }
 
 func (meta *HashMeta) Encode() []byte {
@@ -194,6 +163,51 @@ func (meta *LListMeta) Decode(b []byte) (err error) {
 	return nil
 }
 
+func NewZListMeta() *ZListMeta {
+	now := db.Now()
+	return &ZListMeta{
+		Object: db.Object{
+			ID:        db.UUID(),
+			Type:      db.ObjectList,
+			Encoding:  db.ObjectEncodingZiplist,
+			CreatedAt: now,
+			UpdatedAt: now,
+			ExpireAt:  0,
+		},
+	}
+}
+
+// ZListMeta is a list in the ziplist encoding, whose elements are stored in
+// the meta value
+type ZListMeta struct {
+	db.Object
+	Values [][]byte
+}
+
+func (meta *ZListMeta) Encode() []byte {
+	b := db.EncodeObject(&meta.Object)
+	// marshaling repeated bytes does not fail
+	v, _ := proto.Marshal(&zlistproto.Zlistvalue{V: meta.Values})
+	return append(b, v...)
+}
+
+func (meta *ZListMeta) Decode(b []byte) error {
+	obj, err := db.DecodeObject(b)
+	if err != nil {
+		return err
+	}
+	if obj.Type != db.ObjectList || obj.Encoding != db.ObjectEncodingZiplist {
+		return db.ErrTypeMismatch
+	}
+	var v zlistproto.Zlistvalue
+	if err := proto.Unmarshal(b[db.ObjectEncodingLength:], &v); err != nil {
+		return err
+	}
+	meta.Object = *obj
+	meta.Values = v.V
+	return nil
+}
+
 func NewSetMeta() *SetMeta {
 	now := db.Now()
 	return &SetMeta{
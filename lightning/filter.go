@@ -0,0 +1,222 @@
+package lightning
+
+import (
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// FilterDecoder forwards to the wrapped decoder only the objects accepted by
+// the filter, the other events are passed through
+type FilterDecoder struct {
+	rdb.Decoder
+	accept   func(n int, key []byte) bool
+	db       int
+	skipping bool
+	skipped  int64
+	// idle is the pending idle time of the next object, -1 if none
+	idle int64
+}
+
+// NewFilterDecoder wraps d with the filter accept, which is called with the
+// database and the key of every object
+func NewFilterDecoder(d rdb.Decoder, accept func(n int, key []byte) bool) *FilterDecoder {
+	return &FilterDecoder{Decoder: d, accept: accept, idle: -1}
+}
+
+// Skipped returns the number of objects dropped by the filter
+func (f *FilterDecoder) Skipped() int64 {
+	return f.skipped
+}
+
+func (f *FilterDecoder) start(key []byte) bool {
+	f.skipping = !f.accept(f.db, key)
+	if f.skipping {
+		f.skipped++
+	} else if id, ok := f.Decoder.(rdb.IdleDecoder); ok && f.idle >= 0 {
+		id.Idle(uint64(f.idle))
+	}
+	f.idle = -1
+	return !f.skipping
+}
+
+// Idle holds the idle time until the filter accepts the object it belongs to
+func (f *FilterDecoder) Idle(seconds uint64) {
+	f.idle = int64(seconds)
+}
+
+// SlotInfo forwards the slot info if the wrapped decoder is interested in it
+func (f *FilterDecoder) SlotInfo(slot, size, expiresSize uint64) {
+	if sd, ok := f.Decoder.(rdb.SlotInfoDecoder); ok {
+		sd.SlotInfo(slot, size, expiresSize)
+	}
+}
+
+// Stream forwards the accepted streams if the wrapped decoder handles streams
+func (f *FilterDecoder) Stream(key []byte, s *rdb.Stream, expiry int64) {
+	if sd, ok := f.Decoder.(rdb.StreamDecoder); ok && f.start(key) {
+		sd.Stream(key, s, expiry)
+	}
+}
+
+// Module forwards the accepted module values if the wrapped decoder handles them
+func (f *FilterDecoder) Module(key []byte, m *rdb.Module, expiry int64) {
+	if md, ok := f.Decoder.(rdb.ModuleDecoder); ok && f.start(key) {
+		md.Module(key, m, expiry)
+	}
+}
+
+func (f *FilterDecoder) StartDatabase(n int) {
+	f.db = n
+	f.Decoder.StartDatabase(n)
+}
+
+func (f *FilterDecoder) Set(key, value []byte, expiry int64) {
+	if f.start(key) {
+		f.Decoder.Set(key, value, expiry)
+	}
+}
+
+func (f *FilterDecoder) StartHash(key []byte, length, expiry int64) {
+	if f.start(key) {
+		f.Decoder.StartHash(key, length, expiry)
+	}
+}
+
+func (f *FilterDecoder) Hset(key, field, value []byte) {
+	if !f.skipping {
+		f.Decoder.Hset(key, field, value)
+	}
+}
+
+func (f *FilterDecoder) EndHash(key []byte) {
+	if !f.skipping {
+		f.Decoder.EndHash(key)
+	}
+}
+
+func (f *FilterDecoder) StartSet(key []byte, cardinality, expiry int64) {
+	if f.start(key) {
+		f.Decoder.StartSet(key, cardinality, expiry)
+	}
+}
+
+func (f *FilterDecoder) Sadd(key, member []byte) {
+	if !f.skipping {
+		f.Decoder.Sadd(key, member)
+	}
+}
+
+func (f *FilterDecoder) EndSet(key []byte) {
+	if !f.skipping {
+		f.Decoder.EndSet(key)
+	}
+}
+
+func (f *FilterDecoder) StartList(key []byte, length, expiry int64) {
+	if f.start(key) {
+		f.Decoder.StartList(key, length, expiry)
+	}
+}
+
+func (f *FilterDecoder) Rpush(key, value []byte) {
+	if !f.skipping {
+		f.Decoder.Rpush(key, value)
+	}
+}
+
+func (f *FilterDecoder) EndList(key []byte) {
+	if !f.skipping {
+		f.Decoder.EndList(key)
+	}
+}
+
+func (f *FilterDecoder) StartZSet(key []byte, cardinality, expiry int64) {
+	if f.start(key) {
+		f.Decoder.StartZSet(key, cardinality, expiry)
+	}
+}
+
+func (f *FilterDecoder) Zadd(key []byte, score float64, member []byte) {
+	if !f.skipping {
+		f.Decoder.Zadd(key, score, member)
+	}
+}
+
+func (f *FilterDecoder) EndZSet(key []byte) {
+	if !f.skipping {
+		f.Decoder.EndZSet(key)
+	}
+}
+
+// MatchKey reports whether key matches the glob pattern the way the redis
+// KEYS command does, with *, ?, [...], [^...] and \ escapes
+func MatchKey(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if MatchKey(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					pattern = pattern[1:]
+					match = match || pattern[0] == key[0]
+				case len(pattern) > 2 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || key[0] >= lo && key[0] <= hi
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == key[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			key = key[1:]
+			if len(pattern) == 0 {
+				// an unterminated class ends the pattern
+				return len(key) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
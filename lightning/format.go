@@ -0,0 +1,110 @@
+package lightning
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Formats of the sources
+const (
+	// FormatAuto detects the format by the extension or the content
+	FormatAuto = ""
+	FormatRDB  = "rdb"
+	FormatAOF  = "aof"
+	// FormatRESP is a file of commands written for redis-cli --pipe
+	FormatRESP  = "resp"
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// Line error actions
+const (
+	// LineErrorFail fails the source on an invalid line
+	LineErrorFail = "error"
+	// LineErrorSkip logs and skips the invalid lines
+	LineErrorSkip = "skip"
+)
+
+var formatExts = map[string]string{
+	".rdb":    FormatRDB,
+	".aof":    FormatAOF,
+	".resp":   FormatRESP,
+	".jsonl":  FormatJSONL,
+	".ndjson": FormatJSONL,
+	".csv":    FormatCSV,
+}
+
+// ValidFormat reports whether f is a known format of the sources
+func ValidFormat(f string) bool {
+	switch f {
+	case FormatAuto, FormatRDB, FormatAOF, FormatRESP, FormatJSONL, FormatCSV:
+		return true
+	}
+	return false
+}
+
+// DetectFormat returns the format of the source in path by its extension,
+// ignoring the one of the compression, or by the first bytes of br
+func DetectFormat(path string, br *bufio.Reader) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if _, ok := compressionExts[ext]; ok {
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path))))
+	}
+	if f, ok := formatExts[ext]; ok {
+		return f
+	}
+	head, _ := br.Peek(1)
+	switch {
+	case len(head) == 0:
+	case head[0] == '*':
+		return FormatAOF
+	case head[0] == '{':
+		return FormatJSONL
+	case head[0] >= 'a' && head[0] <= 'z' || head[0] >= 'A' && head[0] <= 'Z':
+		// an inline command, the rdb magic REDIS is checked first
+		if magic, _ := br.Peek(5); string(magic) != "REDIS" {
+			return FormatRESP
+		}
+	}
+	return FormatRDB
+}
+
+// checkTrailing fails if br holds data after a decoded rdb, the rdb is then
+// the preamble of an aof whose commands would be lost
+func checkTrailing(br *bufio.Reader) error {
+	head, _ := br.Peek(1)
+	switch {
+	case len(head) == 0:
+		return nil
+	case head[0] == '*':
+		return fmt.Errorf("commands follow the rdb payload, the source is an aof with an rdb preamble, "+
+			"set source-format = %q", FormatAOF)
+	}
+	return errors.New("unexpected data after the rdb payload")
+}
+
+// lineErrors applies the line error action to the invalid lines of a source
+type lineErrors struct {
+	action  string
+	skipped int64
+}
+
+func (le *lineErrors) handle(line int64, err error) error {
+	if le.action != LineErrorSkip {
+		return fmt.Errorf("line %d: %v", line, err)
+	}
+	le.skipped++
+	zap.L().Warn("skip invalid line", zap.Int64("line", line), zap.Error(err))
+	return nil
+}
+
+func (le *lineErrors) report() {
+	if le.skipped > 0 {
+		zap.L().Warn("invalid lines skipped", zap.Int64("count", le.skipped))
+	}
+}
@@ -0,0 +1,39 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestDecodeSourceTrailingCommands(t *testing.T) {
+	l := &Lightning{cfg: &conf.Import{}, maxBulk: DefaultMaxBulkLen}
+	dump := newRDB(9).selectDB(0).set("k", "v").end()
+	aof := append(append([]byte{}, dump...), "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\nv2\r\n"...)
+
+	if err := l.decodeSource(context.Background(), &Source{Path: "dump"}, bytes.NewReader(dump), nil, nil,
+		rdb.NopDecoder{}); err != nil {
+		t.Fatal(err)
+	}
+	// without the extension an aof with an rdb preamble is detected as an rdb
+	err := l.decodeSource(context.Background(), &Source{Path: "dump"}, bytes.NewReader(aof), nil, nil, rdb.NopDecoder{})
+	if err == nil || !strings.Contains(err.Error(), "aof") {
+		t.Fatalf("expect the commands after the rdb to fail, got %v", err)
+	}
+	rec := newKVRecorder()
+	src := &Source{Path: "dump", Format: FormatAOF, open: func(int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(aof)), nil
+	}}
+	if err := l.decodeSource(context.Background(), src, bytes.NewReader(aof), nil, nil, newTestDecode(rec)); err != nil {
+		t.Fatal(err)
+	}
+	if _, val := rec.meta("ns", 0, "k"); !bytes.HasSuffix(val, []byte("v2")) {
+		t.Errorf("the command after the preamble is not replayed, meta %q", val)
+	}
+}
@@ -0,0 +1,257 @@
+package lightning
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+// StoreHealth is what a HealthProbe reports of a tikv store
+type StoreHealth struct {
+	ID      uint64
+	Address string
+	// State is the state of the store in pd(Up, Offline, Disconnected, Down, Tombstone)
+	State     string
+	Capacity  int64
+	Available int64
+	// PendingCompactionBytes is the estimated compaction debt of the kv db,
+	// -1 if unknown
+	PendingCompactionBytes int64
+	// WriteStall is set if the kv db stalled the writes lately
+	WriteStall bool
+}
+
+// HealthProbe reports the health of the tikv stores of the cluster
+type HealthProbe interface {
+	Probe(ctx context.Context) ([]StoreHealth, error)
+}
+
+// clusterProbe reads the stores from pd and the rocksdb metrics of the kv db
+// from the status address of each store
+type clusterProbe struct {
+	pd *PDClient
+}
+
+// NewClusterProbe returns the probe of the cluster managed by pd
+func NewClusterProbe(pd *PDClient) HealthProbe {
+	return &clusterProbe{pd: pd}
+}
+
+func (p *clusterProbe) Probe(ctx context.Context) ([]StoreHealth, error) {
+	var resp struct {
+		Stores []struct {
+			Store struct {
+				ID            uint64 `json:"id"`
+				Address       string `json:"address"`
+				StatusAddress string `json:"status_address"`
+				StateName     string `json:"state_name"`
+			} `json:"store"`
+			Status struct {
+				Capacity  string `json:"capacity"`
+				Available string `json:"available"`
+			} `json:"status"`
+		} `json:"stores"`
+	}
+	if err := p.pd.do(ctx, http.MethodGet, pdStoresPath, nil, &resp); err != nil {
+		return nil, err
+	}
+	var stores []StoreHealth
+	for _, s := range resp.Stores {
+		h := StoreHealth{
+			ID:                     s.Store.ID,
+			Address:                s.Store.Address,
+			State:                  s.Store.StateName,
+			PendingCompactionBytes: -1,
+		}
+		// the sizes are human readable, as 1.5TiB
+		h.Capacity, _ = units.RAMInBytes(s.Status.Capacity)
+		h.Available, _ = units.RAMInBytes(s.Status.Available)
+		if s.Store.StatusAddress != "" && h.State == "Up" {
+			if err := p.metrics(ctx, s.Store.StatusAddress, &h); err != nil {
+				zap.L().Warn("get store metrics failed", zap.String("store", h.Address), zap.Error(err))
+			}
+		}
+		stores = append(stores, h)
+	}
+	return stores, nil
+}
+
+// metrics reads the pending compaction bytes and the write stalls of the kv
+// db from the prometheus metrics of a store
+func (p *clusterProbe) metrics(ctx context.Context, addr string, h *StoreHealth) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.pd.scheme+"://"+addr+"/metrics", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.pd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get metrics: %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return err
+	}
+	// sum adds up the gauges of the metric with the labels, the kv db reports
+	// them per column family
+	sum := func(name string, labels map[string]string) (float64, bool) {
+		mf, ok := families[name]
+		if !ok {
+			return 0, false
+		}
+		var total float64
+		found := false
+	next:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+					continue next
+				}
+			}
+			total += m.GetGauge().GetValue()
+			found = true
+		}
+		return total, found
+	}
+	if v, ok := sum("tikv_engine_pending_compaction_bytes", map[string]string{"db": "kv"}); ok {
+		h.PendingCompactionBytes = int64(v)
+	}
+	if v, ok := sum("tikv_engine_write_stall", map[string]string{"db": "kv", "type": "write_stall_max"}); ok {
+		h.WriteStall = v > 0
+	}
+	return nil
+}
+
+// HealthGuard probes the cluster periodically and holds the ingest of the
+// engines while a store is unhealthy, the running ingests are stopped and
+// started again once the cluster recovers
+type HealthGuard struct {
+	probe      HealthProbe
+	cfg        *conf.Health
+	maxPending int64
+
+	mu sync.Mutex
+	// healthy is closed while the cluster is healthy, sick while it is not
+	healthy chan struct{}
+	sick    chan struct{}
+	reason  string
+}
+
+// NewHealthGuard returns a guard of the thresholds of cfg, the cluster is
+// healthy until the first probe
+func NewHealthGuard(probe HealthProbe, cfg *conf.Health) (*HealthGuard, error) {
+	g := &HealthGuard{probe: probe, cfg: cfg, healthy: make(chan struct{}), sick: make(chan struct{})}
+	close(g.healthy)
+	var err error
+	if g.maxPending, err = units.RAMInBytes(cfg.MaxPendingCompaction); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// unhealthy returns why the stores are unhealthy, empty if they are not
+func (g *HealthGuard) unhealthy(stores []StoreHealth) string {
+	var reasons []string
+	for _, s := range stores {
+		switch {
+		case s.State == "Disconnected" || s.State == "Down":
+			reasons = append(reasons, fmt.Sprintf("store %s is %s", s.Address, s.State))
+		case s.State != "Up":
+			// offline and tombstone stores take no ingest
+		case s.Capacity > 0 && (s.Capacity-s.Available)*100 > s.Capacity*int64(g.cfg.MaxDiskUsage):
+			reasons = append(reasons, fmt.Sprintf("store %s uses %d%% of its disk", s.Address,
+				(s.Capacity-s.Available)*100/s.Capacity))
+		case g.maxPending > 0 && s.PendingCompactionBytes > g.maxPending:
+			reasons = append(reasons, fmt.Sprintf("store %s has %s of pending compaction", s.Address,
+				units.BytesSize(float64(s.PendingCompactionBytes))))
+		case g.cfg.WriteStall && s.WriteStall:
+			reasons = append(reasons, fmt.Sprintf("store %s stalls writes", s.Address))
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Check probes the cluster once and pauses or resumes the ingest, the state
+// is kept if the probe fails
+func (g *HealthGuard) Check(ctx context.Context) error {
+	stores, err := g.probe.Probe(ctx)
+	if err != nil {
+		return err
+	}
+	reason := g.unhealthy(stores)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	paused := g.reason != ""
+	switch {
+	case reason != "" && !paused:
+		zap.L().Warn("cluster unhealthy, pause ingest", zap.String("reason", reason))
+		g.healthy = make(chan struct{})
+		close(g.sick)
+	case reason == "" && paused:
+		zap.L().Info("cluster recovered, resume ingest")
+		close(g.healthy)
+		g.sick = make(chan struct{})
+	case reason != g.reason:
+		zap.L().Warn("cluster still unhealthy", zap.String("reason", reason))
+	}
+	g.reason = reason
+	return nil
+}
+
+// Run checks the cluster every interval until ctx is done
+func (g *HealthGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := g.Check(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Warn("probe cluster health failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wait blocks while the cluster is unhealthy
+func (g *HealthGuard) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	healthy := g.healthy
+	g.mu.Unlock()
+	select {
+	case <-healthy:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Guard returns a context of ctx which is canceled once the cluster turns
+// unhealthy, so that the ingest running in it stops
+func (g *HealthGuard) Guard(ctx context.Context) (context.Context, context.CancelFunc) {
+	g.mu.Lock()
+	sick := g.sick
+	g.mu.Unlock()
+	gctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-sick:
+			cancel()
+		case <-gctx.Done():
+		}
+	}()
+	return gctx, cancel
+}
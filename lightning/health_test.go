@@ -0,0 +1,111 @@
+package lightning
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+// fakeProbe reports the stores it holds
+type fakeProbe struct {
+	mu     sync.Mutex
+	stores []StoreHealth
+}
+
+func (p *fakeProbe) Probe(ctx context.Context) ([]StoreHealth, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]StoreHealth{}, p.stores...), nil
+}
+
+func (p *fakeProbe) set(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stores = []StoreHealth{{ID: 1, Address: "tikv:20160", State: state, PendingCompactionBytes: -1}}
+}
+
+func TestHealthGuardPauseResume(t *testing.T) {
+	probe := &fakeProbe{}
+	probe.set("Up")
+	g, err := NewHealthGuard(probe, &conf.Health{MaxDiskUsage: 90, MaxPendingCompaction: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := g.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// an ingest running while the cluster turns unhealthy is stopped
+	running, cancel := g.Guard(ctx)
+	defer cancel()
+	probe.set("Down")
+	if err := g.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-running.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the running ingest is not stopped")
+	}
+	wctx, wcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer wcancel()
+	if err := g.Wait(wctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait of an unhealthy cluster returned %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- g.Wait(ctx) }()
+	probe.set("Up")
+	if err := g.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the ingest is not resumed")
+	}
+	// the ingest started again runs on
+	resumed, cancel := g.Guard(ctx)
+	defer cancel()
+	if err := g.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Err() != nil {
+		t.Fatal("the ingest of a healthy cluster is stopped")
+	}
+}
+
+func TestClusterProbeSumsColumnFamilies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE tikv_engine_pending_compaction_bytes gauge")
+		for _, cf := range []string{"default", "write", "lock"} {
+			fmt.Fprintf(w, "tikv_engine_pending_compaction_bytes{cf=%q,db=\"kv\"} 100\n", cf)
+			fmt.Fprintf(w, "tikv_engine_pending_compaction_bytes{cf=%q,db=\"raft\"} 1000\n", cf)
+		}
+		fmt.Fprintln(w, "# TYPE tikv_engine_write_stall gauge")
+		fmt.Fprintf(w, "tikv_engine_write_stall{cf=\"default\",db=\"kv\",type=\"write_stall_max\"} 0\n")
+		fmt.Fprintf(w, "tikv_engine_write_stall{cf=\"write\",db=\"kv\",type=\"write_stall_max\"} 3\n")
+	}))
+	defer srv.Close()
+	p := &clusterProbe{pd: &PDClient{scheme: "http", client: srv.Client()}}
+	h := &StoreHealth{}
+	if err := p.metrics(context.Background(), strings.TrimPrefix(srv.URL, "http://"), h); err != nil {
+		t.Fatal(err)
+	}
+	if h.PendingCompactionBytes != 300 || !h.WriteStall {
+		t.Errorf("pending compaction %d, write stall %v", h.PendingCompactionBytes, h.WriteStall)
+	}
+}
@@ -0,0 +1,405 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nioshield/titan-lightning/rdb"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// maxPrefixes bounds the distinct prefixes counted, the keys of the other
+// prefixes are counted under otherPrefix
+const maxPrefixes = 100000
+
+const (
+	noPrefix    = "(none)"
+	otherPrefix = "(other)"
+)
+
+// ttlBuckets are the upper bounds of the ttl distribution
+var ttlBuckets = []struct {
+	name string
+	max  time.Duration
+}{
+	{"<1m", time.Minute},
+	{"<1h", time.Hour},
+	{"<1d", 24 * time.Hour},
+	{"<7d", 7 * 24 * time.Hour},
+	{"<30d", 30 * 24 * time.Hour},
+}
+
+// InspectReport describes the content of a rdb
+type InspectReport struct {
+	Keys      int64            `json:"keys"`
+	Expires   int64            `json:"expires"`
+	Bytes     int64            `json:"bytes"`
+	DBs       map[int]*DBStats `json:"dbs"`
+	Types     map[string]int64 `json:"types"`
+	Encodings map[string]int64 `json:"encodings"`
+	Modules   map[string]int64 `json:"modules"`
+	TTLs      []*TTLBucket     `json:"ttls"`
+	Prefixes  []*PrefixStats   `json:"prefixes"`
+	BySize    []*KeyStats      `json:"biggest_by_size"`
+	ByLength  []*KeyStats      `json:"biggest_by_length"`
+	Titan     TitanEstimate    `json:"titan"`
+	prefixes  map[string]*PrefixStats
+}
+
+// DBStats counts the keys of a database
+type DBStats struct {
+	Keys    int64            `json:"keys"`
+	Expires int64            `json:"expires"`
+	Types   map[string]int64 `json:"types"`
+}
+
+// TTLBucket counts the keys whose ttl falls in a range
+type TTLBucket struct {
+	Name string `json:"name"`
+	Keys int64  `json:"keys"`
+}
+
+// PrefixStats counts the keys sharing a prefix
+type PrefixStats struct {
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// KeyStats describes one object, Size is the bytes it takes in the rdb and
+// Length the length of a string or the number of elements of the others
+type KeyStats struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	Size     int64  `json:"size"`
+	Length   int64  `json:"length"`
+}
+
+// TitanEstimate is what the import writes for the objects not expired yet
+type TitanEstimate struct {
+	KVs   int64 `json:"kvs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Inspect decodes the rdb in r, compressed or not, and reports its content.
+// The top biggest keys are reported, the prefixes end at the first delimiter,
+// and the titan kvs are estimated by encoding the objects into namespace ns
+func Inspect(path string, r io.Reader, ns string, top int, delimiter string) (*InspectReport, error) {
+	dr, _, err := Decompress(path, r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	in := newInspector(ns, top, delimiter)
+	if err := rdb.Decode(bufio.NewReader(dr), in); err != nil {
+		return nil, err
+	}
+	return in.report(), nil
+}
+
+// inspector collects the report from the decoder events, the events are also
+// passed to a RdbDecode whose kvs are counted instead of written
+type inspector struct {
+	rdb.Decoder
+	rep       *InspectReport
+	now       int64
+	delimiter []byte
+	top       int
+	db        int
+	cur       *KeyStats
+	expiry    int64
+	bySize    *topKeys
+	byLength  *topKeys
+}
+
+func newInspector(ns string, top int, delimiter string) *inspector {
+	in := &inspector{
+		rep: &InspectReport{
+			DBs:       make(map[int]*DBStats),
+			Types:     make(map[string]int64),
+			Encodings: make(map[string]int64),
+			Modules:   make(map[string]int64),
+			prefixes:  make(map[string]*PrefixStats),
+		},
+		now:       nowMs(),
+		delimiter: []byte(delimiter),
+		top:       top,
+		bySize:    &topKeys{n: top, less: func(a, b *KeyStats) bool { return a.Size < b.Size }},
+		byLength:  &topKeys{n: top, less: func(a, b *KeyStats) bool { return a.Length < b.Length }},
+	}
+	for _, b := range ttlBuckets {
+		in.rep.TTLs = append(in.rep.TTLs, &TTLBucket{Name: b.name})
+	}
+	in.rep.TTLs = append(in.rep.TTLs, &TTLBucket{Name: ">=30d"}, &TTLBucket{Name: "expired"}, &TTLBucket{Name: "none"})
+	in.Decoder = NewRdbDecode(context.Background(), nil, ns, WithKVSink(func(kvs []common.KvPair) error {
+		for _, kv := range kvs {
+			in.rep.Titan.KVs++
+			in.rep.Titan.Bytes += int64(len(kv.Key) + len(kv.Val))
+		}
+		return nil
+	}))
+	return in
+}
+
+func (in *inspector) start(key []byte, typ string, expiry int64) {
+	in.cur = &KeyStats{DB: in.db, Key: string(key), Type: typ}
+	in.expiry = expiry
+}
+
+// ObjectInfo completes the stats of the object whose events were just seen
+func (in *inspector) ObjectInfo(key []byte, typ rdb.ValueType, size int64) {
+	cur, rep := in.cur, in.rep
+	if cur == nil {
+		return
+	}
+	in.cur = nil
+	cur.Encoding, cur.Size = typ.Encoding(), size
+
+	dbs, ok := rep.DBs[cur.DB]
+	if !ok {
+		dbs = &DBStats{Types: make(map[string]int64)}
+		rep.DBs[cur.DB] = dbs
+	}
+	rep.Keys++
+	rep.Bytes += size
+	dbs.Keys++
+	dbs.Types[cur.Type]++
+	rep.Types[cur.Type]++
+	rep.Encodings[cur.Encoding]++
+	if in.expiry > 0 {
+		rep.Expires++
+		dbs.Expires++
+	}
+	rep.TTLs[in.ttlBucket()].Keys++
+
+	prefix := noPrefix
+	if i := bytes.Index(key, in.delimiter); len(in.delimiter) > 0 && i >= 0 {
+		prefix = string(key[:i])
+	}
+	ps, ok := rep.prefixes[prefix]
+	if !ok {
+		if len(rep.prefixes) >= maxPrefixes {
+			prefix = otherPrefix
+		}
+		if ps, ok = rep.prefixes[prefix]; !ok {
+			ps = &PrefixStats{Prefix: prefix}
+			rep.prefixes[prefix] = ps
+		}
+	}
+	ps.Keys++
+	ps.Bytes += size
+
+	in.bySize.add(cur)
+	in.byLength.add(cur)
+}
+
+func (in *inspector) ttlBucket() int {
+	n := len(ttlBuckets)
+	switch {
+	case in.expiry == 0:
+		return n + 2
+	case in.expiry <= in.now:
+		return n + 1
+	}
+	ttl := time.Duration(in.expiry-in.now) * time.Millisecond
+	for i, b := range ttlBuckets {
+		if ttl < b.max {
+			return i
+		}
+	}
+	return n
+}
+
+func (in *inspector) report() *InspectReport {
+	rep := in.rep
+	for _, ps := range rep.prefixes {
+		rep.Prefixes = append(rep.Prefixes, ps)
+	}
+	sort.Slice(rep.Prefixes, func(i, j int) bool {
+		a, b := rep.Prefixes[i], rep.Prefixes[j]
+		if a.Keys != b.Keys {
+			return a.Keys > b.Keys
+		}
+		return a.Prefix < b.Prefix
+	})
+	if in.top < len(rep.Prefixes) {
+		rep.Prefixes = rep.Prefixes[:in.top]
+	}
+	rep.BySize = in.bySize.sorted()
+	rep.ByLength = in.byLength.sorted()
+	return rep
+}
+
+func (in *inspector) StartDatabase(n int) {
+	in.db = n
+	in.Decoder.StartDatabase(n)
+}
+
+func (in *inspector) Set(key, value []byte, expiry int64) {
+	in.start(key, "string", expiry)
+	in.cur.Length = int64(len(value))
+	in.Decoder.Set(key, value, expiry)
+}
+
+func (in *inspector) StartHash(key []byte, length, expiry int64) {
+	in.start(key, "hash", expiry)
+	in.Decoder.StartHash(key, length, expiry)
+}
+
+func (in *inspector) Hset(key, field, value []byte) {
+	in.cur.Length++
+	in.Decoder.Hset(key, field, value)
+}
+
+func (in *inspector) StartSet(key []byte, cardinality, expiry int64) {
+	in.start(key, "set", expiry)
+	in.Decoder.StartSet(key, cardinality, expiry)
+}
+
+func (in *inspector) Sadd(key, member []byte) {
+	in.cur.Length++
+	in.Decoder.Sadd(key, member)
+}
+
+func (in *inspector) StartList(key []byte, length, expiry int64) {
+	in.start(key, "list", expiry)
+	in.Decoder.StartList(key, length, expiry)
+}
+
+func (in *inspector) Rpush(key, value []byte) {
+	in.cur.Length++
+	in.Decoder.Rpush(key, value)
+}
+
+func (in *inspector) StartZSet(key []byte, cardinality, expiry int64) {
+	in.start(key, "zset", expiry)
+	in.Decoder.StartZSet(key, cardinality, expiry)
+}
+
+func (in *inspector) Zadd(key []byte, score float64, member []byte) {
+	in.cur.Length++
+	in.Decoder.Zadd(key, score, member)
+}
+
+func (in *inspector) Stream(key []byte, s *rdb.Stream, expiry int64) {
+	in.start(key, "stream", expiry)
+	in.cur.Length = int64(len(s.Entries))
+	in.Decoder.(rdb.StreamDecoder).Stream(key, s, expiry)
+}
+
+func (in *inspector) Module(key []byte, m *rdb.Module, expiry int64) {
+	in.start(key, "module", expiry)
+	in.cur.Length = int64(len(m.Values))
+	in.rep.Modules[fmt.Sprintf("%s v%d", m.Name, m.Version)]++
+	in.Decoder.(rdb.ModuleDecoder).Module(key, m, expiry)
+}
+
+// topKeys keeps the n greatest keys by less in a min heap
+type topKeys struct {
+	n    int
+	less func(a, b *KeyStats) bool
+	keys []*KeyStats
+}
+
+func (t *topKeys) Len() int           { return len(t.keys) }
+func (t *topKeys) Less(i, j int) bool { return t.less(t.keys[i], t.keys[j]) }
+func (t *topKeys) Swap(i, j int)      { t.keys[i], t.keys[j] = t.keys[j], t.keys[i] }
+func (t *topKeys) Push(x interface{}) { t.keys = append(t.keys, x.(*KeyStats)) }
+func (t *topKeys) Pop() interface{} {
+	k := t.keys[len(t.keys)-1]
+	t.keys = t.keys[:len(t.keys)-1]
+	return k
+}
+
+func (t *topKeys) add(k *KeyStats) {
+	if t.n <= 0 {
+		return
+	}
+	if len(t.keys) < t.n {
+		heap.Push(t, k)
+	} else if t.less(t.keys[0], k) {
+		t.keys[0] = k
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the keys from the greatest
+func (t *topKeys) sorted() []*KeyStats {
+	keys := append([]*KeyStats(nil), t.keys...)
+	sort.SliceStable(keys, func(i, j int) bool { return t.less(keys[j], keys[i]) })
+	return keys
+}
+
+// WriteText writes the report as tables
+func (rep *InspectReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "keys\t%d\n", rep.Keys)
+	fmt.Fprintf(tw, "expires\t%d\n", rep.Expires)
+	fmt.Fprintf(tw, "rdb bytes\t%d\n", rep.Bytes)
+	fmt.Fprintf(tw, "titan kvs\t%d\n", rep.Titan.KVs)
+	fmt.Fprintf(tw, "titan bytes\t%d\n", rep.Titan.Bytes)
+
+	fmt.Fprintf(tw, "\ndb\tkeys\texpires\tstring\thash\tset\tlist\tzset\tstream\n")
+	dbs := make([]int, 0, len(rep.DBs))
+	for n := range rep.DBs {
+		dbs = append(dbs, n)
+	}
+	sort.Ints(dbs)
+	for _, n := range dbs {
+		s := rep.DBs[n]
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", n, s.Keys, s.Expires,
+			s.Types["string"], s.Types["hash"], s.Types["set"], s.Types["list"], s.Types["zset"], s.Types["stream"])
+	}
+
+	fmt.Fprintf(tw, "\nencoding\tkeys\n")
+	encodings := make([]string, 0, len(rep.Encodings))
+	for e := range rep.Encodings {
+		encodings = append(encodings, e)
+	}
+	sort.Strings(encodings)
+	for _, e := range encodings {
+		fmt.Fprintf(tw, "%s\t%d\n", e, rep.Encodings[e])
+	}
+
+	if len(rep.Modules) > 0 {
+		fmt.Fprintf(tw, "\nmodule\tkeys\n")
+		modules := make([]string, 0, len(rep.Modules))
+		for m := range rep.Modules {
+			modules = append(modules, m)
+		}
+		sort.Strings(modules)
+		for _, m := range modules {
+			fmt.Fprintf(tw, "%s\t%d\n", m, rep.Modules[m])
+		}
+	}
+
+	fmt.Fprintf(tw, "\nttl\tkeys\n")
+	for _, b := range rep.TTLs {
+		fmt.Fprintf(tw, "%s\t%d\n", b.Name, b.Keys)
+	}
+
+	fmt.Fprintf(tw, "\nprefix\tkeys\tbytes\n")
+	for _, ps := range rep.Prefixes {
+		fmt.Fprintf(tw, "%q\t%d\t%d\n", ps.Prefix, ps.Keys, ps.Bytes)
+	}
+
+	for _, top := range []struct {
+		name string
+		keys []*KeyStats
+	}{{"biggest by size", rep.BySize}, {"biggest by length", rep.ByLength}} {
+		fmt.Fprintf(tw, "\n%s\tdb\ttype\tencoding\tsize\tlength\n", top.name)
+		for _, k := range top.keys {
+			fmt.Fprintf(tw, "%q\t%d\t%s\t%s\t%d\t%d\n", k.Key, k.DB, k.Type, k.Encoding, k.Size, k.Length)
+		}
+	}
+	return tw.Flush()
+}
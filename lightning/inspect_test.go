@@ -0,0 +1,101 @@
+package lightning
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestInspect(t *testing.T) {
+	now := nowMs()
+	dump := newRDB(9).selectDB(0).
+		set("user:1", "alice").
+		expireAt(now+int64(30*time.Minute/time.Millisecond)).set("user:2", "bob").
+		expireAt(now-1000).set("session:1", strings.Repeat("x", 200)).
+		list("queue:jobs", "a", "b", "c", "d", "e", "f").
+		quicklist("log", "l1", "l2").
+		selectDB(2).
+		expireAt(now+int64(48*time.Hour/time.Millisecond)).set("user:3", "carol").
+		end()
+	// the dump compressed is inspected the same
+	rep, err := Inspect("dump.rdb.gz", bytes.NewReader(compressDump(t, CompressionGzip, dump)), "ns", 2, ":")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Keys != 6 || rep.Expires != 3 {
+		t.Errorf("%d keys and %d expires, expect 6 and 3", rep.Keys, rep.Expires)
+	}
+	if db := rep.DBs[0]; db == nil || db.Keys != 5 || db.Expires != 2 || db.Types["string"] != 3 || db.Types["list"] != 2 {
+		t.Errorf("db 0 stats %+v", db)
+	}
+	if db := rep.DBs[2]; db == nil || db.Keys != 1 || db.Types["string"] != 1 {
+		t.Errorf("db 2 stats %+v", db)
+	}
+	if rep.Encodings["string"] != 4 || rep.Encodings["linkedlist"] != 1 || rep.Encodings["quicklist"] != 1 {
+		t.Errorf("encodings %v", rep.Encodings)
+	}
+	ttls := make(map[string]int64)
+	for _, b := range rep.TTLs {
+		ttls[b.Name] = b.Keys
+	}
+	if ttls["<1h"] != 1 || ttls["<7d"] != 1 || ttls["expired"] != 1 || ttls["none"] != 3 {
+		t.Errorf("ttl distribution %v", ttls)
+	}
+
+	// the top prefixes by keys, then by name
+	var prefixes []string
+	for _, ps := range rep.Prefixes {
+		prefixes = append(prefixes, ps.Prefix)
+	}
+	if strings.Join(prefixes, ",") != "user,(none)" || rep.Prefixes[0].Keys != 3 {
+		t.Errorf("prefixes %v", prefixes)
+	}
+	if len(rep.BySize) != 2 || rep.BySize[0].Key != "session:1" || rep.BySize[0].Size <= 200 {
+		t.Errorf("biggest by size %+v", rep.BySize)
+	}
+	if len(rep.ByLength) != 2 || rep.ByLength[0].Key != "session:1" || rep.ByLength[1].Key != "queue:jobs" ||
+		rep.ByLength[1].Length != 6 || rep.ByLength[1].Encoding != "linkedlist" {
+		t.Errorf("biggest by length %+v", rep.ByLength)
+	}
+
+	// the estimate is what the import writes
+	rec := newKVRecorder()
+	if err := rdb.Decode(bytes.NewReader(dump), newTestDecode(rec)); err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for k, v := range rec.kvs {
+		size += int64(len(k) + len(v))
+	}
+	if rep.Titan.KVs != int64(len(rec.kvs)) || rep.Titan.Bytes != size {
+		t.Errorf("estimated %d kvs of %d bytes, the import writes %d of %d", rep.Titan.KVs, rep.Titan.Bytes,
+			len(rec.kvs), size)
+	}
+
+	var out bytes.Buffer
+	if err := rep.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	rows := make(map[string]bool)
+	for _, line := range strings.Split(out.String(), "\n") {
+		rows[strings.Join(strings.Fields(line), " ")] = true
+	}
+	for _, row := range []string{
+		"keys 6",
+		"expires 3",
+		"0 5 2 3 0 0 2 0 0",
+		"2 1 1 1 0 0 0 0 0",
+		"linkedlist 1",
+		"expired 1",
+		`"user" 3 40`,
+		`biggest by length db type encoding size length`,
+		`"queue:jobs" 0 list linkedlist 25 6`,
+	} {
+		if !rows[row] {
+			t.Errorf("report lacks the row %q:\n%s", row, out.String())
+		}
+	}
+}
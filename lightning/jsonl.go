@@ -0,0 +1,239 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// jsonRecord is one line of a JSON Lines source
+type jsonRecord struct {
+	DB    int             `json:"db"`
+	Key   *string         `json:"key"`
+	Type  string          `json:"type"`
+	TTL   int64           `json:"ttl_ms"`
+	Value json.RawMessage `json:"value"`
+	// Encoding is base64 when the key and every string of the value are base64
+	Encoding string `json:"encoding,omitempty"`
+
+	// value is the parsed Value, of the go type matching Type
+	value interface{}
+}
+
+// DecodeJSONL decodes a JSON Lines source, each line holds a whole object such
+// as {"db":0,"key":"k","type":"hash","ttl_ms":1000,"value":{"field":"value"}}.
+// The value is a string, an object of strings for a hash, an array of strings
+// for a set or a list, and an object of scores for a sorted set, db and ttl_ms
+// are optional. With "encoding":"base64" the key and the strings of the value
+// are base64, which keeps binary data intact. Every key is expected once, the objects are streamed to d.
+func DecodeJSONL(r io.Reader, d rdb.Decoder, onError string) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	le := &lineErrors{action: onError}
+	db := -1
+	d.StartRDB()
+	for n := int64(1); ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			rec, verr := parseJSONRecord(line)
+			if verr != nil {
+				if herr := le.handle(n, verr); herr != nil {
+					return herr
+				}
+			} else {
+				if rec.DB != db {
+					if db >= 0 {
+						d.EndDatabase(db)
+					}
+					db = rec.DB
+					d.StartDatabase(db)
+				}
+				emitJSONRecord(d, rec)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if db >= 0 {
+		d.EndDatabase(db)
+	}
+	d.EndRDB()
+	le.report()
+	return nil
+}
+
+func parseJSONRecord(line []byte) (*jsonRecord, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	rec := &jsonRecord{}
+	if err := dec.Decode(rec); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the object")
+	}
+	if rec.Key == nil || *rec.Key == "" {
+		return nil, errors.New("missing key")
+	}
+	if rec.Encoding != "" && rec.Encoding != jsonBase64 {
+		return nil, fmt.Errorf("unknown encoding %q", rec.Encoding)
+	}
+	if rec.DB < 0 {
+		return nil, fmt.Errorf("invalid db %d", rec.DB)
+	}
+	if rec.TTL < 0 {
+		return nil, fmt.Errorf("invalid ttl_ms %d", rec.TTL)
+	}
+	if len(rec.Value) == 0 || string(rec.Value) == "null" {
+		return nil, errors.New("missing value")
+	}
+	var err error
+	size := 1
+	switch rec.Type {
+	case "string":
+		var v string
+		err = json.Unmarshal(rec.Value, &v)
+		rec.value = v
+	case "hash":
+		var v map[string]string
+		err = json.Unmarshal(rec.Value, &v)
+		rec.value, size = v, len(v)
+	case "set", "list":
+		var v []string
+		err = json.Unmarshal(rec.Value, &v)
+		rec.value, size = v, len(v)
+	case "zset":
+		var v map[string]float64
+		err = json.Unmarshal(rec.Value, &v)
+		rec.value, size = v, len(v)
+	default:
+		return nil, fmt.Errorf("unknown type %q", rec.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %v", rec.Type, err)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("empty %s value", rec.Type)
+	}
+	if rec.Encoding == jsonBase64 {
+		if err := decodeBase64Record(rec); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// jsonBase64 is the encoding of records holding binary data
+const jsonBase64 = "base64"
+
+// decodeBase64Record decodes the key and the strings of a parsed value
+func decodeBase64Record(rec *jsonRecord) error {
+	var err error
+	decode := func(s string) string {
+		b, derr := base64.StdEncoding.DecodeString(s)
+		if derr != nil && err == nil {
+			err = derr
+		}
+		return string(b)
+	}
+	key := decode(*rec.Key)
+	rec.Key = &key
+	switch v := rec.value.(type) {
+	case string:
+		rec.value = decode(v)
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for field, value := range v {
+			m[decode(field)] = decode(value)
+		}
+		rec.value = m
+	case []string:
+		for i := range v {
+			v[i] = decode(v[i])
+		}
+	case map[string]float64:
+		m := make(map[string]float64, len(v))
+		for member, score := range v {
+			m[decode(member)] = score
+		}
+		rec.value = m
+	}
+	if err != nil {
+		return fmt.Errorf("invalid base64: %v", err)
+	}
+	if *rec.Key == "" {
+		return errors.New("missing key")
+	}
+	return nil
+}
+
+func emitJSONRecord(d rdb.Decoder, rec *jsonRecord) {
+	key := []byte(*rec.Key)
+	var expiry int64
+	if rec.TTL > 0 {
+		expiry = nowMs() + rec.TTL
+	}
+	switch rec.Type {
+	case "string":
+		d.Set(key, []byte(rec.value.(string)), expiry)
+	case "hash":
+		v := rec.value.(map[string]string)
+		fields := make([]string, 0, len(v))
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		d.StartHash(key, int64(len(v)), expiry)
+		for _, field := range fields {
+			d.Hset(key, []byte(field), []byte(v[field]))
+		}
+		d.EndHash(key)
+	case "set":
+		v := rec.value.([]string)
+		seen := make(map[string]bool, len(v))
+		members := v[:0]
+		for _, member := range v {
+			if !seen[member] {
+				seen[member] = true
+				members = append(members, member)
+			}
+		}
+		d.StartSet(key, int64(len(members)), expiry)
+		for _, member := range members {
+			d.Sadd(key, []byte(member))
+		}
+		d.EndSet(key)
+	case "list":
+		v := rec.value.([]string)
+		d.StartList(key, int64(len(v)), expiry)
+		for _, elem := range v {
+			d.Rpush(key, []byte(elem))
+		}
+		d.EndList(key)
+	case "zset":
+		v := rec.value.(map[string]float64)
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		d.StartZSet(key, int64(len(v)), expiry)
+		for _, member := range members {
+			d.Zadd(key, v[member], []byte(member))
+		}
+		d.EndZSet(key)
+	}
+}
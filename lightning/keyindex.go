@@ -0,0 +1,78 @@
+package lightning
+
+import (
+	"os"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+)
+
+const (
+	// keyIndexMemTableSize and keyIndexCacheSize bound the memory of a key
+	// index, the keys beyond are flushed to disk
+	keyIndexMemTableSize = 64 << 20
+	keyIndexCacheSize    = 128 << 20
+)
+
+// keyIndex is a set of keys kept in a local pebble db, which bounds the
+// memory of the large key sets of an import
+type keyIndex struct {
+	db  *pebble.DB
+	dir string
+}
+
+// openKeyIndex opens the index in dir, the keys left by a former run are
+// kept if keep is set and removed otherwise
+func openKeyIndex(dir string, keep bool) (*keyIndex, error) {
+	if !keep {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+	}
+	cache := pebble.NewCache(keyIndexCacheSize)
+	defer cache.Unref()
+	db, err := pebble.Open(dir, &pebble.Options{
+		Cache:        cache,
+		MemTableSize: keyIndexMemTableSize,
+		// most lookups are of keys not indexed
+		Levels: []pebble.LevelOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keyIndex{db: db, dir: dir}, nil
+}
+
+// get returns a copy of the value of key and whether the key is indexed
+func (ki *keyIndex) get(key []byte) ([]byte, bool, error) {
+	val, closer, err := ki.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+	return append([]byte{}, val...), true, nil
+}
+
+// set indexes key with val, the write survives a crash of the process but
+// not of the host
+func (ki *keyIndex) set(key, val []byte) error {
+	return ki.db.Set(key, val, pebble.NoSync)
+}
+
+// Close closes the db, its files are kept
+func (ki *keyIndex) Close() error {
+	return ki.db.Close()
+}
+
+// removeKeyIndexes removes the indexes of an import which is done
+func removeKeyIndexes(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package lightning
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/distributedio/titan/db"
+	"go.uber.org/zap"
+)
+
+// LayoutAuto detects the layout from the objects of the target cluster
+const LayoutAuto = "auto"
+
+// layoutSampleSize is the max number of meta keys of a database read by DetectLayout
+const layoutSampleSize = 256
+
+// Layout is how a titan release stores the objects in tikv, the parts which
+// did not change between the releases are shared by every layout
+type Layout struct {
+	// Name is the name of the profile
+	Name string
+	// ExpirePrefix is the prefix of the keys indexing the objects by expiry
+	ExpirePrefix []byte
+	// ZSetMember and ZSetScore mark the member and the score keys of a sorted set
+	ZSetMember byte
+	ZSetScore  byte
+	// HashLen is set if the hash meta carries the length and the number of
+	// meta slots after the object
+	HashLen bool
+}
+
+// layouts are the profiles of the titan releases, by name. v0.6 is the layout
+// of the titan db package this tool is built with, the tests compare the
+// encodings with it. v0.4 and v0.5 encode the string, list, set and sorted set
+// metas, the zset keys and the expire index the same way, their hash meta is
+// followed by the length and the meta slot of the hash, 0 for no slots
+var layouts = map[string]*Layout{
+	"v0.4": {
+		Name:         "v0.4",
+		ExpirePrefix: []byte("$sys:0:at:"),
+		ZSetMember:   'M',
+		ZSetScore:    'S',
+		HashLen:      true,
+	},
+	"v0.6": {
+		Name:         "v0.6",
+		ExpirePrefix: []byte("$sys:0:at:"),
+		ZSetMember:   'M',
+		ZSetScore:    'S',
+	},
+}
+
+// DefaultLayout is the layout of the titan release this tool is built with
+var DefaultLayout = layouts["v0.6"]
+
+// LayoutNames returns the names of the layout profiles
+func LayoutNames() []string {
+	var names []string
+	for name := range layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetLayout returns the layout profile of name
+func GetLayout(name string) (*Layout, error) {
+	if l, ok := layouts[name]; ok {
+		return l, nil
+	}
+	return nil, fmt.Errorf("unknown layout %q, expect one of %v or %s", name, LayoutNames(), LayoutAuto)
+}
+
+// DetectLayout picks the layout from the size of the hash metas already in
+// namespace ns, DefaultLayout is returned if no hash is found
+func DetectLayout(ctx context.Context, ks KeyStore, ns string) (*Layout, error) {
+	for id := 0; id < 256; id++ {
+		start := db.MetaKey(&db.DB{Namespace: ns, ID: db.DBID(id)}, nil)
+		end := append(start[:len(start)-1:len(start)-1], ':'+1)
+		kvs, err := ks.Scan(ctx, start, end, layoutSampleSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			obj, err := db.DecodeObject(kv.Val)
+			if err != nil || obj.Type != db.ObjectHash {
+				continue
+			}
+			switch len(kv.Val) - db.ObjectEncodingLength {
+			case 0:
+				return layouts["v0.6"], nil
+			case 16:
+				return layouts["v0.4"], nil
+			}
+			zap.L().Warn("unknown hash meta", zap.ByteString("key", kv.Key), zap.Int("size", len(kv.Val)))
+		}
+	}
+	zap.L().Info("no hash to detect the layout from, use the default", zap.String("layout", DefaultLayout.Name))
+	return DefaultLayout, nil
+}
+
+// ExpireKey is the key indexing the object of metaKey by its expiry ts
+func (l *Layout) ExpireKey(metaKey []byte, ts int64) ([]byte, error) {
+	var buf []byte
+	buf = append(buf, l.ExpirePrefix...)
+	encode, err := db.EncodeInt64(ts)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, encode...)
+	buf = append(buf, ':')
+	buf = append(buf, metaKey...)
+	return buf, nil
+}
+
+// ZSetMemberKey is the key holding the score of member
+func (l *Layout) ZSetMemberKey(dkey []byte, member []byte) []byte {
+	var memberKey []byte
+	memberKey = append(memberKey, dkey...)
+	memberKey = append(memberKey, ':', l.ZSetMember, ':')
+	memberKey = append(memberKey, member...)
+	return memberKey
+}
+
+// ZSetScoreKey is the key ordering member by its score
+func (l *Layout) ZSetScoreKey(dkey []byte, score []byte, member []byte) []byte {
+	var scoreKey []byte
+	scoreKey = append(scoreKey, dkey...)
+	scoreKey = append(scoreKey, ':', l.ZSetScore, ':')
+	scoreKey = append(scoreKey, score...)
+	scoreKey = append(scoreKey, ':')
+	scoreKey = append(scoreKey, member...)
+	return scoreKey
+}
+
+// EncodeMeta encodes the meta value of an object, every meta written goes
+// through it so that a profile may change how any type is encoded. Only the
+// hash meta differs between the profiles, the meta slots are not used
+func (l *Layout) EncodeMeta(meta Meta) []byte {
+	b := meta.Encode()
+	if hm, ok := meta.(*HashMeta); ok && l.HashLen {
+		m := make([]byte, 16)
+		binary.BigEndian.PutUint64(m[:8], uint64(hm.Len))
+		b = append(b, m...)
+	}
+	return b
+}
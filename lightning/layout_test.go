@@ -0,0 +1,174 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+)
+
+func TestDetectLayout(t *testing.T) {
+	hashMeta := func(tail int) []byte {
+		meta := NewHashMeta()
+		return append(meta.Encode(), make([]byte, tail)...)
+	}
+	metaKey := func(ns string, n int, key string) []byte {
+		return db.MetaKey(&db.DB{Namespace: ns, ID: db.DBID(n)}, []byte(key))
+	}
+	for _, c := range []struct {
+		name   string
+		kvs    map[string][]byte
+		expect string
+	}{
+		{"empty", nil, DefaultLayout.Name},
+		{"v0.6 hash", map[string][]byte{string(metaKey("ns", 0, "h")): hashMeta(0)}, "v0.6"},
+		{"v0.4 hash in a later db", map[string][]byte{
+			string(metaKey("ns", 0, "s")): NewStringMeta().Encode(),
+			string(metaKey("ns", 7, "h")): hashMeta(16),
+		}, "v0.4"},
+		// the metas of other types do not tell the layouts apart
+		{"no hash", map[string][]byte{
+			string(metaKey("ns", 0, "l")): NewLListMeta().Encode(),
+			string(metaKey("ns", 0, "s")): NewSetMeta().Encode(),
+		}, DefaultLayout.Name},
+		{"unknown hash meta", map[string][]byte{
+			string(metaKey("ns", 0, "a")): hashMeta(3),
+			string(metaKey("ns", 0, "b")): hashMeta(16),
+		}, "v0.4"},
+		{"other namespace", map[string][]byte{string(metaKey("other", 0, "h")): hashMeta(16)}, DefaultLayout.Name},
+	} {
+		ks := newMemKeyStore()
+		for k, v := range c.kvs {
+			ks.put([]byte(k), v)
+		}
+		l, err := DetectLayout(context.Background(), ks, "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Name != c.expect {
+			t.Errorf("%s: detected %s, expect %s", c.name, l.Name, c.expect)
+		}
+	}
+}
+
+func TestLayoutEncoding(t *testing.T) {
+	const expiry = int64(4102444800000)
+	for _, name := range LayoutNames() {
+		layout, err := GetLayout(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := newKVRecorder()
+		rd := newTestDecode(rec, WithLayout(layout))
+		rd.StartRDB()
+		rd.StartDatabase(0)
+		rd.Set([]byte("s"), []byte("value"), expiry)
+		rd.StartHash([]byte("h"), 2, expiry)
+		rd.Hset([]byte("h"), []byte("f1"), []byte("v1"))
+		rd.Hset([]byte("h"), []byte("f2"), []byte("v2"))
+		rd.EndHash([]byte("h"))
+		rd.StartList([]byte("l"), 2, expiry)
+		rd.Rpush([]byte("l"), []byte("a"))
+		rd.Rpush([]byte("l"), []byte("b"))
+		rd.EndList([]byte("l"))
+		rd.StartSet([]byte("set"), 2, expiry)
+		rd.Sadd([]byte("set"), []byte("a"))
+		rd.Sadd([]byte("set"), []byte("b"))
+		rd.EndSet([]byte("set"))
+		rd.StartZSet([]byte("z"), 2, expiry)
+		rd.Zadd([]byte("z"), 1, []byte("a"))
+		rd.Zadd([]byte("z"), 2, []byte("b"))
+		rd.EndZSet([]byte("z"))
+		rd.EndDatabase(0)
+		rd.EndRDB()
+
+		hashTail := 0
+		if layout.HashLen {
+			hashTail = 16
+		}
+		// the bytes after the object and the length they start with
+		for _, c := range []struct {
+			key  string
+			tail int
+			len  int64
+		}{
+			{"s", len("value"), -1},
+			{"h", hashTail, 2},
+			{"l", 24, 2},
+			{"set", 8, 2},
+			{"z", 8, 2},
+		} {
+			obj, val := rec.meta("ns", 0, c.key)
+			if obj == nil {
+				t.Errorf("%s %s: no meta", name, c.key)
+				continue
+			}
+			tail := val[db.ObjectEncodingLength:]
+			if len(tail) != c.tail {
+				t.Errorf("%s %s: %d bytes after the object, expect %d", name, c.key, len(tail), c.tail)
+			} else if c.len >= 0 && c.tail > 0 && int64(binary.BigEndian.Uint64(tail)) != c.len {
+				t.Errorf("%s %s: length %d, expect %d", name, c.key, binary.BigEndian.Uint64(tail), c.len)
+			}
+			metaKey := db.MetaKey(&db.DB{Namespace: "ns", ID: 0}, []byte(c.key))
+			ekey, err := layout.ExpireKey(metaKey, expiry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id, ok := rec.kvs[string(ekey)]; !ok || !bytes.Equal(id, obj.ID) {
+				t.Errorf("%s %s: expire index %q", name, c.key, id)
+			}
+		}
+
+		obj, _ := rec.meta("ns", 0, "z")
+		dkey := db.DataKey(&db.DB{Namespace: "ns", ID: 0}, obj.ID)
+		if _, ok := rec.kvs[string(layout.ZSetMemberKey(dkey, []byte("b")))]; !ok {
+			t.Errorf("%s: no member key of the sorted set", name)
+		}
+	}
+}
+
+// TestLayoutTitan compares the encodings of the default layout with the db
+// package of titan
+func TestLayoutTitan(t *testing.T) {
+	rec := newKVRecorder()
+	rd := newTestDecode(rec, WithLayout(DefaultLayout))
+	rd.StartRDB()
+	rd.StartDatabase(0)
+	rd.StartHash([]byte("h"), 1, 0)
+	rd.Hset([]byte("h"), []byte("f"), []byte("v"))
+	rd.EndHash([]byte("h"))
+	rd.StartList([]byte("l"), 2, 0)
+	rd.Rpush([]byte("l"), []byte("a"))
+	rd.Rpush([]byte("l"), []byte("b"))
+	rd.EndList([]byte("l"))
+	rd.StartZSet([]byte("z"), 1, 0)
+	rd.Zadd([]byte("z"), 1.5, []byte("m"))
+	rd.EndZSet([]byte("z"))
+	rd.EndDatabase(0)
+	rd.EndRDB()
+
+	obj, val := rec.meta("ns", 0, "h")
+	if expect := db.EncodeHashMeta(&db.HashMeta{Object: *obj}); !bytes.Equal(val, expect) {
+		t.Errorf("hash meta %x, titan encodes %x", val, expect)
+	}
+	obj, val = rec.meta("ns", 0, "l")
+	var lmeta db.LListMeta
+	if err := lmeta.Unmarshal(obj, val); err != nil {
+		t.Fatal(err)
+	}
+	if lmeta.Len != 2 || !bytes.Equal(lmeta.Marshal(), val) {
+		t.Errorf("list meta %x, titan reads %+v", val, lmeta)
+	}
+	obj, _ = rec.meta("ns", 0, "z")
+	score, err := db.EncodeFloat64(1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkey := db.DataKey(&db.DB{Namespace: "ns", ID: 0}, obj.ID)
+	scoreKey := append(append(db.ZSetScorePrefix(dkey), score...), ":m"...)
+	if _, ok := rec.kvs[string(scoreKey)]; !ok {
+		t.Errorf("no score key %q", scoreKey)
+	}
+}
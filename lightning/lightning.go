@@ -1,17 +1,22 @@
 package lightning
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
 	sstpb "github.com/pingcap/kvproto/pkg/import_sstpb"
 	kv "github.com/pingcap/tidb-lightning/lightning/backend"
 	"github.com/pingcap/tidb-lightning/lightning/common"
-	"github.com/tent/rdb"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -23,24 +28,164 @@ type Lightning struct {
 	cfg *conf.Import
 	bk  *Backend
 	tls *common.TLS
+	pd  *PDClient
+	ks  KeyStore
+	// layout is the layout of the target titan release
+	layout *Layout
+
+	sources  []*Source
+	cp       *Checkpoint
+	cpSize   int64
+	partSize int64
+	// diskQuota is the max size of sorted-dir, 0 if unlimited
+	diskQuota int64
+	// presplitSample is the number of bytes of a source sampled by the pre-split
+	presplitSample int64
+	// maxBulk is the max length of a bulk string of an aof or resp source
+	maxBulk int64
+	// limits throttle the writes and the imports of the engines
+	limits *RateLimits
+	// guard holds the imports while the cluster is unhealthy, nil if disabled
+	guard *HealthGuard
+	// compactor compacts the stores once every source is imported
+	compactor StoreCompactor
+	// pending holds a token for each closed engine waiting for or being imported
+	pending  chan struct{}
+	progress *Progress
+	dups     *DuplicateDetector
+	// existing are the keys skipped by conflict=skip, nil for other policies
+	existing *ExistingKeys
 }
 
 func NewLightning(ctx context.Context, cfg *conf.Import) (*Lightning, error) {
 	l := &Lightning{
-		ctx: ctx,
-		cfg: cfg,
+		ctx:      ctx,
+		cfg:      cfg,
+		progress: NewProgress(),
 	}
 	var err error
 
+	if l.sources, err = ParseSources(cfg.SourceAddrs, cfg); err != nil {
+		zap.L().Error("parse sources err", zap.String("source-addrs", cfg.SourceAddrs), zap.Error(err))
+		return nil, err
+	}
+	if !ValidFormat(cfg.SourceFormat) {
+		err = fmt.Errorf("unknown source format %s", cfg.SourceFormat)
+		zap.L().Error("parse sources err", zap.Error(err))
+		return nil, err
+	}
+	if !ValidStream(cfg.Stream) {
+		err = fmt.Errorf("unknown stream strategy %s", cfg.Stream)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	if !ValidModule(cfg.Module) {
+		err = fmt.Errorf("unknown module strategy %s", cfg.Module)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	if !ValidCompact(cfg.Compact) {
+		err = fmt.Errorf("unknown compaction %s", cfg.Compact)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	if !ValidObjectID(cfg.ObjectID) {
+		err = fmt.Errorf("unknown object id strategy %s", cfg.ObjectID)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	for _, src := range l.sources {
+		if src.Format == FormatAuto {
+			src.Format = cfg.SourceFormat
+		}
+		zap.L().Info("import source", zap.String("source", src.Path), zap.Int32("engine", src.ID),
+			zap.Int64("size", src.Size))
+		l.progress.SetStatus(src.Path, src.Size, CheckpointPending)
+	}
+
+	if !ValidPartition(cfg.Partition) {
+		err = fmt.Errorf("unknown partition policy %s", cfg.Partition)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	if l.partSize, err = units.RAMInBytes(cfg.PartitionSize); err != nil {
+		zap.L().Error("parse partition size err", zap.String("partition-size", cfg.PartitionSize), zap.Error(err))
+		return nil, err
+	}
+	if cfg.MaxPendingEngines <= 0 {
+		err = fmt.Errorf("invalid max-pending-engines %d", cfg.MaxPendingEngines)
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	l.pending = make(chan struct{}, cfg.MaxPendingEngines)
+	var engineSize int64
+	if cfg.Partition == PartitionSize {
+		engineSize = l.partSize
+	}
+	if l.limits, err = NewRateLimits(&cfg.Backend, engineSize); err != nil {
+		zap.L().Error("parse rate limits err", zap.Error(err))
+		return nil, err
+	}
+	if l.diskQuota, err = units.RAMInBytes(cfg.Backend.DiskQuota); err != nil {
+		zap.L().Error("parse disk quota err", zap.String("disk-quota", cfg.Backend.DiskQuota), zap.Error(err))
+		return nil, err
+	}
+	if l.presplitSample, err = units.RAMInBytes(cfg.PresplitSample); err != nil {
+		zap.L().Error("parse presplit sample err", zap.String("presplit-sample", cfg.PresplitSample), zap.Error(err))
+		return nil, err
+	}
+	if l.maxBulk, err = units.RAMInBytes(cfg.ProtoMaxBulkLen); err != nil {
+		zap.L().Error("parse proto max bulk len err", zap.String("proto-max-bulk-len", cfg.ProtoMaxBulkLen), zap.Error(err))
+		return nil, err
+	}
+	if cfg.PauseSchedulers && cfg.CheckpointPath == "" {
+		// the pd settings are saved in the checkpoint, a crash would leave pd paused
+		err = errors.New("pause-schedulers needs checkpoint-path to restore pd after a crash")
+		zap.L().Error("parse config err", zap.Error(err))
+		return nil, err
+	}
+	if l.cp, err = LoadCheckpoint(cfg.CheckpointPath, cfg.NameSpace, cfg.Partition); err != nil {
+		zap.L().Error("load checkpoint err", zap.String("path", cfg.CheckpointPath), zap.Error(err))
+		return nil, err
+	}
+	if l.cpSize, err = units.RAMInBytes(cfg.CheckpointSize); err != nil {
+		zap.L().Error("parse checkpoint size err", zap.String("checkpoint-size", cfg.CheckpointSize), zap.Error(err))
+		return nil, err
+	}
+
 	if l.tls, err = common.NewTLS(cfg.Security.CAPath, cfg.Security.CertPath, cfg.Security.KeyPath, cfg.PdAddrs); err != nil {
 		zap.L().Error("tlserr", zap.Error(err))
 		return nil, err
 	}
+	l.pd = NewPDClient(l.tls, cfg.PdAddrs)
+	l.compactor = NewTiKVCompactor(l.tls)
+	if cfg.Health.Interval > 0 {
+		if l.guard, err = NewHealthGuard(NewClusterProbe(l.pd), &cfg.Health); err != nil {
+			zap.L().Error("parse health config err", zap.Error(err))
+			return nil, err
+		}
+	}
 
 	if l.bk, err = NewBackend(ctx, &cfg.Backend, l.tls, cfg.PdAddrs); err != nil {
 		zap.L().Error("new backerr", zap.Error(err))
 		return nil, err
 	}
+
+	if l.ks, err = NewKeyStore(cfg.PdAddrs, &cfg.Security); err != nil {
+		zap.L().Error("new key store err", zap.Error(err))
+		return nil, err
+	}
+	if cfg.Layout == LayoutAuto {
+		l.layout, err = DetectLayout(ctx, l.ks, cfg.NameSpace)
+	} else {
+		l.layout, err = GetLayout(cfg.Layout)
+	}
+	if err != nil {
+		zap.L().Error("get layout err", zap.String("layout", cfg.Layout), zap.Error(err))
+		l.ks.Close()
+		return nil, err
+	}
+	zap.L().Info("titan layout", zap.String("layout", l.layout.Name))
 	return l, nil
 }
 
@@ -77,59 +222,489 @@ func (l *Lightning) switchMode(ctx context.Context, mode sstpb.SwitchMode) {
 }
 
 func (l *Lightning) Run() error {
+	defer l.ks.Close()
+	if !l.cp.Started() {
+		if err := CheckConflict(l.ctx, l.ks, l.layout, l.cfg.Conflict, l.cfg.NameSpace); err != nil {
+			zap.L().Error("check conflict failed", zap.String("policy", l.cfg.Conflict), zap.Error(err))
+			return err
+		}
+		if l.cfg.ObjectID == ObjectIDHash {
+			if err := CheckPendingGC(l.ctx, l.ks, l.cfg.NameSpace); err != nil {
+				zap.L().Error("check pending gc failed", zap.Error(err))
+				return err
+			}
+		}
+	}
+	if l.cfg.PreVerify {
+		if err := l.verify(l.ctx); err != nil {
+			return err
+		}
+	}
 	ctx, cancel := context.WithCancel(l.ctx)
 	go l.tickerWork(ctx)
+	go l.progress.LogLoop(ctx)
+	if l.guard != nil {
+		go l.guard.Run(ctx)
+	}
 	l.switchMode(ctx, sstpb.SwitchMode_Import)
-	if err := l.process(ctx); err != nil {
-		cancel()
-		return err
+	var err error
+	if l.cfg.PauseSchedulers {
+		err = l.pauseSchedulers(ctx)
+	}
+	// the regions split by a failed import are kept
+	if err == nil && l.cfg.PresplitRegions > 0 && !l.cp.Started() {
+		err = l.presplit(ctx)
+	}
+	if err == nil {
+		err = l.process(ctx)
+	}
+	if err == nil {
+		err = l.compact(ctx)
 	}
 	cancel()
-	l.switchMode(ctx, sstpb.SwitchMode_Normal)
+	l.switchMode(l.ctx, sstpb.SwitchMode_Normal)
+	// the settings saved by a crashed import are restored as well
+	if rerr := l.restoreSchedulers(l.ctx); rerr != nil {
+		zap.L().Error("pd schedulers not restored, run pd-schedulers restore", zap.Error(rerr))
+		if err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := l.cp.Remove(); err != nil {
+		zap.L().Error("remove checkpoint failed", zap.Error(err))
+	}
+	// the indexes are kept for a resumed import as long as the checkpoint
+	if err := removeKeyIndexes(filepath.Join(l.cfg.Backend.SortedDir, existingDir),
+		filepath.Join(l.cfg.Backend.SortedDir, duplicateDir)); err != nil {
+		zap.L().Warn("remove key indexes failed", zap.Error(err))
+	}
 	return nil
 }
 
+// Progress returns the progress of the sources
+func (l *Lightning) Progress() *Progress {
+	return l.progress
+}
+
+// RateLimits returns the rate limits of the import
+func (l *Lightning) RateLimits() *RateLimits {
+	return l.limits
+}
+
+// verify decodes the sources not written yet without importing anything, so
+// that a corrupt or truncated source fails before tikv is switched to import mode
+func (l *Lightning) verify(ctx context.Context) error {
+	concurrency := l.cfg.SourceConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, src := range l.sources {
+		src := src
+		if status := l.cp.Source(src).Status; status == CheckpointImported || status == CheckpointClosed {
+			continue
+		}
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			defer func() { <-sem }()
+			f, err := src.Open(0)
+			if err != nil {
+				zap.L().Error("open source failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+			defer f.Close()
+			if err := l.decodeSource(gctx, src, f, nil, nil, rdb.NopDecoder{}); err != nil {
+				zap.L().Error("verify source failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+			zap.L().Info("source verified", zap.String("source", src.Path))
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// process imports the sources concurrently, each into its own engines
 func (l *Lightning) process(ctx context.Context) error {
-	openEngin, err := l.bk.OpenEngine(l.ctx, DefaultTable, 0)
-	if err != nil {
-		zap.L().Error("open engin failed", zap.Error(err))
+	concurrency := l.cfg.SourceConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if l.cfg.Conflict == ConflictSkip {
+		ek, err := LoadExistingKeys(ctx, l.ks, l.cfg.NameSpace, filepath.Join(l.cfg.Backend.SortedDir, existingDir),
+			l.cp.Started())
+		if err != nil {
+			zap.L().Error("index existing keys failed", zap.Error(err))
+			return err
+		}
+		defer func() {
+			if err := ek.Close(); err != nil {
+				zap.L().Warn("close existing keys failed", zap.Error(err))
+			}
+		}()
+		l.existing = ek
+	}
+	// a single source has no keys of another source
+	if len(l.sources) > 1 {
+		dups, err := NewDuplicateDetector(filepath.Join(l.cfg.Backend.SortedDir, duplicateDir), l.cp.Started())
+		if err != nil {
+			zap.L().Error("open duplicate detector failed", zap.Error(err))
+			return err
+		}
+		defer func() {
+			if err := dups.Close(); err != nil {
+				zap.L().Warn("close duplicate detector failed", zap.Error(err))
+			}
+		}()
+		l.dups = dups
+	}
+	sem := make(chan struct{}, concurrency)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, src := range l.sources {
+		src := src
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			defer func() { <-sem }()
+			return l.processSource(gctx, src)
+		})
+	}
+	err := g.Wait()
+	if l.dups == nil {
 		return err
 	}
-	w, err := openEngin.LocalWriter(ctx)
+	if n := l.dups.Count(); n > 0 {
+		zap.L().Warn("duplicate keys found across sources", zap.Int64("count", n))
+	}
+	return err
+}
+
+func (l *Lightning) processSource(ctx context.Context, src *Source) error {
+	scp := l.cp.Source(src)
+	l.progress.SetStatus(src.Path, src.Size, scp.Status)
+	switch scp.Status {
+	case CheckpointImported:
+		zap.L().Info("source already imported", zap.String("source", src.Path))
+		return nil
+	case CheckpointClosed:
+		es := l.newEngineSet(ctx, src, 0, 0)
+		err := l.importClosed(es, scp)
+		if werr := es.wait(); err == nil {
+			err = werr
+		}
+		if err != nil {
+			return err
+		}
+		return l.updateCheckpoint(src, CheckpointImported)
+	case CheckpointWriting:
+		if scp.Position != nil && src.Resumable {
+			zap.L().Info("resume partially written engin", zap.String("source", src.Path),
+				zap.Int64("offset", scp.Position.Offset))
+			break
+		}
+		zap.L().Info("drop partially written engin", zap.String("source", src.Path))
+		for id := range scp.Engines {
+			if err := l.bk.ResetEngine(DefaultTable, id); err != nil {
+				zap.L().Error("reset engin failed", zap.String("source", src.Path), zap.Int32("engine", id), zap.Error(err))
+				return err
+			}
+			if err := l.cp.UpdateEngine(src, id, CheckpointPending); err != nil {
+				zap.L().Error("save checkpoint failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+		}
+		scp.Position = nil
+		scp.Engines = nil
+	}
+
+	if scp.Position == nil {
+		if err := l.updateCheckpoint(src, CheckpointWriting); err != nil {
+			return err
+		}
+	}
+	es := l.newEngineSet(ctx, src, scp.Part, scp.PartSize)
+	err := l.writeEngines(ctx, es, scp)
+	if err == nil {
+		err = l.updateCheckpoint(src, CheckpointClosed)
+	}
+	// the engines closed before a failure are still imported, a failed import
+	// stops the decoding and its error is the cause
+	if werr := es.wait(); werr != nil {
+		err = werr
+	}
 	if err != nil {
-		zap.L().Error("get local writer failed", zap.Error(err))
 		return err
 	}
-	callbak := NewRdbDecode(ctx, w, l.cfg.NameSpace)
-	f, err := l.reader()
+	return l.updateCheckpoint(src, CheckpointImported)
+}
+
+// importClosed imports the engines of scp which were closed but not imported
+func (l *Lightning) importClosed(es *engineSet, scp *SourceCheckpoint) error {
+	for id, status := range scp.Engines {
+		if status != CheckpointClosed {
+			continue
+		}
+		close, err := l.bk.UnsafeCloseEngine(es.ctx, DefaultTable, id)
+		if err != nil {
+			zap.L().Error("reopen closed engin failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+			return err
+		}
+		if err := es.submit(id, close); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEngines decodes the source of es into the engines of its partitions,
+// from the position of scp if it is not nil, and closes them
+func (l *Lightning) writeEngines(ctx context.Context, es *engineSet, scp *SourceCheckpoint) error {
+	src, pos := es.src, scp.Position
+	if pos != nil {
+		// the engines written before the position are closed with the others
+		for id, status := range scp.Engines {
+			if n := (id-src.ID)>>16 + 1; n > es.next {
+				es.next = n
+			}
+			if status != CheckpointWriting {
+				continue
+			}
+			part, ok := scp.Partitions[id]
+			if !ok {
+				part = (id - src.ID) >> 16
+			}
+			if _, err := es.reopen(part, id); err != nil {
+				return err
+			}
+		}
+		if err := l.importClosed(es, scp); err != nil {
+			return err
+		}
+	}
+	opts := []DecodeOption{
+		WithKVSink(es.write),
+		WithDuplicateDetector(l.dups, src, l.cfg.DuplicateKey == DuplicateError),
+		WithStream(l.cfg.Stream),
+		WithModule(l.cfg.Module, l.cfg.ModulePrefix, l.cfg.ModuleJSON),
+		WithIdleTime(l.cfg.IdleTime),
+		WithListZip(l.cfg.ListZipLength, l.cfg.ListZipValue),
+		WithLayout(l.layout),
+		WithObjectID(l.cfg.ObjectID, l.cfg.ImportID),
+	}
+	if l.cfg.Conflict == ConflictSkip {
+		opts = append(opts, WithExistingKeys(l.existing))
+	}
+	callbak := NewRdbDecode(ctx, nil, l.cfg.NameSpace, opts...)
+	var offset int64
+	if pos != nil {
+		offset = pos.Offset
+	}
+	f, err := src.Open(offset)
 	if err != nil {
-		zap.L().Error("get reader failed", zap.Error(err))
+		zap.L().Error("open source failed", zap.String("source", src.Path), zap.Error(err))
 		return err
 	}
-	if err := rdb.Decode(f, callbak); err != nil {
-		zap.L().Error("decode failed", zap.Error(err))
+	defer f.Close()
+	size := src.Size
+	if sized, ok := f.(interface{ Size() int64 }); ok {
+		size = sized.Size()
+	}
+	var decoder rdb.Decoder = callbak
+	if src.Slots != nil {
+		sd := newSlotDecoder(callbak, src)
+		defer func() {
+			zap.L().Info("skip keys outside node slots", zap.String("source", src.Path), zap.Int64("count", sd.Skipped()))
+		}()
+		decoder = sd
+	}
+	// progress is measured on the compressed bytes consumed
+	in := es.reader(l.progress.Reader(src.Path, size, offset, f))
+	if pos != nil {
+		// only uncompressed sources record positions
+		br := bufio.NewReader(in)
+		err = rdb.Resume(br, l.positionRecorder(ctx, src, es, callbak, decoder, offset), *pos)
+		if err == nil {
+			err = checkTrailing(br)
+		}
+	} else {
+		err = l.decodeSource(ctx, src, in, es, callbak, decoder)
+	}
+	if err != nil {
+		zap.L().Error("decode failed", zap.String("source", src.Path), zap.Error(err))
 		return err
 	}
-	if err := w.Close(); err != nil {
-		zap.L().Error("close writer failed", zap.Error(err))
+	if err := callbak.Err(); err != nil {
+		zap.L().Error("decode incomplete", zap.String("source", src.Path), zap.Error(err))
 		return err
 	}
-	close, err := openEngin.Close(ctx)
+	return es.close()
+}
+
+// decodeSource decompresses the source read from in and decodes it by its
+// format, es is nil when the source is only verified
+func (l *Lightning) decodeSource(ctx context.Context, src *Source, in io.Reader, es *engineSet,
+	rd *RdbDecode, d rdb.Decoder) error {
+	r, compression, err := Decompress(src.Path, in)
 	if err != nil {
-		zap.L().Error("get close engin failed", zap.Error(err))
+		zap.L().Error("open decompressor failed", zap.String("source", src.Path), zap.Error(err))
 		return err
 	}
-	if err := close.Import(ctx); err != nil {
-		zap.L().Error("close engin import failed", zap.Error(err))
-		return err
+	defer r.Close()
+	br := bufio.NewReader(r)
+	format := src.Format
+	if format == FormatAuto {
+		format = DetectFormat(src.Path, br)
+	}
+	zap.L().Info("decode source", zap.String("source", src.Path), zap.String("format", format),
+		zap.String("compression", compression))
+	switch format {
+	case FormatAOF:
+		var touched *TouchedKeys
+		if hasPreamble(br) {
+			if touched, err = l.scanAOF(src, d); err != nil {
+				zap.L().Error("scan aof failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+		}
+		return DecodeAOF(br, d, l.cfg.CommandError, l.maxBulk, touched)
+	case FormatRESP:
+		return DecodeRESP(br, d, l.cfg.CommandError, l.maxBulk)
+	case FormatJSONL:
+		return DecodeJSONL(br, d, l.cfg.LineError)
+	case FormatCSV:
+		return DecodeCSV(br, d, l.cfg.LineError)
 	}
-	if err := close.Cleanup(ctx); err != nil {
-		zap.L().Error("close engin cleanup failed", zap.Error(err))
+	// only uncompressed sources can be reopened at a position
+	if es != nil && compression == CompressionNone && src.Resumable {
+		d = l.positionRecorder(ctx, src, es, rd, d, 0)
+	}
+	if err := rdb.Decode(br, d); err != nil {
 		return err
 	}
-	return nil
+	return checkTrailing(br)
 }
 
-func (l *Lightning) reader() (io.Reader, error) {
-	return os.Open(l.cfg.SourceAddrs)
+// scanAOF reads the aof source once more for the keys touched by its commands,
+// so that the other keys of its preamble are streamed. Samples stream the
+// whole preamble, only their keys matter
+func (l *Lightning) scanAOF(src *Source, d rdb.Decoder) (*TouchedKeys, error) {
+	if _, ok := d.(sampler); ok {
+		return NewTouchedKeys(), nil
+	}
+	f, err := src.Open(0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := Decompress(src.Path, f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ScanAOF(r, l.maxBulk)
+}
+
+// positionRecorder wraps d to record the position of src in the checkpoint
+// every cpSize bytes, d is returned as is if checkpoints are disabled
+func (l *Lightning) positionRecorder(ctx context.Context, src *Source, es *engineSet,
+	rd *RdbDecode, d rdb.Decoder, offset int64) rdb.Decoder {
+	if l.cp.path == "" || l.cpSize <= 0 {
+		return d
+	}
+	es.atPositions = true
+	return &positionRecorder{Decoder: d, ctx: ctx, l: l, src: src, es: es, rd: rd, last: offset}
+}
+
+// positionRecorder flushes the engines before recording a position, so that
+// everything decoded before it survives a restart
+type positionRecorder struct {
+	rdb.Decoder
+	ctx  context.Context
+	l    *Lightning
+	src  *Source
+	es   *engineSet
+	rd   *RdbDecode
+	last int64
+}
+
+func (p *positionRecorder) Position(pos rdb.Position) {
+	full, due := p.es.full(), p.es.quotaDue()
+	if p.rd.err != nil || (!full && !due && pos.Offset-p.last < p.l.cpSize) {
+		return
+	}
+	p.last = pos.Offset
+	if err := p.es.flush(); err != nil {
+		p.rd.err = err
+		return
+	}
+	record := func(part int32, partSize int64) error {
+		if err := p.l.cp.UpdatePosition(p.src, pos, part, partSize); err != nil {
+			zap.L().Error("save checkpoint failed", zap.String("source", p.src.Path), zap.Error(err))
+			return err
+		}
+		return nil
+	}
+	var err error
+	if full {
+		// the position of the new partition is recorded before the full one is
+		// closed, so that a resumed import never writes into a closed engine
+		err = p.es.rotate(record)
+	} else {
+		err = record(p.es.part, p.es.partSize)
+	}
+	// the engines imported early hold nothing after the recorded position
+	if err == nil && due {
+		err = p.es.keepQuota()
+	}
+	if err != nil {
+		p.rd.err = err
+	}
+}
+
+// SlotInfo forwards the slot info if the wrapped decoder is interested in it
+func (p *positionRecorder) SlotInfo(slot, size, expiresSize uint64) {
+	if sd, ok := p.Decoder.(rdb.SlotInfoDecoder); ok {
+		sd.SlotInfo(slot, size, expiresSize)
+	}
+}
+
+// Stream forwards the stream if the wrapped decoder handles streams
+func (p *positionRecorder) Stream(key []byte, s *rdb.Stream, expiry int64) {
+	if sd, ok := p.Decoder.(rdb.StreamDecoder); ok {
+		sd.Stream(key, s, expiry)
+	}
+}
+
+// Idle forwards the idle time if the wrapped decoder is interested in it
+func (p *positionRecorder) Idle(seconds uint64) {
+	if id, ok := p.Decoder.(rdb.IdleDecoder); ok {
+		id.Idle(seconds)
+	}
+}
+
+// Module forwards the module value if the wrapped decoder handles them
+func (p *positionRecorder) Module(key []byte, m *rdb.Module, expiry int64) {
+	if md, ok := p.Decoder.(rdb.ModuleDecoder); ok {
+		md.Module(key, m, expiry)
+	}
+}
+
+func (l *Lightning) updateCheckpoint(src *Source, status CheckpointStatus) error {
+	l.progress.SetStatus(src.Path, src.Size, status)
+	if err := l.cp.Update(src, status); err != nil {
+		zap.L().Error("save checkpoint failed", zap.String("source", src.Path), zap.Error(err))
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package lightning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestVerifyReportsOffset(t *testing.T) {
+	b := newRDB(9).selectDB(0)
+	for i := 0; i < 100; i++ {
+		b.set(fmt.Sprintf("key%02d", i), "value")
+	}
+	dump := b.endSum()
+	corrupted := append([]byte{}, dump...)
+	corrupted[len(corrupted)/2] ^= 0x20
+
+	for _, c := range []struct {
+		name   string
+		data   []byte
+		err    error
+		offset int64
+	}{
+		{"valid.rdb", dump, nil, 0},
+		{"corrupted.rdb", corrupted, nil, int64(len(dump))},
+		// the offsets of a compressed source are of its decompressed bytes
+		{"corrupted.rdb.gz", compressDump(t, CompressionGzip, corrupted), nil, int64(len(dump))},
+		{"truncated.rdb", dump[:len(dump)/3], rdb.ErrTruncated, int64(len(dump) / 3)},
+		{"no-checksum.rdb", dump[:len(dump)-8], rdb.ErrTruncated, int64(len(dump) - 8)},
+	} {
+		dir, err := ioutil.TempDir("", "verify")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &conf.Import{NameSpace: "ns"}
+		sources, err := ParseSources(path, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp, err := LoadCheckpoint("", "ns", PartitionNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Lightning{cfg: cfg, cp: cp, sources: sources}
+		err = l.verify(context.Background())
+		if c.offset == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		var derr *rdb.DecodeError
+		if !errors.As(err, &derr) {
+			t.Errorf("%s: got %v, expect a decode error", c.name, err)
+			continue
+		}
+		if c.err != nil && derr.Err != c.err || c.err == nil && !strings.Contains(derr.Err.Error(), "checksum mismatch") {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		if derr.Offset != c.offset {
+			t.Errorf("%s: error at offset %d, expect %d", c.name, derr.Offset, c.offset)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package lightning
+
+import (
+	"github.com/nioshield/titan-lightning/rdb"
+	"go.uber.org/zap"
+)
+
+// Module strategies, titan has no module types
+const (
+	// ModuleSkip logs and drops the values of module types
+	ModuleSkip = "skip"
+	// ModuleRaw imports the payload of DUMP as a string at a side key, which
+	// can be given to RESTORE on a redis server loading the module
+	ModuleRaw = "raw"
+)
+
+// redisJSONModule is the module type of RedisJSON, whose values of encoding
+// version 3 are the serialized json
+const (
+	redisJSONModule  = "ReJSON-RL"
+	redisJSONVersion = 3
+)
+
+// ValidModule reports whether s is a known module strategy
+func ValidModule(s string) bool {
+	switch s {
+	case ModuleSkip, ModuleRaw:
+		return true
+	}
+	return false
+}
+
+// WithModule sets the strategy of the values of module types, raw values are
+// imported at prefix followed by the key. RedisJSON documents are imported
+// as strings at their key if json is set, whatever the strategy.
+func WithModule(strategy, prefix string, json bool) DecodeOption {
+	return func(r *RdbDecode) {
+		r.module, r.modulePrefix, r.moduleJSON = strategy, prefix, json
+	}
+}
+
+// Module imports a value of a module type by the strategy of r
+func (r *RdbDecode) Module(key []byte, m *rdb.Module, expiry int64) {
+	defer func() { r.idle = -1 }()
+	if r.moduleJSON && m.Name == redisJSONModule && m.Version == redisJSONVersion && len(m.Values) == 1 {
+		if doc, ok := m.Values[0].([]byte); ok {
+			r.Set(key, doc, expiry)
+			return
+		}
+	}
+	if r.module == ModuleRaw && m.Dump != nil {
+		r.Set(append([]byte(r.modulePrefix), key...), m.Dump, expiry)
+		return
+	}
+	if r.skippedModules == nil {
+		r.skippedModules = make(map[string]int64)
+	}
+	r.skippedModules[m.Name]++
+	zap.L().Debug("skip module value", zap.String("key", string(key)), zap.String("module", m.Name),
+		zap.Int("version", m.Version))
+}
@@ -0,0 +1,54 @@
+package lightning
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestModuleStrategies(t *testing.T) {
+	doc := &rdb.Module{Name: redisJSONModule, Version: redisJSONVersion, Values: []interface{}{[]byte(`{"a":1}`)},
+		Dump: []byte("\x07json")}
+	bloom := &rdb.Module{Name: "MBbloom--", Version: 0, Values: []interface{}{uint64(1)}, Dump: []byte("\x07bloom")}
+	for _, c := range []struct {
+		strategy string
+		json     bool
+		keys     string
+		values   map[string][]byte
+		skipped  int64
+	}{
+		{ModuleSkip, false, "", nil, 2},
+		{ModuleRaw, false, "_module:bloom,_module:doc", map[string][]byte{
+			"_module:doc": doc.Dump, "_module:bloom": bloom.Dump}, 0},
+		// the documents are converted whatever the strategy
+		{ModuleSkip, true, "doc", map[string][]byte{"doc": []byte(`{"a":1}`)}, 1},
+		{ModuleRaw, true, "_module:bloom,doc", map[string][]byte{"doc": []byte(`{"a":1}`),
+			"_module:bloom": bloom.Dump}, 0},
+	} {
+		rec := newKVRecorder()
+		rd := newTestDecode(rec, WithModule(c.strategy, "_module:", c.json))
+		rd.StartRDB()
+		rd.StartDatabase(0)
+		rd.Module([]byte("doc"), doc, 0)
+		rd.Module([]byte("bloom"), bloom, 0)
+		rd.EndDatabase(0)
+		rd.EndRDB()
+		if got := strings.Join(rec.metaKeys("ns", 0), ","); got != c.keys {
+			t.Errorf("%s json %v: imported keys %q, expect %q", c.strategy, c.json, got, c.keys)
+		}
+		for key, val := range c.values {
+			if _, meta := rec.meta("ns", 0, key); !bytes.HasSuffix(meta, val) {
+				t.Errorf("%s json %v: %s imported as %q, expect %q", c.strategy, c.json, key, meta, val)
+			}
+		}
+		var skipped int64
+		for _, n := range rd.skippedModules {
+			skipped += n
+		}
+		if skipped != c.skipped {
+			t.Errorf("%s json %v: %d values skipped, expect %d", c.strategy, c.json, skipped, c.skipped)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package lightning
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/distributedio/titan/db"
+)
+
+// Object id strategies
+const (
+	// ObjectIDRandom gives every object a random uuid like titan does
+	ObjectIDRandom = "random"
+	// ObjectIDHash derives the id from the meta key of the object keyed by
+	// the import id, so that importing a key again overwrites its data keys
+	ObjectIDHash = "hash"
+)
+
+// ValidObjectID reports whether s is a known object id strategy
+func ValidObjectID(s string) bool {
+	return s == ObjectIDRandom || s == ObjectIDHash
+}
+
+// WithObjectID sets the strategy of the object ids, importID is the key of
+// the hash and is not used by the random ids
+func WithObjectID(strategy, importID string) DecodeOption {
+	return func(r *RdbDecode) {
+		if strategy == ObjectIDHash {
+			r.idKey = []byte(importID)
+			r.hashID = true
+		}
+	}
+}
+
+// objectID returns the id of the object of key
+func (r *RdbDecode) objectID(key []byte) []byte {
+	if !r.hashID {
+		return db.UUID()
+	}
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(db.MetaKey(r.db, key))
+	id := mac.Sum(nil)[:16]
+	// mark it as a version 8 uuid of the rfc 4122 variant
+	id[6] = id[6]&0x0f | 0x80
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
+
+// CheckPendingGC fails if titan's gc still has to delete data keys of ns. The
+// gc deletes the data keys under the ids of deleted objects, and the hashed
+// ids of an import reuse them when the same keys are imported again.
+func CheckPendingGC(ctx context.Context, ks KeyStore, ns string) error {
+	start, end := GCRange(ns)
+	empty, err := ks.IsEmpty(ctx, start, end)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("namespace %s has pending gc which would delete objects imported with hashed ids, "+
+			"wait for titan's gc or use conflict=%s", ns, ConflictReplace)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package lightning
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+)
+
+func TestCheckPendingGC(t *testing.T) {
+	ctx := context.Background()
+	ks := newMemKeyStore()
+	if err := CheckPendingGC(ctx, ks, "ns"); err != nil {
+		t.Fatal(err)
+	}
+	gcKey := append(append([]byte{}, sysGCPrefix...), db.DataKey(&db.DB{Namespace: "ns"}, []byte("id"))...)
+	ks.put(gcKey, []byte{0})
+	if err := CheckPendingGC(ctx, ks, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPendingGC(ctx, ks, "ns"); err == nil {
+		t.Fatal("expect an error for the pending gc")
+	}
+	if err := CheckConflict(ctx, ks, DefaultLayout, ConflictReplace, "ns"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPendingGC(ctx, ks, "ns"); err != nil {
+		t.Fatal(err)
+	}
+}
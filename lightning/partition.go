@@ -0,0 +1,430 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	kv "github.com/pingcap/tidb-lightning/lightning/backend"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// Partition policies, which split the kvs of a source into engines written,
+// closed and imported on their own
+const (
+	// PartitionNone writes a source into one engine
+	PartitionNone = "none"
+	// PartitionDB writes each database of a source into its own engine
+	PartitionDB = "db"
+	// PartitionSize starts a new engine every partition-size bytes of kvs,
+	// the full engines are imported while the source is still decoded
+	PartitionSize = "size"
+	// PartitionClass writes the meta keys, the data keys and the expire
+	// index of a source into three engines
+	PartitionClass = "class"
+)
+
+// maxPartitions is the number of engine ids reserved for the engines of a
+// source, the first one is the id of the source itself
+const maxPartitions = 1 << 15
+
+// key classes of PartitionClass
+const (
+	classMeta = iota
+	classData
+	classExpire
+)
+
+// ValidPartition reports whether p is a known partition policy
+func ValidPartition(p string) bool {
+	switch p {
+	case PartitionNone, PartitionDB, PartitionSize, PartitionClass:
+		return true
+	}
+	return false
+}
+
+// engineID is the id of the nth engine opened for src
+func engineID(src *Source, n int32) int32 {
+	return src.ID + n<<16
+}
+
+// engineSet writes the kvs of a source into the engines of their partitions,
+// which are opened when their first kv is written, and imports the closed
+// engines in the background. A partition is written into a new engine once
+// its engine was imported early to keep sorted-dir under the disk quota. A
+// failed import cancels ctx, which stops the decoding of the source.
+type engineSet struct {
+	ctx context.Context
+	// parent is the context the imports are started from
+	parent context.Context
+	l      *Lightning
+	src    *Source
+	// engines are the engines being written by partition
+	engines map[int32]*partitionEngine
+	imports *errgroup.Group
+	// next is the part of the engine id given to the next opened engine
+	next int32
+	// written is the number of bytes written since the disk usage was checked
+	written int64
+
+	// part is the current partition of PartitionSize holding partSize bytes
+	part     int32
+	partSize int64
+	// atPositions is set if a full partition is rotated at the next position
+	// recorded in the checkpoint instead of before the next write
+	atPositions bool
+	// lateImport is set once the engines are found to be imported only when
+	// the source is decoded to the end
+	lateImport bool
+}
+
+type partitionEngine struct {
+	id     int32
+	engine *kv.OpenedEngine
+	w      *kv.LocalEngineWriter
+	// size is the number of bytes written into the engine
+	size int64
+}
+
+func (l *Lightning) newEngineSet(ctx context.Context, src *Source, part int32, partSize int64) *engineSet {
+	imports, gctx := errgroup.WithContext(ctx)
+	return &engineSet{
+		ctx:      gctx,
+		parent:   ctx,
+		imports:  imports,
+		l:        l,
+		src:      src,
+		engines:  make(map[int32]*partitionEngine),
+		part:     part,
+		partSize: partSize,
+	}
+}
+
+// partition returns the partition of a kv, the key is either a meta key, a
+// data key or an expire key of the namespace
+func (es *engineSet) partition(pair common.KvPair) int32 {
+	switch es.l.cfg.Partition {
+	case PartitionDB:
+		key := pair.Key
+		if bytes.HasPrefix(key, es.l.layout.ExpirePrefix) {
+			// the prefix, the encoded expiry, ':' and the meta key
+			key = key[len(es.l.layout.ExpirePrefix)+9:]
+		}
+		// the namespace, ':' and the 3 digits of the db
+		start := len(es.l.cfg.NameSpace) + 1
+		if len(key) < start+3 {
+			return 0
+		}
+		id, err := strconv.Atoi(string(key[start : start+3]))
+		if err != nil {
+			return 0
+		}
+		return int32(id)
+	case PartitionSize:
+		es.partSize += int64(len(pair.Key) + len(pair.Val))
+		return es.part
+	case PartitionClass:
+		return es.l.keyClass(pair.Key)
+	}
+	return 0
+}
+
+// keyClass returns whether key is a meta key, a data key or an expire key
+func (l *Lightning) keyClass(key []byte) int32 {
+	if bytes.HasPrefix(key, l.layout.ExpirePrefix) {
+		return classExpire
+	}
+	// the namespace, ':', the 3 digits of the db and ':'
+	if i := len(l.cfg.NameSpace) + 5; len(key) > i && key[i] == 'M' {
+		return classMeta
+	}
+	return classData
+}
+
+// write passes the kvs to the engines of their partitions
+func (es *engineSet) write(kvs []common.KvPair) error {
+	if err := es.ctx.Err(); err != nil {
+		return err
+	}
+	if !es.atPositions && es.full() && es.earlyImport() {
+		if err := es.rotate(nil); err != nil {
+			return err
+		}
+	}
+	if !es.atPositions && es.quotaDue() && es.earlyImport() {
+		if err := es.keepQuota(); err != nil {
+			return err
+		}
+	}
+	parts := make([]int32, len(kvs))
+	for i, pair := range kvs {
+		parts[i] = es.partition(pair)
+	}
+	start := 0
+	for i := 1; i <= len(kvs); i++ {
+		if i < len(kvs) && parts[i] == parts[start] {
+			continue
+		}
+		if err := es.writePart(parts[start], kvs[start:i]); err != nil {
+			return err
+		}
+		start = i
+	}
+	return nil
+}
+
+// earlyImport reports whether the engines of the source may be imported
+// before it is decoded to the end. A source without recorded positions is
+// decoded again from the start after a restart, which would import the kvs
+// of the engines imported early a second time under new object ids, unless
+// the ids are derived from the keys or nothing is resumed
+func (es *engineSet) earlyImport() bool {
+	if es.atPositions || es.l.cp.path == "" || es.l.cfg.ObjectID == ObjectIDHash {
+		return true
+	}
+	if !es.lateImport {
+		es.lateImport = true
+		zap.L().Warn("source can not be resumed at a position, its engines are imported once it is decoded",
+			zap.String("source", es.src.Path), zap.String("object-id", es.l.cfg.ObjectID))
+	}
+	return false
+}
+
+func (es *engineSet) writePart(part int32, kvs []common.KvPair) error {
+	pe, err := es.open(part)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, pair := range kvs {
+		size += int64(len(pair.Key) + len(pair.Val))
+	}
+	if err := es.l.limits.WaitWrite(es.ctx, len(kvs), size); err != nil {
+		return err
+	}
+	pe.size += size
+	es.written += size
+	return pe.w.WriteRows(es.ctx, nil, kv.MakeRowsFromKvPairs(kvs))
+}
+
+// open returns the engine of part, a new engine is opened and recorded in the
+// checkpoint before the first kv is written into it
+func (es *engineSet) open(part int32) (*partitionEngine, error) {
+	if pe, ok := es.engines[part]; ok {
+		return pe, nil
+	}
+	if es.next >= maxPartitions {
+		err := fmt.Errorf("source %s uses more than %d engines", es.src.Path, maxPartitions)
+		zap.L().Error("open engin failed", zap.String("source", es.src.Path), zap.Error(err))
+		return nil, err
+	}
+	es.next++
+	return es.reopen(part, engineID(es.src, es.next-1))
+}
+
+// reopen opens the engine id to write the kvs of part into it
+func (es *engineSet) reopen(part, id int32) (*partitionEngine, error) {
+	if err := es.l.cp.OpenEngine(es.src, id, part); err != nil {
+		zap.L().Error("save checkpoint failed", zap.String("source", es.src.Path), zap.Error(err))
+		return nil, err
+	}
+	engine, err := es.l.bk.OpenEngine(es.ctx, DefaultTable, id)
+	if err != nil {
+		zap.L().Error("open engin failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+		return nil, err
+	}
+	w, err := engine.LocalWriter(es.ctx)
+	if err != nil {
+		zap.L().Error("get local writer failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+		return nil, err
+	}
+	pe := &partitionEngine{id: id, engine: engine, w: w}
+	es.engines[part] = pe
+	if n := (id-es.src.ID)>>16 + 1; n > es.next {
+		es.next = n
+	}
+	return pe, nil
+}
+
+// flush makes everything written so far survive a restart
+func (es *engineSet) flush() error {
+	for _, pe := range es.engines {
+		if err := pe.w.Close(); err != nil {
+			zap.L().Error("close writer failed", zap.String("source", es.src.Path), zap.Error(err))
+			return err
+		}
+		w, err := pe.engine.LocalWriter(es.ctx)
+		if err != nil {
+			zap.L().Error("get local writer failed", zap.String("source", es.src.Path), zap.Error(err))
+			return err
+		}
+		pe.w = w
+		if err := pe.engine.Flush(); err != nil {
+			zap.L().Error("flush engin failed", zap.String("source", es.src.Path),
+				zap.Int32("engine", pe.id), zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// full reports whether the current partition of PartitionSize is full, the
+// partitions are cut at one region batch while the imports are throttled
+func (es *engineSet) full() bool {
+	return es.l.cfg.Partition == PartitionSize && es.partSize >= es.l.limits.EngineSize(es.l.partSize) &&
+		es.part < maxPartitions-1
+}
+
+// rotate moves on to a new partition, record is called with the new
+// partition before the full one is closed and imported in the background
+func (es *engineSet) rotate(record func(part int32, partSize int64) error) error {
+	full := es.part
+	es.part++
+	es.partSize = 0
+	if record != nil {
+		if err := record(es.part, es.partSize); err != nil {
+			return err
+		}
+	}
+	pe, ok := es.engines[full]
+	if !ok {
+		return nil
+	}
+	delete(es.engines, full)
+	return es.retire(pe)
+}
+
+// retire closes an engine, records it as closed and imports it
+func (es *engineSet) retire(pe *partitionEngine) error {
+	id := pe.id
+	if err := pe.w.Close(); err != nil {
+		zap.L().Error("close writer failed", zap.String("source", es.src.Path), zap.Error(err))
+		return err
+	}
+	ce, err := pe.engine.Close(es.ctx)
+	if err != nil {
+		zap.L().Error("get close engin failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+		return err
+	}
+	if err := es.l.cp.UpdateEngine(es.src, id, CheckpointClosed); err != nil {
+		zap.L().Error("save checkpoint failed", zap.String("source", es.src.Path), zap.Error(err))
+		return err
+	}
+	return es.submit(id, ce)
+}
+
+// submit imports a closed engine in the background, it blocks while the
+// max number of engines are pending import
+func (es *engineSet) submit(id int32, ce *kv.ClosedEngine) error {
+	if err := es.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case es.l.pending <- struct{}{}:
+	case <-es.ctx.Done():
+		return es.ctx.Err()
+	}
+	ctx := es.ctx
+	es.imports.Go(func() error {
+		defer func() { <-es.l.pending }()
+		_, uid := kv.MakeUUID(DefaultTable, id)
+		size, err := dirSize(filepath.Join(es.l.cfg.Backend.SortedDir, uid.String()))
+		if err != nil {
+			zap.L().Warn("get engin size failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+		}
+		if es.l.guard != nil {
+			if err := es.l.guard.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := es.l.limits.WaitImport(ctx, size); err != nil {
+			return err
+		}
+		if err := es.importEngine(ctx, id, ce); err != nil {
+			zap.L().Error("close engin import failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+			return err
+		}
+		if err := ce.Cleanup(ctx); err != nil {
+			zap.L().Error("close engin cleanup failed", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+			return err
+		}
+		if err := es.l.cp.UpdateEngine(es.src, id, CheckpointImported); err != nil {
+			zap.L().Error("save checkpoint failed", zap.String("source", es.src.Path), zap.Error(err))
+			return err
+		}
+		zap.L().Info("engin imported", zap.String("source", es.src.Path), zap.Int32("engine", id))
+		return nil
+	})
+	return nil
+}
+
+// importEngine imports a closed engine, an import stopped by the health guard
+// is started again once the cluster recovers
+func (es *engineSet) importEngine(ctx context.Context, id int32, ce *kv.ClosedEngine) error {
+	if es.l.guard == nil {
+		return ce.Import(ctx)
+	}
+	for {
+		if err := es.l.guard.Wait(ctx); err != nil {
+			return err
+		}
+		gctx, cancel := es.l.guard.Guard(ctx)
+		err := ce.Import(gctx)
+		paused := gctx.Err() != nil && ctx.Err() == nil
+		cancel()
+		if err == nil || !paused {
+			return err
+		}
+		zap.L().Warn("engin import paused", zap.String("source", es.src.Path), zap.Int32("engine", id), zap.Error(err))
+	}
+}
+
+// close closes and imports the engines still open
+func (es *engineSet) close() error {
+	for part, pe := range es.engines {
+		delete(es.engines, part)
+		if err := es.retire(pe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait waits for the imports of the closed engines
+func (es *engineSet) wait() error {
+	return es.imports.Wait()
+}
+
+// drain waits for the imports of the closed engines while the source is still
+// written, the imports submitted next start a new group as the wait cancels
+// the context of the former one
+func (es *engineSet) drain() error {
+	if err := es.wait(); err != nil {
+		return err
+	}
+	es.imports, es.ctx = errgroup.WithContext(es.parent)
+	return nil
+}
+
+// reader stops reading r once an import of the source failed
+func (es *engineSet) reader(r io.Reader) io.Reader {
+	return &engineSetReader{es: es, r: r}
+}
+
+type engineSetReader struct {
+	es *engineSet
+	r  io.Reader
+}
+
+func (er *engineSetReader) Read(p []byte) (int, error) {
+	if err := er.es.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return er.r.Read(p)
+}
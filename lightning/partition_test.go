@@ -0,0 +1,391 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
+	kv "github.com/pingcap/tidb-lightning/lightning/backend"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+func TestFailedImportStopsDecoding(t *testing.T) {
+	l := &Lightning{cfg: &conf.Import{}}
+	es := l.newEngineSet(context.Background(), &Source{Path: "dump.rdb"}, 0, 0)
+	failed := errors.New("import failed")
+	es.imports.Go(func() error { return failed })
+	<-es.ctx.Done()
+
+	if err := es.write([]common.KvPair{{Key: []byte("k"), Val: []byte("v")}}); err != context.Canceled {
+		t.Errorf("write after a failed import returned %v", err)
+	}
+	if err := es.submit(1, nil); err != context.Canceled {
+		t.Errorf("submit after a failed import returned %v", err)
+	}
+	if _, err := ioutil.ReadAll(es.reader(bytes.NewReader([]byte("data")))); err != context.Canceled {
+		t.Errorf("read after a failed import returned %v", err)
+	}
+	if err := es.wait(); err != failed {
+		t.Errorf("wait returned %v, expect the import error", err)
+	}
+}
+
+func TestDecodeStopsWritingAfterError(t *testing.T) {
+	writes := 0
+	failed := errors.New("write failed")
+	rd := NewRdbDecode(context.Background(), nil, "ns", WithKVSink(func(kvs []common.KvPair) error {
+		writes++
+		return failed
+	}))
+	dump := newRDB(9).selectDB(0).set("a", "v").set("b", "v").list("c", "x", "y").end()
+	if err := rdb.Decode(bytes.NewReader(dump), rd); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Err() != failed || writes != 1 {
+		t.Errorf("decode ended with %v after %d writes", rd.Err(), writes)
+	}
+}
+
+// memBackend keeps the kvs written into each engine in memory and a file of
+// their size under dir, the other methods of the backend are not called
+type memBackend struct {
+	kv.AbstractBackend
+	dir string
+
+	mu       sync.Mutex
+	kvs      map[uuid.UUID][]common.KvPair
+	imported map[uuid.UUID]bool
+	cleaned  map[uuid.UUID]bool
+}
+
+func newMemBackend(dir string) *memBackend {
+	return &memBackend{
+		dir:      dir,
+		kvs:      make(map[uuid.UUID][]common.KvPair),
+		imported: make(map[uuid.UUID]bool),
+		cleaned:  make(map[uuid.UUID]bool),
+	}
+}
+
+func (m *memBackend) OpenEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return os.MkdirAll(filepath.Join(m.dir, engineUUID.String()), 0755)
+}
+
+func (m *memBackend) CloseEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return nil
+}
+
+func (m *memBackend) ImportEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.imported[engineUUID] = true
+	return nil
+}
+
+func (m *memBackend) CleanupEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	m.mu.Lock()
+	m.cleaned[engineUUID] = true
+	m.mu.Unlock()
+	return os.RemoveAll(filepath.Join(m.dir, engineUUID.String()))
+}
+
+func (m *memBackend) LocalWriter(ctx context.Context, engineUUID uuid.UUID) (kv.EngineWriter, error) {
+	return &memWriter{m: m, uuid: engineUUID}, nil
+}
+
+type memWriter struct {
+	m    *memBackend
+	uuid uuid.UUID
+	n    int
+}
+
+func (w *memWriter) AppendRows(ctx context.Context, tableName string, columnNames []string, commitTS uint64, rows kv.Rows) error {
+	// the rows of the local backend are a slice of kv pairs
+	kvs := reflect.ValueOf(rows).Convert(reflect.TypeOf([]common.KvPair(nil))).Interface().([]common.KvPair)
+	var data []byte
+	for _, pair := range kvs {
+		data = append(append(data, pair.Key...), pair.Val...)
+	}
+	w.m.mu.Lock()
+	w.m.kvs[w.uuid] = append(w.m.kvs[w.uuid], kvs...)
+	w.m.mu.Unlock()
+	w.n++
+	return ioutil.WriteFile(filepath.Join(w.m.dir, w.uuid.String(), fmt.Sprintf("%p-%d.sst", w, w.n)), data, 0644)
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+// engine returns the kvs written into the engine id and whether it is
+// imported and cleaned up
+func (m *memBackend) engine(id int32) ([]common.KvPair, bool) {
+	_, uid := kv.MakeUUID(DefaultTable, id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kvs[uid], m.imported[uid] && m.cleaned[uid]
+}
+
+// engines returns the number of engines written
+func (m *memBackend) engines() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.kvs)
+}
+
+func newTestEngineLightning(t *testing.T, partition, objectID, cpPath string) (*Lightning, *memBackend, string) {
+	dir, err := ioutil.TempDir("", "sorted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.Import{NameSpace: "ns", Partition: partition, ObjectID: objectID}
+	cfg.Backend.SortedDir = dir
+	cp, err := LoadCheckpoint(cpPath, "ns", partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := NewRateLimits(&conf.Backend{ReginSplitSize: "96M", UploadRate: "0", WriteRate: "0"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := newMemBackend(dir)
+	return &Lightning{
+		cfg:     cfg,
+		bk:      &Backend{b: kv.MakeBackend(mem), cfg: &cfg.Backend},
+		layout:  DefaultLayout,
+		cp:      cp,
+		limits:  limits,
+		pending: make(chan struct{}, 4),
+	}, mem, dir
+}
+
+// testEngineDump has strings with and without expiry and a list in two dbs
+func testEngineDump() []byte {
+	b := newRDB(9).selectDB(0)
+	for i := 0; i < 20; i++ {
+		b.expireAt(4102444800000).set(fmt.Sprintf("s%d", i), strings.Repeat("v", 20))
+	}
+	b.list("l", "a", "b", "c").selectDB(1)
+	for i := 0; i < 20; i++ {
+		b.set(fmt.Sprintf("t%d", i), strings.Repeat("v", 20))
+	}
+	return b.end()
+}
+
+// writeEngines decodes dump into the engines of src and imports them, it
+// returns the kvs of the engines in the order they were opened
+func writeEngines(t *testing.T, l *Lightning, mem *memBackend, src *Source, dump []byte) [][]common.KvPair {
+	es := l.newEngineSet(context.Background(), src, 0, 0)
+	rd := NewRdbDecode(context.Background(), nil, "ns", WithKVSink(es.write),
+		WithLayout(DefaultLayout), WithObjectID(ObjectIDHash, "test"))
+	if err := rdb.Decode(bytes.NewReader(dump), rd); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Err() != nil {
+		t.Fatal(rd.Err())
+	}
+	if err := es.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.wait(); err != nil {
+		t.Fatal(err)
+	}
+	scp := l.cp.Source(src)
+	var engines [][]common.KvPair
+	for n := int32(0); n < es.next; n++ {
+		id := engineID(src, n)
+		kvs, imported := mem.engine(id)
+		if !imported {
+			t.Errorf("engine %d is not imported and cleaned up", id)
+		}
+		if scp.Engines[id] != CheckpointImported {
+			t.Errorf("engine %d is %v in the checkpoint", id, scp.Engines[id])
+		}
+		engines = append(engines, kvs)
+	}
+	if len(engines) != mem.engines() {
+		t.Errorf("%d engines written, %d recorded", mem.engines(), len(engines))
+	}
+	return engines
+}
+
+func TestPartitions(t *testing.T) {
+	dump := testEngineDump()
+	l, mem, dir := newTestEngineLightning(t, PartitionNone, ObjectIDHash, "")
+	defer os.RemoveAll(dir)
+	src := &Source{ID: 1, Path: "dump.rdb"}
+	all := writeEngines(t, l, mem, src, dump)
+	if len(all) != 1 {
+		t.Fatalf("none wrote %d engines", len(all))
+	}
+	expect := make(map[string]bool)
+	for _, pair := range all[0] {
+		expect[string(pair.Key)] = true
+	}
+
+	for _, c := range []struct {
+		partition string
+		engines   int
+	}{
+		{PartitionDB, 2},
+		{PartitionClass, 3},
+	} {
+		l, mem, dir := newTestEngineLightning(t, c.partition, ObjectIDHash, "")
+		defer os.RemoveAll(dir)
+		engines := writeEngines(t, l, mem, src, dump)
+		if len(engines) != c.engines {
+			t.Errorf("%s wrote %d engines, expect %d", c.partition, len(engines), c.engines)
+		}
+		// each engine holds the kvs of one db or one class of keys
+		es := &engineSet{l: l}
+		got := make(map[string]bool)
+		parts := make(map[int32]bool)
+		for i, kvs := range engines {
+			part := es.partition(kvs[0])
+			if parts[part] {
+				t.Errorf("%s: partition %d in several engines", c.partition, part)
+			}
+			parts[part] = true
+			for _, pair := range kvs {
+				got[string(pair.Key)] = true
+				if es.partition(pair) != part {
+					t.Errorf("%s: engine %d holds %q and %q", c.partition, i, kvs[0].Key, pair.Key)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s wrote %d keys, expect %d", c.partition, len(got), len(expect))
+		}
+	}
+}
+
+func TestPartitionSize(t *testing.T) {
+	dump := testEngineDump()
+	src := &Source{ID: 1, Path: "dump.rdb"}
+	l, mem, dir := newTestEngineLightning(t, PartitionSize, ObjectIDRandom, "")
+	defer os.RemoveAll(dir)
+	l.partSize = 512
+	es := l.newEngineSet(context.Background(), src, 0, 0)
+	rd := NewRdbDecode(context.Background(), nil, "ns", WithKVSink(es.write), WithLayout(DefaultLayout))
+	if err := rdb.Decode(bytes.NewReader(dump), rd); err != nil || rd.Err() != nil {
+		t.Fatal(err, rd.Err())
+	}
+	if err := es.drain(); err != nil {
+		t.Fatal(err)
+	}
+	// the full engines are imported while the source is decoded
+	if es.next < 3 {
+		t.Fatalf("wrote %d engines of %d bytes", es.next, l.partSize)
+	}
+	for n := int32(0); n < es.next; n++ {
+		kvs, imported := mem.engine(engineID(src, n))
+		if imported != (n < es.next-1) {
+			t.Errorf("engine %d of %d imported: %v", n, es.next, imported)
+		}
+		// an engine is full once the kvs written into it reach partition-size
+		var size int64
+		for _, pair := range kvs {
+			size += int64(len(pair.Key) + len(pair.Val))
+		}
+		if n < es.next-1 && size < l.partSize {
+			t.Errorf("engine %d rotated at %d bytes", n, size)
+		}
+	}
+	if err := es.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, imported := mem.engine(engineID(src, es.next-1)); !imported {
+		t.Error("last engine is not imported")
+	}
+}
+
+func TestPartitionLateImport(t *testing.T) {
+	dump := testEngineDump()
+	src := &Source{ID: 1, Path: "dump.rdb"}
+	cpDir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cpDir)
+	for _, c := range []struct {
+		objectID string
+		cpPath   string
+		late     bool
+	}{
+		// the engines of the first decoding would be imported again under new
+		// object ids after a restart
+		{ObjectIDRandom, filepath.Join(cpDir, "random.json"), true},
+		{ObjectIDHash, filepath.Join(cpDir, "hash.json"), false},
+		{ObjectIDRandom, "", false},
+	} {
+		l, mem, dir := newTestEngineLightning(t, PartitionSize, c.objectID, c.cpPath)
+		defer os.RemoveAll(dir)
+		l.partSize = 512
+		es := l.newEngineSet(context.Background(), src, 0, 0)
+		rd := NewRdbDecode(context.Background(), nil, "ns", WithKVSink(es.write), WithLayout(DefaultLayout))
+		if err := rdb.Decode(bytes.NewReader(dump), rd); err != nil || rd.Err() != nil {
+			t.Fatal(err, rd.Err())
+		}
+		if late := es.next == 1; late != c.late || es.lateImport != c.late {
+			t.Errorf("%s checkpoint %q: wrote %d engines, late import %v", c.objectID, c.cpPath, es.next, es.lateImport)
+		}
+		if err := es.close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := es.wait(); err != nil {
+			t.Fatal(err)
+		}
+		if mem.engines() != int(es.next) {
+			t.Errorf("%s checkpoint %q: %d engines written", c.objectID, c.cpPath, mem.engines())
+		}
+	}
+}
+
+func TestPartitionSizeThrottled(t *testing.T) {
+	dump := testEngineDump()
+	src := &Source{ID: 1, Path: "dump.rdb"}
+	l, _, dir := newTestEngineLightning(t, PartitionSize, ObjectIDRandom, "")
+	defer os.RemoveAll(dir)
+	l.partSize = 1 << 20
+	l.limits.regionSize = 512
+	l.limits.engineSize = l.partSize
+	decode := func() int32 {
+		es := l.newEngineSet(context.Background(), src, 0, 0)
+		rd := NewRdbDecode(context.Background(), nil, "ns", WithKVSink(es.write), WithLayout(DefaultLayout))
+		if err := rdb.Decode(bytes.NewReader(dump), rd); err != nil || rd.Err() != nil {
+			t.Fatal(err, rd.Err())
+		}
+		if err := es.close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := es.wait(); err != nil {
+			t.Fatal(err)
+		}
+		return es.next
+	}
+	if n := decode(); n != 1 {
+		t.Errorf("wrote %d engines without import limits", n)
+	}
+	// a limit set while importing cuts the next engines at a region
+	rate := "1G"
+	if err := l.limits.Update(&RateLimitConfig{UploadRate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	if n := decode(); n < 3 {
+		t.Errorf("wrote %d engines of a region", n)
+	}
+}
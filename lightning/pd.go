@@ -0,0 +1,268 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"go.uber.org/zap"
+)
+
+const (
+	pdSchedulersPath = "/pd/api/v1/schedulers"
+	pdScheduleConfig = "/pd/api/v1/config/schedule"
+	pdStoresPath     = "/pd/api/v1/stores"
+)
+
+// pdSchedulers are the schedulers moving the regions and leaders being
+// ingested, they are removed during the import
+var pdSchedulers = map[string]bool{
+	"balance-region-scheduler":     true,
+	"balance-leader-scheduler":     true,
+	"balance-hot-region-scheduler": true,
+}
+
+// pdScheduleLimits are raised during the import to the original value times
+// the number of stores, up to maxScheduleLimit
+var pdScheduleLimits = []string{"leader-schedule-limit", "region-schedule-limit", "max-snapshot-count"}
+
+// pdMergeLimits are set to 0 during the import, which stops pd from merging
+// the empty regions split before ingesting
+var pdMergeLimits = []string{"max-merge-region-keys", "max-merge-region-size"}
+
+const maxScheduleLimit = 40
+
+// PDState is what the import changed in pd, it is saved in the checkpoint
+// before pd is changed so it can be restored after a crash
+type PDState struct {
+	// Schedulers are the removed schedulers
+	Schedulers []string `json:"schedulers"`
+	// Config holds the original values of the changed schedule config
+	Config map[string]interface{} `json:"config"`
+}
+
+// PDClient changes the schedulers and the schedule config through the http
+// api of pd
+type PDClient struct {
+	url    string
+	scheme string
+	client *http.Client
+}
+
+// NewPDClient returns a client of the pd at addr
+func NewPDClient(tls *common.TLS, addr string) *PDClient {
+	c := &PDClient{scheme: "http", client: &http.Client{}}
+	if tc := tls.TLSConfig(); tc != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tc
+		c.scheme = "https"
+		c.client = &http.Client{Transport: transport}
+	}
+	c.url = c.scheme + "://" + addr
+	return c
+}
+
+func (c *PDClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s, %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Save returns the running schedulers removed by Pause and the original
+// values of the schedule config changed by it
+func (c *PDClient) Save(ctx context.Context) (*PDState, error) {
+	var running []string
+	if err := c.do(ctx, http.MethodGet, pdSchedulersPath, nil, &running); err != nil {
+		return nil, err
+	}
+	var cfg map[string]interface{}
+	if err := c.do(ctx, http.MethodGet, pdScheduleConfig, nil, &cfg); err != nil {
+		return nil, err
+	}
+	state := &PDState{Config: make(map[string]interface{})}
+	for _, name := range running {
+		if pdSchedulers[name] {
+			state.Schedulers = append(state.Schedulers, name)
+		}
+	}
+	for _, key := range append(pdScheduleLimits, pdMergeLimits...) {
+		if v, ok := cfg[key]; ok {
+			state.Config[key] = v
+		}
+	}
+	return state, nil
+}
+
+// Pause removes the schedulers of state and changes the schedule config from
+// its original values, it may be called again after a crash
+func (c *PDClient) Pause(ctx context.Context, state *PDState) error {
+	var stores struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, http.MethodGet, pdStoresPath, nil, &stores); err != nil {
+		return err
+	}
+	cfg := make(map[string]interface{})
+	for _, key := range pdScheduleLimits {
+		if v, ok := state.Config[key].(float64); ok {
+			cfg[key] = math.Max(v, math.Min(maxScheduleLimit, v*float64(stores.Count)))
+		}
+	}
+	for _, key := range pdMergeLimits {
+		if _, ok := state.Config[key]; ok {
+			cfg[key] = 0
+		}
+	}
+	if err := c.do(ctx, http.MethodPost, pdScheduleConfig, cfg, nil); err != nil {
+		return err
+	}
+	running, err := c.running(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range state.Schedulers {
+		if !running[name] {
+			continue
+		}
+		if err := c.do(ctx, http.MethodDelete, pdSchedulersPath+"/"+name, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore adds the schedulers of state back and restores the original values
+// of the schedule config
+func (c *PDClient) Restore(ctx context.Context, state *PDState) error {
+	if len(state.Config) > 0 {
+		if err := c.do(ctx, http.MethodPost, pdScheduleConfig, state.Config, nil); err != nil {
+			return err
+		}
+	}
+	running, err := c.running(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range state.Schedulers {
+		if running[name] {
+			continue
+		}
+		in := map[string]string{"name": name}
+		if err := c.do(ctx, http.MethodPost, pdSchedulersPath, in, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *PDClient) running(ctx context.Context) (map[string]bool, error) {
+	var names []string
+	if err := c.do(ctx, http.MethodGet, pdSchedulersPath, nil, &names); err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(names))
+	for _, name := range names {
+		running[name] = true
+	}
+	return running, nil
+}
+
+// pauseSchedulers saves the pd settings in the checkpoint unless a crashed
+// import saved them already, and pauses the schedulers
+func (l *Lightning) pauseSchedulers(ctx context.Context) error {
+	state := l.cp.PD()
+	if state == nil {
+		var err error
+		if state, err = l.pd.Save(ctx); err != nil {
+			zap.L().Error("get pd schedulers failed", zap.Error(err))
+			return err
+		}
+		if err := l.cp.UpdatePD(state); err != nil {
+			zap.L().Error("save checkpoint failed", zap.Error(err))
+			return err
+		}
+	}
+	if err := l.pd.Pause(ctx, state); err != nil {
+		zap.L().Error("pause pd schedulers failed", zap.Error(err))
+		return err
+	}
+	zap.L().Info("pause pd schedulers", zap.Strings("schedulers", state.Schedulers), zap.Any("config", state.Config))
+	return nil
+}
+
+// restoreSchedulers restores the pd settings saved in the checkpoint
+func (l *Lightning) restoreSchedulers(ctx context.Context) error {
+	state := l.cp.PD()
+	if state == nil {
+		return nil
+	}
+	return restoreSchedulers(ctx, l.pd, state, func() error { return l.cp.UpdatePD(nil) })
+}
+
+// restoreSchedulers restores state in pd and calls done to drop it from the
+// checkpoint
+func restoreSchedulers(ctx context.Context, pd *PDClient, state *PDState, done func() error) error {
+	if err := pd.Restore(ctx, state); err != nil {
+		zap.L().Error("restore pd schedulers failed", zap.Error(err))
+		return err
+	}
+	zap.L().Info("restore pd schedulers", zap.Strings("schedulers", state.Schedulers), zap.Any("config", state.Config))
+	if err := done(); err != nil {
+		zap.L().Error("save checkpoint failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// RestoreSchedulers restores the pd settings saved in the checkpoint of cfg
+// by an import which did not finish, only the pd settings of the checkpoint
+// are read and rewritten
+func RestoreSchedulers(ctx context.Context, cfg *conf.Import) error {
+	state, err := LoadPDState(cfg.CheckpointPath)
+	if err != nil {
+		zap.L().Error("load checkpoint failed", zap.String("checkpoint", cfg.CheckpointPath), zap.Error(err))
+		return err
+	}
+	if state == nil {
+		zap.L().Info("no pd schedulers to restore", zap.String("checkpoint", cfg.CheckpointPath))
+		return nil
+	}
+	tls, err := common.NewTLS(cfg.Security.CAPath, cfg.Security.CertPath, cfg.Security.KeyPath, cfg.PdAddrs)
+	if err != nil {
+		return err
+	}
+	return restoreSchedulers(ctx, NewPDClient(tls, cfg.PdAddrs), state, func() error {
+		return ClearPDState(cfg.CheckpointPath)
+	})
+}
@@ -0,0 +1,193 @@
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+// fakePD serves the schedulers, the schedule config and the store count of
+// the http api of pd
+type fakePD struct {
+	mu         sync.Mutex
+	schedulers map[string]bool
+	config     map[string]interface{}
+	stores     int
+}
+
+func newFakePD() *fakePD {
+	return &fakePD{
+		schedulers: map[string]bool{
+			"balance-region-scheduler":     true,
+			"balance-leader-scheduler":     true,
+			"balance-hot-region-scheduler": true,
+			"label-scheduler":              true,
+		},
+		config: map[string]interface{}{
+			"leader-schedule-limit":  float64(4),
+			"region-schedule-limit":  float64(2048),
+			"max-snapshot-count":     float64(3),
+			"max-merge-region-keys":  float64(200000),
+			"max-merge-region-size":  float64(20),
+			"patrol-region-interval": "100ms",
+		},
+		stores: 3,
+	}
+}
+
+func (pd *fakePD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	var out interface{}
+	switch {
+	case r.URL.Path == pdStoresPath && r.Method == http.MethodGet:
+		out = map[string]int{"count": pd.stores}
+	case r.URL.Path == pdSchedulersPath && r.Method == http.MethodGet:
+		out = pd.running()
+	case r.URL.Path == pdSchedulersPath && r.Method == http.MethodPost:
+		var in map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pd.schedulers[in["name"]] = true
+	case strings.HasPrefix(r.URL.Path, pdSchedulersPath+"/") && r.Method == http.MethodDelete:
+		name := strings.TrimPrefix(r.URL.Path, pdSchedulersPath+"/")
+		if !pd.schedulers[name] {
+			http.Error(w, "scheduler not found", http.StatusInternalServerError)
+			return
+		}
+		delete(pd.schedulers, name)
+	case r.URL.Path == pdScheduleConfig && r.Method == http.MethodGet:
+		out = pd.config
+	case r.URL.Path == pdScheduleConfig && r.Method == http.MethodPost:
+		var in map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range in {
+			pd.config[k] = v
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func (pd *fakePD) running() []string {
+	var names []string
+	for name := range pd.schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// state returns the running schedulers and a copy of the schedule config
+func (pd *fakePD) state() ([]string, map[string]interface{}) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	cfg := make(map[string]interface{}, len(pd.config))
+	for k, v := range pd.config {
+		cfg[k] = v
+	}
+	return pd.running(), cfg
+}
+
+func TestPauseRestoreSchedulers(t *testing.T) {
+	pd := newFakePD()
+	srv := httptest.NewServer(pd)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	src := &Source{ID: 1, Path: "dump.rdb", Size: 10}
+	client := &PDClient{url: srv.URL, client: srv.Client()}
+	originSchedulers, originConfig := pd.state()
+
+	cp, err := LoadCheckpoint(path, "ns", PartitionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Update(src, CheckpointWriting); err != nil {
+		t.Fatal(err)
+	}
+	l := &Lightning{cp: cp, pd: client}
+	if err := l.pauseSchedulers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	schedulers, cfg := pd.state()
+	if !reflect.DeepEqual(schedulers, []string{"label-scheduler"}) {
+		t.Errorf("paused schedulers leave %v running", schedulers)
+	}
+	for k, v := range map[string]float64{
+		"leader-schedule-limit": 12,
+		"region-schedule-limit": 2048,
+		"max-snapshot-count":    9,
+		"max-merge-region-keys": 0,
+		"max-merge-region-size": 0,
+	} {
+		if cfg[k] != v {
+			t.Errorf("paused %s is %v, expect %v", k, cfg[k], v)
+		}
+	}
+
+	// a crashed import pauses pd again from the saved settings
+	cp, err = LoadCheckpoint(path, "ns", PartitionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = &Lightning{cp: cp, pd: client}
+	if err := l.pauseSchedulers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if state := cp.PD(); state == nil || state.Config["leader-schedule-limit"] != float64(4) || len(state.Schedulers) != 3 {
+		t.Fatalf("saved pd settings %+v", state)
+	}
+
+	// restore is done with a config whose partition policy refuses the
+	// sources of the checkpoint
+	cfg2 := &conf.Import{CheckpointPath: path, NameSpace: "ns", Partition: PartitionDB,
+		PdAddrs: strings.TrimPrefix(srv.URL, "http://")}
+	if _, err := LoadCheckpoint(path, cfg2.NameSpace, cfg2.Partition); err == nil {
+		t.Fatal("expect the checkpoint to be refused with another partition policy")
+	}
+	if err := RestoreSchedulers(context.Background(), cfg2); err != nil {
+		t.Fatal(err)
+	}
+	schedulers, cfg = pd.state()
+	if !reflect.DeepEqual(schedulers, originSchedulers) || !reflect.DeepEqual(cfg, originConfig) {
+		t.Errorf("restored %v %v, expect %v %v", schedulers, cfg, originSchedulers, originConfig)
+	}
+	if state, err := LoadPDState(path); err != nil || state != nil {
+		t.Errorf("pd settings %+v left in the checkpoint, %v", state, err)
+	}
+	cp, err = LoadCheckpoint(path, "ns", PartitionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scp := cp.Source(src); scp.Status != CheckpointWriting || cp.PD() != nil {
+		t.Errorf("restore rewrote the checkpoint, source %+v", scp)
+	}
+
+	// nothing is left to restore
+	if err := RestoreSchedulers(context.Background(), cfg2); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,275 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// TouchedKeys are the keys the commands of an aof act on, per db. The keys of
+// the RDB preamble which are touched are replayed in memory, the others are
+// streamed as they are decoded
+type TouchedKeys struct {
+	db   int
+	keys map[int]map[string]struct{}
+	// flushed are the dbs emptied by FLUSHDB, all is set by FLUSHALL, every
+	// key of them is touched
+	flushed map[int]bool
+	all     bool
+}
+
+// NewTouchedKeys creates an empty set of touched keys
+func NewTouchedKeys() *TouchedKeys {
+	return &TouchedKeys{keys: make(map[int]map[string]struct{}), flushed: make(map[int]bool)}
+}
+
+// touch records the keys of a command
+func (t *TouchedKeys) touch(args [][]byte) {
+	switch strings.ToUpper(string(args[0])) {
+	case "SELECT":
+		if len(args) != 2 {
+			return
+		}
+		if n, err := parseInt(args[1]); err == nil && n >= 0 {
+			t.db = int(n)
+		}
+		return
+	case "FLUSHDB":
+		t.flushed[t.db] = true
+		return
+	case "FLUSHALL":
+		t.all = true
+		return
+	}
+	for _, key := range commandKeys(args) {
+		keys, ok := t.keys[t.db]
+		if !ok {
+			keys = make(map[string]struct{})
+			t.keys[t.db] = keys
+		}
+		keys[string(key)] = struct{}{}
+	}
+}
+
+// has tells whether key of db n is touched
+func (t *TouchedKeys) has(n int, key []byte) bool {
+	if t.all || t.flushed[n] {
+		return true
+	}
+	_, ok := t.keys[n][string(key)]
+	return ok
+}
+
+// hasPreamble tells whether the aof read by br starts with an RDB preamble
+func hasPreamble(br *bufio.Reader) bool {
+	head, _ := br.Peek(5)
+	return bytes.Equal(head, []byte("REDIS"))
+}
+
+// ScanAOF reads the aof in r and returns the keys touched by its commands, the
+// RDB preamble is decoded without keeping anything. Bulk strings longer than
+// maxBulk fail the scan
+func ScanAOF(r io.Reader, maxBulk int64) (*TouchedKeys, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	if hasPreamble(br) {
+		if err := rdb.Decode(br, rdb.NopDecoder{}); err != nil {
+			return nil, fmt.Errorf("decode rdb preamble: %v", err)
+		}
+	}
+	t := NewTouchedKeys()
+	rr := NewRespReader(br)
+	rr.SetMaxBulkLen(maxBulk)
+	var n int64
+	for {
+		args, err := rr.ReadCommand()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the replay discards a truncated command at the end too
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("command %d: %v", n+1, err)
+		}
+		n++
+		t.touch(args)
+	}
+}
+
+// preambleDecoder streams the objects of an RDB preamble to d, the objects
+// whose keys are touched are loaded into rp instead, all of them if touched
+// is nil. The idle time of the objects loaded into rp is dropped, the
+// commands have accessed them since
+type preambleDecoder struct {
+	d       rdb.Decoder
+	rp      *Replayer
+	touched *TouchedKeys
+	db      int
+	// idle is the idle time of the next object, set if hasIdle
+	idle    uint64
+	hasIdle bool
+	// replay is set while an object loaded into rp is decoded
+	replay bool
+}
+
+func newPreambleDecoder(d rdb.Decoder, rp *Replayer, touched *TouchedKeys) *preambleDecoder {
+	return &preambleDecoder{d: d, rp: rp, touched: touched}
+}
+
+// route returns the decoder of the object of key, which starts
+func (p *preambleDecoder) route(key []byte) rdb.Decoder {
+	p.replay = p.touched == nil || p.touched.has(p.db, key)
+	hasIdle := p.hasIdle
+	p.hasIdle = false
+	if p.replay {
+		return p.rp
+	}
+	if id, ok := p.d.(rdb.IdleDecoder); ok && hasIdle {
+		id.Idle(p.idle)
+	}
+	return p.d
+}
+
+// cur returns the decoder of the object being decoded
+func (p *preambleDecoder) cur() rdb.Decoder {
+	if p.replay {
+		return p.rp
+	}
+	return p.d
+}
+
+// StartRDB is called by DecodeAOF for d.
+func (p *preambleDecoder) StartRDB() {}
+
+// StartDatabase is called when database n starts.
+func (p *preambleDecoder) StartDatabase(n int) {
+	p.db = n
+	p.rp.StartDatabase(n)
+	p.d.StartDatabase(n)
+}
+
+// Aux field
+func (p *preambleDecoder) Aux(key, value []byte) {
+	p.d.Aux(key, value)
+}
+
+// ResizeDatabase hint
+func (p *preambleDecoder) ResizeDatabase(dbSize, expiresSize uint32) {
+	p.d.ResizeDatabase(dbSize, expiresSize)
+}
+
+// SlotInfo is passed on to d.
+func (p *preambleDecoder) SlotInfo(slot, size, expiresSize uint64) {
+	if sd, ok := p.d.(rdb.SlotInfoDecoder); ok {
+		sd.SlotInfo(slot, size, expiresSize)
+	}
+}
+
+// Idle is kept until the object it belongs to is routed.
+func (p *preambleDecoder) Idle(seconds uint64) {
+	p.idle, p.hasIdle = seconds, true
+}
+
+// ObjectInfo is passed on to d for the objects streamed to it.
+func (p *preambleDecoder) ObjectInfo(key []byte, typ rdb.ValueType, size int64) {
+	if od, ok := p.d.(rdb.ObjectInfoDecoder); ok && !p.replay {
+		od.ObjectInfo(key, typ, size)
+	}
+}
+
+// Set routes a string.
+func (p *preambleDecoder) Set(key, value []byte, expiry int64) {
+	p.route(key).Set(key, value, expiry)
+}
+
+// StartHash routes a hash.
+func (p *preambleDecoder) StartHash(key []byte, length, expiry int64) {
+	p.route(key).StartHash(key, length, expiry)
+}
+
+// Hset is called once for each field=value pair in a hash.
+func (p *preambleDecoder) Hset(key, field, value []byte) {
+	p.cur().Hset(key, field, value)
+}
+
+// EndHash is called when there are no more fields in a hash.
+func (p *preambleDecoder) EndHash(key []byte) {
+	p.cur().EndHash(key)
+}
+
+// StartSet routes a set.
+func (p *preambleDecoder) StartSet(key []byte, cardinality, expiry int64) {
+	p.route(key).StartSet(key, cardinality, expiry)
+}
+
+// Sadd is called once for each member of a set.
+func (p *preambleDecoder) Sadd(key, member []byte) {
+	p.cur().Sadd(key, member)
+}
+
+// EndSet is called when there are no more members in a set.
+func (p *preambleDecoder) EndSet(key []byte) {
+	p.cur().EndSet(key)
+}
+
+// StartList routes a list.
+func (p *preambleDecoder) StartList(key []byte, length, expiry int64) {
+	p.route(key).StartList(key, length, expiry)
+}
+
+// Rpush is called once for each value in a list.
+func (p *preambleDecoder) Rpush(key, value []byte) {
+	p.cur().Rpush(key, value)
+}
+
+// EndList is called when there are no more values in a list.
+func (p *preambleDecoder) EndList(key []byte) {
+	p.cur().EndList(key)
+}
+
+// StartZSet routes a sorted set.
+func (p *preambleDecoder) StartZSet(key []byte, cardinality, expiry int64) {
+	p.route(key).StartZSet(key, cardinality, expiry)
+}
+
+// Zadd is called once for each member of a sorted set.
+func (p *preambleDecoder) Zadd(key []byte, score float64, member []byte) {
+	p.cur().Zadd(key, score, member)
+}
+
+// EndZSet is called when there are no more members in a sorted set.
+func (p *preambleDecoder) EndZSet(key []byte) {
+	p.cur().EndZSet(key)
+}
+
+// Stream routes a stream, d drops it unless it decodes streams.
+func (p *preambleDecoder) Stream(key []byte, stream *rdb.Stream, expiry int64) {
+	if d := p.route(key); p.replay {
+		p.rp.Stream(key, stream, expiry)
+	} else if sd, ok := d.(rdb.StreamDecoder); ok {
+		sd.Stream(key, stream, expiry)
+	}
+}
+
+// Module routes a value of a module type, d drops it unless it decodes
+// module values.
+func (p *preambleDecoder) Module(key []byte, m *rdb.Module, expiry int64) {
+	if d := p.route(key); p.replay {
+		p.rp.Module(key, m, expiry)
+	} else if md, ok := d.(rdb.ModuleDecoder); ok {
+		md.Module(key, m, expiry)
+	}
+}
+
+// EndDatabase is called at the end of a database.
+func (p *preambleDecoder) EndDatabase(n int) {
+	p.d.EndDatabase(n)
+}
+
+// EndRDB is called by DecodeAOF for d.
+func (p *preambleDecoder) EndRDB() {}
@@ -0,0 +1,226 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb/util/codec"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// presplitSamples is the max number of keys of a class kept by the sampler
+const presplitSamples = 1 << 16
+
+// presplitBatch is the max number of keys a region is split by at once
+const presplitBatch = 1024
+
+type sampledKey struct {
+	key  []byte
+	size int64
+}
+
+// keyReservoir keeps a uniform sample of the kvs of a key class
+type keyReservoir struct {
+	seen int64
+	size int64
+	keys []sampledKey
+}
+
+// keySampler samples the kvs of the sources by key class
+type keySampler struct {
+	mu      sync.Mutex
+	l       *Lightning
+	rnd     *rand.Rand
+	classes [classExpire + 1]keyReservoir
+}
+
+func (s *keySampler) add(kvs []common.KvPair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pair := range kvs {
+		r := &s.classes[s.l.keyClass(pair.Key)]
+		size := int64(len(pair.Key) + len(pair.Val))
+		r.seen++
+		r.size += size
+		sk := sampledKey{key: append([]byte{}, pair.Key...), size: size}
+		if len(r.keys) < presplitSamples {
+			r.keys = append(r.keys, sk)
+		} else if i := s.rnd.Int63n(r.seen); i < presplitSamples {
+			r.keys[i] = sk
+		}
+	}
+	return nil
+}
+
+// splitKeys returns the sorted keys splitting the sampled kvs into about n
+// regions of the same size, each class gets regions by its share of the bytes
+func (s *keySampler) splitKeys(n int) [][]byte {
+	var total int64
+	for i := range s.classes {
+		total += s.classes[i].size
+	}
+	if total == 0 {
+		return nil
+	}
+	var keys [][]byte
+	for i := range s.classes {
+		r := &s.classes[i]
+		regions := int64(float64(n)*float64(r.size)/float64(total) + 0.5)
+		if regions < 2 {
+			continue
+		}
+		sort.Slice(r.keys, func(a, b int) bool { return bytes.Compare(r.keys[a].key, r.keys[b].key) < 0 })
+		var weight int64
+		for _, sk := range r.keys {
+			weight += sk.size
+		}
+		var sum int64
+		next := int64(1)
+		for _, sk := range r.keys {
+			sum += sk.size
+			if next < regions && sum*regions >= next*weight {
+				keys = append(keys, sk.key)
+				next++
+			}
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return bytes.Compare(keys[a], keys[b]) < 0 })
+	return keys
+}
+
+// sampleDecoder takes the objects of a replayed source even if the sample
+// ends before the source
+type sampleDecoder struct {
+	*RdbDecode
+}
+
+func (sampleDecoder) sample() {}
+
+// sample decodes the first presplit-sample bytes of the sources not written
+// yet and returns the split keys of presplit-regions regions. The nodes of a
+// cluster are not sampled, each open of their source costs a full sync.
+func (l *Lightning) sample(ctx context.Context) ([][]byte, error) {
+	s := &keySampler{l: l, rnd: rand.New(rand.NewSource(1))}
+	concurrency := l.cfg.SourceConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, src := range l.sources {
+		src := src
+		if l.cp.Source(src).Status != CheckpointPending {
+			continue
+		}
+		if src.Slots != nil {
+			zap.L().Info("skip sampling cluster node", zap.String("source", src.Path))
+			continue
+		}
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			defer func() { <-sem }()
+			f, err := src.Open(0)
+			if err != nil {
+				zap.L().Error("open source failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+			defer f.Close()
+			rd := NewRdbDecode(gctx, nil, l.cfg.NameSpace,
+				WithKVSink(s.add),
+				WithStream(l.cfg.Stream),
+				WithModule(l.cfg.Module, l.cfg.ModulePrefix, l.cfg.ModuleJSON),
+				WithListZip(l.cfg.ListZipLength, l.cfg.ListZipValue),
+				WithLayout(l.layout),
+				WithObjectID(l.cfg.ObjectID, l.cfg.ImportID),
+			)
+			in := &io.LimitedReader{R: f, N: l.presplitSample}
+			// the sample ends in the middle of the source
+			if err := l.decodeSource(gctx, src, in, nil, rd, sampleDecoder{rd}); err != nil && in.N > 0 {
+				zap.L().Error("sample source failed", zap.String("source", src.Path), zap.Error(err))
+				return err
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return s.splitKeys(l.cfg.PresplitRegions), nil
+}
+
+// presplit splits and scatters the regions of the namespace by the keys
+// sampled from the sources, so that the first ingests are spread over the
+// stores, the failures are logged and left to the split of the backend
+func (l *Lightning) presplit(ctx context.Context) error {
+	keys, err := l.sample(ctx)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	pdCli, err := pd.NewClientWithContext(ctx, []string{l.cfg.PdAddrs}, l.tls.ToPDSecurityOption())
+	if err != nil {
+		zap.L().Error("new pd client err", zap.Error(err))
+		return err
+	}
+	defer pdCli.Close()
+	cli := restore.NewSplitClient(pdCli, l.tls.TLSConfig())
+	var regions []*restore.RegionInfo
+	for len(keys) > 0 {
+		region, err := cli.GetRegion(ctx, codec.EncodeBytes(nil, keys[0]))
+		if err != nil || region == nil {
+			zap.L().Warn("get region failed, stop pre-split", zap.ByteString("key", keys[0]), zap.Error(err))
+			break
+		}
+		// the keys inside the region, a key at its start is split already
+		var batch [][]byte
+		n := 0
+		for ; n < len(keys) && len(batch) < presplitBatch; n++ {
+			encoded := codec.EncodeBytes(nil, keys[n])
+			if bytes.Equal(encoded, region.Region.GetStartKey()) {
+				continue
+			}
+			if !region.ContainsInterior(encoded) {
+				break
+			}
+			batch = append(batch, keys[n])
+		}
+		if n == 0 {
+			n = 1
+		}
+		keys = keys[n:]
+		if len(batch) == 0 {
+			continue
+		}
+		split, err := cli.BatchSplitRegions(ctx, region, batch)
+		if err != nil {
+			zap.L().Warn("split region failed", zap.Uint64("region", region.Region.GetId()),
+				zap.Int("keys", len(batch)), zap.Error(err))
+			continue
+		}
+		regions = append(regions, split...)
+	}
+	scattered := 0
+	for _, region := range regions {
+		if err := cli.ScatterRegion(ctx, region); err != nil {
+			zap.L().Warn("scatter region failed", zap.Uint64("region", region.Region.GetId()), zap.Error(err))
+			continue
+		}
+		scattered++
+	}
+	zap.L().Info("pre-split regions", zap.Int("regions", len(regions)), zap.Int("scattered", scattered))
+	return nil
+}
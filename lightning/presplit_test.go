@@ -0,0 +1,104 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+func TestSampleTruncatedReplay(t *testing.T) {
+	var resp, csv bytes.Buffer
+	csv.WriteString("key,type,value\n")
+	preamble := newRDB(9).selectDB(0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		fmt.Fprintf(&resp, "*3\r\n$3\r\nSET\r\n$5\r\n%s\r\n$1\r\nv\r\n", key)
+		fmt.Fprintf(&csv, "%s,string,v\n", key)
+		preamble.set(key, "v")
+	}
+	aof := preamble.end()
+	for _, c := range []struct {
+		format string
+		data   []byte
+	}{
+		{FormatRESP, resp.Bytes()},
+		{FormatCSV, csv.Bytes()},
+		{FormatAOF, aof},
+	} {
+		// the sample ends in the middle of a command, a row or the preamble
+		size := int64(len(c.data)/2 + 3)
+		l := &Lightning{cfg: &conf.Import{CommandError: CommandErrorFail, LineError: LineErrorFail}, maxBulk: DefaultMaxBulkLen}
+		data := c.data[:size]
+		src := &Source{Path: "source", Format: c.format, open: func(int64) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}}
+
+		rec := newKVRecorder()
+		rd := newTestDecode(rec)
+		in := &io.LimitedReader{R: bytes.NewReader(c.data), N: size}
+		if err := l.decodeSource(context.Background(), src, in, nil, rd, sampleDecoder{rd}); err == nil {
+			t.Errorf("%s: expect the truncated sample to fail", c.format)
+		}
+		if keys := rec.metaKeys("ns", 0); len(keys) < 40 || len(keys) > 60 {
+			t.Errorf("%s: sampled %d keys, expect about half of them", c.format, len(keys))
+		}
+
+		// the objects of a source failing on import are not written
+		rec = newKVRecorder()
+		rd = newTestDecode(rec)
+		in = &io.LimitedReader{R: bytes.NewReader(c.data), N: size}
+		l.decodeSource(context.Background(), src, in, nil, rd, rd)
+		if keys := rec.metaKeys("ns", 0); len(keys) != 0 {
+			t.Errorf("%s: truncated source imported %s", c.format, strings.Join(keys, ","))
+		}
+	}
+}
+
+func TestSampleSkipsClusterNodes(t *testing.T) {
+	c := startFakeCluster(t, false, [][2]int{{0, SlotCount - 1}})
+	defer c.Close()
+	c.nodes[0].rdb = newRDB(9).selectDB(0).set("node", "v").end()
+	dir, err := ioutil.TempDir("", "sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.rdb")
+	b := newRDB(9).selectDB(0)
+	for i := 0; i < 100; i++ {
+		b.set(fmt.Sprintf("key%02d", i), "v")
+	}
+	if err := ioutil.WriteFile(path, b.end(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &conf.Import{NameSpace: "ns", PresplitRegions: 4, Redis: conf.Redis{Timeout: 5 * time.Second}}
+	sources, err := ParseSources(path+","+RedisClusterScheme+c.nodes[0].ln.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(filepath.Join(dir, "checkpoint"), "ns", PartitionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Lightning{cfg: cfg, cp: cp, sources: sources, layout: DefaultLayout, presplitSample: 1 << 20}
+	keys, err := l.sample(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 {
+		t.Error("no split key sampled from the dump")
+	}
+	if c.nodes[0].syncs != 0 {
+		t.Errorf("cluster node synced %d times to be sampled", c.nodes[0].syncs)
+	}
+}
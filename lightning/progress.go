@@ -0,0 +1,128 @@
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const progressLogInterval = 30 * time.Second
+
+// SourceProgress is the progress of one source
+type SourceProgress struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	ReadBytes int64  `json:"read-bytes"`
+	Size      int64  `json:"size"`
+}
+
+// Progress tracks the bytes read from every source
+type Progress struct {
+	mu      sync.Mutex
+	sources map[string]*sourceProgress
+}
+
+type sourceProgress struct {
+	path   string
+	size   int64
+	read   int64
+	status atomic.Value
+}
+
+// NewProgress creates an empty progress tracker
+func NewProgress() *Progress {
+	return &Progress{sources: make(map[string]*sourceProgress)}
+}
+
+func (p *Progress) source(path string, size int64) *sourceProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sp, ok := p.sources[path]
+	if !ok {
+		sp = &sourceProgress{path: path, size: size}
+		sp.status.Store(CheckpointPending.String())
+		p.sources[path] = sp
+	} else if size != 0 {
+		// the size of a cluster source is only known once it is opened
+		atomic.StoreInt64(&sp.size, size)
+	}
+	return sp
+}
+
+// SetStatus updates the status of the source in path
+func (p *Progress) SetStatus(path string, size int64, status CheckpointStatus) {
+	sp := p.source(path, size)
+	sp.status.Store(status.String())
+	if status >= CheckpointClosed {
+		atomic.StoreInt64(&sp.read, atomic.LoadInt64(&sp.size))
+	}
+}
+
+// Reader counts the bytes read from r as the progress of the source in path,
+// offset is the number of bytes already read before r
+func (p *Progress) Reader(path string, size, offset int64, r io.Reader) io.Reader {
+	sp := p.source(path, size)
+	atomic.StoreInt64(&sp.read, offset)
+	return &progressReader{r: r, read: &sp.read}
+}
+
+// Snapshot returns the current progress of all sources ordered by path
+func (p *Progress) Snapshot() []SourceProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ps []SourceProgress
+	for _, sp := range p.sources {
+		ps = append(ps, SourceProgress{
+			Path:      sp.path,
+			Status:    sp.status.Load().(string),
+			ReadBytes: atomic.LoadInt64(&sp.read),
+			Size:      atomic.LoadInt64(&sp.size),
+		})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Path < ps[j].Path })
+	return ps
+}
+
+// ServeHTTP writes the progress snapshot as json
+func (p *Progress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.Snapshot()); err != nil {
+		zap.L().Error("write progress err", zap.Error(err))
+	}
+}
+
+// LogLoop logs the progress periodically until ctx is done
+func (p *Progress) LogLoop(ctx context.Context) {
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, sp := range p.Snapshot() {
+				zap.L().Info("import progress", zap.String("source", sp.Path),
+					zap.String("status", sp.Status), zap.Int64("read", sp.ReadBytes),
+					zap.Int64("size", sp.Size))
+			}
+		}
+	}
+}
+
+type progressReader struct {
+	r    io.Reader
+	read *int64
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	atomic.AddInt64(pr.read, int64(n))
+	return n, err
+}
@@ -0,0 +1,21 @@
+package lightning
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestProgressSizeKnownOnOpen(t *testing.T) {
+	p := NewProgress()
+	// a cluster source has no size until its dump is fetched
+	p.SetStatus("redis://node", 0, CheckpointPending)
+	if _, err := ioutil.ReadAll(p.Reader("redis://node", 10, 0, strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	p.SetStatus("redis://node", 0, CheckpointClosed)
+	ps := p.Snapshot()
+	if len(ps) != 1 || ps[0].Size != 10 || ps[0].ReadBytes != 10 {
+		t.Fatalf("unexpected progress %+v", ps)
+	}
+}
@@ -0,0 +1,89 @@
+package lightning
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// quotaCheckSize is the number of bytes written by a source between two
+// checks of the disk usage of sorted-dir
+const quotaCheckSize = 64 << 20
+
+// the engines are imported early once sorted-dir reaches quotaHigh percent of
+// the disk quota, until its usage is estimated to drop under quotaLow percent
+const (
+	quotaHigh = 90
+	quotaLow  = 70
+)
+
+// dirSize is the size of the files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the files of the engines cleaned up meanwhile
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// quotaDue reports whether the disk usage is to be checked against the quota
+func (es *engineSet) quotaDue() bool {
+	return es.l.diskQuota > 0 && es.written >= quotaCheckSize
+}
+
+// keepQuota imports the largest engines of the source and waits for the
+// imports, which removes their files, if sorted-dir approaches the disk quota.
+// The partitions of the imported engines go on in new engines, every kv is
+// written on its own so the members of a key may span several engines.
+func (es *engineSet) keepQuota() error {
+	es.written = 0
+	dir := es.l.cfg.Backend.SortedDir
+	size, err := dirSize(dir)
+	if err != nil {
+		zap.L().Error("get disk usage failed", zap.String("sorted-dir", dir), zap.Error(err))
+		return err
+	}
+	if size < es.l.diskQuota*quotaHigh/100 {
+		return nil
+	}
+	zap.L().Info("disk quota approached, import engines early", zap.String("source", es.src.Path),
+		zap.Int64("usage", size), zap.Int64("quota", es.l.diskQuota))
+	largest := make([]int32, 0, len(es.engines))
+	for part := range es.engines {
+		largest = append(largest, part)
+	}
+	sort.Slice(largest, func(i, j int) bool {
+		return es.engines[largest[i]].size > es.engines[largest[j]].size
+	})
+	for _, part := range largest {
+		if size < es.l.diskQuota*quotaLow/100 {
+			break
+		}
+		pe := es.engines[part]
+		delete(es.engines, part)
+		if err := es.retire(pe); err != nil {
+			return err
+		}
+		size -= pe.size
+	}
+	if err := es.drain(); err != nil {
+		return err
+	}
+	if size, err = dirSize(dir); err == nil && size >= es.l.diskQuota*quotaHigh/100 {
+		zap.L().Warn("disk quota exceeded by the engines of other sources", zap.String("source", es.src.Path),
+			zap.Int64("usage", size), zap.Int64("quota", es.l.diskQuota))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package lightning
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+func TestKeepQuota(t *testing.T) {
+	l, mem, dir := newTestEngineLightning(t, PartitionClass, ObjectIDRandom, "")
+	defer os.RemoveAll(dir)
+	src := &Source{ID: 1, Path: "dump.rdb"}
+	es := l.newEngineSet(context.Background(), src, 0, 0)
+	pair := func(key string, size int) []common.KvPair {
+		return []common.KvPair{{Key: []byte(key), Val: []byte(strings.Repeat("v", size-len(key)))}}
+	}
+	for _, kvs := range [][]common.KvPair{
+		pair("ns:000:M:a", 2000),
+		pair("ns:000:D:a", 6000),
+		pair(string(l.layout.ExpirePrefix)+"00000000:ns:000:M:a", 500),
+	} {
+		if err := es.write(kvs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, data, expire := es.engines[classMeta].id, es.engines[classData].id, es.engines[classExpire].id
+
+	// nothing is imported under the quota
+	l.diskQuota = 10000
+	es.written = quotaCheckSize
+	if err := es.write(pair("ns:000:M:b", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.engines) != 3 || es.written != 100 {
+		t.Fatalf("%d engines open, %d bytes written since the check", len(es.engines), es.written)
+	}
+
+	// the largest engine brings the usage under the low mark
+	l.diskQuota = 9000
+	es.written = quotaCheckSize
+	if err := es.write(pair("ns:000:D:b", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, imported := mem.engine(data); !imported {
+		t.Error("largest engine is not imported")
+	}
+	for _, id := range []int32{meta, expire} {
+		if _, imported := mem.engine(id); imported {
+			t.Errorf("engine %d imported", id)
+		}
+	}
+	if l.cp.Source(src).Engines[data] != CheckpointImported {
+		t.Error("imported engine is not recorded")
+	}
+	// the data keys go on in a new engine
+	pe := es.engines[classData]
+	if pe == nil || pe.id == data || pe.size != 100 {
+		t.Fatalf("data partition continues in %+v", pe)
+	}
+	if size, err := dirSize(dir); err != nil || size >= l.diskQuota*quotaLow/100 {
+		t.Errorf("sorted-dir holds %d bytes, %v", size, err)
+	}
+
+	if err := es.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.wait(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int32{meta, data, expire, pe.id} {
+		if _, imported := mem.engine(id); !imported {
+			t.Errorf("engine %d is not imported", id)
+		}
+	}
+	if kvs, _ := mem.engine(pe.id); len(kvs) != 1 || string(kvs[0].Key) != "ns:000:D:b" {
+		t.Errorf("new engine holds %v", kvs)
+	}
+}
@@ -0,0 +1,245 @@
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/nioshield/titan-lightning/conf"
+	"go.uber.org/zap"
+)
+
+// rateLimiter spaces out events at limit per second, a wait for more events
+// than the limit delays the following waits, 0 means no limit
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit float64
+	next  time.Time
+}
+
+// Limit returns the events allowed per second
+func (r *rateLimiter) Limit() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.limit
+}
+
+// SetLimit changes the events allowed per second, the waits already started
+// keep their delay and the events reserved beyond them are spaced at the new
+// limit
+func (r *rateLimiter) SetLimit(limit float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if ahead := r.next.Sub(now); ahead > 0 && r.limit > 0 && limit > 0 {
+		r.next = now.Add(time.Duration(float64(ahead) * r.limit / limit))
+	} else {
+		r.next = now
+	}
+	r.limit = limit
+}
+
+// Wait blocks until n events are allowed
+func (r *rateLimiter) Wait(ctx context.Context, n int64) error {
+	r.mu.Lock()
+	if r.limit <= 0 || n <= 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	at := r.next
+	if at.Before(now) {
+		at = now
+	}
+	r.next = at.Add(time.Duration(float64(n) / r.limit * float64(time.Second)))
+	r.mu.Unlock()
+	if d := at.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// RateLimits throttles the local writes and the ingest of the engines, the
+// limits can be changed while importing
+type RateLimits struct {
+	// upload is in bytes of the engines, ingest in regions of the engines
+	upload rateLimiter
+	ingest rateLimiter
+	// write is in bytes of kvs, writeOps in kvs
+	write    rateLimiter
+	writeOps rateLimiter
+
+	// regionSize is the size of the regions the engines are ingested in
+	regionSize int64
+	// engineSize is the max size of an engine, zero if the engines are not
+	// bounded, which leaves nothing to throttle the imports by
+	engineSize int64
+}
+
+// RateLimitConfig is the json of the rate limits, the rates are in bytes per
+// second with an optional unit and the ops are per second, 0 for unlimited.
+// Only the fields set are changed by an update.
+type RateLimitConfig struct {
+	UploadRate *string `json:"upload-rate,omitempty"`
+	IngestOps  *int    `json:"ingest-ops,omitempty"`
+	WriteRate  *string `json:"write-rate,omitempty"`
+	WriteOps   *int    `json:"write-ops,omitempty"`
+}
+
+// NewRateLimits returns the rate limits of the backend config, engineSize is
+// the max size of an engine, zero if unbounded
+func NewRateLimits(cfg *conf.Backend, engineSize int64) (*RateLimits, error) {
+	rl := &RateLimits{engineSize: engineSize}
+	var err error
+	if rl.regionSize, err = units.RAMInBytes(cfg.ReginSplitSize); err != nil {
+		return nil, err
+	}
+	err = rl.Update(&RateLimitConfig{
+		UploadRate: &cfg.UploadRate,
+		IngestOps:  &cfg.IngestOps,
+		WriteRate:  &cfg.WriteRate,
+		WriteOps:   &cfg.WriteOps,
+	})
+	return rl, err
+}
+
+// Update applies the fields set in c, nothing is changed if one is invalid
+func (rl *RateLimits) Update(c *RateLimitConfig) error {
+	parse := func(name string, rate *string) (float64, error) {
+		n, err := units.RAMInBytes(*rate)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("negative rate")
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q, %v", name, *rate, err)
+		}
+		return float64(n), nil
+	}
+	var upload, write float64
+	var err error
+	if c.UploadRate != nil {
+		if upload, err = parse("upload-rate", c.UploadRate); err != nil {
+			return err
+		}
+	}
+	if c.WriteRate != nil {
+		if write, err = parse("write-rate", c.WriteRate); err != nil {
+			return err
+		}
+	}
+	if c.IngestOps != nil && *c.IngestOps < 0 {
+		return fmt.Errorf("invalid ingest-ops %d", *c.IngestOps)
+	}
+	// the backend uploads and ingests a whole engine at once, the limits only
+	// hold if the engines are small
+	if rl.engineSize == 0 && (upload > 0 || (c.IngestOps != nil && *c.IngestOps > 0)) {
+		return fmt.Errorf("upload-rate and ingest-ops need partition = %q", PartitionSize)
+	}
+	if c.WriteOps != nil && *c.WriteOps < 0 {
+		return fmt.Errorf("invalid write-ops %d", *c.WriteOps)
+	}
+	if c.UploadRate != nil {
+		rl.upload.SetLimit(upload)
+	}
+	if c.IngestOps != nil {
+		rl.ingest.SetLimit(float64(*c.IngestOps))
+	}
+	if c.WriteRate != nil {
+		rl.write.SetLimit(write)
+	}
+	if c.WriteOps != nil {
+		rl.writeOps.SetLimit(float64(*c.WriteOps))
+	}
+	return nil
+}
+
+// Config returns the current rate limits
+func (rl *RateLimits) Config() *RateLimitConfig {
+	rate := func(r *rateLimiter) *string {
+		s := strconv.FormatInt(int64(r.Limit()), 10)
+		return &s
+	}
+	ops := func(r *rateLimiter) *int {
+		n := int(r.Limit())
+		return &n
+	}
+	return &RateLimitConfig{
+		UploadRate: rate(&rl.upload),
+		IngestOps:  ops(&rl.ingest),
+		WriteRate:  rate(&rl.write),
+		WriteOps:   ops(&rl.writeOps),
+	}
+}
+
+// WaitWrite blocks until kvs of size bytes may be written into an engine, a
+// change of the limits takes effect from the next batch of kvs
+func (rl *RateLimits) WaitWrite(ctx context.Context, kvs int, size int64) error {
+	if err := rl.writeOps.Wait(ctx, int64(kvs)); err != nil {
+		return err
+	}
+	return rl.write.Wait(ctx, size)
+}
+
+// EngineSize returns the size the engines of PartitionSize are cut at. The
+// backend uploads and ingests an engine at once, so while upload-rate or
+// ingest-ops is set an engine holds one region batch of regionSize bytes, and
+// partSize bytes otherwise.
+func (rl *RateLimits) EngineSize(partSize int64) int64 {
+	if rl.regionSize > 0 && rl.regionSize < partSize && (rl.upload.Limit() > 0 || rl.ingest.Limit() > 0) {
+		return rl.regionSize
+	}
+	return partSize
+}
+
+// WaitImport blocks until an engine of size bytes may be imported. The limits
+// space out the imports of the engines, which hold one region batch while the
+// imports are throttled, so a change takes effect from the next engine to
+// start its import, the imports already started keep their pace.
+func (rl *RateLimits) WaitImport(ctx context.Context, size int64) error {
+	regions := int64(1)
+	if rl.regionSize > 0 {
+		regions = int64(math.Ceil(float64(size) / float64(rl.regionSize)))
+	}
+	if err := rl.ingest.Wait(ctx, regions); err != nil {
+		return err
+	}
+	return rl.upload.Wait(ctx, size)
+}
+
+// ServeHTTP writes the rate limits as json, a POST or PUT updates the limits
+// set in its json body first
+func (rl *RateLimits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		c := &RateLimitConfig{}
+		err := json.NewDecoder(r.Body).Decode(c)
+		if err == nil {
+			err = rl.Update(c)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		zap.L().Info("rate limits updated", zap.Any("limits", rl.Config()))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rl.Config()); err != nil {
+		zap.L().Error("write rate limits err", zap.Error(err))
+	}
+}
@@ -0,0 +1,84 @@
+package lightning
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	r := &rateLimiter{}
+	r.SetLimit(10)
+	// the first wait returns at once and reserves 2s for the next ones
+	if err := r.Wait(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+	r.SetLimit(20)
+	if ahead := time.Until(r.next); ahead < 900*time.Millisecond || ahead > time.Second {
+		t.Errorf("%v reserved at twice the limit, expect 1s", ahead)
+	}
+	r.SetLimit(0)
+	if ahead := time.Until(r.next); ahead > 0 {
+		t.Errorf("%v reserved without a limit", ahead)
+	}
+}
+
+func TestRateLimitsNeedSmallEngines(t *testing.T) {
+	cfg := &conf.Backend{ReginSplitSize: "96M", UploadRate: "10M", WriteRate: "0"}
+	if _, err := NewRateLimits(cfg, 0); err == nil {
+		t.Error("expect an upload rate of unbounded engines to be refused")
+	}
+	cfg.UploadRate = "0"
+	rl, err := NewRateLimits(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := 10
+	if err := rl.Update(&RateLimitConfig{IngestOps: &ops}); err == nil {
+		t.Error("expect ingest ops of unbounded engines to be refused")
+	}
+	rate := "20M"
+	if err := rl.Update(&RateLimitConfig{WriteRate: &rate}); err != nil {
+		t.Errorf("write rate refused: %v", err)
+	}
+
+	if rl, err = NewRateLimits(cfg, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Update(&RateLimitConfig{UploadRate: &rate, IngestOps: &ops}); err != nil {
+		t.Fatal(err)
+	}
+	if c := rl.Config(); *c.UploadRate != "20971520" || *c.IngestOps != 10 {
+		t.Errorf("limits %s %d", *c.UploadRate, *c.IngestOps)
+	}
+}
+
+func TestEngineSize(t *testing.T) {
+	cfg := &conf.Backend{ReginSplitSize: "96M", UploadRate: "0", WriteRate: "10M"}
+	rl, err := NewRateLimits(cfg, 8<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := rl.EngineSize(8 << 30); size != 8<<30 {
+		t.Errorf("engines cut at %d without import limits", size)
+	}
+	ops := 10
+	if err := rl.Update(&RateLimitConfig{IngestOps: &ops}); err != nil {
+		t.Fatal(err)
+	}
+	if size := rl.EngineSize(8 << 30); size != 96<<20 {
+		t.Errorf("engines cut at %d while throttled, expect a region", size)
+	}
+	if size := rl.EngineSize(64 << 20); size != 64<<20 {
+		t.Errorf("engines smaller than a region cut at %d", size)
+	}
+	ops = 0
+	if err := rl.Update(&RateLimitConfig{IngestOps: &ops}); err != nil {
+		t.Fatal(err)
+	}
+	if size := rl.EngineSize(8 << 30); size != 8<<30 {
+		t.Errorf("engines cut at %d once the limits are lifted", size)
+	}
+}
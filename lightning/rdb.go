@@ -2,6 +2,9 @@ package lightning
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/distributedio/titan/db"
 	kv "github.com/pingcap/tidb-lightning/lightning/backend"
@@ -9,32 +12,203 @@ import (
 	"go.uber.org/zap"
 )
 
-func NewRdbDecode(ctx context.Context, w *kv.LocalEngineWriter, ns string) *RdbDecode {
-	return &RdbDecode{
-		ctx: ctx,
-		ns:  ns,
-		w:   w,
+// DecodeOption configures a RdbDecode
+type DecodeOption func(r *RdbDecode)
+
+// WithExistingKeys skips the objects whose meta key is in ek
+func WithExistingKeys(ek *ExistingKeys) DecodeOption {
+	return func(r *RdbDecode) {
+		r.keys = ek
+	}
+}
+
+// WithDuplicateDetector reports the keys of src which were already seen in
+// another source, the decode fails on the first one if abort is true
+func WithDuplicateDetector(dd *DuplicateDetector, src *Source, abort bool) DecodeOption {
+	return func(r *RdbDecode) {
+		r.dups = dd
+		r.src = src
+		r.dupAbort = abort
+	}
+}
+
+// WithKVSink passes the encoded kvs to sink instead of the engine writer
+func WithKVSink(sink func(kvs []common.KvPair) error) DecodeOption {
+	return func(r *RdbDecode) {
+		r.sink = sink
+	}
+}
+
+// WithIdleTime sets the update time of the objects to the time they were last
+// accessed, derived from their LRU idle time and the ctime of the dump
+func WithIdleTime(enable bool) DecodeOption {
+	return func(r *RdbDecode) {
+		r.idleTime = enable
+	}
+}
+
+// WithListZip imports the lists of at most maxLen elements, none longer than
+// maxValue bytes, in titan's compact ziplist encoding, a maxLen of zero keeps
+// every list in the linked list encoding
+func WithListZip(maxLen, maxValue int) DecodeOption {
+	return func(r *RdbDecode) {
+		r.zipLen = maxLen
+		r.zipValue = maxValue
+	}
+}
+
+// WithLayout encodes the objects in the layout l instead of DefaultLayout
+func WithLayout(l *Layout) DecodeOption {
+	return func(r *RdbDecode) {
+		r.layout = l
+	}
+}
+
+// NewRdbDecode creates a decoder encoding objects into titan kvs written into w
+func NewRdbDecode(ctx context.Context, w *kv.LocalEngineWriter, ns string, opts ...DecodeOption) *RdbDecode {
+	r := &RdbDecode{
+		ctx:    ctx,
+		ns:     ns,
+		w:      w,
+		nowTs:  time.Now().UnixNano() / int64(time.Millisecond),
+		idle:   -1,
+		layout: DefaultLayout,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 type RdbDecode struct {
-	ctx   context.Context
-	w     *kv.LocalEngineWriter
-	meta  Meta
-	db    *db.DB
-	ns    string
-	nowTs int64
+	ctx      context.Context
+	w        *kv.LocalEngineWriter
+	meta     Meta
+	db       *db.DB
+	ns       string
+	nowTs    int64
+	keys     *ExistingKeys
+	dups     *DuplicateDetector
+	src      *Source
+	dupAbort bool
+	sink     func(kvs []common.KvPair) error
+	stream   string
+	layout   *Layout
+	err      error
+
+	hashID bool
+	idKey  []byte
+
+	zipLen   int
+	zipValue int
+
+	idleTime bool
+	// idle is the idle time in seconds of the next object, -1 if unknown
+	idle int64
+	// ctime is the time in seconds the dump was written, zero if unknown
+	ctime int64
+
+	module         string
+	modulePrefix   string
+	moduleJSON     bool
+	skippedStreams int64
+	skippedModules map[string]int64
+}
+
+// Err returns the first error which makes the import incomplete
+func (r *RdbDecode) Err() error {
+	return r.err
 }
 
+// IsExpired reports whether the expiry in milliseconds has passed, zero means no expiry
 func (r *RdbDecode) IsExpired(expire int64) bool {
-	if expire > r.nowTs {
+	if expire == 0 || expire > r.nowTs {
 		return false
 	}
 	return true
 }
 
-func (r *RdbDecode) write(rows kv.Rows) error {
-	return r.w.WriteRows(r.ctx, nil, rows)
+// skip reports whether the object of key should not be imported
+func (r *RdbDecode) skip(key []byte) bool {
+	if r.err != nil {
+		return true
+	}
+	if r.dups != nil {
+		prev, ok, err := r.dups.Add(int(r.db.ID), key, r.src.ID)
+		if err != nil {
+			zap.L().Error("lookup duplicate key err", zap.String("key", string(key)), zap.Error(err))
+			r.err = err
+			return true
+		}
+		if ok {
+			zap.L().Warn("duplicate key", zap.String("key", string(key)), zap.Int("db", int(r.db.ID)),
+				zap.String("source", r.src.Path), zap.Int32("engine", prev))
+			if r.dupAbort {
+				r.err = fmt.Errorf("duplicate key %s of db %d in %s", key, r.db.ID, r.src.Path)
+				return true
+			}
+		}
+	}
+	if r.keys == nil {
+		return false
+	}
+	exist, err := r.keys.Exists(db.MetaKey(r.db, key))
+	if err != nil {
+		zap.L().Error("lookup existing key err", zap.String("key", string(key)), zap.Error(err))
+		r.err = err
+		return true
+	}
+	if exist {
+		zap.L().Debug("skip existing key", zap.String("key", string(key)))
+	}
+	return exist
+}
+
+// accessedAt returns the time in nanoseconds the next object was last
+// accessed, zero if unknown. The idle time is consumed by the call.
+func (r *RdbDecode) accessedAt() int64 {
+	idle := r.idle
+	r.idle = -1
+	if !r.idleTime || idle < 0 {
+		return 0
+	}
+	base := r.ctime
+	if base == 0 {
+		base = r.nowTs / 1000
+	}
+	return (base - idle) * int64(time.Second)
+}
+
+// touch sets the timestamps of obj to at if it is known, an object is never
+// created after its last access
+func touch(obj *db.Object, at int64) {
+	if at > 0 {
+		obj.CreatedAt = at
+		obj.UpdatedAt = at
+	}
+}
+
+// Idle records the idle time of the next object
+func (r *RdbDecode) Idle(seconds uint64) {
+	r.idle = int64(seconds)
+}
+
+// write writes kvs, the first error fails the source and nothing is written
+// after it
+func (r *RdbDecode) write(kvs []common.KvPair) error {
+	if r.err != nil {
+		return nil
+	}
+	var err error
+	if r.sink != nil {
+		err = r.sink(kvs)
+	} else {
+		err = r.w.WriteRows(r.ctx, nil, kv.MakeRowsFromKvPairs(kvs))
+	}
+	if err != nil {
+		r.err = err
+	}
+	return err
 }
 
 // StartRDB is called when parsing of a valid RDB file starts.
@@ -54,29 +228,42 @@ func (r *RdbDecode) StartDatabase(n int) {
 }
 
 // AUX field
-func (r *RdbDecode) Aux(key, value []byte) {}
+func (r *RdbDecode) Aux(key, value []byte) {
+	if string(key) != "ctime" {
+		return
+	}
+	ctime, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		zap.L().Warn("invalid ctime aux field", zap.String("value", string(value)))
+		return
+	}
+	r.ctime = ctime
+}
 
 // ResizeDB hint
 func (r *RdbDecode) ResizeDatabase(dbSize, expiresSize uint32) {}
 
 // Set is called once for each string key.
 func (r *RdbDecode) Set(key, value []byte, expiry int64) {
-	if r.IsExpired(expiry) {
+	at := r.accessedAt()
+	if r.IsExpired(expiry) || r.skip(key) {
 		return
 	}
 	meta := NewStringMeta()
+	meta.ID = r.objectID(key)
+	touch(&meta.Object, at)
 	meta.Value = value
 	metaKey := db.MetaKey(r.db, key)
 	var kvs []common.KvPair
 	if expiry > 0 {
 		meta.Object.ExpireAt = expiry
-		if ekey, err := ExpireKey(metaKey, expiry); err == nil {
+		if ekey, err := r.layout.ExpireKey(metaKey, expiry); err == nil {
 			kvs = append(kvs, common.KvPair{Key: ekey, Val: meta.ID})
 		}
 	}
 
-	kvs = append(kvs, common.KvPair{Key: metaKey, Val: meta.Encode()})
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	kvs = append(kvs, common.KvPair{Key: metaKey, Val: r.layout.EncodeMeta(meta)})
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write string err", zap.String("key", string(key)), zap.Error(err))
 	}
 }
@@ -84,11 +271,18 @@ func (r *RdbDecode) Set(key, value []byte, expiry int64) {
 // StartHash is called at the beginning of a hash.
 // Hset will be called exactly length times before EndHash.
 func (r *RdbDecode) StartHash(key []byte, length, expiry int64) {
+	r.meta = nil
+	at := r.accessedAt()
 	if r.IsExpired(expiry) {
 		zap.L().Info("hash key expired", zap.String("key", string(key)))
 		return
 	}
+	if r.skip(key) {
+		return
+	}
 	meta := NewHashMeta()
+	meta.ID = r.objectID(key)
+	touch(&meta.Object, at)
 	if expiry > 0 {
 		meta.Object.ExpireAt = expiry
 	}
@@ -104,9 +298,10 @@ func (r *RdbDecode) Hset(key, field, value []byte) {
 	var kvs []common.KvPair
 	kvs = append(kvs, common.KvPair{Key: HashItemKey(r.db, meta, field), Val: value})
 
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write hash iter err", zap.String("key", string(key)), zap.Error(err))
 	}
+	meta.Len++
 }
 
 // EndHash is called when there are no more fields in a hash.
@@ -117,14 +312,14 @@ func (r *RdbDecode) EndHash(key []byte) {
 	meta := r.meta.(*HashMeta)
 	metaKey := db.MetaKey(r.db, key)
 	var kvs []common.KvPair
-	kvs = append(kvs, common.KvPair{Key: metaKey, Val: meta.Encode()})
+	kvs = append(kvs, common.KvPair{Key: metaKey, Val: r.layout.EncodeMeta(meta)})
 	if meta.ExpireAt > 0 {
-		if ekey, err := ExpireKey(metaKey, meta.ExpireAt); err == nil {
+		if ekey, err := r.layout.ExpireKey(metaKey, meta.ExpireAt); err == nil {
 			kvs = append(kvs, common.KvPair{Key: ekey, Val: meta.ID})
 		}
 	}
 
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write hash meta err", zap.String("key", string(key)), zap.Error(err))
 	}
 }
@@ -132,10 +327,14 @@ func (r *RdbDecode) EndHash(key []byte) {
 // StartSet is called at the beginning of a set.
 // Sadd will be called exactly cardinality times before EndSet.
 func (r *RdbDecode) StartSet(key []byte, cardinality, expiry int64) {
-	if r.IsExpired(expiry) {
+	r.meta = nil
+	at := r.accessedAt()
+	if r.IsExpired(expiry) || r.skip(key) {
 		return
 	}
 	meta := NewSetMeta()
+	meta.ID = r.objectID(key)
+	touch(&meta.Object, at)
 	if expiry > 0 {
 		meta.Object.ExpireAt = expiry
 	}
@@ -150,7 +349,7 @@ func (r *RdbDecode) Sadd(key, member []byte) {
 	meta := r.meta.(*SetMeta)
 	var kvs []common.KvPair
 	kvs = append(kvs, common.KvPair{Key: SetItemKey(r.db, meta, member), Val: db.SetNilValue})
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write set iter err", zap.String("key", string(key)), zap.Error(err))
 	}
 	meta.Len += 1
@@ -165,13 +364,13 @@ func (r *RdbDecode) EndSet(key []byte) {
 	meta := r.meta.(*SetMeta)
 	metaKey := db.MetaKey(r.db, key)
 	var kvs []common.KvPair
-	kvs = append(kvs, common.KvPair{Key: metaKey, Val: meta.Encode()})
+	kvs = append(kvs, common.KvPair{Key: metaKey, Val: r.layout.EncodeMeta(meta)})
 	if meta.ExpireAt > 0 {
-		if ekey, err := ExpireKey(metaKey, meta.ExpireAt); err == nil {
+		if ekey, err := r.layout.ExpireKey(metaKey, meta.ExpireAt); err == nil {
 			kvs = append(kvs, common.KvPair{Key: ekey, Val: meta.ID})
 		}
 	}
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write set meta err", zap.String("key", string(key)), zap.Error(err))
 	}
 
@@ -181,10 +380,26 @@ func (r *RdbDecode) EndSet(key []byte) {
 // Rpush will be called exactly length times before EndList.
 // If length of the list is not known, then length is -1
 func (r *RdbDecode) StartList(key []byte, length, expiry int64) {
-	if r.IsExpired(expiry) {
+	r.meta = nil
+	at := r.accessedAt()
+	if r.IsExpired(expiry) || r.skip(key) {
+		return
+	}
+	// a list of unknown length, such as a quicklist, is held as a ziplist
+	// until it outgrows one
+	if r.zipLen > 0 && length <= int64(r.zipLen) {
+		meta := NewZListMeta()
+		meta.ID = r.objectID(key)
+		touch(&meta.Object, at)
+		if expiry > 0 {
+			meta.Object.ExpireAt = expiry
+		}
+		r.meta = meta
 		return
 	}
 	meta := NewLListMeta()
+	meta.ID = r.objectID(key)
+	touch(&meta.Object, at)
 	if expiry > 0 {
 		meta.Object.ExpireAt = expiry
 	}
@@ -193,10 +408,27 @@ func (r *RdbDecode) StartList(key []byte, length, expiry int64) {
 
 // Rpush is called once for each value in a list.
 func (r *RdbDecode) Rpush(key, value []byte) {
-	if r.meta == nil {
-		return
+	switch meta := r.meta.(type) {
+	case *ZListMeta:
+		if len(value) <= r.zipValue && len(meta.Values) < r.zipLen {
+			meta.Values = append(meta.Values, value)
+			return
+		}
+		// too large or too long for a ziplist, write the elements held so far as a linked list
+		lmeta := NewLListMeta()
+		lmeta.Object = meta.Object
+		lmeta.Object.Encoding = db.ObjectEncodingLinkedlist
+		r.meta = lmeta
+		for _, v := range meta.Values {
+			r.rpush(key, lmeta, v)
+		}
+		r.rpush(key, lmeta, value)
+	case *LListMeta:
+		r.rpush(key, meta, value)
 	}
-	meta := r.meta.(*LListMeta)
+}
+
+func (r *RdbDecode) rpush(key []byte, meta *LListMeta, value []byte) {
 	meta.Rindex++
 	iterKey, err := LListItemKey(r.db, meta, meta.Rindex)
 	if err != nil {
@@ -208,27 +440,34 @@ func (r *RdbDecode) Rpush(key, value []byte) {
 	}
 	var kvs []common.KvPair
 	kvs = append(kvs, common.KvPair{Key: iterKey, Val: value})
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write set iter err", zap.String("key", string(key)), zap.Error(err))
 	}
-	meta.Len += 1
 }
 
 // EndList is called when there are no more values in a list.
 func (r *RdbDecode) EndList(key []byte) {
-	if r.meta == nil {
+	var obj *db.Object
+	switch meta := r.meta.(type) {
+	case *ZListMeta:
+		if len(meta.Values) == 0 {
+			return
+		}
+		obj = &meta.Object
+	case *LListMeta:
+		obj = &meta.Object
+	default:
 		return
 	}
-	meta := r.meta.(*LListMeta)
 	metaKey := db.MetaKey(r.db, key)
 	var kvs []common.KvPair
-	kvs = append(kvs, common.KvPair{Key: metaKey, Val: meta.Encode()})
-	if meta.ExpireAt > 0 {
-		if ekey, err := ExpireKey(key, meta.ExpireAt); err == nil {
-			kvs = append(kvs, common.KvPair{Key: ekey, Val: meta.ID})
+	kvs = append(kvs, common.KvPair{Key: metaKey, Val: r.layout.EncodeMeta(r.meta)})
+	if obj.ExpireAt > 0 {
+		if ekey, err := r.layout.ExpireKey(metaKey, obj.ExpireAt); err == nil {
+			kvs = append(kvs, common.KvPair{Key: ekey, Val: obj.ID})
 		}
 	}
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write llist meta err", zap.String("key", string(key)), zap.Error(err))
 	}
 }
@@ -236,10 +475,14 @@ func (r *RdbDecode) EndList(key []byte) {
 // StartZSet is called at the beginning of a sorted set.
 // Zadd will be called exactly cardinality times before EndZSet.
 func (r *RdbDecode) StartZSet(key []byte, cardinality, expiry int64) {
-	if r.IsExpired(expiry) {
+	r.meta = nil
+	at := r.accessedAt()
+	if r.IsExpired(expiry) || r.skip(key) {
 		return
 	}
 	meta := NewZSetMeta()
+	meta.ID = r.objectID(key)
+	touch(&meta.Object, at)
 	if expiry > 0 {
 		meta.Object.ExpireAt = expiry
 	}
@@ -254,7 +497,7 @@ func (r *RdbDecode) Zadd(key []byte, score float64, member []byte) {
 	}
 	meta := r.meta.(*ZSetMeta)
 	dkey := db.DataKey(r.db, meta.ID)
-	iterKey := ZsetItemKey(dkey, member)
+	iterKey := r.layout.ZSetMemberKey(dkey, member)
 	bytesScore, err := db.EncodeFloat64(score)
 	if err != nil {
 		zap.L().Info("write zset encode score err", zap.Error(err))
@@ -262,10 +505,10 @@ func (r *RdbDecode) Zadd(key []byte, score float64, member []byte) {
 	}
 	var kvs []common.KvPair
 	kvs = append(kvs, common.KvPair{Key: iterKey, Val: bytesScore})
-	scoreKey := ZsetScoreKey(dkey, bytesScore, member)
+	scoreKey := r.layout.ZSetScoreKey(dkey, bytesScore, member)
 	kvs = append(kvs, common.KvPair{Key: scoreKey, Val: db.NilValue})
 
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write zset iter err", zap.String("key", string(key)), zap.Error(err))
 	}
 
@@ -280,13 +523,13 @@ func (r *RdbDecode) EndZSet(key []byte) {
 	meta := r.meta.(*ZSetMeta)
 	metaKey := db.MetaKey(r.db, key)
 	var kvs []common.KvPair
-	kvs = append(kvs, common.KvPair{Key: metaKey, Val: meta.Encode()})
+	kvs = append(kvs, common.KvPair{Key: metaKey, Val: r.layout.EncodeMeta(meta)})
 	if meta.ExpireAt > 0 {
-		if ekey, err := ExpireKey(metaKey, meta.ExpireAt); err == nil {
+		if ekey, err := r.layout.ExpireKey(metaKey, meta.ExpireAt); err == nil {
 			kvs = append(kvs, common.KvPair{Key: ekey, Val: meta.ID})
 		}
 	}
-	if err := r.write(kv.MakeRowsFromKvPairs(kvs)); err != nil {
+	if err := r.write(kvs); err != nil {
 		zap.L().Error("write zset meta err", zap.String("key", string(key)), zap.Error(err))
 	}
 }
@@ -296,4 +539,10 @@ func (r *RdbDecode) EndDatabase(n int) {}
 
 // EndRDB is called when parsing of the RDB file is complete.
 func (r *RdbDecode) EndRDB() {
+	if r.skippedStreams > 0 {
+		zap.L().Warn("streams skipped", zap.Int64("count", r.skippedStreams))
+	}
+	for name, n := range r.skippedModules {
+		zap.L().Warn("module values skipped", zap.String("module", name), zap.Int64("count", n))
+	}
 }
@@ -0,0 +1,51 @@
+package lightning
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestListZipEncoding(t *testing.T) {
+	big := strings.Repeat("v", 20)
+	dump := newRDB(11).selectDB(0).
+		list("linked", "a", "b").
+		quicklist("short", "a", "b", "c").
+		quicklist("long", "a", "b", "c", "d").
+		quicklist("big", "a", big).
+		end()
+	rec := newKVRecorder()
+	if err := rdb.Decode(bytes.NewReader(dump), newTestDecode(rec, WithListZip(3, 16))); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string][]string{"linked": {"a", "b"}, "short": {"a", "b", "c"}} {
+		_, val := rec.meta("ns", 0, key)
+		meta := &ZListMeta{}
+		if err := meta.Decode(val); err != nil {
+			t.Fatalf("list %s is not a ziplist: %v", key, err)
+		}
+		var got []string
+		for _, v := range meta.Values {
+			got = append(got, string(v))
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("ziplist %s holds %v, expect %v", key, got, want)
+		}
+	}
+	for key, n := range map[string]int64{"long": 4, "big": 2} {
+		obj, val := rec.meta("ns", 0, key)
+		if obj == nil || obj.Encoding != db.ObjectEncodingLinkedlist {
+			t.Fatalf("list %s is not a linked list: %v", key, obj)
+		}
+		meta := &LListMeta{}
+		if err := meta.Decode(val); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Len != n {
+			t.Errorf("linked list %s has length %d, expect %d", key, meta.Len, n)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"sort"
+	"sync"
+
+	"github.com/distributedio/titan/db"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// rdbBuilder writes the RDB files of the tests, the checksum is zero, which
+// disables its verification
+type rdbBuilder struct {
+	bytes.Buffer
+}
+
+func newRDB(version int) *rdbBuilder {
+	b := &rdbBuilder{}
+	fmt.Fprintf(b, "REDIS%04d", version)
+	return b
+}
+
+func (b *rdbBuilder) length(n int) {
+	switch {
+	case n < 1<<6:
+		b.WriteByte(byte(n))
+	case n < 1<<14:
+		b.WriteByte(byte(n>>8) | 0x40)
+		b.WriteByte(byte(n))
+	default:
+		b.WriteByte(0x80)
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(n))
+		b.Write(buf[:])
+	}
+}
+
+func (b *rdbBuilder) str(s []byte) {
+	b.length(len(s))
+	b.Write(s)
+}
+
+func (b *rdbBuilder) aux(key, val string) *rdbBuilder {
+	b.WriteByte(0xfa)
+	b.str([]byte(key))
+	b.str([]byte(val))
+	return b
+}
+
+func (b *rdbBuilder) selectDB(n int) *rdbBuilder {
+	b.WriteByte(0xfe)
+	b.length(n)
+	return b
+}
+
+func (b *rdbBuilder) set(key, val string) *rdbBuilder {
+	b.WriteByte(0)
+	b.str([]byte(key))
+	b.str([]byte(val))
+	return b
+}
+
+// expireAt writes the expiry in unix milliseconds of the next object
+func (b *rdbBuilder) expireAt(ms int64) *rdbBuilder {
+	b.WriteByte(0xfc)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	b.Write(buf[:])
+	return b
+}
+
+// idle writes the LRU idle time of the next object
+func (b *rdbBuilder) idle(seconds int) *rdbBuilder {
+	b.WriteByte(0xf8)
+	b.length(seconds)
+	return b
+}
+
+// list writes a list of the linked list encoding, which the decoder reports
+// with its length
+func (b *rdbBuilder) list(key string, vals ...string) *rdbBuilder {
+	b.WriteByte(1)
+	b.str([]byte(key))
+	b.length(len(vals))
+	for _, v := range vals {
+		b.str([]byte(v))
+	}
+	return b
+}
+
+// quicklist writes a list of the quicklist2 encoding with a plain node per
+// element, which the decoder reports without a length
+func (b *rdbBuilder) quicklist(key string, vals ...string) *rdbBuilder {
+	b.WriteByte(18)
+	b.str([]byte(key))
+	b.length(len(vals))
+	for _, v := range vals {
+		b.length(1)
+		b.str([]byte(v))
+	}
+	return b
+}
+
+// stream writes an empty stream of the first listpacks encoding, whose last
+// id is ms-0
+func (b *rdbBuilder) stream(key string, ms int) *rdbBuilder {
+	b.WriteByte(15)
+	b.str([]byte(key))
+	// no listpacks, the length, the last id and no groups
+	b.length(0)
+	b.length(0)
+	b.length(ms)
+	b.length(0)
+	b.length(0)
+	return b
+}
+
+func (b *rdbBuilder) end() []byte {
+	b.WriteByte(0xff)
+	b.Write(make([]byte, 8))
+	return b.Bytes()
+}
+
+// endSum ends the file with its checksum, which the decoder verifies
+func (b *rdbBuilder) endSum() []byte {
+	b.WriteByte(0xff)
+	tab := crc64.MakeTable(0x95ac9329ac4bc9b5)
+	var crc uint64
+	for _, c := range b.Bytes() {
+		crc = tab[byte(crc)^c] ^ (crc >> 8)
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], crc)
+	b.Write(buf[:])
+	return b.Bytes()
+}
+
+// kvRecorder collects the kvs encoded by a RdbDecode
+type kvRecorder struct {
+	mu  sync.Mutex
+	kvs map[string][]byte
+}
+
+func newKVRecorder() *kvRecorder {
+	return &kvRecorder{kvs: make(map[string][]byte)}
+}
+
+func (rec *kvRecorder) add(kvs []common.KvPair) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, pair := range kvs {
+		rec.kvs[string(pair.Key)] = pair.Val
+	}
+	return nil
+}
+
+// metaKeys returns the user keys of the objects of db n in ns, sorted
+func (rec *kvRecorder) metaKeys(ns string, n int) []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	prefix := string(db.MetaKey(&db.DB{Namespace: ns, ID: db.DBID(n)}, nil))
+	var keys []string
+	for k := range rec.kvs {
+		if len(k) > len(prefix) && k[:len(prefix)] == prefix {
+			keys = append(keys, k[len(prefix):])
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (rec *kvRecorder) meta(ns string, n int, key string) (*db.Object, []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	val, ok := rec.kvs[string(db.MetaKey(&db.DB{Namespace: ns, ID: db.DBID(n)}, []byte(key)))]
+	if !ok {
+		return nil, nil
+	}
+	obj, err := db.DecodeObject(val)
+	if err != nil {
+		return nil, nil
+	}
+	return obj, val
+}
+
+func newTestDecode(rec *kvRecorder, opts ...DecodeOption) *RdbDecode {
+	return NewRdbDecode(context.Background(), nil, "ns", append([]DecodeOption{WithKVSink(rec.add)}, opts...)...)
+}
@@ -0,0 +1,1146 @@
+package lightning
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+var (
+	errWrongType = errors.New("operation against a key holding the wrong kind of value")
+	errNoSuchKey = errors.New("no such key")
+	errSyntax    = errors.New("syntax error")
+	errNotInt    = errors.New("value is not an integer or out of range")
+	errNotFloat  = errors.New("value is not a valid float")
+)
+
+// Replayer folds redis write commands into the final state of every key, the
+// whole dataset is kept in memory until it is emitted. It is also a rdb
+// decoder, so that the keys of a snapshot can be loaded before the commands
+// are replayed, streams and module values are kept as they are decoded and
+// only commands acting on any key, like DEL or EXPIRE, apply to them.
+type Replayer struct {
+	db  int
+	dbs map[int]map[string]*replayObject
+	// cur is the object being loaded from a snapshot
+	cur *replayObject
+}
+
+// NewReplayer creates an empty replayer
+func NewReplayer() *Replayer {
+	return &Replayer{dbs: make(map[int]map[string]*replayObject)}
+}
+
+type replayObject struct {
+	typ    rdb.ValueType
+	expiry int64 // unix time in milliseconds, 0 for no expiry
+	str    []byte
+	hash   map[string][]byte
+	set    map[string]struct{}
+	list   replayList
+	zset   map[string]float64
+	stream *rdb.Stream
+	module *rdb.Module
+}
+
+func newReplayObject(typ rdb.ValueType, size int) *replayObject {
+	obj := &replayObject{typ: typ}
+	switch typ {
+	case rdb.TypeHash:
+		obj.hash = make(map[string][]byte, size)
+	case rdb.TypeSet:
+		obj.set = make(map[string]struct{}, size)
+	case rdb.TypeZSet:
+		obj.zset = make(map[string]float64, size)
+	}
+	return obj
+}
+
+func (obj *replayObject) len() int {
+	switch obj.typ {
+	case rdb.TypeHash:
+		return len(obj.hash)
+	case rdb.TypeSet:
+		return len(obj.set)
+	case rdb.TypeList:
+		return obj.list.len()
+	case rdb.TypeZSet:
+		return len(obj.zset)
+	}
+	return 1
+}
+
+// replayList is a deque, head holds the elements pushed on the left in reverse order
+type replayList struct {
+	head [][]byte
+	tail [][]byte
+}
+
+func (l *replayList) len() int {
+	return len(l.head) + len(l.tail)
+}
+
+func (l *replayList) lpush(v []byte) {
+	l.head = append(l.head, v)
+}
+
+func (l *replayList) rpush(v []byte) {
+	l.tail = append(l.tail, v)
+}
+
+func (l *replayList) lpop() []byte {
+	var v []byte
+	if n := len(l.head); n > 0 {
+		v, l.head = l.head[n-1], l.head[:n-1]
+	} else if len(l.tail) > 0 {
+		v, l.tail = l.tail[0], l.tail[1:]
+	}
+	return v
+}
+
+func (l *replayList) rpop() []byte {
+	var v []byte
+	if n := len(l.tail); n > 0 {
+		v, l.tail = l.tail[n-1], l.tail[:n-1]
+	} else if len(l.head) > 0 {
+		v, l.head = l.head[0], l.head[1:]
+	}
+	return v
+}
+
+// flatten moves all the elements into tail, so they can be indexed
+func (l *replayList) flatten() [][]byte {
+	if len(l.head) > 0 {
+		all := make([][]byte, 0, l.len())
+		for i := len(l.head) - 1; i >= 0; i-- {
+			all = append(all, l.head[i])
+		}
+		l.head, l.tail = nil, append(all, l.tail...)
+	}
+	return l.tail
+}
+
+func (r *Replayer) keys() map[string]*replayObject {
+	objs, ok := r.dbs[r.db]
+	if !ok {
+		objs = make(map[string]*replayObject)
+		r.dbs[r.db] = objs
+	}
+	return objs
+}
+
+// lookup returns the object of key, a new one is created if create is true
+func (r *Replayer) lookup(key []byte, typ rdb.ValueType, create bool) (*replayObject, error) {
+	objs := r.keys()
+	obj, ok := objs[string(key)]
+	if ok {
+		if obj.typ != typ {
+			return nil, errWrongType
+		}
+		return obj, nil
+	}
+	if !create {
+		return nil, nil
+	}
+	obj = newReplayObject(typ, 0)
+	objs[string(key)] = obj
+	return obj, nil
+}
+
+// removeEmpty deletes the collection of key once its last member is removed
+func (r *Replayer) removeEmpty(key []byte, obj *replayObject) {
+	if obj != nil && obj.len() == 0 {
+		delete(r.keys(), string(key))
+	}
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// StartRDB is called when parsing of a valid RDB file starts.
+func (r *Replayer) StartRDB() {}
+
+// StartDatabase is called when database n starts.
+func (r *Replayer) StartDatabase(n int) {
+	r.db = n
+}
+
+// Aux field
+func (r *Replayer) Aux(key, value []byte) {}
+
+// ResizeDatabase hint
+func (r *Replayer) ResizeDatabase(dbSize, expiresSize uint32) {}
+
+// Set loads a string of the snapshot.
+func (r *Replayer) Set(key, value []byte, expiry int64) {
+	obj := newReplayObject(rdb.TypeString, 0)
+	obj.str, obj.expiry = value, expiry
+	r.keys()[string(key)] = obj
+}
+
+func (r *Replayer) start(key []byte, typ rdb.ValueType, size, expiry int64) {
+	r.cur = newReplayObject(typ, int(size))
+	r.cur.expiry = expiry
+	r.keys()[string(key)] = r.cur
+}
+
+// StartHash loads a hash of the snapshot.
+func (r *Replayer) StartHash(key []byte, length, expiry int64) {
+	r.start(key, rdb.TypeHash, length, expiry)
+}
+
+// Hset loads a field of the hash.
+func (r *Replayer) Hset(key, field, value []byte) {
+	r.cur.hash[string(field)] = value
+}
+
+// EndHash is called when there are no more fields in a hash.
+func (r *Replayer) EndHash(key []byte) {
+	r.cur = nil
+}
+
+// StartSet loads a set of the snapshot.
+func (r *Replayer) StartSet(key []byte, cardinality, expiry int64) {
+	r.start(key, rdb.TypeSet, cardinality, expiry)
+}
+
+// Sadd loads a member of the set.
+func (r *Replayer) Sadd(key, member []byte) {
+	r.cur.set[string(member)] = struct{}{}
+}
+
+// EndSet is called when there are no more members in a set.
+func (r *Replayer) EndSet(key []byte) {
+	r.cur = nil
+}
+
+// StartList loads a list of the snapshot.
+func (r *Replayer) StartList(key []byte, length, expiry int64) {
+	r.start(key, rdb.TypeList, length, expiry)
+}
+
+// Rpush loads an element of the list.
+func (r *Replayer) Rpush(key, value []byte) {
+	r.cur.list.rpush(value)
+}
+
+// EndList is called when there are no more elements in a list.
+func (r *Replayer) EndList(key []byte) {
+	r.cur = nil
+}
+
+// StartZSet loads a sorted set of the snapshot.
+func (r *Replayer) StartZSet(key []byte, cardinality, expiry int64) {
+	r.start(key, rdb.TypeZSet, cardinality, expiry)
+}
+
+// Zadd loads a member of the sorted set.
+func (r *Replayer) Zadd(key []byte, score float64, member []byte) {
+	r.cur.zset[string(member)] = score
+}
+
+// EndZSet is called when there are no more members in a sorted set.
+func (r *Replayer) EndZSet(key []byte) {
+	r.cur = nil
+}
+
+// Stream loads a stream of the snapshot.
+func (r *Replayer) Stream(key []byte, stream *rdb.Stream, expiry int64) {
+	obj := newReplayObject(rdb.TypeStreamListpacks, 0)
+	obj.stream, obj.expiry = stream, expiry
+	r.keys()[string(key)] = obj
+}
+
+// Module loads a value of a module type of the snapshot.
+func (r *Replayer) Module(key []byte, m *rdb.Module, expiry int64) {
+	obj := newReplayObject(rdb.TypeModule2, 0)
+	obj.module, obj.expiry = m, expiry
+	r.keys()[string(key)] = obj
+}
+
+// EndDatabase is called at the end of a database.
+func (r *Replayer) EndDatabase(n int) {}
+
+// EndRDB is called when parsing of the RDB file is complete.
+func (r *Replayer) EndRDB() {}
+
+type replayCommand struct {
+	// arity is the minimal number of arguments, the command name included
+	arity int
+	// step is the number of arguments repeated after the first arity ones
+	step  int
+	apply func(r *Replayer, args [][]byte) error
+}
+
+var replayCommands = map[string]replayCommand{
+	"SELECT":    {2, 0, (*Replayer).selectDB},
+	"FLUSHDB":   {1, 0, (*Replayer).flushDB},
+	"FLUSHALL":  {1, 0, (*Replayer).flushAll},
+	"DEL":       {2, 1, (*Replayer).del},
+	"UNLINK":    {2, 1, (*Replayer).del},
+	"EXPIRE":    {3, 0, func(r *Replayer, args [][]byte) error { return r.expire(args, 1000, false) }},
+	"PEXPIRE":   {3, 0, func(r *Replayer, args [][]byte) error { return r.expire(args, 1, false) }},
+	"EXPIREAT":  {3, 0, func(r *Replayer, args [][]byte) error { return r.expire(args, 1000, true) }},
+	"PEXPIREAT": {3, 0, func(r *Replayer, args [][]byte) error { return r.expire(args, 1, true) }},
+	"PERSIST":   {2, 0, (*Replayer).persist},
+	"RENAME":    {3, 0, (*Replayer).rename},
+
+	"SET":         {3, 0, (*Replayer).set},
+	"SETEX":       {4, 0, func(r *Replayer, args [][]byte) error { return r.setex(args, 1000) }},
+	"PSETEX":      {4, 0, func(r *Replayer, args [][]byte) error { return r.setex(args, 1) }},
+	"SETNX":       {3, 0, (*Replayer).setnx},
+	"GETSET":      {3, 0, (*Replayer).getset},
+	"GETDEL":      {2, 0, (*Replayer).del},
+	"MSET":        {3, 2, (*Replayer).mset},
+	"MSETNX":      {3, 2, (*Replayer).msetnx},
+	"APPEND":      {3, 0, (*Replayer).append},
+	"INCR":        {2, 0, func(r *Replayer, args [][]byte) error { return r.incrBy(args[1], 1) }},
+	"DECR":        {2, 0, func(r *Replayer, args [][]byte) error { return r.incrBy(args[1], -1) }},
+	"INCRBY":      {3, 0, (*Replayer).incrByArg},
+	"DECRBY":      {3, 0, (*Replayer).decrByArg},
+	"INCRBYFLOAT": {3, 0, (*Replayer).incrByFloat},
+
+	"HSET":         {4, 2, (*Replayer).hset},
+	"HMSET":        {4, 2, (*Replayer).hset},
+	"HSETNX":       {4, 0, (*Replayer).hsetnx},
+	"HDEL":         {3, 1, (*Replayer).hdel},
+	"HINCRBY":      {4, 0, (*Replayer).hincrBy},
+	"HINCRBYFLOAT": {4, 0, (*Replayer).hincrByFloat},
+
+	"SADD":  {3, 1, (*Replayer).sadd},
+	"SREM":  {3, 1, (*Replayer).srem},
+	"SMOVE": {4, 0, (*Replayer).smove},
+
+	"RPUSH":     {3, 1, func(r *Replayer, args [][]byte) error { return r.push(args, false, false) }},
+	"LPUSH":     {3, 1, func(r *Replayer, args [][]byte) error { return r.push(args, true, false) }},
+	"RPUSHX":    {3, 1, func(r *Replayer, args [][]byte) error { return r.push(args, false, true) }},
+	"LPUSHX":    {3, 1, func(r *Replayer, args [][]byte) error { return r.push(args, true, true) }},
+	"RPOP":      {2, 0, func(r *Replayer, args [][]byte) error { return r.pop(args, false) }},
+	"LPOP":      {2, 0, func(r *Replayer, args [][]byte) error { return r.pop(args, true) }},
+	"LSET":      {4, 0, (*Replayer).lset},
+	"LTRIM":     {4, 0, (*Replayer).ltrim},
+	"LREM":      {4, 0, (*Replayer).lrem},
+	"LINSERT":   {5, 0, (*Replayer).linsert},
+	"LMOVE":     {5, 0, (*Replayer).lmove},
+	"RPOPLPUSH": {3, 0, (*Replayer).rpoplpush},
+
+	"ZADD":    {4, 0, (*Replayer).zadd},
+	"ZREM":    {3, 1, (*Replayer).zrem},
+	"ZINCRBY": {4, 0, (*Replayer).zincrBy},
+}
+
+// Apply replays one write command, args holds the command name and its arguments
+func (r *Replayer) Apply(args [][]byte) error {
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := replayCommands[name]
+	if !ok {
+		return fmt.Errorf("unsupported command %s", name)
+	}
+	if len(args) < cmd.arity || (cmd.step > 0 && (len(args)-cmd.arity)%cmd.step != 0) {
+		return fmt.Errorf("wrong number of arguments for %s", name)
+	}
+	return cmd.apply(r, args)
+}
+
+// commandKeys returns the keys a command written to the replayer acts on, nil
+// for the commands without keys and the ones the replayer does not support
+func commandKeys(args [][]byte) [][]byte {
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := replayCommands[name]
+	if !ok || len(args) < cmd.arity {
+		return nil
+	}
+	switch name {
+	case "SELECT", "FLUSHDB", "FLUSHALL":
+		return nil
+	case "DEL", "UNLINK":
+		return args[1:]
+	case "MSET", "MSETNX":
+		keys := make([][]byte, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "RENAME", "SMOVE", "LMOVE", "RPOPLPUSH":
+		return args[1:3]
+	}
+	return args[1:2]
+}
+
+func parseInt(b []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, errNotInt
+	}
+	return n, nil
+}
+
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+func formatFloat(f float64) []byte {
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func (r *Replayer) selectDB(args [][]byte) error {
+	n, err := parseInt(args[1])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid db index %s", args[1])
+	}
+	r.db = int(n)
+	return nil
+}
+
+func (r *Replayer) flushDB(args [][]byte) error {
+	delete(r.dbs, r.db)
+	return nil
+}
+
+func (r *Replayer) flushAll(args [][]byte) error {
+	r.dbs = make(map[int]map[string]*replayObject)
+	return nil
+}
+
+func (r *Replayer) del(args [][]byte) error {
+	objs := r.keys()
+	for _, key := range args[1:] {
+		delete(objs, string(key))
+	}
+	return nil
+}
+
+// expire sets the expiry of a key to args[2] in unit milliseconds, relative to
+// now unless absolute, a key expiring in the past is deleted
+func (r *Replayer) expire(args [][]byte, unit int64, absolute bool) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	at := n * unit
+	if !absolute {
+		at += nowMs()
+	}
+	obj, ok := r.keys()[string(args[1])]
+	if !ok {
+		return nil
+	}
+	if len(args) > 3 {
+		switch strings.ToUpper(string(args[3])) {
+		case "NX":
+			ok = obj.expiry == 0
+		case "XX":
+			ok = obj.expiry != 0
+		case "GT":
+			ok = obj.expiry != 0 && at > obj.expiry
+		case "LT":
+			ok = obj.expiry == 0 || at < obj.expiry
+		default:
+			return errSyntax
+		}
+		if !ok {
+			return nil
+		}
+	}
+	if at <= nowMs() {
+		delete(r.keys(), string(args[1]))
+		return nil
+	}
+	obj.expiry = at
+	return nil
+}
+
+func (r *Replayer) persist(args [][]byte) error {
+	if obj, ok := r.keys()[string(args[1])]; ok {
+		obj.expiry = 0
+	}
+	return nil
+}
+
+func (r *Replayer) rename(args [][]byte) error {
+	objs := r.keys()
+	obj, ok := objs[string(args[1])]
+	if !ok {
+		return errNoSuchKey
+	}
+	delete(objs, string(args[1]))
+	objs[string(args[2])] = obj
+	return nil
+}
+
+// putString replaces key with a string value, expiring at expiry
+func (r *Replayer) putString(key, value []byte, expiry int64) {
+	if expiry != 0 && expiry <= nowMs() {
+		delete(r.keys(), string(key))
+		return
+	}
+	obj := newReplayObject(rdb.TypeString, 0)
+	obj.str, obj.expiry = value, expiry
+	r.keys()[string(key)] = obj
+}
+
+func (r *Replayer) set(args [][]byte) error {
+	var expiry int64
+	var nx, xx, keepTTL bool
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "GET":
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				return err
+			}
+			switch opt {
+			case "EX":
+				expiry = nowMs() + n*1000
+			case "PX":
+				expiry = nowMs() + n
+			case "EXAT":
+				expiry = n * 1000
+			case "PXAT":
+				expiry = n
+			}
+		default:
+			return errSyntax
+		}
+	}
+	obj, exists := r.keys()[string(args[1])]
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	if keepTTL && exists {
+		expiry = obj.expiry
+	}
+	r.putString(args[1], args[2], expiry)
+	return nil
+}
+
+func (r *Replayer) setex(args [][]byte, unit int64) error {
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	r.putString(args[1], args[3], nowMs()+n*unit)
+	return nil
+}
+
+func (r *Replayer) setnx(args [][]byte) error {
+	if _, exists := r.keys()[string(args[1])]; !exists {
+		r.putString(args[1], args[2], 0)
+	}
+	return nil
+}
+
+func (r *Replayer) getset(args [][]byte) error {
+	r.putString(args[1], args[2], 0)
+	return nil
+}
+
+func (r *Replayer) mset(args [][]byte) error {
+	for i := 1; i+1 < len(args); i += 2 {
+		r.putString(args[i], args[i+1], 0)
+	}
+	return nil
+}
+
+func (r *Replayer) msetnx(args [][]byte) error {
+	objs := r.keys()
+	for i := 1; i+1 < len(args); i += 2 {
+		if _, exists := objs[string(args[i])]; exists {
+			return nil
+		}
+	}
+	return r.mset(args)
+}
+
+func (r *Replayer) append(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeString, true)
+	if err != nil {
+		return err
+	}
+	obj.str = append(append([]byte{}, obj.str...), args[2]...)
+	return nil
+}
+
+func (r *Replayer) incrBy(key []byte, delta int64) error {
+	obj, err := r.lookup(key, rdb.TypeString, true)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if len(obj.str) > 0 {
+		if n, err = parseInt(obj.str); err != nil {
+			return err
+		}
+	}
+	obj.str = strconv.AppendInt(nil, n+delta, 10)
+	return nil
+}
+
+func (r *Replayer) incrByArg(args [][]byte) error {
+	delta, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	return r.incrBy(args[1], delta)
+}
+
+func (r *Replayer) decrByArg(args [][]byte) error {
+	delta, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	return r.incrBy(args[1], -delta)
+}
+
+func (r *Replayer) incrByFloat(args [][]byte) error {
+	delta, err := parseFloat(args[2])
+	if err != nil {
+		return err
+	}
+	obj, err := r.lookup(args[1], rdb.TypeString, true)
+	if err != nil {
+		return err
+	}
+	var f float64
+	if len(obj.str) > 0 {
+		if f, err = parseFloat(obj.str); err != nil {
+			return err
+		}
+	}
+	obj.str = formatFloat(f + delta)
+	return nil
+}
+
+func (r *Replayer) hset(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeHash, true)
+	if err != nil {
+		return err
+	}
+	for i := 2; i+1 < len(args); i += 2 {
+		obj.hash[string(args[i])] = args[i+1]
+	}
+	return nil
+}
+
+func (r *Replayer) hsetnx(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeHash, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := obj.hash[string(args[2])]; !ok {
+		obj.hash[string(args[2])] = args[3]
+	}
+	return nil
+}
+
+func (r *Replayer) hdel(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeHash, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	for _, field := range args[2:] {
+		delete(obj.hash, string(field))
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) hincrBy(args [][]byte) error {
+	delta, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	obj, err := r.lookup(args[1], rdb.TypeHash, true)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if v, ok := obj.hash[string(args[2])]; ok {
+		if n, err = parseInt(v); err != nil {
+			return err
+		}
+	}
+	obj.hash[string(args[2])] = strconv.AppendInt(nil, n+delta, 10)
+	return nil
+}
+
+func (r *Replayer) hincrByFloat(args [][]byte) error {
+	delta, err := parseFloat(args[3])
+	if err != nil {
+		return err
+	}
+	obj, err := r.lookup(args[1], rdb.TypeHash, true)
+	if err != nil {
+		return err
+	}
+	var f float64
+	if v, ok := obj.hash[string(args[2])]; ok {
+		if f, err = parseFloat(v); err != nil {
+			return err
+		}
+	}
+	obj.hash[string(args[2])] = formatFloat(f + delta)
+	return nil
+}
+
+func (r *Replayer) sadd(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeSet, true)
+	if err != nil {
+		return err
+	}
+	for _, member := range args[2:] {
+		obj.set[string(member)] = struct{}{}
+	}
+	return nil
+}
+
+func (r *Replayer) srem(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeSet, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	for _, member := range args[2:] {
+		delete(obj.set, string(member))
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) smove(args [][]byte) error {
+	src, err := r.lookup(args[1], rdb.TypeSet, false)
+	if err != nil || src == nil {
+		return err
+	}
+	if _, ok := src.set[string(args[3])]; !ok {
+		return nil
+	}
+	dst, err := r.lookup(args[2], rdb.TypeSet, true)
+	if err != nil {
+		return err
+	}
+	delete(src.set, string(args[3]))
+	dst.set[string(args[3])] = struct{}{}
+	r.removeEmpty(args[1], src)
+	return nil
+}
+
+func (r *Replayer) push(args [][]byte, left, exists bool) error {
+	obj, err := r.lookup(args[1], rdb.TypeList, !exists)
+	if err != nil || obj == nil {
+		return err
+	}
+	for _, v := range args[2:] {
+		if left {
+			obj.list.lpush(v)
+		} else {
+			obj.list.rpush(v)
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) pop(args [][]byte, left bool) error {
+	count := int64(1)
+	if len(args) > 2 {
+		var err error
+		if count, err = parseInt(args[2]); err != nil || count < 0 {
+			return errNotInt
+		}
+	}
+	obj, err := r.lookup(args[1], rdb.TypeList, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	for i := int64(0); i < count && obj.list.len() > 0; i++ {
+		if left {
+			obj.list.lpop()
+		} else {
+			obj.list.rpop()
+		}
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+// listIndex converts a redis list index, which may count from the end, into an
+// offset of a list of n elements
+func listIndex(b []byte, n int) (int, error) {
+	i, err := parseInt(b)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		i += int64(n)
+	}
+	return int(i), nil
+}
+
+func (r *Replayer) lset(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeList, false)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return errNoSuchKey
+	}
+	elems := obj.list.flatten()
+	i, err := listIndex(args[2], len(elems))
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(elems) {
+		return errors.New("index out of range")
+	}
+	elems[i] = args[3]
+	return nil
+}
+
+func (r *Replayer) ltrim(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeList, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	elems := obj.list.flatten()
+	start, err := listIndex(args[2], len(elems))
+	if err != nil {
+		return err
+	}
+	stop, err := listIndex(args[3], len(elems))
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(elems) {
+		stop = len(elems) - 1
+	}
+	if start > stop {
+		obj.list.tail = nil
+	} else {
+		obj.list.tail = elems[start : stop+1]
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) lrem(args [][]byte) error {
+	count, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	obj, err := r.lookup(args[1], rdb.TypeList, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	elems := obj.list.flatten()
+	value := string(args[3])
+	removed := make([]bool, len(elems))
+	var n int64
+	if count >= 0 {
+		for i := 0; i < len(elems) && (count == 0 || n < count); i++ {
+			if string(elems[i]) == value {
+				removed[i] = true
+				n++
+			}
+		}
+	} else {
+		for i := len(elems) - 1; i >= 0 && n < -count; i-- {
+			if string(elems[i]) == value {
+				removed[i] = true
+				n++
+			}
+		}
+	}
+	kept := elems[:0]
+	for i, v := range elems {
+		if !removed[i] {
+			kept = append(kept, v)
+		}
+	}
+	obj.list.tail = kept
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) linsert(args [][]byte) error {
+	var after bool
+	switch strings.ToUpper(string(args[2])) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return errSyntax
+	}
+	obj, err := r.lookup(args[1], rdb.TypeList, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	elems := obj.list.flatten()
+	for i, v := range elems {
+		if string(v) != string(args[3]) {
+			continue
+		}
+		if after {
+			i++
+		}
+		elems = append(elems, nil)
+		copy(elems[i+1:], elems[i:])
+		elems[i] = args[4]
+		obj.list.tail = elems
+		break
+	}
+	return nil
+}
+
+func (r *Replayer) move(srcKey, dstKey []byte, fromLeft, toLeft bool) error {
+	src, err := r.lookup(srcKey, rdb.TypeList, false)
+	if err != nil || src == nil {
+		return err
+	}
+	if dst, ok := r.keys()[string(dstKey)]; ok && dst.typ != rdb.TypeList {
+		return errWrongType
+	}
+	var v []byte
+	if fromLeft {
+		v = src.list.lpop()
+	} else {
+		v = src.list.rpop()
+	}
+	r.removeEmpty(srcKey, src)
+	dst, _ := r.lookup(dstKey, rdb.TypeList, true)
+	if toLeft {
+		dst.list.lpush(v)
+	} else {
+		dst.list.rpush(v)
+	}
+	return nil
+}
+
+func parseSide(b []byte) (bool, error) {
+	switch strings.ToUpper(string(b)) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, errSyntax
+}
+
+func (r *Replayer) lmove(args [][]byte) error {
+	fromLeft, err := parseSide(args[3])
+	if err != nil {
+		return err
+	}
+	toLeft, err := parseSide(args[4])
+	if err != nil {
+		return err
+	}
+	return r.move(args[1], args[2], fromLeft, toLeft)
+}
+
+func (r *Replayer) rpoplpush(args [][]byte) error {
+	return r.move(args[1], args[2], false, true)
+}
+
+func (r *Replayer) zadd(args [][]byte) error {
+	var nx, xx, gt, lt, incr bool
+	i := 2
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 || (nx && (xx || gt || lt)) || (gt && lt) || (incr && len(pairs) != 2) {
+		return errSyntax
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseFloat(pairs[2*j])
+		if err != nil {
+			return err
+		}
+		scores[j] = score
+	}
+	obj, err := r.lookup(args[1], rdb.TypeZSet, !xx)
+	if err != nil || obj == nil {
+		return err
+	}
+	for j, score := range scores {
+		member := string(pairs[2*j+1])
+		old, exists := obj.zset[member]
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		if incr && exists {
+			score += old
+		}
+		if exists && ((gt && score <= old) || (lt && score >= old)) {
+			continue
+		}
+		obj.zset[member] = score
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) zrem(args [][]byte) error {
+	obj, err := r.lookup(args[1], rdb.TypeZSet, false)
+	if err != nil || obj == nil {
+		return err
+	}
+	for _, member := range args[2:] {
+		delete(obj.zset, string(member))
+	}
+	r.removeEmpty(args[1], obj)
+	return nil
+}
+
+func (r *Replayer) zincrBy(args [][]byte) error {
+	delta, err := parseFloat(args[2])
+	if err != nil {
+		return err
+	}
+	obj, err := r.lookup(args[1], rdb.TypeZSet, true)
+	if err != nil {
+		return err
+	}
+	obj.zset[string(args[3])] += delta
+	return nil
+}
+
+// Emit sends the final state of every key to d ordered by database and key,
+// the replayer is emptied as it goes
+func (r *Replayer) Emit(d rdb.Decoder) {
+	d.StartRDB()
+	r.emitDatabases(d)
+	d.EndRDB()
+}
+
+// emitDatabases emits the objects of every database, between the StartRDB and
+// EndRDB of another source of objects
+func (r *Replayer) emitDatabases(d rdb.Decoder) {
+	dbs := make([]int, 0, len(r.dbs))
+	for n := range r.dbs {
+		dbs = append(dbs, n)
+	}
+	sort.Ints(dbs)
+
+	for _, n := range dbs {
+		objs := r.dbs[n]
+		delete(r.dbs, n)
+		if len(objs) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(objs))
+		for key := range objs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		d.StartDatabase(n)
+		for _, key := range keys {
+			emitObject(d, []byte(key), objs[key])
+		}
+		d.EndDatabase(n)
+	}
+}
+
+func emitObject(d rdb.Decoder, key []byte, obj *replayObject) {
+	switch obj.typ {
+	case rdb.TypeString:
+		d.Set(key, obj.str, obj.expiry)
+	case rdb.TypeHash:
+		d.StartHash(key, int64(len(obj.hash)), obj.expiry)
+		fields := make([]string, 0, len(obj.hash))
+		for field := range obj.hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			d.Hset(key, []byte(field), obj.hash[field])
+		}
+		d.EndHash(key)
+	case rdb.TypeSet:
+		d.StartSet(key, int64(len(obj.set)), obj.expiry)
+		members := make([]string, 0, len(obj.set))
+		for member := range obj.set {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			d.Sadd(key, []byte(member))
+		}
+		d.EndSet(key)
+	case rdb.TypeList:
+		d.StartList(key, int64(obj.list.len()), obj.expiry)
+		for _, v := range obj.list.flatten() {
+			d.Rpush(key, v)
+		}
+		d.EndList(key)
+	case rdb.TypeZSet:
+		d.StartZSet(key, int64(len(obj.zset)), obj.expiry)
+		members := make([]string, 0, len(obj.zset))
+		for member := range obj.zset {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			si, sj := obj.zset[members[i]], obj.zset[members[j]]
+			if si != sj {
+				return si < sj
+			}
+			return members[i] < members[j]
+		})
+		for _, member := range members {
+			d.Zadd(key, obj.zset[member], []byte(member))
+		}
+		d.EndZSet(key)
+	case rdb.TypeStreamListpacks:
+		if sd, ok := d.(rdb.StreamDecoder); ok {
+			sd.Stream(key, obj.stream, obj.expiry)
+		}
+	case rdb.TypeModule2:
+		if md, ok := d.(rdb.ModuleDecoder); ok {
+			md.Module(key, obj.module, obj.expiry)
+		}
+	}
+}
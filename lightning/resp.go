@@ -0,0 +1,318 @@
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RespError is an error reply of the redis protocol
+type RespError string
+
+func (e RespError) Error() string {
+	return string(e)
+}
+
+// DefaultMaxBulkLen is the default max length of a bulk string, the same as
+// proto-max-bulk-len of redis
+const DefaultMaxBulkLen = 512 << 20
+
+const (
+	// respMaxArrayLen is the max number of values of an array, redis rejects
+	// longer multibulks too
+	respMaxArrayLen = 1<<31 - 1
+	// respPrealloc bounds the memory allocated ahead for a bulk string or an
+	// array, longer ones grow as they are read so a corrupt length does not
+	// allocate at once
+	respPrealloc = 64 << 10
+)
+
+// RespReader reads values of the redis serialization protocol
+type RespReader struct {
+	r *bufio.Reader
+	// maxBulk is the max length of a bulk string
+	maxBulk int64
+}
+
+// NewRespReader creates a reader of the redis protocol
+func NewRespReader(r io.Reader) *RespReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &RespReader{r: br, maxBulk: DefaultMaxBulkLen}
+}
+
+// SetMaxBulkLen sets the max length of a bulk string, longer ones fail the read
+func (rr *RespReader) SetMaxBulkLen(n int64) {
+	rr.maxBulk = n
+}
+
+// Buffered returns the underlying buffered reader
+func (rr *RespReader) Buffered() *bufio.Reader {
+	return rr.r
+}
+
+// ReadLine reads a line without the trailing \r\n
+func (rr *RespReader) ReadLine() ([]byte, error) {
+	line, err := rr.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("resp: line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("resp: invalid line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// ReadValue reads a reply, which is one of string for simple strings, []byte
+// for bulk strings, int64, []interface{} or RespError, nil bulk strings and
+// arrays are returned as nil
+func (rr *RespReader) ReadValue() (interface{}, error) {
+	line, err := rr.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return RespError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if n < -1 {
+			return nil, fmt.Errorf("resp: invalid bulk length %d", n)
+		}
+		if n > rr.maxBulk {
+			return nil, fmt.Errorf("resp: bulk length %d exceeds %d", n, rr.maxBulk)
+		}
+		return rr.readBulk(n)
+	case '*':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if n < -1 || n > respMaxArrayLen {
+			return nil, fmt.Errorf("resp: invalid array length %d", n)
+		}
+		prealloc := n
+		if prealloc > respPrealloc {
+			prealloc = respPrealloc
+		}
+		values := make([]interface{}, 0, prealloc)
+		for i := int64(0); i < n; i++ {
+			v, err := rr.ReadValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("resp: unknown reply type %q", line[0])
+}
+
+// readBulk reads a bulk string of n bytes and its trailing \r\n, the buffer
+// grows as the bytes arrive instead of being allocated from the length
+func (rr *RespReader) readBulk(n int64) ([]byte, error) {
+	var b []byte
+	if n <= respPrealloc {
+		b = make([]byte, n)
+		if _, err := io.ReadFull(rr.r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	} else {
+		buf := bytes.NewBuffer(make([]byte, 0, respPrealloc))
+		if _, err := io.CopyN(buf, rr.r, n); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		b = buf.Bytes()
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(rr.r, crlf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return nil, errors.New("resp: bulk string not terminated by CRLF")
+	}
+	return b, nil
+}
+
+// unexpectedEOF turns io.EOF inside a value into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadCommand reads a command sent as an array of bulk strings, io.EOF is
+// only returned between two commands, io.ErrUnexpectedEOF inside one
+func (rr *RespReader) ReadCommand() ([][]byte, error) {
+	if _, err := rr.r.Peek(1); err != nil {
+		return nil, err
+	}
+	v, err := rr.ReadValue()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, ok := v.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, errors.New("resp: command is not an array of bulk strings")
+	}
+	args := make([][]byte, len(values))
+	for i, value := range values {
+		if args[i], ok = value.([]byte); !ok {
+			return nil, errors.New("resp: command is not an array of bulk strings")
+		}
+	}
+	return args, nil
+}
+
+// ReadInline reads an inline command, a line of arguments separated by spaces
+// which may be quoted like in redis-cli, empty lines are skipped
+func (rr *RespReader) ReadInline() ([][]byte, error) {
+	for {
+		line, err := rr.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("resp: inline command too long")
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		args, err := splitArgs(bytes.TrimRight(line, "\r\n"))
+		if err != nil || len(args) > 0 {
+			return args, err
+		}
+	}
+}
+
+// splitArgs splits an inline command the same way as sdssplitargs of redis:
+// double quoted arguments support escapes, single quoted ones only \'
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("resp: unbalanced quotes in inline command")
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					case 'x':
+						if i+2 < len(line) {
+							if v, err := strconv.ParseUint(string(line[i+1:i+3]), 16, 8); err == nil {
+								c = byte(v)
+								i += 2
+								break
+							}
+						}
+						c = 'x'
+					default:
+						c = line[i]
+					}
+				}
+				arg = append(arg, c)
+			}
+		case '\'':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("resp: unbalanced quotes in inline command")
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				arg = append(arg, c)
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg = append(arg, line[i])
+				i++
+			}
+		}
+		// a closing quote must be followed by a space or the end of line
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, errors.New("resp: unbalanced quotes in inline command")
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+// WriteCommand writes args as an array of bulk strings
+func WriteCommand(w io.Writer, args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
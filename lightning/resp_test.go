@@ -0,0 +1,91 @@
+package lightning
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadValue(t *testing.T) {
+	big := strings.Repeat("x", respPrealloc*3+5)
+	for _, c := range []struct {
+		in     string
+		expect interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR bad\r\n", RespError("ERR bad")},
+		{":42\r\n", int64(42)},
+		{"$3\r\nfoo\r\n", []byte("foo")},
+		{"$0\r\n\r\n", []byte{}},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []interface{}{}},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}},
+		{"$" + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n", []byte(big)},
+	} {
+		// one byte at a time so that the large bulks are read in pieces
+		rr := NewRespReader(iotest.OneByteReader(strings.NewReader(c.in)))
+		v, err := rr.ReadValue()
+		if err != nil {
+			t.Errorf("%.20q: %v", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, c.expect) {
+			t.Errorf("%.20q: read %.20v, expect %.20v", c.in, v, c.expect)
+		}
+	}
+}
+
+func TestReadValueCorrupt(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		max int64
+		err string
+	}{
+		{"$-2\r\n", DefaultMaxBulkLen, "invalid bulk length -2"},
+		{"$-9223372036854775808\r\n", DefaultMaxBulkLen, "invalid bulk length"},
+		{"*-2\r\n", DefaultMaxBulkLen, "invalid array length -2"},
+		{"*2147483648\r\n", DefaultMaxBulkLen, "invalid array length"},
+		{"$536870913\r\n", DefaultMaxBulkLen, "bulk length 536870913 exceeds 536870912"},
+		{"$9223372036854775807\r\n", DefaultMaxBulkLen, "exceeds"},
+		{"$4\r\nabcd\r\n", 3, "bulk length 4 exceeds 3"},
+		{"*1\r\n$4\r\nabcd\r\n", 3, "bulk length 4 exceeds 3"},
+		{"$3\r\nfooXY", DefaultMaxBulkLen, "not terminated by CRLF"},
+		{"$3\r\nfoo\n\r", DefaultMaxBulkLen, "not terminated by CRLF"},
+		{"$3\r\nfoobar\r\n", DefaultMaxBulkLen, "not terminated by CRLF"},
+		{"$3\r\nfo", DefaultMaxBulkLen, io.ErrUnexpectedEOF.Error()},
+		{"$3\r\nfoo", DefaultMaxBulkLen, io.ErrUnexpectedEOF.Error()},
+		{"$3\r\nfoo\r", DefaultMaxBulkLen, io.ErrUnexpectedEOF.Error()},
+		{"$100000\r\nfoo", DefaultMaxBulkLen, io.ErrUnexpectedEOF.Error()},
+		{"$1x\r\n", DefaultMaxBulkLen, "invalid syntax"},
+	} {
+		rr := NewRespReader(strings.NewReader(c.in))
+		rr.SetMaxBulkLen(c.max)
+		v, err := rr.ReadValue()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: read %v, expect error %q, got %v", c.in, v, c.err, err)
+		}
+	}
+}
+
+func TestReplayCommandsMaxBulk(t *testing.T) {
+	cmds := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n"
+	rp := NewReplayer()
+	if err := ReplayCommands(bufio.NewReader(strings.NewReader(cmds)), rp, CommandErrorFail, false, 5); err != nil {
+		t.Fatal(err)
+	}
+	err := ReplayCommands(bufio.NewReader(strings.NewReader(cmds)), NewReplayer(), CommandErrorFail, false, 4)
+	if err == nil || !strings.Contains(err.Error(), "command 1: resp: bulk length 5 exceeds 4") {
+		t.Fatalf("expect the long bulk to fail the source, got %v", err)
+	}
+	// a corrupt bulk is not mistaken for the truncated end of an aof
+	corrupt := "*1\r\n$4\r\nPING\n\n"
+	err = ReplayCommands(bufio.NewReader(strings.NewReader(corrupt)), NewReplayer(), CommandErrorSkip, false, 5)
+	if err == nil || !strings.Contains(err.Error(), "CRLF") {
+		t.Fatalf("expect the corrupt bulk to fail the source, got %v", err)
+	}
+}
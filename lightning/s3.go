@@ -0,0 +1,207 @@
+package lightning
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/docker/go-units"
+	"github.com/nioshield/titan-lightning/conf"
+	"go.uber.org/zap"
+)
+
+// S3Scheme is the source address prefix of an object or a prefix in a s3 compatible storage
+const S3Scheme = "s3://"
+
+// s3RetryBackoff is the delay before the first retry of a failed request
+var s3RetryBackoff = time.Second
+
+// NewS3Client creates a client of the s3 compatible storage in cfg
+func NewS3Client(cfg *conf.S3) (*s3.S3, error) {
+	awsCfg := aws.NewConfig().
+		WithRegion(cfg.Region).
+		WithS3ForcePathStyle(cfg.ForcePathStyle).
+		WithMaxRetries(cfg.Retries)
+	if cfg.Endpoint != "" {
+		awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.AccessKey != "" {
+		awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""))
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// s3Sources returns a source for the object addressed by bucket/key, or for
+// every object under the prefix if the key is empty or ends with a slash
+func s3Sources(addr string, cfg *conf.S3) ([]*Source, error) {
+	parts := strings.SplitN(addr, "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid s3 address %s%s", S3Scheme, addr)
+	}
+	partSize, err := units.RAMInBytes(cfg.PartSize)
+	if err != nil {
+		return nil, err
+	}
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid s3 part size %s", cfg.PartSize)
+	}
+	client, err := NewS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*s3.Object
+	if key == "" || strings.HasSuffix(key, "/") {
+		err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(key),
+		}, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range page.Contents {
+				if !strings.HasSuffix(aws.StringValue(obj.Key), "/") {
+					objects = append(objects, obj)
+				}
+			}
+			return true
+		})
+	} else {
+		var head *s3.HeadObjectOutput
+		head, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err == nil {
+			objects = append(objects, &s3.Object{
+				Key:          aws.String(key),
+				Size:         head.ContentLength,
+				LastModified: head.LastModified,
+				ETag:         head.ETag,
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []*Source
+	for _, obj := range objects {
+		obj := obj
+		sources = append(sources, &Source{
+			Path:      S3Scheme + bucket + "/" + aws.StringValue(obj.Key),
+			Size:      aws.Int64Value(obj.Size),
+			ModTime:   aws.TimeValue(obj.LastModified).UnixNano(),
+			Resumable: true,
+			open: func(offset int64) (io.ReadCloser, error) {
+				return &s3Reader{
+					client:   client,
+					bucket:   bucket,
+					key:      aws.StringValue(obj.Key),
+					etag:     aws.StringValue(obj.ETag),
+					size:     aws.Int64Value(obj.Size),
+					offset:   offset,
+					partSize: partSize,
+					retries:  cfg.Retries,
+				}, nil
+			},
+		})
+	}
+	return sources, nil
+}
+
+// s3Reader streams an object through ranged GETs of partSize bytes, a failed
+// request or an interrupted body is retried from the current offset
+type s3Reader struct {
+	client   *s3.S3
+	bucket   string
+	key      string
+	etag     string
+	size     int64
+	offset   int64
+	partSize int64
+	retries  int
+
+	body io.ReadCloser
+	end  int64
+}
+
+func (r *s3Reader) Read(b []byte) (int, error) {
+	for attempt := 0; ; {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		var err error
+		if r.body == nil {
+			err = r.get()
+		}
+		if err == nil {
+			var n int
+			n, err = r.body.Read(b)
+			r.offset += int64(n)
+			if err == io.EOF && r.offset < r.end {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				r.body.Close()
+				r.body = nil
+			}
+			if n > 0 {
+				return n, nil
+			}
+			if err == nil || err == io.EOF {
+				// the range is complete, move on to the next one
+				continue
+			}
+		}
+		if attempt >= r.retries {
+			return 0, err
+		}
+		attempt++
+		zap.L().Warn("read s3 object failed, retry", zap.String("bucket", r.bucket), zap.String("key", r.key),
+			zap.Int64("offset", r.offset), zap.Int("attempt", attempt), zap.Error(err))
+		time.Sleep(time.Duration(attempt) * s3RetryBackoff)
+	}
+}
+
+// get requests the next range starting at the current offset
+func (r *s3Reader) get() error {
+	r.end = r.offset + r.partSize
+	if r.end > r.size {
+		r.end = r.size
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, r.end-1)),
+	}
+	if r.etag != "" {
+		// fail instead of mixing the ranges of two versions of the object
+		input.IfMatch = aws.String(r.etag)
+	}
+	out, err := r.client.GetObject(input)
+	if err != nil {
+		return err
+	}
+	r.body = out.Body
+	return nil
+}
+
+// Size returns the size of the object
+func (r *s3Reader) Size() int64 {
+	return r.size
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nioshield/titan-lightning/conf"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+// fakeS3 serves one object with ranged GETs, fail is called with the start of
+// each range and returns how many bytes are sent before the body breaks, -1
+// for the whole range and 0 for an internal error
+type fakeS3 struct {
+	mu     sync.Mutex
+	key    string
+	data   []byte
+	fail   func(start int64) int
+	ranges []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bucket/"+f.key {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprint(len(f.data)))
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != `"v1"` {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.ranges = append(f.ranges, r.Header.Get("Range"))
+	n := -1
+	if f.fail != nil {
+		n = f.fail(start)
+	}
+	f.mu.Unlock()
+	if n == 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body := f.data[start : end+1]
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	if n > 0 && n < len(body) {
+		// the connection is closed before the declared length
+		w.Write(body[:n])
+		return
+	}
+	w.Write(body)
+}
+
+func (f *fakeS3) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.ranges...)
+}
+
+func startFakeS3(t *testing.T, f *fakeS3) (*httptest.Server, *Source) {
+	srv := httptest.NewServer(f)
+	sources, err := s3Sources("bucket/"+f.key, &conf.S3{
+		Endpoint:       srv.URL,
+		Region:         "us-east-1",
+		AccessKey:      "access",
+		SecretKey:      "secret",
+		ForcePathStyle: true,
+		PartSize:       "100",
+		Retries:        3,
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Size != int64(len(f.data)) || !sources[0].Resumable {
+		srv.Close()
+		t.Fatalf("unexpected sources %+v", sources)
+	}
+	return srv, sources[0]
+}
+
+func TestS3ReaderRetry(t *testing.T) {
+	defer func(backoff time.Duration) { s3RetryBackoff = backoff }(s3RetryBackoff)
+	s3RetryBackoff = time.Millisecond
+
+	data := bytes.Repeat([]byte("0123456789"), 45)
+	failed := make(map[int64]bool)
+	f := &fakeS3{key: "dump.rdb", data: data, fail: func(start int64) int {
+		if failed[start] {
+			return -1
+		}
+		failed[start] = true
+		switch start {
+		case 100:
+			return 0
+		case 200:
+			return 30
+		}
+		return -1
+	}}
+	srv, src := startFakeS3(t, f)
+	defer srv.Close()
+	r, err := src.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes differing from the object", len(got))
+	}
+	// the broken range is requested again from where its body broke
+	want := "bytes=0-99,bytes=100-199,bytes=100-199,bytes=200-299,bytes=230-329,bytes=330-429,bytes=430-449"
+	if ranges := strings.Join(f.requested(), ","); ranges != want {
+		t.Errorf("requested %s, expect %s", ranges, want)
+	}
+}
+
+// keyOrder records the string keys in the order they are decoded and the
+// positions reported between them
+type keyOrder struct {
+	rdb.Decoder
+	keys      []string
+	positions []rdb.Position
+	// before is the number of keys decoded before each position
+	before []int
+}
+
+func (k *keyOrder) Set(key, value []byte, expiry int64) {
+	k.keys = append(k.keys, string(key))
+	k.Decoder.Set(key, value, expiry)
+}
+
+func (k *keyOrder) Idle(seconds uint64) {
+	if id, ok := k.Decoder.(rdb.IdleDecoder); ok {
+		id.Idle(seconds)
+	}
+}
+
+func (k *keyOrder) Position(pos rdb.Position) {
+	k.positions = append(k.positions, pos)
+	k.before = append(k.before, len(k.keys))
+}
+
+func TestS3ResumeFromPosition(t *testing.T) {
+	b := newRDB(9).aux("ctime", "1600000000").selectDB(0)
+	for i := 0; i < 50; i++ {
+		b.set(fmt.Sprintf("key%02d", i), strings.Repeat("v", 20))
+	}
+	f := &fakeS3{key: "dump.rdb", data: b.end()}
+	srv, src := startFakeS3(t, f)
+	defer srv.Close()
+
+	r, err := src.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := &keyOrder{Decoder: newTestDecode(newKVRecorder())}
+	err = rdb.Decode(r, full)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(full.keys) != 50 || len(full.positions) < 50 {
+		t.Fatalf("decoded %d keys and %d positions", len(full.keys), len(full.positions))
+	}
+
+	// resume from a position recorded in the middle of the third range
+	i := 0
+	for full.positions[i].Offset < 250 {
+		i++
+	}
+	// the position is recorded in the checkpoint and read back by the next run
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	cp, err := LoadCheckpoint(path, "ns", PartitionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.UpdatePosition(src, full.positions[i], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = LoadCheckpoint(path, "ns", PartitionNone); err != nil {
+		t.Fatal(err)
+	}
+	scp := cp.Source(src)
+	if scp.Status != CheckpointWriting || scp.Position == nil || *scp.Position != full.positions[i] {
+		t.Fatalf("checkpoint of the source %+v, expect position %+v", scp, full.positions[i])
+	}
+	pos := *scp.Position
+	requested := len(f.requested())
+	r, err = src.Open(pos.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	resumed := &keyOrder{Decoder: newTestDecode(newKVRecorder())}
+	if err := rdb.Resume(r, resumed, pos); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(resumed.keys, ","), strings.Join(full.keys[full.before[i]:], ","); got != want {
+		t.Errorf("resumed keys %s, expect %s", got, want)
+	}
+	if ranges := f.requested()[requested:]; ranges[0] != fmt.Sprintf("bytes=%d-%d", pos.Offset, pos.Offset+99) {
+		t.Errorf("resumed source requested %v", ranges)
+	}
+}
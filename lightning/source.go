@@ -0,0 +1,158 @@
+package lightning
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nioshield/titan-lightning/conf"
+)
+
+// Source is one input of the import, each source is written into its own engines
+type Source struct {
+	ID      int32
+	Path    string
+	Size    int64
+	ModTime int64
+	// Slots are the hash slots owned by a redis cluster node, nil for files
+	Slots *SlotSet
+	// Resumable means the source can be reopened at a byte offset
+	Resumable bool
+	// Format of the source, detected when the source is read if empty
+	Format string
+
+	open func(offset int64) (io.ReadCloser, error)
+}
+
+// Open opens the source for reading from offset, which must be zero unless
+// the source is resumable
+func (s *Source) Open(offset int64) (io.ReadCloser, error) {
+	if offset > 0 && !s.Resumable {
+		return nil, fmt.Errorf("source %s can not be opened at offset %d", s.Path, offset)
+	}
+	if s.open != nil {
+		return s.open(offset)
+	}
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParseSources expands the comma separated list of files, globs, directories,
+// multi part aof directories, s3 objects and redis cluster seeds into sources, the result is sorted by
+// path so engine IDs are stable across runs
+func ParseSources(addrs string, cfg *conf.Import) ([]*Source, error) {
+	var candidates []*Source
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if strings.HasPrefix(addr, RedisClusterScheme) {
+			srcs, err := clusterSources(strings.TrimPrefix(addr, RedisClusterScheme), &cfg.Redis)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, srcs...)
+			continue
+		}
+		if strings.HasPrefix(addr, S3Scheme) {
+			srcs, err := s3Sources(strings.TrimPrefix(addr, S3Scheme), &cfg.S3)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, srcs...)
+			continue
+		}
+		manifest, err := findManifest(addr)
+		if err != nil {
+			return nil, err
+		}
+		if manifest != "" {
+			src, err := aofDirSource(manifest)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, src)
+			continue
+		}
+		paths, err := expandSource(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, &Source{
+				Path:      path,
+				Size:      info.Size(),
+				ModTime:   info.ModTime().UnixNano(),
+				Resumable: true,
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Path < candidates[j].Path })
+
+	var sources []*Source
+	seen := make(map[string]bool)
+	for _, src := range candidates {
+		if seen[src.Path] {
+			continue
+		}
+		seen[src.Path] = true
+		src.ID = int32(len(sources))
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source found in %s", addrs)
+	}
+	return sources, nil
+}
+
+func expandSource(addr string) ([]string, error) {
+	if strings.ContainsAny(addr, "*?[") {
+		matches, err := filepath.Glob(addr)
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				paths = append(paths, filepath.Clean(match))
+			}
+		}
+		return paths, nil
+	}
+
+	info, err := os.Stat(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{filepath.Clean(addr)}, nil
+	}
+	files, err := ioutil.ReadDir(addr)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(addr, f.Name()))
+	}
+	return paths, nil
+}
@@ -0,0 +1,79 @@
+package lightning
+
+import (
+	"github.com/nioshield/titan-lightning/rdb"
+	"go.uber.org/zap"
+)
+
+// Stream strategies, titan has no stream type
+const (
+	// StreamSkip logs and drops the streams
+	StreamSkip = "skip"
+	// StreamHash imports each entry as a hash at key:id, and the ids as a
+	// sorted set at the key of the stream scored by their milliseconds
+	StreamHash = "hash"
+	// StreamDump imports the payload of DUMP as a string at the key of the
+	// stream, which can be given to RESTORE on a redis server
+	StreamDump = "dump"
+)
+
+// ValidStream reports whether s is a known stream strategy
+func ValidStream(s string) bool {
+	switch s {
+	case StreamSkip, StreamHash, StreamDump:
+		return true
+	}
+	return false
+}
+
+// WithStream sets the strategy of the streams, which are skipped by default
+func WithStream(strategy string) DecodeOption {
+	return func(r *RdbDecode) {
+		r.stream = strategy
+	}
+}
+
+// Stream imports a stream by the strategy of r
+func (r *RdbDecode) Stream(key []byte, s *rdb.Stream, expiry int64) {
+	// every object made of the stream shares its idle time
+	idle := r.idle
+	defer func() { r.idle = -1 }()
+	switch r.stream {
+	case StreamHash:
+		if r.IsExpired(expiry) {
+			return
+		}
+		for _, e := range s.Entries {
+			hkey := append(append(append([]byte{}, key...), ':'), e.ID.String()...)
+			r.idle = idle
+			r.StartHash(hkey, int64(len(e.Fields)/2), expiry)
+			for i := 0; i+1 < len(e.Fields); i += 2 {
+				r.Hset(hkey, e.Fields[i], e.Fields[i+1])
+			}
+			r.EndHash(hkey)
+		}
+		if len(s.Entries) == 0 {
+			return
+		}
+		r.idle = idle
+		r.StartZSet(key, int64(len(s.Entries)), expiry)
+		for _, e := range s.Entries {
+			r.Zadd(key, float64(e.ID.Ms), []byte(e.ID.String()))
+		}
+		r.EndZSet(key)
+		if len(s.Groups) > 0 {
+			zap.L().Warn("drop consumer groups of stream", zap.String("key", string(key)),
+				zap.Int("groups", len(s.Groups)))
+		}
+	case StreamDump:
+		if s.Dump == nil {
+			zap.L().Warn("skip stream without dump payload", zap.String("key", string(key)))
+			return
+		}
+		r.Set(key, s.Dump, expiry)
+	default:
+		r.skippedStreams++
+		zap.L().Warn("skip stream", zap.String("key", string(key)), zap.Int("entries", len(s.Entries)),
+			zap.Int("groups", len(s.Groups)), zap.String("last-id", s.LastID.String()))
+	}
+}
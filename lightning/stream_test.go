@@ -0,0 +1,60 @@
+package lightning
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/distributedio/titan/db"
+	"github.com/nioshield/titan-lightning/rdb"
+)
+
+func TestStreamStrategies(t *testing.T) {
+	s := &rdb.Stream{
+		Entries: []rdb.StreamEntry{
+			{ID: rdb.StreamID{Ms: 1000, Seq: 0}, Fields: [][]byte{[]byte("f"), []byte("v")}},
+			{ID: rdb.StreamID{Ms: 2000, Seq: 1}, Fields: [][]byte{[]byte("g"), []byte("w"), []byte("h"), []byte("x")}},
+		},
+		Length: 2,
+		Groups: []rdb.StreamGroup{{Name: []byte("group")}},
+		Dump:   []byte("\x15payload"),
+	}
+	for _, c := range []struct {
+		strategy string
+		keys     string
+	}{
+		{StreamSkip, ""},
+		{StreamHash, "s,s:1000-0,s:2000-1"},
+		{StreamDump, "s"},
+	} {
+		rec := newKVRecorder()
+		rd := newTestDecode(rec, WithStream(c.strategy))
+		rd.StartRDB()
+		rd.StartDatabase(0)
+		rd.Stream([]byte("s"), s, 0)
+		rd.EndDatabase(0)
+		rd.EndRDB()
+		if got := strings.Join(rec.metaKeys("ns", 0), ","); got != c.keys {
+			t.Errorf("%s: imported keys %q, expect %q", c.strategy, got, c.keys)
+		}
+		switch c.strategy {
+		case StreamSkip:
+			if rd.skippedStreams != 1 {
+				t.Errorf("skip: %d streams counted", rd.skippedStreams)
+			}
+		case StreamHash:
+			// the ids are a sorted set scored by their milliseconds
+			if obj, _ := rec.meta("ns", 0, "s"); obj == nil || obj.Type != db.ObjectZSet {
+				t.Errorf("hash: index of the stream is %+v", obj)
+			}
+			if obj, _ := rec.meta("ns", 0, "s:2000-1"); obj == nil || obj.Type != db.ObjectHash {
+				t.Errorf("hash: entry of the stream is %+v", obj)
+			}
+		case StreamDump:
+			if obj, val := rec.meta("ns", 0, "s"); obj == nil || obj.Type != db.ObjectString ||
+				!bytes.HasSuffix(val, s.Dump) {
+				t.Errorf("dump: stream imported as %+v %q", obj, val)
+			}
+		}
+	}
+}
@@ -0,0 +1,863 @@
+// Package rdb implements parsing of the Redis RDB file format.
+//
+// It is derived from github.com/tent/rdb and extended to the formats written
+// by Redis up to RDB version 12: 64 bit lengths, listpack encodings, binary
+// zset scores and the slot, function, module aux, idle and freq opcodes.
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Version is the newest RDB version the decoder understands
+const Version = 12
+
+// A Decoder must be implemented to parse a RDB file.
+type Decoder interface {
+	// StartRDB is called when parsing of a valid RDB file starts.
+	StartRDB()
+	// StartDatabase is called when database n starts.
+	// Once a database starts, another database will not start until EndDatabase is called.
+	StartDatabase(n int)
+	// AUX field
+	Aux(key, value []byte)
+	// ResizeDB hint
+	ResizeDatabase(dbSize, expiresSize uint32)
+	// Set is called once for each string key.
+	Set(key, value []byte, expiry int64)
+	// StartHash is called at the beginning of a hash.
+	// Hset will be called exactly length times before EndHash.
+	StartHash(key []byte, length, expiry int64)
+	// Hset is called once for each field=value pair in a hash.
+	Hset(key, field, value []byte)
+	// EndHash is called when there are no more fields in a hash.
+	EndHash(key []byte)
+	// StartSet is called at the beginning of a set.
+	// Sadd will be called exactly cardinality times before EndSet.
+	StartSet(key []byte, cardinality, expiry int64)
+	// Sadd is called once for each member of a set.
+	Sadd(key, member []byte)
+	// EndSet is called when there are no more fields in a set.
+	EndSet(key []byte)
+	// StartList is called at the beginning of a list.
+	// Rpush will be called exactly length times before EndList.
+	// If length of the list is not known, then length is -1
+	StartList(key []byte, length, expiry int64)
+	// Rpush is called once for each value in a list.
+	Rpush(key, value []byte)
+	// EndList is called when there are no more values in a list.
+	EndList(key []byte)
+	// StartZSet is called at the beginning of a sorted set.
+	// Zadd will be called exactly cardinality times before EndZSet.
+	StartZSet(key []byte, cardinality, expiry int64)
+	// Zadd is called once for each member of a sorted set.
+	Zadd(key []byte, score float64, member []byte)
+	// EndZSet is called when there are no more members in a sorted set.
+	EndZSet(key []byte)
+	// EndDatabase is called at the end of a database.
+	EndDatabase(n int)
+	// EndRDB is called when parsing of the RDB file is complete.
+	EndRDB()
+}
+
+// SlotInfoDecoder is implemented by decoders interested in the slot info
+// opcode written by cluster nodes
+type SlotInfoDecoder interface {
+	// SlotInfo is called once for each slot the dumped node owns.
+	SlotInfo(slot, size, expiresSize uint64)
+}
+
+// ObjectInfoDecoder is implemented by decoders interested in how the objects
+// are stored in the file
+type ObjectInfoDecoder interface {
+	// ObjectInfo is called after the events of each object with the type it
+	// is stored as and the bytes taken by its type, key and value.
+	ObjectInfo(key []byte, typ ValueType, size int64)
+}
+
+// IdleDecoder is implemented by decoders interested in the LRU idle time of
+// the objects, written by servers with a LRU maxmemory-policy
+type IdleDecoder interface {
+	// Idle is called before the events of an object with the seconds since
+	// the object was last accessed when the file was written.
+	Idle(seconds uint64)
+}
+
+// Position is a point between two objects of a RDB file, where the decoding
+// can be resumed
+type Position struct {
+	Offset  int64 `json:"offset"`
+	Version int   `json:"version"`
+	DB      int   `json:"db"`
+	// CRC is the checksum of the bytes before Offset, zero if unknown
+	CRC uint64 `json:"crc,omitempty"`
+	// CTime is the ctime aux field of the file, replayed by Resume
+	CTime string `json:"ctime,omitempty"`
+}
+
+// PositionDecoder is implemented by decoders which record where the decoding
+// can be resumed
+type PositionDecoder interface {
+	// Position is called before each top level opcode of a database which
+	// does not belong to a pending object.
+	Position(pos Position)
+}
+
+// ErrTruncated is returned when the file ends before the EOF opcode and the
+// checksum
+var ErrTruncated = errors.New("rdb: unexpected end of file, the dump is truncated")
+
+// DecodeError is an error of Decode or Resume with the offset of the file
+// where it occurred
+type DecodeError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decode parses a RDB file from r and calls the decode hooks on d. The CRC64
+// checksum of files of version 5 and above is verified at the end, unless it
+// was disabled when the file was written.
+func Decode(r io.Reader, d Decoder) error {
+	decoder := &decode{event: d, intBuf: make([]byte, 8), r: &countReader{r: newByteReader(r)}, verify: true}
+	if err := decoder.checkHeader(); err != nil {
+		return decoder.wrap(err)
+	}
+	decoder.event.StartRDB()
+	return decoder.wrap(decoder.decode(0, false))
+}
+
+// Resume parses a RDB file from pos, a position reported by a PositionDecoder,
+// r must start at pos.Offset of the file. StartRDB and StartDatabase are
+// called before the remaining objects as if the file started at pos. The
+// checksum is verified only if the checksum of pos is known.
+func Resume(r io.Reader, d Decoder, pos Position) error {
+	if pos.Version < 1 || pos.Version > Version {
+		return fmt.Errorf("rdb: invalid RDB version number %d", pos.Version)
+	}
+	decoder := &decode{
+		event:   d,
+		intBuf:  make([]byte, 8),
+		r:       &countReader{r: newByteReader(r), n: pos.Offset, crc: pos.CRC},
+		version: pos.Version,
+		verify:  pos.CRC != 0,
+	}
+	decoder.event.StartRDB()
+	if pos.CTime != "" {
+		decoder.ctime = pos.CTime
+		decoder.event.Aux([]byte("ctime"), []byte(pos.CTime))
+	}
+	decoder.event.StartDatabase(pos.DB)
+	return decoder.wrap(decoder.decode(uint64(pos.DB), true))
+}
+
+// wrap adds the offset to the errors of the file, an early end of the file is
+// reported as ErrTruncated
+func (d *decode) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return &DecodeError{Offset: d.offset(), Err: err}
+}
+
+// DecodeDump decodes a byte slice from the Redis DUMP command. The dump does not contain the
+// database, key or expiry, so they must be included in the function call (but
+// can be zero values).
+func DecodeDump(dump []byte, db int, key []byte, expiry int64, d Decoder) error {
+	err := verifyDump(dump)
+	if err != nil {
+		return err
+	}
+
+	decoder := &decode{event: d, intBuf: make([]byte, 8), r: bytes.NewReader(dump[1:])}
+	decoder.event.StartRDB()
+	decoder.event.StartDatabase(db)
+
+	err = decoder.readObject(key, ValueType(dump[0]), expiry)
+
+	decoder.event.EndDatabase(db)
+	decoder.event.EndRDB()
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// countReader counts the bytes consumed by the decoder and their checksum,
+// the bytes are also kept in raw while capture is set
+type countReader struct {
+	r       byteReader
+	n       int64
+	crc     uint64
+	capture bool
+	raw     []byte
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	cr.crc = crc64Update(cr.crc, b[:n])
+	if cr.capture {
+		cr.raw = append(cr.raw, b[:n]...)
+	}
+	return n, err
+}
+
+func (cr *countReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+		cr.crc = crc64Table[byte(cr.crc)^b] ^ (cr.crc >> 8)
+		if cr.capture {
+			cr.raw = append(cr.raw, b)
+		}
+	}
+	return b, err
+}
+
+// offset returns the number of bytes of the file consumed so far
+func (d *decode) offset() int64 {
+	if cr, ok := d.r.(*countReader); ok {
+		return cr.n
+	}
+	return 0
+}
+
+// capture keeps the bytes read from now on, and returns the function building
+// the DUMP payload of an object of typ whose value is the bytes kept, which
+// returns nil if the bytes can not be kept
+func (d *decode) capture() func(typ ValueType) []byte {
+	cr, ok := d.r.(*countReader)
+	if !ok {
+		return func(ValueType) []byte { return nil }
+	}
+	cr.raw, cr.capture = cr.raw[:0], true
+	return func(typ ValueType) []byte {
+		cr.capture = false
+		dump := append([]byte{byte(typ)}, cr.raw...)
+		dump = append(dump, byte(d.version), byte(d.version>>8))
+		n := len(dump)
+		dump = append(dump, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(dump[n:], crc64Digest(dump[:n]))
+		return dump
+	}
+}
+
+// checksum returns the checksum of the bytes consumed so far
+func (d *decode) checksum() uint64 {
+	if cr, ok := d.r.(*countReader); ok {
+		return cr.crc
+	}
+	return 0
+}
+
+// newByteReader uses r directly if it is already buffered, so that the caller
+// can continue reading r right after the RDB payload
+func newByteReader(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+type decode struct {
+	event   Decoder
+	intBuf  []byte
+	r       byteReader
+	version int
+	// verify is set if the checksum covers the whole file
+	verify bool
+	ctime  string
+}
+
+// ValueType is the type of an object in the RDB file
+type ValueType byte
+
+const (
+	TypeString ValueType = 0
+	TypeList   ValueType = 1
+	TypeSet    ValueType = 2
+	TypeZSet   ValueType = 3
+	TypeHash   ValueType = 4
+	TypeZSet2  ValueType = 5
+	TypeModule ValueType = 6
+
+	TypeModule2 ValueType = 7
+
+	TypeHashZipmap          ValueType = 9
+	TypeListZiplist         ValueType = 10
+	TypeSetIntset           ValueType = 11
+	TypeZSetZiplist         ValueType = 12
+	TypeHashZiplist         ValueType = 13
+	TypeListQuicklist       ValueType = 14
+	TypeStreamListpacks     ValueType = 15
+	TypeHashListpack        ValueType = 16
+	TypeZSetListpack        ValueType = 17
+	TypeListQuicklist2      ValueType = 18
+	TypeStreamListpacks2    ValueType = 19
+	TypeSetListpack         ValueType = 20
+	TypeStreamListpacks3    ValueType = 21
+	TypeHashMetadataPreGA   ValueType = 22
+	TypeHashListpackExPreGA ValueType = 23
+	TypeHashMetadata        ValueType = 24
+	TypeHashListpackEx      ValueType = 25
+)
+
+// Encoding returns the name of the encoding of an object stored as t
+func (t ValueType) Encoding() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "linkedlist"
+	case TypeSet, TypeHash, TypeHashMetadataPreGA, TypeHashMetadata:
+		return "hashtable"
+	case TypeZSet, TypeZSet2:
+		return "skiplist"
+	case TypeModule, TypeModule2:
+		return "module"
+	case TypeHashZipmap:
+		return "zipmap"
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist:
+		return "ziplist"
+	case TypeSetIntset:
+		return "intset"
+	case TypeListQuicklist, TypeListQuicklist2:
+		return "quicklist"
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return "stream"
+	case TypeHashListpack, TypeZSetListpack, TypeSetListpack, TypeHashListpackExPreGA, TypeHashListpackEx:
+		return "listpack"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+const (
+	rdb6bitLen  = 0
+	rdb14bitLen = 1
+	rdbEncVal   = 3
+	rdb32bitLen = 0x80
+	rdb64bitLen = 0x81
+
+	rdbFlagSlotInfo  = 0xf4
+	rdbFlagFunction2 = 0xf5
+	rdbFlagFunction  = 0xf6
+	rdbFlagModuleAux = 0xf7
+	rdbFlagIdle      = 0xf8
+	rdbFlagFreq      = 0xf9
+	rdbFlagAux       = 0xfa
+	rdbFlagResizeDB  = 0xfb
+	rdbFlagExpiryMS  = 0xfc
+	rdbFlagExpiry    = 0xfd
+	rdbFlagSelectDB  = 0xfe
+	rdbFlagEOF       = 0xff
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
+
+func (d *decode) decode(db uint64, started bool) error {
+	var expiry int64
+	firstDB := !started
+	// pending is set by the opcodes which precede an object
+	pending := false
+	pd, _ := d.event.(PositionDecoder)
+	od, _ := d.event.(ObjectInfoDecoder)
+	id, _ := d.event.(IdleDecoder)
+	for {
+		if pd != nil && !pending && !firstDB {
+			pd.Position(Position{Offset: d.offset(), Version: d.version, DB: int(db), CRC: d.checksum(), CTime: d.ctime})
+		}
+		objType, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch objType {
+		case rdbFlagAux:
+			auxKey, err := d.readString()
+			if err != nil {
+				return err
+			}
+			auxVal, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if string(auxKey) == "ctime" {
+				d.ctime = string(auxVal)
+			}
+			d.event.Aux(auxKey, auxVal)
+		case rdbFlagResizeDB:
+			dbSize, _, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			expiresSize, _, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			d.event.ResizeDatabase(uint32(dbSize), uint32(expiresSize))
+		case rdbFlagExpiryMS:
+			_, err := io.ReadFull(d.r, d.intBuf)
+			if err != nil {
+				return err
+			}
+			expiry = int64(binary.LittleEndian.Uint64(d.intBuf))
+			pending = true
+		case rdbFlagExpiry:
+			_, err := io.ReadFull(d.r, d.intBuf[:4])
+			if err != nil {
+				return err
+			}
+			expiry = int64(binary.LittleEndian.Uint32(d.intBuf)) * 1000
+			pending = true
+		case rdbFlagSelectDB:
+			if !firstDB {
+				d.event.EndDatabase(int(db))
+			}
+			firstDB = false
+			db, _, err = d.readLength()
+			if err != nil {
+				return err
+			}
+			d.event.StartDatabase(int(db))
+		case rdbFlagSlotInfo:
+			if err := d.readSlotInfo(); err != nil {
+				return err
+			}
+		case rdbFlagFunction2:
+			// function libraries are not data, skip the library code
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+		case rdbFlagFunction:
+			return fmt.Errorf("rdb: unsupported pre-GA function opcode")
+		case rdbFlagModuleAux:
+			if err := d.skipModuleAux(); err != nil {
+				return err
+			}
+		case rdbFlagIdle:
+			idle, _, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			if id != nil {
+				id.Idle(idle)
+			}
+			pending = true
+		case rdbFlagFreq:
+			if _, err := d.r.ReadByte(); err != nil {
+				return err
+			}
+			pending = true
+		case rdbFlagEOF:
+			// consume the checksum, so that the caller can continue reading
+			// right after the payload, a zero checksum means it was disabled
+			if d.version >= 5 {
+				sum := d.checksum()
+				if _, err := io.ReadFull(d.r, d.intBuf); err != nil {
+					return err
+				}
+				expected := binary.LittleEndian.Uint64(d.intBuf)
+				if d.verify && expected != 0 && expected != sum {
+					return fmt.Errorf("rdb: checksum mismatch, expected %016x but computed %016x", expected, sum)
+				}
+			}
+			d.event.EndDatabase(int(db))
+			d.event.EndRDB()
+			return nil
+		default:
+			start := d.offset() - 1
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			err = d.readObject(key, ValueType(objType), expiry)
+			if err != nil {
+				return err
+			}
+			if od != nil {
+				od.ObjectInfo(key, ValueType(objType), d.offset()-start)
+			}
+			expiry = 0
+			pending = false
+		}
+	}
+}
+
+func (d *decode) readSlotInfo() error {
+	slot, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	size, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	expiresSize, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if sd, ok := d.event.(SlotInfoDecoder); ok {
+		sd.SlotInfo(slot, size, expiresSize)
+	}
+	return nil
+}
+
+func (d *decode) skipModuleAux() error {
+	// module id, the when opcode and the when value precede the framed payload
+	if _, _, err := d.readLength(); err != nil {
+		return err
+	}
+	if _, _, err := d.readLength(); err != nil {
+		return err
+	}
+	if _, _, err := d.readLength(); err != nil {
+		return err
+	}
+	_, err := d.readModuleValue()
+	return err
+}
+
+func (d *decode) readObject(key []byte, typ ValueType, expiry int64) error {
+	switch typ {
+	case TypeString:
+		value, err := d.readString()
+		if err != nil {
+			return err
+		}
+		d.event.Set(key, value, expiry)
+	case TypeList:
+		length, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		d.event.StartList(key, int64(length), expiry)
+		for i := uint64(0); i < length; i++ {
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.event.Rpush(key, value)
+		}
+		d.event.EndList(key)
+	case TypeListQuicklist:
+		length, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		d.event.StartList(key, int64(-1), expiry)
+		for i := uint64(0); i < length; i++ {
+			if err := d.readZiplist(key, 0, false); err != nil {
+				return err
+			}
+		}
+		d.event.EndList(key)
+	case TypeListQuicklist2:
+		return d.readQuicklist2(key, expiry)
+	case TypeSet:
+		cardinality, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		d.event.StartSet(key, int64(cardinality), expiry)
+		for i := uint64(0); i < cardinality; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.event.Sadd(key, member)
+		}
+		d.event.EndSet(key)
+	case TypeZSet, TypeZSet2:
+		cardinality, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		d.event.StartZSet(key, int64(cardinality), expiry)
+		for i := uint64(0); i < cardinality; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if typ == TypeZSet2 {
+				score, err = d.readBinaryFloat64()
+			} else {
+				score, err = d.readFloat64()
+			}
+			if err != nil {
+				return err
+			}
+			d.event.Zadd(key, score, member)
+		}
+		d.event.EndZSet(key)
+	case TypeHash:
+		length, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		d.event.StartHash(key, int64(length), expiry)
+		for i := uint64(0); i < length; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.event.Hset(key, field, value)
+		}
+		d.event.EndHash(key)
+	case TypeHashZipmap:
+		return d.readZipmap(key, expiry)
+	case TypeListZiplist:
+		return d.readZiplist(key, expiry, true)
+	case TypeSetIntset:
+		return d.readIntset(key, expiry)
+	case TypeZSetZiplist:
+		return d.readZiplistZset(key, expiry)
+	case TypeHashZiplist:
+		return d.readZiplistHash(key, expiry)
+	case TypeHashListpack:
+		return d.readListpackHash(key, expiry)
+	case TypeZSetListpack:
+		return d.readListpackZset(key, expiry)
+	case TypeSetListpack:
+		return d.readListpackSet(key, expiry)
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return d.readStream(key, typ, expiry)
+	case TypeModule2:
+		return d.readModule(key, expiry)
+	case TypeModule:
+		id, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rdb: value of module %s for key %s is not framed and can not be skipped", ModuleName(id), key)
+	default:
+		return fmt.Errorf("rdb: unsupported object type %d for key %s", typ, key)
+	}
+	return nil
+}
+
+func (d *decode) checkHeader() error {
+	header := make([]byte, 9)
+	_, err := io.ReadFull(d.r, header)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[:5], []byte("REDIS")) {
+		return fmt.Errorf("rdb: invalid file format")
+	}
+
+	version, _ := strconv.ParseInt(string(header[5:]), 10, 64)
+	if version < 1 || version > Version {
+		return fmt.Errorf("rdb: invalid RDB version number %d", version)
+	}
+	d.version = int(version)
+
+	return nil
+}
+
+func (d *decode) readString() ([]byte, error) {
+	length, encoded, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if encoded {
+		switch length {
+		case rdbEncInt8:
+			i, err := d.readUint8()
+			return []byte(strconv.FormatInt(int64(int8(i)), 10)), err
+		case rdbEncInt16:
+			i, err := d.readUint16()
+			return []byte(strconv.FormatInt(int64(int16(i)), 10)), err
+		case rdbEncInt32:
+			i, err := d.readUint32()
+			return []byte(strconv.FormatInt(int64(int32(i)), 10)), err
+		case rdbEncLZF:
+			clen, _, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			ulen, _, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			compressed := make([]byte, clen)
+			_, err = io.ReadFull(d.r, compressed)
+			if err != nil {
+				return nil, err
+			}
+			decompressed, err := lzfDecompress(compressed, int(ulen))
+			if err != nil {
+				return nil, err
+			}
+			return decompressed, nil
+		default:
+			return nil, fmt.Errorf("rdb: unknown string encoding %d", length)
+		}
+	}
+
+	str := make([]byte, length)
+	_, err = io.ReadFull(d.r, str)
+	return str, err
+}
+
+func (d *decode) readUint8() (uint8, error) {
+	b, err := d.r.ReadByte()
+	return uint8(b), err
+}
+
+func (d *decode) readUint16() (uint16, error) {
+	_, err := io.ReadFull(d.r, d.intBuf[:2])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(d.intBuf), nil
+}
+
+func (d *decode) readUint32() (uint32, error) {
+	_, err := io.ReadFull(d.r, d.intBuf[:4])
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(d.intBuf), nil
+}
+
+func (d *decode) readUint64() (uint64, error) {
+	_, err := io.ReadFull(d.r, d.intBuf)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(d.intBuf), nil
+}
+
+// Doubles are saved as strings prefixed by an unsigned
+// 8 bit integer specifying the length of the representation.
+// This 8 bit integer has special values in order to specify the following
+// conditions:
+// 253: not a number
+// 254: + inf
+// 255: - inf
+func (d *decode) readFloat64() (float64, error) {
+	length, err := d.readUint8()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(0), nil
+	case 255:
+		return math.Inf(-1), nil
+	default:
+		floatBytes := make([]byte, length)
+		_, err := io.ReadFull(d.r, floatBytes)
+		if err != nil {
+			return 0, err
+		}
+		f, err := strconv.ParseFloat(string(floatBytes), 64)
+		return f, err
+	}
+}
+
+// readBinaryFloat64 reads a little endian IEEE 754 double used since RDB version 8
+func (d *decode) readBinaryFloat64() (float64, error) {
+	u, err := d.readUint64()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(u), nil
+}
+
+func (d *decode) readLength() (uint64, bool, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	// The first two bits of the first byte are used to indicate the length encoding type
+	switch (b & 0xc0) >> 6 {
+	case rdb6bitLen:
+		// When the first two bits are 00, the next 6 bits are the length.
+		return uint64(b & 0x3f), false, nil
+	case rdb14bitLen:
+		// When the first two bits are 01, the next 14 bits are the length.
+		bb, err := d.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return (uint64(b&0x3f) << 8) | uint64(bb), false, nil
+	case rdbEncVal:
+		// When the first two bits are 11, the next object is encoded.
+		// The next 6 bits indicate the encoding type.
+		return uint64(b & 0x3f), true, nil
+	}
+	// When the first two bits are 10, the whole byte tells if
+	// a big endian 32 or 64 bit length follows.
+	switch b {
+	case rdb32bitLen:
+		_, err := io.ReadFull(d.r, d.intBuf[:4])
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(d.intBuf)), false, nil
+	case rdb64bitLen:
+		_, err := io.ReadFull(d.r, d.intBuf)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(d.intBuf), false, nil
+	}
+	return 0, false, fmt.Errorf("rdb: unknown length encoding %d", b)
+}
+
+func verifyDump(d []byte) error {
+	if len(d) < 10 {
+		return fmt.Errorf("rdb: invalid dump length")
+	}
+	version := binary.LittleEndian.Uint16(d[len(d)-10:])
+	if version > uint16(Version) {
+		return fmt.Errorf("rdb: invalid version %d, expecting at most %d", version, Version)
+	}
+
+	if binary.LittleEndian.Uint64(d[len(d)-8:]) != crc64Digest(d[:len(d)-8]) {
+		return fmt.Errorf("rdb: invalid CRC checksum")
+	}
+
+	return nil
+}
@@ -0,0 +1,591 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// recorder folds the events of a file into its objects, each one formatted
+// as its type and its sorted elements
+type recorder struct {
+	NopDecoder
+	db      int
+	started int
+	ended   int
+	aux     map[string]string
+	objects map[string]string
+	expiry  map[string]int64
+	idle    map[string]uint64
+	slots   []uint64
+	pos     []Position
+	elems   []string
+	length  int64
+	// lastIdle is the idle time of the next object
+	lastIdle uint64
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		aux:     make(map[string]string),
+		objects: make(map[string]string),
+		expiry:  make(map[string]int64),
+		idle:    make(map[string]uint64),
+	}
+}
+
+func (r *recorder) name(key []byte) string {
+	return strconv.Itoa(r.db) + "/" + string(key)
+}
+
+func (r *recorder) StartRDB()                     { r.started++ }
+func (r *recorder) EndRDB()                       { r.ended++ }
+func (r *recorder) StartDatabase(n int)           { r.db = n }
+func (r *recorder) Aux(key, value []byte)         { r.aux[string(key)] = string(value) }
+func (r *recorder) Idle(seconds uint64)           { r.lastIdle = seconds }
+func (r *recorder) Position(pos Position)         { r.pos = append(r.pos, pos) }
+func (r *recorder) SlotInfo(slot, size, _ uint64) { r.slots = append(r.slots, slot, size) }
+
+func (r *recorder) start(key []byte, length, expiry int64) {
+	r.elems, r.length = nil, length
+	if expiry != 0 {
+		r.expiry[r.name(key)] = expiry
+	}
+	if r.lastIdle != 0 {
+		r.idle[r.name(key)] = r.lastIdle
+		r.lastIdle = 0
+	}
+}
+
+// end records the object, the elements of sets, hashes and zsets are sorted
+func (r *recorder) end(typ string, key []byte, sorted bool) {
+	if r.length >= 0 && int64(len(r.elems)) != r.length {
+		r.objects[r.name(key)] = fmt.Sprintf("%s of length %d with %d elements", typ, r.length, len(r.elems))
+		return
+	}
+	if sorted {
+		sort.Strings(r.elems)
+	}
+	r.objects[r.name(key)] = typ + " " + strings.Join(r.elems, ",")
+}
+
+func (r *recorder) Set(key, value []byte, expiry int64) {
+	r.start(key, -1, expiry)
+	r.objects[r.name(key)] = "string " + string(value)
+}
+
+func (r *recorder) StartHash(key []byte, length, expiry int64) { r.start(key, length, expiry) }
+func (r *recorder) Hset(key, field, value []byte) {
+	r.elems = append(r.elems, string(field)+"="+string(value))
+}
+func (r *recorder) EndHash(key []byte) { r.end("hash", key, true) }
+
+func (r *recorder) StartSet(key []byte, cardinality, expiry int64) { r.start(key, cardinality, expiry) }
+func (r *recorder) Sadd(key, member []byte)                        { r.elems = append(r.elems, string(member)) }
+func (r *recorder) EndSet(key []byte)                              { r.end("set", key, true) }
+
+func (r *recorder) StartList(key []byte, length, expiry int64) { r.start(key, length, expiry) }
+func (r *recorder) Rpush(key, value []byte)                    { r.elems = append(r.elems, string(value)) }
+func (r *recorder) EndList(key []byte)                         { r.end("list", key, false) }
+
+func (r *recorder) StartZSet(key []byte, cardinality, expiry int64) {
+	r.start(key, cardinality, expiry)
+}
+func (r *recorder) Zadd(key []byte, score float64, member []byte) {
+	r.elems = append(r.elems, string(member)+"="+strconv.FormatFloat(score, 'g', -1, 64))
+}
+func (r *recorder) EndZSet(key []byte) { r.end("zset", key, true) }
+
+// dumpBuilder writes the RDB files of the tests
+type dumpBuilder struct {
+	bytes.Buffer
+}
+
+func newDump(version int) *dumpBuilder {
+	b := &dumpBuilder{}
+	fmt.Fprintf(b, "REDIS%04d", version)
+	return b
+}
+
+func (b *dumpBuilder) length(n uint64) *dumpBuilder {
+	var buf [8]byte
+	switch {
+	case n < 1<<6:
+		b.WriteByte(byte(n))
+	case n < 1<<14:
+		b.WriteByte(byte(n>>8) | 0x40)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		b.WriteByte(rdb32bitLen)
+		binary.BigEndian.PutUint32(buf[:4], uint32(n))
+		b.Write(buf[:4])
+	default:
+		b.WriteByte(rdb64bitLen)
+		binary.BigEndian.PutUint64(buf[:], n)
+		b.Write(buf[:])
+	}
+	return b
+}
+
+func (b *dumpBuilder) str(s string) *dumpBuilder {
+	b.length(uint64(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *dumpBuilder) aux(key, val string) *dumpBuilder {
+	b.WriteByte(rdbFlagAux)
+	return b.str(key).str(val)
+}
+
+func (b *dumpBuilder) selectDB(n uint64) *dumpBuilder {
+	b.WriteByte(rdbFlagSelectDB)
+	return b.length(n)
+}
+
+func (b *dumpBuilder) resizeDB(size, expires uint64) *dumpBuilder {
+	b.WriteByte(rdbFlagResizeDB)
+	return b.length(size).length(expires)
+}
+
+// object writes the type and the key of an object, its value follows
+func (b *dumpBuilder) object(typ ValueType, key string) *dumpBuilder {
+	b.WriteByte(byte(typ))
+	return b.str(key)
+}
+
+func (b *dumpBuilder) expireMs(ms int64) *dumpBuilder {
+	b.WriteByte(rdbFlagExpiryMS)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	b.Write(buf[:])
+	return b
+}
+
+// float writes a binary zset score
+func (b *dumpBuilder) float(f float64) *dumpBuilder {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	b.Write(buf[:])
+	return b
+}
+
+func (b *dumpBuilder) set(key, val string) *dumpBuilder {
+	return b.object(TypeString, key).str(val)
+}
+
+// end writes the EOF opcode and the checksum of the file
+func (b *dumpBuilder) end() []byte {
+	b.WriteByte(rdbFlagEOF)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], crc64Digest(b.Bytes()))
+	b.Write(buf[:])
+	return b.Bytes()
+}
+
+// listpack encodes the entries, which are strings or int64
+func listpack(entries ...interface{}) string {
+	var body bytes.Buffer
+	for _, e := range entries {
+		var entry []byte
+		switch v := e.(type) {
+		case string:
+			if len(v) < 64 {
+				entry = append([]byte{0x80 | byte(len(v))}, v...)
+			} else {
+				entry = append([]byte{0xe0 | byte(len(v)>>8), byte(len(v))}, v...)
+			}
+		case int64:
+			switch {
+			case v >= 0 && v < 128:
+				entry = []byte{byte(v)}
+			case v >= -4096 && v < 4096:
+				entry = []byte{0xc0 | byte(v>>8)&0x1f, byte(v)}
+			default:
+				entry = make([]byte, 9)
+				entry[0] = 0xf4
+				binary.LittleEndian.PutUint64(entry[1:], uint64(v))
+			}
+		}
+		body.Write(entry)
+		// the back length, 7 bits per byte
+		if n := len(entry); n <= 127 {
+			body.WriteByte(byte(n))
+		} else {
+			body.Write([]byte{byte(n >> 7), byte(n&127) | 128})
+		}
+	}
+	body.WriteByte(listpackEOF)
+	lp := make([]byte, 6, 6+body.Len())
+	binary.LittleEndian.PutUint32(lp, uint32(6+body.Len()))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(len(entries)))
+	return string(append(lp, body.Bytes()...))
+}
+
+// ziplist encodes the entries, which are strings or int64
+func ziplist(entries ...interface{}) string {
+	var body bytes.Buffer
+	prev := 0
+	for _, e := range entries {
+		entry := []byte{byte(prev)}
+		switch v := e.(type) {
+		case string:
+			entry = append(append(entry, byte(len(v))), v...)
+		case int64:
+			entry = append(entry, rdbZiplistInt16, byte(v), byte(v>>8))
+		}
+		body.Write(entry)
+		prev = len(entry)
+	}
+	body.WriteByte(0xff)
+	zl := make([]byte, 10, 10+body.Len())
+	binary.LittleEndian.PutUint32(zl, uint32(10+body.Len()))
+	binary.LittleEndian.PutUint32(zl[4:], uint32(10+body.Len()-1-prev))
+	binary.LittleEndian.PutUint16(zl[8:], uint16(len(entries)))
+	return string(append(zl, body.Bytes()...))
+}
+
+func decodeFile(t *testing.T, data []byte) *recorder {
+	t.Helper()
+	r := newRecorder()
+	if err := Decode(bytes.NewReader(data), r); err != nil {
+		t.Fatal(err)
+	}
+	if r.started != 1 || r.ended != 1 {
+		t.Fatalf("StartRDB called %d times and EndRDB %d times", r.started, r.ended)
+	}
+	return r
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	for _, c := range []struct {
+		file    string
+		objects map[string]string
+		// elems holds the number of elements of the large objects
+		elems  map[string]int
+		expiry map[string]int64
+	}{
+		{file: "empty_database.rdb"},
+		{file: "multiple_databases.rdb", objects: map[string]string{
+			"0/key_in_zeroth_database": "string zero",
+			"2/key_in_second_database": "string second",
+		}},
+		{file: "easily_compressible_string_key.rdb", objects: map[string]string{
+			"0/" + strings.Repeat("a", 200): "string Key that redis should compress easily",
+		}},
+		{file: "integer_keys.rdb", objects: map[string]string{
+			"0/125":        "string Positive 8 bit integer",
+			"0/-123":       "string Negative 8 bit integer",
+			"0/43947":      "string Positive 16 bit integer",
+			"0/-29477":     "string Negative 16 bit integer",
+			"0/183358245":  "string Positive 32 bit integer",
+			"0/-183358245": "string Negative 32 bit integer",
+		}},
+		{file: "intset_16.rdb", objects: map[string]string{"0/intset_16": "set 32764,32765,32766"}},
+		{file: "intset_32.rdb", objects: map[string]string{"0/intset_32": "set 2147418108,2147418109,2147418110"}},
+		{file: "intset_64.rdb", objects: map[string]string{
+			"0/intset_64": "set 9223090557583032316,9223090557583032317,9223090557583032318",
+		}},
+		{file: "regular_set.rdb", objects: map[string]string{"0/regular_set": "set alpha,beta,delta,gamma,kappa,phi"}},
+		{file: "hash_as_ziplist.rdb", objects: map[string]string{
+			"0/zipmap_compresses_easily": "hash a=aa,aa=aaaa,aaaaa=aaaaaaaaaaaaaa",
+		}},
+		{file: "zipmap_that_compresses_easily.rdb", objects: map[string]string{
+			"0/zipmap_compresses_easily": "hash a=aa,aa=aaaa,aaaaa=aaaaaaaaaaaaaa",
+		}},
+		{file: "zipmap_that_doesnt_compress.rdb", objects: map[string]string{
+			"0/zimap_doesnt_compress": "hash MKD1G6=2,YNNXK=F7TI",
+		}},
+		{file: "zipmap_with_big_values.rdb", elems: map[string]int{"0/zipmap_with_big_values": 5}},
+		{file: "dictionary.rdb", elems: map[string]int{"0/force_dictionary": 1000}},
+		{file: "ziplist_that_compresses_easily.rdb", objects: map[string]string{
+			"0/ziplist_compresses_easily": "list aaaaaa,aaaaaaaaaaaa,aaaaaaaaaaaaaaaaaa,aaaaaaaaaaaaaaaaaaaaaaaa," +
+				"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa,aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		}},
+		{file: "ziplist_that_doesnt_compress.rdb", objects: map[string]string{
+			"0/ziplist_doesnt_compress": "list aj2410,cc953a17a8e096e76a44169ad3f9ac87c5f8248a403274416179aa9fbd852344",
+		}},
+		{file: "ziplist_with_integers.rdb", objects: map[string]string{
+			"0/ziplist_with_integers": "list 0,1,2,3,4,5,6,7,8,9,10,11,12,-2,13,25,-61,63,16380,-16000,65535,-65523," +
+				"4194304,9223372036854775807",
+		}},
+		{file: "linkedlist.rdb", elems: map[string]int{"0/force_linkedlist": 1000}},
+		{file: "rdb_v7_list_quicklist.rdb", objects: map[string]string{"0/foo": "list bar,baz,boo"}},
+		{file: "sorted_set_as_ziplist.rdb", objects: map[string]string{
+			"0/sorted_set_as_ziplist": "zset 523af537946b79c4f8369ed39ba78605=3.423,8b6ba6718a786daefa69438148361901=1," +
+				"cb7a24bb7528f934b841b34c3a73e0c7=2.37",
+		}},
+		{file: "regular_sorted_set.rdb", elems: map[string]int{"0/force_sorted_set": 500}},
+		{file: "keys_with_expiry.rdb", objects: map[string]string{
+			"0/expires_ms_precision": "string 2022-12-25 10:11:12.573 UTC",
+		}, expiry: map[string]int64{"0/expires_ms_precision": 1671963072573}},
+		{file: "keys_with_mixed_expiry.rdb", objects: map[string]string{
+			"0/key01": "string this does expire",
+			"0/key02": "string this does not expire",
+			"0/key03": "string this does not expire",
+			"0/key04": "string this does expire",
+		}, expiry: map[string]int64{"0/key01": 2080245030932, "0/key04": 2080245034115}},
+		{file: "rdb_version_5_with_checksum.rdb", objects: map[string]string{
+			"0/abc":          "string def",
+			"0/abcd":         "string efgh",
+			"0/abcdef":       "string abcdef",
+			"0/bar":          "string baz",
+			"0/foo":          "string bar",
+			"0/longerstring": "string thisisalongerstring.idontknowwhatitmeans",
+		}},
+	} {
+		t.Run(c.file, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "v7", c.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := decodeFile(t, data)
+			for key, expect := range c.objects {
+				if got := r.objects[key]; got != expect {
+					t.Errorf("%s: got %q, expect %q", key, got, expect)
+				}
+			}
+			for key, n := range c.elems {
+				obj, ok := r.objects[key]
+				if got := len(strings.Split(obj, ",")); !ok || got != n {
+					t.Errorf("%s: got %d elements, expect %d", key, got, n)
+				}
+			}
+			if n := len(c.objects) + len(c.elems); len(r.objects) < n || c.objects != nil && len(r.objects) != n {
+				t.Errorf("decoded %d objects, expect %d", len(r.objects), n)
+			}
+			for key, obj := range r.objects {
+				if strings.Contains(obj, " of length ") {
+					t.Errorf("%s: %s", key, obj)
+				}
+			}
+			if len(r.expiry) != len(c.expiry) {
+				t.Errorf("decoded %d expiries, expect %d", len(r.expiry), len(c.expiry))
+			}
+			for key, expect := range c.expiry {
+				if got := r.expiry[key]; got != expect {
+					t.Errorf("%s: expiry %d, expect %d", key, got, expect)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeFixtureKeyLengths(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "v7", "uncompressible_string_keys.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths := make(map[string]int)
+	for key, obj := range decodeFile(t, data).objects {
+		lengths[obj] = len(key) - len("0/")
+	}
+	for obj, n := range map[string]int{
+		"string Key length within 6 bits":                          60,
+		"string Key length more than 6 bits but less than 14 bits": 16382,
+		"string Key length more than 14 bits but less than 32":     16386,
+	} {
+		if lengths[obj] != n {
+			t.Errorf("key of %q has %d bytes, expect %d", obj, lengths[obj], n)
+		}
+	}
+}
+
+// redis7Dump writes a dump of the encodings of Redis 7
+func redis7Dump(version int) []byte {
+	b := newDump(version).aux("redis-ver", "7.2.4").aux("redis-bits", "64").aux("ctime", "1700000000").
+		aux("aof-base", "0")
+	// a function library, then the aux data of a module with a framed value
+	b.WriteByte(rdbFlagFunction2)
+	b.str("#!lua name=lib\nredis.register_function('f', function() return 1 end)")
+	b.WriteByte(rdbFlagModuleAux)
+	b.length(0x1234 << 10).length(rdbModuleOpcodeUint).length(2)
+	b.length(rdbModuleOpcodeString).str("aux").length(rdbModuleOpcodeEOF)
+
+	b.selectDB(0).resizeDB(12, 1)
+	b.WriteByte(rdbFlagSlotInfo)
+	b.length(1234).length(12).length(1)
+	b.object(TypeHashListpack, "hash").str(listpack("f1", "v1", "f2", int64(-3), "f3", int64(100000)))
+	b.object(TypeZSetListpack, "zset").str(listpack("a", "1.5", "b", int64(3), "c", "-inf"))
+	b.object(TypeSetListpack, "set").str(listpack("x", int64(7), int64(-4000)))
+	b.object(TypeSetIntset, "intset").str("\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\xff\xff")
+	big := strings.Repeat("p", 300)
+	b.object(TypeListQuicklist2, "list").length(2).
+		length(rdbQuicklistNodePacked).str(listpack("a", "b", int64(1), big)).
+		length(rdbQuicklistNodePlain).str(big)
+	b.object(TypeListQuicklist, "quicklist").length(2).str(ziplist("a", int64(2))).str(ziplist("c"))
+	b.object(TypeHashZiplist, "ziphash").str(ziplist("f", "v", "n", int64(-1)))
+	b.object(TypeZSetZiplist, "zipzset").str(ziplist("m", "2.5"))
+	b.object(TypeZSet2, "zset2").length(2).str("a").float(1.5).str("b").float(math.Inf(-1))
+	// the 64 bit lengths of Redis 7
+	b.object(TypeSet, "set64")
+	b.WriteByte(rdb64bitLen)
+	b.Write([]byte{0, 0, 0, 0, 0, 0, 0, 2})
+	b.str("m1").str("m2")
+	// the int encodings of strings
+	b.object(TypeString, "int8").Write([]byte{0xc0, 0x85})
+	b.object(TypeString, "int32").Write([]byte{0xc2, 0x15, 0xcd, 0x5b, 0x07})
+	b.WriteByte(rdbFlagIdle)
+	b.length(3600)
+	b.WriteByte(rdbFlagFreq)
+	b.WriteByte(5)
+	b.expireMs(1700000000123).set("idle", "v")
+	b.selectDB(9).set("other", "db")
+	return b.end()
+}
+
+func TestDecodeRedis7(t *testing.T) {
+	big := strings.Repeat("p", 300)
+	for _, version := range []int{10, 11, 12} {
+		t.Run(strconv.Itoa(version), func(t *testing.T) {
+			r := decodeFile(t, redis7Dump(version))
+			for key, expect := range map[string]string{
+				"0/hash":      "hash f1=v1,f2=-3,f3=100000",
+				"0/zset":      "zset a=1.5,b=3,c=-Inf",
+				"0/set":       "set -4000,7,x",
+				"0/intset":    "set -1,1",
+				"0/list":      "list a,b,1," + big + "," + big,
+				"0/quicklist": "list a,2,c",
+				"0/ziphash":   "hash f=v,n=-1",
+				"0/zipzset":   "zset m=2.5",
+				"0/zset2":     "zset a=1.5,b=-Inf",
+				"0/set64":     "set m1,m2",
+				"0/int8":      "string -123",
+				"0/int32":     "string 123456789",
+				"0/idle":      "string v",
+				"9/other":     "string db",
+			} {
+				if got := r.objects[key]; got != expect {
+					t.Errorf("%s: got %q, expect %q", key, got, expect)
+				}
+			}
+			if len(r.objects) != 14 {
+				t.Errorf("decoded %d objects, expect 14", len(r.objects))
+			}
+			if r.aux["redis-ver"] != "7.2.4" || r.aux["ctime"] != "1700000000" {
+				t.Errorf("aux fields %v", r.aux)
+			}
+			if r.expiry["0/idle"] != 1700000000123 || r.idle["0/idle"] != 3600 || len(r.idle) != 1 {
+				t.Errorf("expiry %v and idle %v of 0/idle", r.expiry, r.idle)
+			}
+			if fmt.Sprint(r.slots) != "[1234 12]" {
+				t.Errorf("slot info %v, expect slot 1234 of 12 keys", r.slots)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := newDump(11).set("key", "value").end()
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"unknown version", []byte("REDIS0013"), "invalid RDB version number 13"},
+		{"not a dump", []byte("RESP00011"), "invalid file format"},
+		{"pre-GA function", append(newDump(10).Bytes(), rdbFlagFunction), "unsupported pre-GA function opcode"},
+		{"unsupported type", newDump(12).object(TypeHashMetadata, "h").end(), "unsupported object type 24"},
+		{"unframed module", newDump(12).object(TypeModule, "m").length(1 << 10).end(), "is not framed"},
+		{"odd listpack", newDump(11).object(TypeHashListpack, "h").str(listpack("f")).end(), "odd listpack length 1"},
+		{"unknown quicklist node", newDump(11).object(TypeListQuicklist2, "l").length(1).length(3).str("x").end(),
+			"unknown quicklist container 3"},
+	} {
+		err := Decode(bytes.NewReader(c.data), newRecorder())
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, expect %q", c.name, err, c.err)
+		}
+	}
+	if err := Decode(bytes.NewReader(valid), newRecorder()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeChecksum(t *testing.T) {
+	data := redis7Dump(11)
+	// a corrupted value is found once the whole file is read
+	corrupted := append([]byte{}, data...)
+	i := bytes.Index(corrupted, []byte("f1"))
+	corrupted[i] = 'g'
+	err := Decode(bytes.NewReader(corrupted), newRecorder())
+	var derr *DecodeError
+	if !errors.As(err, &derr) || !strings.Contains(derr.Err.Error(), "checksum mismatch") {
+		t.Fatalf("got %v, expect a checksum mismatch", err)
+	}
+	if derr.Offset != int64(len(data)) {
+		t.Errorf("checksum mismatch reported at offset %d, expect the end of the file %d", derr.Offset, len(data))
+	}
+	// a zero checksum disables the verification
+	binary.LittleEndian.PutUint64(corrupted[len(corrupted)-8:], 0)
+	if err := Decode(bytes.NewReader(corrupted), newRecorder()); err != nil {
+		t.Errorf("checksum verified though disabled: %v", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data := redis7Dump(12)
+	for n := 9; n < len(data); n++ {
+		err := Decode(bytes.NewReader(data[:n]), newRecorder())
+		var derr *DecodeError
+		if !errors.As(err, &derr) {
+			t.Fatalf("dump truncated to %d bytes: got %v, expect a DecodeError", n, err)
+		}
+		if derr.Err != ErrTruncated || derr.Offset != int64(n) {
+			t.Errorf("dump truncated to %d bytes: got %v", n, err)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	data := redis7Dump(12)
+	all := decodeFile(t, data)
+	if len(all.pos) < len(all.objects) {
+		t.Fatalf("%d positions reported for %d objects", len(all.pos), len(all.objects))
+	}
+	for _, pos := range all.pos {
+		if pos.Version != 12 || pos.CTime != "1700000000" || pos.CRC == 0 {
+			t.Fatalf("position %+v lacks the version, ctime or checksum", pos)
+		}
+		r := newRecorder()
+		if err := Resume(bytes.NewReader(data[pos.Offset:]), r, pos); err != nil {
+			t.Fatalf("resume from %+v: %v", pos, err)
+		}
+		// the objects from pos on are decoded again, none of the ones before
+		rest := 0
+		for _, p := range all.pos {
+			if p.Offset >= pos.Offset {
+				rest++
+			}
+		}
+		if r.aux["ctime"] != "1700000000" || r.ended != 1 {
+			t.Errorf("resume from %d: ctime %q, EndRDB called %d times", pos.Offset, r.aux["ctime"], r.ended)
+		}
+		for key, obj := range r.objects {
+			if all.objects[key] != obj {
+				t.Errorf("resume from %d: %s decoded as %q, expect %q", pos.Offset, key, obj, all.objects[key])
+			}
+		}
+		if len(r.pos) != rest {
+			t.Errorf("resume from %d: %d positions reported, expect %d", pos.Offset, len(r.pos), rest)
+		}
+	}
+
+	// the checksum of the bytes before the position is verified with the rest
+	pos := all.pos[len(all.pos)/2]
+	pos.CRC++
+	err := Resume(bytes.NewReader(data[pos.Offset:]), newRecorder(), pos)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("resume with a wrong checksum: got %v", err)
+	}
+	if err := Resume(bytes.NewReader(data), newRecorder(), Position{Version: 13}); err == nil {
+		t.Error("resume of an unknown version succeeded")
+	}
+}
@@ -0,0 +1,585 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"strconv"
+)
+
+const (
+	rdbZiplist6bitlenString  = 0
+	rdbZiplist14bitlenString = 1
+	rdbZiplist32bitlenString = 2
+
+	rdbZiplistInt16 = 0xc0
+	rdbZiplistInt32 = 0xd0
+	rdbZiplistInt64 = 0xe0
+	rdbZiplistInt24 = 0xf0
+	rdbZiplistInt8  = 0xfe
+	rdbZiplistInt4  = 15
+
+	listpackEOF = 0xff
+)
+
+// crc64Table is the table of the crc64 variant with the Jones coefficients
+// used by redis, which has an init value of 0 and no final xor
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, b []byte) uint64 {
+	for _, v := range b {
+		crc = crc64Table[byte(crc)^v] ^ (crc >> 8)
+	}
+	return crc
+}
+
+func crc64Digest(b []byte) uint64 {
+	return crc64Update(0, b)
+}
+
+func (d *decode) readZipmap(key []byte, expiry int64) error {
+	var length int
+	zipmap, err := d.readString()
+	if err != nil {
+		return err
+	}
+	buf := newSliceBuffer(zipmap)
+	lenByte, err := buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	if lenByte >= 254 { // we need to count the items manually
+		length, err = countZipmapItems(buf)
+		length /= 2
+		if err != nil {
+			return err
+		}
+	} else {
+		length = int(lenByte)
+	}
+	d.event.StartHash(key, int64(length), expiry)
+	for i := 0; i < length; i++ {
+		field, err := readZipmapItem(buf, false)
+		if err != nil {
+			return err
+		}
+		value, err := readZipmapItem(buf, true)
+		if err != nil {
+			return err
+		}
+		d.event.Hset(key, field, value)
+	}
+	d.event.EndHash(key)
+	return nil
+}
+
+func readZipmapItem(buf *sliceBuffer, readFree bool) ([]byte, error) {
+	length, free, err := readZipmapItemLength(buf, readFree)
+	if err != nil {
+		return nil, err
+	}
+	if length == -1 {
+		return nil, nil
+	}
+	value, err := buf.Slice(length)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Seek(int64(free), 1)
+	return value, err
+}
+
+func countZipmapItems(buf *sliceBuffer) (int, error) {
+	n := 0
+	for {
+		strLen, free, err := readZipmapItemLength(buf, n%2 != 0)
+		if err != nil {
+			return 0, err
+		}
+		if strLen == -1 {
+			break
+		}
+		_, err = buf.Seek(int64(strLen)+int64(free), 1)
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	_, err := buf.Seek(1, 0)
+	return n, err
+}
+
+func readZipmapItemLength(buf *sliceBuffer, readFree bool) (int, int, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch b {
+	case 253:
+		s, err := buf.Slice(5)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(binary.BigEndian.Uint32(s)), int(s[4]), nil
+	case 254:
+		return 0, 0, fmt.Errorf("rdb: invalid zipmap item length")
+	case 255:
+		return -1, 0, nil
+	}
+	var free byte
+	if readFree {
+		free, err = buf.ReadByte()
+	}
+	return int(b), int(free), err
+}
+
+func (d *decode) readZiplist(key []byte, expiry int64, addListEvents bool) error {
+	ziplist, err := d.readString()
+	if err != nil {
+		return err
+	}
+	buf := newSliceBuffer(ziplist)
+	length, err := readZiplistLength(buf)
+	if err != nil {
+		return err
+	}
+	if addListEvents {
+		d.event.StartList(key, length, expiry)
+	}
+	for i := int64(0); i < length; i++ {
+		entry, err := readZiplistEntry(buf)
+		if err != nil {
+			return err
+		}
+		d.event.Rpush(key, entry)
+	}
+	if addListEvents {
+		d.event.EndList(key)
+	}
+	return nil
+}
+
+func (d *decode) readZiplistZset(key []byte, expiry int64) error {
+	ziplist, err := d.readString()
+	if err != nil {
+		return err
+	}
+	buf := newSliceBuffer(ziplist)
+	cardinality, err := readZiplistLength(buf)
+	if err != nil {
+		return err
+	}
+	cardinality /= 2
+	d.event.StartZSet(key, cardinality, expiry)
+	for i := int64(0); i < cardinality; i++ {
+		member, err := readZiplistEntry(buf)
+		if err != nil {
+			return err
+		}
+		scoreBytes, err := readZiplistEntry(buf)
+		if err != nil {
+			return err
+		}
+		score, err := strconv.ParseFloat(string(scoreBytes), 64)
+		if err != nil {
+			return err
+		}
+		d.event.Zadd(key, score, member)
+	}
+	d.event.EndZSet(key)
+	return nil
+}
+
+func (d *decode) readZiplistHash(key []byte, expiry int64) error {
+	ziplist, err := d.readString()
+	if err != nil {
+		return err
+	}
+	buf := newSliceBuffer(ziplist)
+	length, err := readZiplistLength(buf)
+	if err != nil {
+		return err
+	}
+	length /= 2
+	d.event.StartHash(key, length, expiry)
+	for i := int64(0); i < length; i++ {
+		field, err := readZiplistEntry(buf)
+		if err != nil {
+			return err
+		}
+		value, err := readZiplistEntry(buf)
+		if err != nil {
+			return err
+		}
+		d.event.Hset(key, field, value)
+	}
+	d.event.EndHash(key)
+	return nil
+}
+
+func readZiplistLength(buf *sliceBuffer) (int64, error) {
+	buf.Seek(8, 0) // skip the zlbytes and zltail
+	lenBytes, err := buf.Slice(2)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint16(lenBytes)), nil
+}
+
+func readZiplistEntry(buf *sliceBuffer) ([]byte, error) {
+	prevLen, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if prevLen == 254 {
+		buf.Seek(4, 1) // skip the 4-byte prevlen
+	}
+
+	header, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case header>>6 == rdbZiplist6bitlenString:
+		return buf.Slice(int(header & 0x3f))
+	case header>>6 == rdbZiplist14bitlenString:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Slice((int(header&0x3f) << 8) | int(b))
+	case header>>6 == rdbZiplist32bitlenString:
+		lenBytes, err := buf.Slice(4)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Slice(int(binary.BigEndian.Uint32(lenBytes)))
+	case header == rdbZiplistInt16:
+		intBytes, err := buf.Slice(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(intBytes))), 10)), nil
+	case header == rdbZiplistInt32:
+		intBytes, err := buf.Slice(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(intBytes))), 10)), nil
+	case header == rdbZiplistInt64:
+		intBytes, err := buf.Slice(8)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(binary.LittleEndian.Uint64(intBytes)), 10)), nil
+	case header == rdbZiplistInt24:
+		intBytes := make([]byte, 4)
+		_, err := buf.Read(intBytes[1:])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(intBytes))>>8), 10)), nil
+	case header == rdbZiplistInt8:
+		b, err := buf.ReadByte()
+		return []byte(strconv.FormatInt(int64(int8(b)), 10)), err
+	case header>>4 == rdbZiplistInt4:
+		return []byte(strconv.FormatInt(int64(header&0x0f)-1, 10)), nil
+	}
+
+	return nil, fmt.Errorf("rdb: unknown ziplist header byte: %d", header)
+}
+
+func (d *decode) readIntset(key []byte, expiry int64) error {
+	intset, err := d.readString()
+	if err != nil {
+		return err
+	}
+	buf := newSliceBuffer(intset)
+	intSizeBytes, err := buf.Slice(4)
+	if err != nil {
+		return err
+	}
+	intSize := binary.LittleEndian.Uint32(intSizeBytes)
+
+	if intSize != 2 && intSize != 4 && intSize != 8 {
+		return fmt.Errorf("rdb: unknown intset encoding: %d", intSize)
+	}
+
+	lenBytes, err := buf.Slice(4)
+	if err != nil {
+		return err
+	}
+	cardinality := binary.LittleEndian.Uint32(lenBytes)
+
+	d.event.StartSet(key, int64(cardinality), expiry)
+	for i := uint32(0); i < cardinality; i++ {
+		intBytes, err := buf.Slice(int(intSize))
+		if err != nil {
+			return err
+		}
+		var intString string
+		switch intSize {
+		case 2:
+			intString = strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(intBytes))), 10)
+		case 4:
+			intString = strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(intBytes))), 10)
+		case 8:
+			intString = strconv.FormatInt(int64(binary.LittleEndian.Uint64(intBytes)), 10)
+		}
+		d.event.Sadd(key, []byte(intString))
+	}
+	d.event.EndSet(key)
+	return nil
+}
+
+// readQuicklist2 reads a quicklist whose nodes are listpacks or plain elements
+func (d *decode) readQuicklist2(key []byte, expiry int64) error {
+	length, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	d.event.StartList(key, int64(-1), expiry)
+	for i := uint64(0); i < length; i++ {
+		container, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		node, err := d.readString()
+		if err != nil {
+			return err
+		}
+		switch container {
+		case rdbQuicklistNodePlain:
+			d.event.Rpush(key, node)
+		case rdbQuicklistNodePacked:
+			entries, err := readListpack(node)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				d.event.Rpush(key, entry)
+			}
+		default:
+			return fmt.Errorf("rdb: unknown quicklist container %d for key %s", container, key)
+		}
+	}
+	d.event.EndList(key)
+	return nil
+}
+
+func (d *decode) readListpackSet(key []byte, expiry int64) error {
+	listpack, err := d.readString()
+	if err != nil {
+		return err
+	}
+	entries, err := readListpack(listpack)
+	if err != nil {
+		return err
+	}
+	d.event.StartSet(key, int64(len(entries)), expiry)
+	for _, entry := range entries {
+		d.event.Sadd(key, entry)
+	}
+	d.event.EndSet(key)
+	return nil
+}
+
+func (d *decode) readListpackHash(key []byte, expiry int64) error {
+	listpack, err := d.readString()
+	if err != nil {
+		return err
+	}
+	entries, err := readListpack(listpack)
+	if err != nil {
+		return err
+	}
+	if len(entries)%2 != 0 {
+		return fmt.Errorf("rdb: odd listpack length %d for hash %s", len(entries), key)
+	}
+	d.event.StartHash(key, int64(len(entries)/2), expiry)
+	for i := 0; i < len(entries); i += 2 {
+		d.event.Hset(key, entries[i], entries[i+1])
+	}
+	d.event.EndHash(key)
+	return nil
+}
+
+func (d *decode) readListpackZset(key []byte, expiry int64) error {
+	listpack, err := d.readString()
+	if err != nil {
+		return err
+	}
+	entries, err := readListpack(listpack)
+	if err != nil {
+		return err
+	}
+	if len(entries)%2 != 0 {
+		return fmt.Errorf("rdb: odd listpack length %d for zset %s", len(entries), key)
+	}
+	d.event.StartZSet(key, int64(len(entries)/2), expiry)
+	for i := 0; i < len(entries); i += 2 {
+		score, err := strconv.ParseFloat(string(entries[i+1]), 64)
+		if err != nil {
+			return err
+		}
+		d.event.Zadd(key, score, entries[i])
+	}
+	d.event.EndZSet(key)
+	return nil
+}
+
+// readListpack returns all the entries of a listpack, integers are formatted as strings
+func readListpack(listpack []byte) ([][]byte, error) {
+	buf := newSliceBuffer(listpack)
+	// skip the total bytes and the number of elements, which is not reliable above 65535
+	if _, err := buf.Slice(6); err != nil {
+		return nil, err
+	}
+	var entries [][]byte
+	for {
+		entry, err := readListpackEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// readListpackEntry reads an entry and its back length, nil is returned at the end of the listpack
+func readListpackEntry(buf *sliceBuffer) ([]byte, error) {
+	header, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var entry []byte
+	var size int
+	switch {
+	case header == listpackEOF:
+		return nil, nil
+	case header&0x80 == 0:
+		// 7 bit unsigned integer
+		entry = []byte(strconv.FormatInt(int64(header&0x7f), 10))
+		size = 1
+	case header&0xc0 == 0x80:
+		// 6 bit string length
+		length := int(header & 0x3f)
+		if entry, err = buf.Slice(length); err != nil {
+			return nil, err
+		}
+		size = 1 + length
+	case header&0xe0 == 0xc0:
+		// 13 bit signed integer
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		v := int64(header&0x1f)<<8 | int64(b)
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		entry = []byte(strconv.FormatInt(v, 10))
+		size = 2
+	case header&0xf0 == 0xe0:
+		// 12 bit string length
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length := int(header&0x0f)<<8 | int(b)
+		if entry, err = buf.Slice(length); err != nil {
+			return nil, err
+		}
+		size = 2 + length
+	case header == 0xf0:
+		// 32 bit string length
+		lenBytes, err := buf.Slice(4)
+		if err != nil {
+			return nil, err
+		}
+		length := int(binary.LittleEndian.Uint32(lenBytes))
+		if entry, err = buf.Slice(length); err != nil {
+			return nil, err
+		}
+		size = 5 + length
+	case header >= 0xf1 && header <= 0xf4:
+		width := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[header]
+		intBytes, err := buf.Slice(width)
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for i := width - 1; i >= 0; i-- {
+			u = u<<8 | uint64(intBytes[i])
+		}
+		// sign extend the little endian integer of width bytes
+		shift := uint(64 - width*8)
+		entry = []byte(strconv.FormatInt(int64(u<<shift)>>shift, 10))
+		size = 1 + width
+	default:
+		return nil, fmt.Errorf("rdb: unknown listpack header byte: %d", header)
+	}
+	if _, err := buf.Seek(int64(listpackBacklenSize(size)), 1); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// listpackBacklenSize returns the bytes used to store the back length of an entry of size bytes
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+func lzfDecompress(in []byte, outlen int) ([]byte, error) {
+	out := make([]byte, outlen)
+	i, o := 0, 0
+	for i < len(in) {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			if i+ctrl+1 > len(in) || o+ctrl+1 > outlen {
+				return nil, fmt.Errorf("rdb: invalid lzf literal run")
+			}
+			o += copy(out[o:], in[i:i+ctrl+1])
+			i += ctrl + 1
+			continue
+		}
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, fmt.Errorf("rdb: invalid lzf back reference")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, fmt.Errorf("rdb: invalid lzf back reference")
+		}
+		ref := o - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 || o+length+2 > outlen {
+			return nil, fmt.Errorf("rdb: invalid lzf back reference")
+		}
+		for x := 0; x <= length+1; x++ {
+			out[o] = out[ref]
+			ref++
+			o++
+		}
+	}
+	if o != outlen {
+		return nil, fmt.Errorf("rdb: decompressed string length %d didn't match expected length %d", o, outlen)
+	}
+	return out, nil
+}
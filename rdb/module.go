@@ -0,0 +1,95 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// moduleCharset encodes the names of the module types in their ids
+const moduleCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// ModuleDecoder is implemented by decoders which handle the values of module
+// types, the values are parsed and dropped for the other decoders
+type ModuleDecoder interface {
+	// Module is called once for each value of a module type.
+	Module(key []byte, m *Module, expiry int64)
+}
+
+// Module is a value of a module type. Values holds what the module saved, in
+// order, as uint64, int64, float32, float64 or []byte. Dump is the payload
+// of the DUMP command for the value, it is nil for values of DecodeDump.
+type Module struct {
+	ID      uint64
+	Name    string
+	Version int
+	Values  []interface{}
+	Dump    []byte
+}
+
+// ModuleName returns the name of the module type of id, such as ReJSON-RL
+func ModuleName(id uint64) string {
+	name := make([]byte, 9)
+	id >>= 10
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleCharset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+func (d *decode) readModule(key []byte, expiry int64) error {
+	dump := d.capture()
+	id, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	m := &Module{ID: id, Name: ModuleName(id), Version: int(id & 1023)}
+	if m.Values, err = d.readModuleValue(); err != nil {
+		return fmt.Errorf("%v for key %s of module %s", err, key, m.Name)
+	}
+	m.Dump = dump(TypeModule2)
+	if md, ok := d.event.(ModuleDecoder); ok {
+		md.Module(key, m, expiry)
+	}
+	return nil
+}
+
+// readModuleValue reads a module value framed by module opcodes until the EOF opcode
+func (d *decode) readModuleValue() ([]interface{}, error) {
+	var values []interface{}
+	for {
+		opcode, _, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return values, nil
+		case rdbModuleOpcodeSint:
+			var n uint64
+			n, _, err = d.readLength()
+			v = int64(n)
+		case rdbModuleOpcodeUint:
+			v, _, err = d.readLength()
+		case rdbModuleOpcodeFloat:
+			if _, err = io.ReadFull(d.r, d.intBuf[:4]); err == nil {
+				v = math.Float32frombits(binary.LittleEndian.Uint32(d.intBuf))
+			}
+		case rdbModuleOpcodeDouble:
+			if _, err = io.ReadFull(d.r, d.intBuf); err == nil {
+				v = math.Float64frombits(binary.LittleEndian.Uint64(d.intBuf))
+			}
+		case rdbModuleOpcodeString:
+			v, err = d.readString()
+		default:
+			return nil, fmt.Errorf("rdb: unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+}
@@ -0,0 +1,92 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// moduleRecorder keeps the module values besides the other objects
+type moduleRecorder struct {
+	*recorder
+	modules map[string]*Module
+}
+
+func (r *moduleRecorder) Module(key []byte, m *Module, expiry int64) {
+	r.modules[string(key)] = m
+}
+
+// moduleID returns the id of the module type name of version
+func moduleID(name string, version int) uint64 {
+	var id uint64
+	for _, c := range name {
+		id = id<<6 | uint64(strings.IndexRune(moduleCharset, c))
+	}
+	return id<<10 | uint64(version)
+}
+
+// module writes a value of the module type with one value of each opcode
+func (b *dumpBuilder) module(key string, id uint64) *dumpBuilder {
+	b.object(TypeModule2, key).length(id)
+	b.length(rdbModuleOpcodeUint).length(7)
+	b.length(rdbModuleOpcodeSint)
+	b.WriteByte(rdb64bitLen)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(0xffffffffffffffff)) // -1
+	b.Write(buf[:])
+	b.length(rdbModuleOpcodeFloat)
+	binary.LittleEndian.PutUint32(buf[:4], math.Float32bits(1.5))
+	b.Write(buf[:4])
+	b.length(rdbModuleOpcodeDouble).float(-2.25)
+	b.length(rdbModuleOpcodeString).str(`{"a":1}`)
+	return b.length(rdbModuleOpcodeEOF)
+}
+
+func TestDecodeModule(t *testing.T) {
+	id := moduleID("ReJSON-RL", 3)
+	if name := ModuleName(id); name != "ReJSON-RL" {
+		t.Fatalf("module name %q, expect ReJSON-RL", name)
+	}
+	data := newDump(11).selectDB(0).module("doc", id).set("after", "v").end()
+	r := &moduleRecorder{recorder: newRecorder(), modules: make(map[string]*Module)}
+	if err := Decode(bytes.NewReader(data), r); err != nil {
+		t.Fatal(err)
+	}
+	m := r.modules["doc"]
+	if m == nil || r.objects["0/after"] != "string v" {
+		t.Fatalf("module %+v, next object %q", m, r.objects["0/after"])
+	}
+	expect := &Module{ID: id, Name: "ReJSON-RL", Version: 3,
+		Values: []interface{}{uint64(7), int64(-1), float32(1.5), float64(-2.25), []byte(`{"a":1}`)}}
+	dump := m.Dump
+	m.Dump = nil
+	if !reflect.DeepEqual(m, expect) {
+		t.Errorf("decoded %+v, expect %+v", m, expect)
+	}
+
+	// the payload is passed through as is and restores the same value
+	if len(dump) < 10 || dump[0] != byte(TypeModule2) || !bytes.Contains(data, dump[1:len(dump)-10]) {
+		t.Fatalf("invalid dump payload %q", dump)
+	}
+	restored := &moduleRecorder{recorder: newRecorder(), modules: make(map[string]*Module)}
+	if err := DecodeDump(dump, 0, []byte("doc"), 0, restored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.modules["doc"], m) {
+		t.Errorf("dump decoded to %+v, expect %+v", restored.modules["doc"], m)
+	}
+
+	// the decoders without modules skip the value by its framing
+	plain := newRecorder()
+	if err := Decode(bytes.NewReader(data), plain); err != nil || plain.objects["0/after"] != "string v" {
+		t.Errorf("module value not skipped, %v", err)
+	}
+
+	data = newDump(11).selectDB(0).object(TypeModule2, "doc").length(id).length(9).end()
+	if err := Decode(bytes.NewReader(data), plain); err == nil || !strings.Contains(err.Error(), "unknown module opcode 9") {
+		t.Errorf("got %v, expect an unknown opcode", err)
+	}
+}
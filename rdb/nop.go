@@ -0,0 +1,25 @@
+package rdb
+
+// NopDecoder ignores every event, it can be embedded by decoders interested
+// in a few of them only
+type NopDecoder struct{}
+
+func (NopDecoder) StartRDB()                                       {}
+func (NopDecoder) StartDatabase(n int)                             {}
+func (NopDecoder) Aux(key, value []byte)                           {}
+func (NopDecoder) ResizeDatabase(dbSize, expiresSize uint32)       {}
+func (NopDecoder) Set(key, value []byte, expiry int64)             {}
+func (NopDecoder) StartHash(key []byte, length, expiry int64)      {}
+func (NopDecoder) Hset(key, field, value []byte)                   {}
+func (NopDecoder) EndHash(key []byte)                              {}
+func (NopDecoder) StartSet(key []byte, cardinality, expiry int64)  {}
+func (NopDecoder) Sadd(key, member []byte)                         {}
+func (NopDecoder) EndSet(key []byte)                               {}
+func (NopDecoder) StartList(key []byte, length, expiry int64)      {}
+func (NopDecoder) Rpush(key, value []byte)                         {}
+func (NopDecoder) EndList(key []byte)                              {}
+func (NopDecoder) StartZSet(key []byte, cardinality, expiry int64) {}
+func (NopDecoder) Zadd(key []byte, score float64, member []byte)   {}
+func (NopDecoder) EndZSet(key []byte)                              {}
+func (NopDecoder) EndDatabase(n int)                               {}
+func (NopDecoder) EndRDB()                                         {}
@@ -0,0 +1,310 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// stream entry flags of the listpacks
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// StreamDecoder is implemented by decoders which handle streams, the streams
+// are parsed and dropped for the other decoders
+type StreamDecoder interface {
+	// Stream is called once for each stream.
+	Stream(key []byte, stream *Stream, expiry int64)
+}
+
+// StreamID is the id of a stream entry
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// StreamEntry is an entry of a stream, Fields holds the field names and the
+// values one after another
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// StreamPending is an entry delivered to a consumer of a group but not acknowledged
+type StreamPending struct {
+	ID            StreamID
+	DeliveryTime  int64
+	DeliveryCount uint64
+	Consumer      []byte
+}
+
+// StreamConsumer is a consumer of a group
+type StreamConsumer struct {
+	Name       []byte
+	SeenTime   int64
+	ActiveTime int64
+}
+
+// StreamGroup is a consumer group of a stream
+type StreamGroup struct {
+	Name        []byte
+	LastID      StreamID
+	EntriesRead int64
+	Pending     []StreamPending
+	Consumers   []StreamConsumer
+}
+
+// Stream is a stream object. Dump is the payload of the DUMP command for the
+// stream, accepted by RESTORE on servers of the same RDB version or newer, it
+// is nil for streams of DecodeDump.
+type Stream struct {
+	Entries      []StreamEntry
+	Length       uint64
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+	Dump         []byte
+}
+
+func (d *decode) readStreamID() (StreamID, error) {
+	ms, _, err := d.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := d.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+func (d *decode) readRawStreamID() (StreamID, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{Ms: binary.BigEndian.Uint64(b), Seq: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func (d *decode) readMillisecondTime() (int64, error) {
+	if _, err := io.ReadFull(d.r, d.intBuf); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(d.intBuf)), nil
+}
+
+func (d *decode) readStream(key []byte, typ ValueType, expiry int64) error {
+	dump := d.capture()
+	s := &Stream{}
+	nodes, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if len(nodeKey) != 16 {
+			return fmt.Errorf("rdb: invalid stream node key length %d for key %s", len(nodeKey), key)
+		}
+		master := StreamID{Ms: binary.BigEndian.Uint64(nodeKey), Seq: binary.BigEndian.Uint64(nodeKey[8:])}
+		listpack, err := d.readString()
+		if err != nil {
+			return err
+		}
+		entries, err := readListpack(listpack)
+		if err != nil {
+			return err
+		}
+		if s.Entries, err = appendStreamEntries(s.Entries, master, entries); err != nil {
+			return fmt.Errorf("rdb: %v for stream %s", err, key)
+		}
+	}
+	if s.Length, _, err = d.readLength(); err != nil {
+		return err
+	}
+	if s.LastID, err = d.readStreamID(); err != nil {
+		return err
+	}
+	if typ >= TypeStreamListpacks2 {
+		if s.FirstID, err = d.readStreamID(); err != nil {
+			return err
+		}
+		if s.MaxDeletedID, err = d.readStreamID(); err != nil {
+			return err
+		}
+		if s.EntriesAdded, _, err = d.readLength(); err != nil {
+			return err
+		}
+	}
+	groups, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		g, err := d.readStreamGroup(typ)
+		if err != nil {
+			return err
+		}
+		s.Groups = append(s.Groups, *g)
+	}
+	s.Dump = dump(typ)
+	if sd, ok := d.event.(StreamDecoder); ok {
+		sd.Stream(key, s, expiry)
+	}
+	return nil
+}
+
+func (d *decode) readStreamGroup(typ ValueType) (*StreamGroup, error) {
+	g := &StreamGroup{EntriesRead: -1}
+	var err error
+	if g.Name, err = d.readString(); err != nil {
+		return nil, err
+	}
+	if g.LastID, err = d.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ >= TypeStreamListpacks2 {
+		read, _, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		g.EntriesRead = int64(read)
+	}
+	pending, _, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	pel := make(map[StreamID]int, pending)
+	for i := uint64(0); i < pending; i++ {
+		var p StreamPending
+		if p.ID, err = d.readRawStreamID(); err != nil {
+			return nil, err
+		}
+		if p.DeliveryTime, err = d.readMillisecondTime(); err != nil {
+			return nil, err
+		}
+		if p.DeliveryCount, _, err = d.readLength(); err != nil {
+			return nil, err
+		}
+		pel[p.ID] = len(g.Pending)
+		g.Pending = append(g.Pending, p)
+	}
+	consumers, _, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		var c StreamConsumer
+		if c.Name, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if c.SeenTime, err = d.readMillisecondTime(); err != nil {
+			return nil, err
+		}
+		c.ActiveTime = -1
+		if typ >= TypeStreamListpacks3 {
+			if c.ActiveTime, err = d.readMillisecondTime(); err != nil {
+				return nil, err
+			}
+		}
+		owned, _, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < owned; j++ {
+			id, err := d.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			k, ok := pel[id]
+			if !ok {
+				return nil, fmt.Errorf("rdb: consumer %s owns %s missing from the pending entries of group %s", c.Name, id, g.Name)
+			}
+			g.Pending[k].Consumer = c.Name
+		}
+		g.Consumers = append(g.Consumers, c)
+	}
+	return g, nil
+}
+
+// appendStreamEntries appends the entries of a stream listpack whose ids are
+// relative to master, the deleted entries are dropped
+func appendStreamEntries(dst []StreamEntry, master StreamID, lp [][]byte) ([]StreamEntry, error) {
+	next := func() (int64, error) {
+		if len(lp) == 0 {
+			return 0, fmt.Errorf("truncated stream listpack")
+		}
+		n, err := strconv.ParseInt(string(lp[0]), 10, 64)
+		lp = lp[1:]
+		return n, err
+	}
+	// the master entry: count, deleted, the master fields and a terminating 0
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	nfields, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(lp)) < nfields+1 {
+		return nil, fmt.Errorf("truncated stream listpack")
+	}
+	masterFields := lp[:nfields]
+	lp = lp[nfields+1:]
+
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		e := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}}
+		if flags&streamItemFlagSameFields != 0 {
+			if int64(len(lp)) < nfields {
+				return nil, fmt.Errorf("truncated stream listpack")
+			}
+			for j, field := range masterFields {
+				e.Fields = append(e.Fields, field, lp[j])
+			}
+			lp = lp[nfields:]
+		} else {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(lp)) < 2*n {
+				return nil, fmt.Errorf("truncated stream listpack")
+			}
+			e.Fields = append(e.Fields, lp[:2*n]...)
+			lp = lp[2*n:]
+		}
+		// the lp-count used to walk the listpack backwards
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			dst = append(dst, e)
+		}
+	}
+	return dst, nil
+}
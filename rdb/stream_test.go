@@ -0,0 +1,167 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// streamRecorder keeps the streams besides the other objects
+type streamRecorder struct {
+	*recorder
+	streams map[string]*Stream
+	expiry  map[string]int64
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{recorder: newRecorder(), streams: make(map[string]*Stream), expiry: make(map[string]int64)}
+}
+
+func (r *streamRecorder) Stream(key []byte, s *Stream, expiry int64) {
+	r.streams[string(key)] = s
+	r.expiry[string(key)] = expiry
+}
+
+const streamMs = 1700000000000
+
+func rawStreamID(ms, seq uint64) string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, ms)
+	binary.BigEndian.PutUint64(b[8:], seq)
+	return string(b)
+}
+
+func (b *dumpBuilder) millis(ms int64) *dumpBuilder {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	b.Write(buf[:])
+	return b
+}
+
+// stream writes a stream of typ with an entry of the master fields, an entry
+// of its own fields, a deleted entry and a group whose consumer owns the
+// second entry
+func (b *dumpBuilder) stream(typ ValueType, key string) *dumpBuilder {
+	b.object(typ, key).length(1)
+	b.str(rawStreamID(streamMs, 0))
+	b.str(listpack(
+		// the master entry: count, deleted, the fields and a terminating 0
+		int64(2), int64(1), int64(2), "f1", "f2", int64(0),
+		// flags, the id relative to the master, the values and the lp-count
+		int64(streamItemFlagSameFields), int64(0), int64(0), "v1", "v2", int64(5),
+		int64(0), int64(0), int64(1), int64(1), "g", "w", int64(6),
+		int64(streamItemFlagSameFields|streamItemFlagDeleted), int64(5), int64(0), "x", "y", int64(5),
+	))
+	b.length(2).length(streamMs + 5).length(0)
+	if typ >= TypeStreamListpacks2 {
+		b.length(streamMs).length(0).length(streamMs + 5).length(0).length(3)
+	}
+	b.length(1).str("group").length(streamMs).length(1)
+	if typ >= TypeStreamListpacks2 {
+		b.length(2)
+	}
+	b.length(1).WriteString(rawStreamID(streamMs, 1))
+	b.millis(streamMs + 100).length(3)
+	b.length(1).str("consumer").millis(streamMs + 200)
+	if typ >= TypeStreamListpacks3 {
+		b.millis(streamMs + 300)
+	}
+	b.length(1).WriteString(rawStreamID(streamMs, 1))
+	return b
+}
+
+func expectedStream(typ ValueType) *Stream {
+	s := &Stream{
+		Entries: []StreamEntry{
+			{ID: StreamID{streamMs, 0}, Fields: [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")}},
+			{ID: StreamID{streamMs, 1}, Fields: [][]byte{[]byte("g"), []byte("w")}},
+		},
+		Length: 2,
+		LastID: StreamID{streamMs + 5, 0},
+		Groups: []StreamGroup{{
+			Name:        []byte("group"),
+			LastID:      StreamID{streamMs, 1},
+			EntriesRead: -1,
+			Pending: []StreamPending{{ID: StreamID{streamMs, 1}, DeliveryTime: streamMs + 100, DeliveryCount: 3,
+				Consumer: []byte("consumer")}},
+			Consumers: []StreamConsumer{{Name: []byte("consumer"), SeenTime: streamMs + 200, ActiveTime: -1}},
+		}},
+	}
+	if typ >= TypeStreamListpacks2 {
+		s.FirstID, s.MaxDeletedID, s.EntriesAdded = StreamID{streamMs, 0}, StreamID{streamMs + 5, 0}, 3
+		s.Groups[0].EntriesRead = 2
+	}
+	if typ >= TypeStreamListpacks3 {
+		s.Groups[0].Consumers[0].ActiveTime = streamMs + 300
+	}
+	return s
+}
+
+func TestDecodeStream(t *testing.T) {
+	for _, c := range []struct {
+		typ     ValueType
+		version int
+	}{
+		{TypeStreamListpacks, 9},
+		{TypeStreamListpacks2, 10},
+		{TypeStreamListpacks3, 11},
+	} {
+		data := newDump(c.version).selectDB(0).expireMs(streamMs+1000).stream(c.typ, "s").set("after", "v").end()
+		r := newStreamRecorder()
+		if err := Decode(bytes.NewReader(data), r); err != nil {
+			t.Fatalf("type %d: %v", c.typ, err)
+		}
+		s := r.streams["s"]
+		if s == nil {
+			t.Fatalf("type %d: no stream decoded", c.typ)
+		}
+		if r.expiry["s"] != streamMs+1000 || r.objects["0/after"] != "string v" {
+			t.Errorf("type %d: expiry %d, the next object %q", c.typ, r.expiry["s"], r.objects["0/after"])
+		}
+		dump := s.Dump
+		s.Dump = nil
+		if expect := expectedStream(c.typ); !reflect.DeepEqual(s, expect) {
+			t.Errorf("type %d: decoded %+v, expect %+v", c.typ, s, expect)
+		}
+
+		// the dump payload is of the version of the file and decodes to the same stream
+		if len(dump) < 10 || dump[0] != byte(c.typ) || int(binary.LittleEndian.Uint16(dump[len(dump)-10:])) != c.version {
+			t.Fatalf("type %d: invalid dump payload %q", c.typ, dump)
+		}
+		restored := newStreamRecorder()
+		if err := DecodeDump(dump, 0, []byte("s"), 0, restored); err != nil {
+			t.Fatalf("type %d: decode dump: %v", c.typ, err)
+		}
+		if !reflect.DeepEqual(restored.streams["s"], s) {
+			t.Errorf("type %d: dump decoded to %+v, expect %+v", c.typ, restored.streams["s"], s)
+		}
+
+		// the decoders without streams skip them
+		plain := newRecorder()
+		if err := Decode(bytes.NewReader(data), plain); err != nil || plain.objects["0/after"] != "string v" {
+			t.Errorf("type %d: stream not skipped, %v", c.typ, err)
+		}
+	}
+}
+
+func TestDecodeStreamErrors(t *testing.T) {
+	// a consumer owns an entry missing from the pending entries of its group
+	b := newDump(11).selectDB(0).stream(TypeStreamListpacks3, "s")
+	data := b.end()
+	i := bytes.LastIndex(data, []byte(rawStreamID(streamMs, 1)))
+	copy(data[i:], rawStreamID(streamMs, 9))
+	err := Decode(bytes.NewReader(data), newStreamRecorder())
+	if err == nil || !strings.Contains(err.Error(), "missing from the pending entries") {
+		t.Errorf("got %v, expect the consumer to own a missing entry", err)
+	}
+
+	// the listpack ends before its entries
+	data = newDump(11).selectDB(0).object(TypeStreamListpacks3, "s").length(1).str(rawStreamID(streamMs, 0)).
+		str(listpack(int64(2), int64(0), int64(1), "f", int64(0))).end()
+	err = Decode(bytes.NewReader(data), newStreamRecorder())
+	if err == nil || !strings.Contains(err.Error(), "truncated stream listpack for stream s") {
+		t.Errorf("got %v, expect a truncated listpack", err)
+	}
+}